@@ -0,0 +1,183 @@
+/*
+Package apierror is the error taxonomy of the server. Failed HTTP API responses carry
+one of its codes in an Error body, and failed jobs carry one as the cause of their
+JOB_FAILED message (and webhook event). Codes like InvalidCSV, TokenRevoked and
+RateLimited mean the same whether a request or a job failed. Clients switch on the
+codes, so a code is never renamed or given another meaning.
+
+A failed response looks like:
+
+	{
+		"error": {
+			"code": "validation_failed",
+			"message": "the request has invalid fields",
+			"fields": [{"field": "mode", "code": "invalid", "message": "unknown mode: shuffle"}]
+		}
+	}
+*/
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// codes of failed requests and jobs
+const (
+	// InvalidRequest - the body or the query of the request can't be parsed
+	InvalidRequest = "invalid_request"
+	// ValidationFailed - fields of the request are missing or have bad values, see Error.Fields
+	ValidationFailed = "validation_failed"
+	// InvalidCSV - the uploaded file or a row of it can't be read
+	InvalidCSV = "invalid_csv"
+	// UnknownUser - the user never logged in
+	UnknownUser = "unknown_user"
+	// Unauthorized - the request doesn't carry a valid Spotify access token of the user
+	Unauthorized = "unauthorized"
+	// TokenRevoked - the user revoked the access of the application, the user has to log in again
+	TokenRevoked = "token_revoked"
+	// RateLimited - Spotify kept rejecting requests for exceeding its rate limit
+	RateLimited = "rate_limited"
+	// PayloadTooLarge - the request body (or the decompressed upload) exceeds the size limit
+	PayloadTooLarge = "payload_too_large"
+	// NotFound - the job, batch or webhook doesn't exist or belongs to another user
+	NotFound = "not_found"
+	// PlaylistNotFound - the playlist doesn't exist or isn't visible to the user
+	PlaylistNotFound = "playlist_not_found"
+	// PlaylistNotOwned - the playlist is owned by another user
+	PlaylistNotOwned = "playlist_not_owned"
+	// Conflict - the job isn't in a state which allows the request, e.g. committing a running job
+	Conflict = "conflict"
+	// Forbidden - the access token belongs to another user or the user isn't allowed to act on the other account
+	Forbidden = "forbidden"
+	// MethodNotAllowed - the route doesn't support the HTTP method
+	MethodNotAllowed = "method_not_allowed"
+	// SpotifyError - a Spotify request failed
+	SpotifyError = "spotify_error"
+	// InternalError - an unexpected failure of the server
+	InternalError = "internal_error"
+)
+
+// causes of failed jobs only
+const (
+	// InvalidConfig - the server is misconfigured
+	InvalidConfig = "invalid_config"
+	// TokenRefreshFailed - couldn't get an access token with the user's refresh token
+	TokenRefreshFailed = "token_refresh_failed"
+	// PlaylistCreateFailed - the playlist of the job couldn't be created or found
+	PlaylistCreateFailed = "playlist_create_failed"
+	// AddTracksFailed - the found tracks couldn't be added to the playlist
+	AddTracksFailed = "add_tracks_failed"
+	// SyncFailed - the playlist couldn't be synced with the file
+	SyncFailed = "sync_failed"
+	// LibraryUpdateFailed - the found tracks couldn't be saved to the user's library
+	LibraryUpdateFailed = "library_update_failed"
+	// ExportFailed - the playlist couldn't be exported
+	ExportFailed = "export_failed"
+	// LookupFailed - the tracks couldn't be looked up
+	LookupFailed = "lookup_failed"
+	// MigrationFailed - a playlist couldn't be copied to the target account
+	MigrationFailed = "migration_failed"
+	// TargetUserNotFound - the target account of a migration never logged in
+	TargetUserNotFound = "target_user_not_found"
+	// Interrupted - the server stopped while the job was running, migrations can be resumed
+	Interrupted = "interrupted"
+)
+
+// codes of invalid fields
+const (
+	// FieldMissing - the field is required
+	FieldMissing = "missing"
+	// FieldInvalid - the value of the field isn't allowed
+	FieldInvalid = "invalid"
+)
+
+// statuses are the HTTP statuses of the request codes, other codes are internal errors
+var statuses = map[string]int{
+	InvalidRequest:   http.StatusBadRequest,
+	ValidationFailed: http.StatusBadRequest,
+	InvalidCSV:       http.StatusBadRequest,
+	UnknownUser:      http.StatusNotFound,
+	Unauthorized:     http.StatusUnauthorized,
+	TokenRevoked:     http.StatusUnauthorized,
+	RateLimited:      http.StatusTooManyRequests,
+	PayloadTooLarge:  http.StatusRequestEntityTooLarge,
+	NotFound:         http.StatusNotFound,
+	PlaylistNotFound: http.StatusNotFound,
+	PlaylistNotOwned: http.StatusForbidden,
+	Conflict:         http.StatusConflict,
+	Forbidden:        http.StatusForbidden,
+	MethodNotAllowed: http.StatusMethodNotAllowed,
+	SpotifyError:     http.StatusBadGateway,
+	InternalError:    http.StatusInternalServerError,
+}
+
+// Error is a failed request, Code is one of the package codes
+type Error struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a missing or invalid field of a request
+type FieldError struct {
+	// Field is the JSON name of the field, fields of objects are separated by dots e.g. playlist.coverImage
+	Field string `json:"field"`
+	// Code is FieldMissing or FieldInvalid
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// response is the body of a failed response
+type response struct {
+	Error *Error `json:"error"`
+}
+
+// New returns an error of code
+func New(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Invalid returns the ValidationFailed error of fields
+func Invalid(fields ...FieldError) *Error {
+	return &Error{
+		Code:    ValidationFailed,
+		Message: "the request has invalid fields",
+		Fields:  fields,
+	}
+}
+
+// Missing returns the FieldError of a missing field
+func Missing(field string) FieldError {
+	return FieldError{Field: field, Code: FieldMissing, Message: field + " is required"}
+}
+
+// BadValue returns the FieldError of a field with a value which isn't allowed
+func BadValue(field string, message string) FieldError {
+	return FieldError{Field: field, Code: FieldInvalid, Message: message}
+}
+
+func (err *Error) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+// Status returns the HTTP status of the error
+func (err *Error) Status() int {
+	if status, found := statuses[err.Code]; found {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Send writes err as a JSON response with its HTTP status
+func Send(w http.ResponseWriter, err *Error) {
+	body, marshalErr := json.Marshal(response{Error: err})
+	if marshalErr != nil {
+		http.Error(w, marshalErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.Status())
+	w.Write(body)
+}
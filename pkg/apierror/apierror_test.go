@@ -0,0 +1,52 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	const funcName = "TestSend"
+	recorder := httptest.NewRecorder()
+	Send(recorder, Invalid(Missing("userId"), BadValue("mode", "unknown mode: shuffle")))
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("%s: unexpected status %d or content type %s", funcName, recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var body struct {
+		Error Error `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: json.Unmarshal: %v", funcName, err)
+	}
+	expected := Error{
+		Code:    ValidationFailed,
+		Message: "the request has invalid fields",
+		Fields: []FieldError{
+			{Field: "userId", Code: FieldMissing, Message: "userId is required"},
+			{Field: "mode", Code: FieldInvalid, Message: "unknown mode: shuffle"},
+		},
+	}
+	if !reflect.DeepEqual(body.Error, expected) {
+		t.Errorf("%s: expected %+v, got %+v", funcName, expected, body.Error)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	statuses := map[string]int{
+		UnknownUser:     http.StatusNotFound,
+		TokenRevoked:    http.StatusUnauthorized,
+		RateLimited:     http.StatusTooManyRequests,
+		PayloadTooLarge: http.StatusRequestEntityTooLarge,
+		InvalidCSV:      http.StatusBadRequest,
+		// causes of failed jobs only aren't request errors
+		AddTracksFailed: http.StatusInternalServerError,
+	}
+	for code, status := range statuses {
+		if actual := New(code, "").Status(); actual != status {
+			t.Errorf("TestStatus: expected %d for %s, got %d", status, code, actual)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessTokenRoute is the token endpoint of the accounts service
+const accessTokenRoute = "/api/token"
+
+// SpotifyAPI is the HTTP surface of Spotify the provider talks to: the accounts
+// service which issues access tokens and the Web API (search, playlists, tracks etc.)
+type SpotifyAPI interface {
+	// URL returns the Web API URL of route e.g. URL("/search")
+	URL(route string) string
+	// TokenURL returns the URL access tokens are requested from
+	TokenURL() string
+	// Do sends an HTTP request
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// httpSpotifyAPI is a SpotifyAPI served at baseURL and accountsURL
+type httpSpotifyAPI struct {
+	baseURL     string
+	accountsURL string
+	client      *http.Client
+}
+
+// NewSpotifyAPI returns the SpotifyAPI of the Web API at baseURL (e.g. https://api.spotify.com/v1)
+// and the accounts service at accountsURL (e.g. https://accounts.spotify.com)
+func NewSpotifyAPI(baseURL string, accountsURL string) SpotifyAPI {
+	return &httpSpotifyAPI{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		accountsURL: strings.TrimSuffix(accountsURL, "/"),
+		client: &http.Client{
+			Timeout: time.Duration(time.Duration(conf.ClientTimeout) * time.Second),
+		},
+	}
+}
+
+func (api *httpSpotifyAPI) URL(route string) string {
+	return api.baseURL + route
+}
+
+func (api *httpSpotifyAPI) TokenURL() string {
+	return api.accountsURL + accessTokenRoute
+}
+
+func (api *httpSpotifyAPI) Do(req *http.Request) (*http.Response, error) {
+	return api.client.Do(req)
+}
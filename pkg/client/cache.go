@@ -0,0 +1,154 @@
+package client
+
+import (
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+const (
+	// matchCacheTTL is how long a match is reused before the track is searched again
+	matchCacheTTL = 30 * 24 * time.Hour
+	// notFoundCacheTTL is shorter since tracks are added to the catalog all the time
+	notFoundCacheTTL = 24 * time.Hour
+)
+
+var (
+	// cacheMetrics are published by the /metrics route
+	cacheMetrics = expvar.NewMap("matchCache")
+	cacheHits    = new(expvar.Int)
+	// cacheNegativeHits are hits of tracks which weren't found
+	cacheNegativeHits = new(expvar.Int)
+	cacheMisses       = new(expvar.Int)
+)
+
+func init() {
+	cacheMetrics.Set("hits", cacheHits)
+	cacheMetrics.Set("negativeHits", cacheNegativeHits)
+	cacheMetrics.Set("misses", cacheMisses)
+	cacheMetrics.Set("hitRate", expvar.Func(func() interface{} {
+		hits := cacheHits.Value() + cacheNegativeHits.Value()
+		if total := hits + cacheMisses.Value(); total > 0 {
+			return float64(hits) / float64(total)
+		}
+		return 0.0
+	}))
+}
+
+// matchCache stores lookup outcomes which are shared by all users
+type matchCache interface {
+	find(key string) *db.CachedMatch
+	save(match db.CachedMatch)
+}
+
+// dbMatchCache is the matchCache of the server, it's stored in mongo
+type dbMatchCache struct{}
+
+func (dbMatchCache) find(key string) *db.CachedMatch {
+	return db.FindCachedMatch(key)
+}
+
+func (dbMatchCache) save(match db.CachedMatch) {
+	db.SaveCachedMatch(match)
+}
+
+// matchCacheKey identifies an input track in market regardless of case and punctuation,
+// versions such as "(Live)" are different tracks. The ISRC is part of the key if it's set.
+func matchCacheKey(track csv.TrackInput, market string) string {
+	return strings.Join([]string{
+		strings.ToUpper(strings.TrimSpace(track.ISRC)),
+		Normalize(track.Artist, true),
+		Normalize(track.Track, true),
+		strings.ToUpper(market),
+	}, "\x00")
+}
+
+// matchCacheKey is the cache key of the track, matches picked by
+// preferences are cached apart from the matches of other preferences
+func (provider *SpotifyProvider) matchCacheKey(track csv.TrackInput, market string) string {
+	key := matchCacheKey(track, market)
+	if preferencesKey := provider.preferences.key(track); preferencesKey != "" {
+		key += "\x00" + preferencesKey
+	}
+	return key
+}
+
+// cachedResult returns the cached outcome of the track, found is false if there's none.
+// Tracks which weren't found and matches which review mode parks are searched again
+// in review mode since the cache doesn't hold the candidates.
+func (provider *SpotifyProvider) cachedResult(track csv.TrackInput, market string) (result SearchResult, found bool) {
+	if provider.cache == nil {
+		return
+	}
+	match := provider.cache.find(provider.matchCacheKey(track, market))
+	if match == nil || (provider.reviewMatches && needsReview(match)) {
+		cacheMisses.Add(1)
+		return
+	}
+	if !match.IsFound {
+		cacheNegativeHits.Add(1)
+		return SearchResult{
+			Index:   track.Index,
+			Input:   track,
+			Outcome: OutcomeNotFound,
+			Reason:  match.Reason,
+			Cached:  true,
+		}, true
+	}
+	cacheHits.Add(1)
+	return SearchResult{
+		Index:       track.Index,
+		Input:       track,
+		IsFound:     true,
+		Outcome:     OutcomeFound,
+		TrackID:     match.TrackID,
+		TrackName:   match.TrackName,
+		TrackArtist: match.TrackArtist,
+		URI:         match.URI,
+		ISRC:        match.ISRC,
+		AlbumID:     match.AlbumID,
+		ArtistIDs:   match.ArtistIDs,
+		Confidence:  match.Confidence,
+		Ambiguous:   match.Ambiguous,
+		Strategy:    match.Strategy,
+		Cached:      true,
+	}, true
+}
+
+// needsReview reports whether review mode would park the cached outcome or search for its candidates
+func needsReview(match *db.CachedMatch) bool {
+	return !match.IsFound || match.Ambiguous || match.Confidence < minConfidence
+}
+
+// cacheResult stores the outcome of a search, errored results
+// and results which need review aren't final so they're not stored
+func (provider *SpotifyProvider) cacheResult(result SearchResult, market string) {
+	if provider.cache == nil || (result.Outcome != OutcomeFound && result.Outcome != OutcomeNotFound) {
+		return
+	}
+	now := time.Now()
+	ttl := matchCacheTTL
+	if !result.IsFound {
+		ttl = notFoundCacheTTL
+	}
+	provider.cache.save(db.CachedMatch{
+		Key:         provider.matchCacheKey(result.Input, market),
+		IsFound:     result.IsFound,
+		URI:         result.URI,
+		ISRC:        result.ISRC,
+		TrackID:     result.TrackID,
+		TrackName:   result.TrackName,
+		TrackArtist: result.TrackArtist,
+		AlbumID:     result.AlbumID,
+		ArtistIDs:   result.ArtistIDs,
+		Confidence:  result.Confidence,
+		Ambiguous:   result.Ambiguous,
+		Strategy:    result.Strategy,
+		Reason:      result.Reason,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	})
+}
@@ -4,15 +4,19 @@ Package client communicates with Spotify
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
 	"github.com/yossisp/csv-to-spotify/pkg/db"
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
 
@@ -23,29 +27,67 @@ import (
 var (
 	conf   config.Config = config.NewConfig()
 	logger               = utils.NewLogger("client")
+	// spotifyAPI is the API of NewSpotifyProvider, see UseAPI
+	spotifyAPI = NewSpotifyAPI(conf.SpotifyAPIURL, conf.SpotifyAccountsURL)
+	// retryDelay is the retry delay of NewSpotifyProvider, see UseRetryDelay
+	retryDelay = 5 * time.Second
 )
 
-// NewSpotifyProvider provides spotify state
+// NewSpotifyProvider provides spotify state, it talks to the Spotify API
+// at the SPOTIFY_API_URL and SPOTIFY_ACCOUNTS_URL env vars unless UseAPI was called
 func NewSpotifyProvider() *SpotifyProvider {
+	return NewSpotifyProviderWithAPI(spotifyAPI)
+}
+
+// UseAPI makes NewSpotifyProvider talk to api e.g. a fake Spotify in end-to-end tests
+func UseAPI(api SpotifyAPI) {
+	spotifyAPI = api
+}
+
+// UseRetryDelay sets the wait of NewSpotifyProvider before rate limited requests without
+// a Retry-After header are retried e.g. a short one in end-to-end tests
+func UseRetryDelay(delay time.Duration) {
+	retryDelay = delay
+}
+
+// UseLookupInterval sets the seconds StreamSearchResults waits between lookup
+// batches (TRACK_LOOKUP_INTERVAL) e.g. none in end-to-end tests
+func UseLookupInterval(seconds int) {
+	conf.TrackLookupInterval = strconv.Itoa(seconds)
+}
+
+// NewSpotifyProviderWithAPI provides spotify state which talks to api
+func NewSpotifyProviderWithAPI(api SpotifyAPI) *SpotifyProvider {
 	return &SpotifyProvider{
 		maxRetries:       7,
 		actualRetries:    0,
+		retryDelay:       retryDelay,
 		trackIsFoundChan: make(chan bool),
-		client: &http.Client{
-			Timeout: time.Duration(time.Duration(conf.ClientTimeout) * time.Second),
-		},
+		cache:            dbMatchCache{},
+		api:              api,
 	}
 }
 
-func (provider *SpotifyProvider) lookupTracksBatch(batch []csv.TrackInput, isLastBatch bool, tracksProgress TracksLookupProgress) {
-	searchChan := make(chan SearchResult)
+// lookupTracksBatch looks up tracks in parallel, every track ends
+// with a result even if the lookup panics
+func (provider *SpotifyProvider) lookupTracksBatch(ctx context.Context, batch []csv.TrackInput, tracksProgress TracksLookupProgress) {
+	// the lookups don't block once ctx is done and the results aren't received anymore
+	searchChan := make(chan SearchResult, len(batch))
+	resolved := provider.resolveTrackURIs(batch)
 	for _, inputTrack := range batch {
+		if result, found := resolved[inputTrack.Index]; found {
+			searchChan <- result
+			continue
+		}
 		inputTrack := inputTrack
 		go func() {
-			track := provider.lookupTrack(inputTrack)
-			if track != nil {
-				searchChan <- *track
-			}
+			defer func() {
+				if err := recover(); err != nil {
+					logger("lookupTracksBatch: track: %d panic: %v", inputTrack.Index, err)
+					searchChan <- newErroredResult(inputTrack, reasonInternalError)
+				}
+			}()
+			searchChan <- provider.lookupTrack(inputTrack)
 		}()
 	}
 
@@ -54,55 +96,97 @@ func (provider *SpotifyProvider) lookupTracksBatch(batch []csv.TrackInput, isLas
 		if track.IsFound {
 			log.Println("track found")
 			log.Println(track)
-			provider.LookedUpTracks = append(provider.LookedUpTracks, track)
+			provider.mutex.Lock()
+			provider.LookedUpTracks = append(provider.LookedUpTracks, track.foundTrack())
+			provider.mutex.Unlock()
+		}
+		select {
+		case tracksProgress.Results <- track:
+		case <-ctx.Done():
+			return
 		}
-		tracksProgress.IsFound <- track.IsFound
-	}
-	if isLastBatch {
-		tracksProgress.Quit <- true
 	}
 }
 
-// GetSearchResults gets search results
-func (provider *SpotifyProvider) GetSearchResults(tracksProgress TracksLookupProgress, inputTracks []csv.TrackInput) {
+// GetSearchResults looks up inputTracks, see StreamSearchResults
+func (provider *SpotifyProvider) GetSearchResults(ctx context.Context, tracksProgress TracksLookupProgress, inputTracks []csv.TrackInput) {
+	provider.StreamSearchResults(ctx, tracksProgress, csv.NewSliceIterator(inputTracks))
+}
+
+// StreamSearchResults looks up the tracks in batches as they're read from inputTracks,
+// a batch is read only once the previous one was started so a large file isn't read
+// ahead of the lookups. Batches are started at most every TrackLookupInterval seconds
+// and only while fewer than batchesInFlight batches have results which weren't received,
+// so slow lookups or a slow receiver don't pile up batches. No more batches are looked
+// up once ctx is done.
+// It always ends by sending on tracksProgress.Done after the last result:
+// nil when every track was looked up or a *LookupError.
+func (provider *SpotifyProvider) StreamSearchResults(ctx context.Context, tracksProgress TracksLookupProgress, inputTracks csv.TrackIterator) {
 	var (
-		lowerBound         int
-		upperBound         int
-		batch              []csv.TrackInput
 		tracksSearchedNum  int = 0
 		resultsNumPerBatch int = 3
+		batchesInFlight    int = 2
+		batchesWaitGroup   sync.WaitGroup
 	)
+	done := func(err error) {
+		select {
+		case tracksProgress.Done <- err:
+		case <-ctx.Done():
+		}
+	}
 	trackLookupInterval, err := strconv.Atoi(conf.TrackLookupInterval)
 	if err != nil {
-		tracksProgress.Quit <- false
+		done(&LookupError{Cause: apierror.InvalidConfig, Err: err})
 		return
 	}
-	playlistTracks := inputTracks[:]
-	batchesNum := int(math.Ceil(float64(len(playlistTracks)) / float64(resultsNumPerBatch)))
-	log.Println("len(playlistTracks)", len(playlistTracks), "batchesNum", batchesNum)
+	nextBatch := func() []csv.TrackInput {
+		batch := make([]csv.TrackInput, 0, resultsNumPerBatch)
+		for len(batch) < resultsNumPerBatch && inputTracks.Next() {
+			batch = append(batch, inputTracks.Track())
+		}
+		return batch
+	}
 	// access token may have expired so it should be set once
-	// here instead of re-setting it `len(inputTracks)` times
+	// here instead of re-setting it for every track
 	err = provider.setAccessToken()
 	if err != nil {
-		tracksProgress.Quit <- false
+		done(tokenRefreshError(err))
 		return
 	}
 
-	for i := 0; i < batchesNum; i++ {
-		lowerBound = i * resultsNumPerBatch
-		upperBound = lowerBound + resultsNumPerBatch
-		if upperBound > len(playlistTracks) {
-			upperBound = lowerBound + (len(playlistTracks) % resultsNumPerBatch)
+	// a batch holds a slot until its results were received
+	inFlight := make(chan struct{}, batchesInFlight)
+	for batch := nextBatch(); len(batch) > 0; {
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return
 		}
-
-		batch = playlistTracks[lowerBound:upperBound]
 		log.Println("batch ", batch)
-		log.Println("lowerBound ", lowerBound, "upperBound ", upperBound)
 		tracksSearchedNum += len(batch)
-		isLastBatch := i == batchesNum-1
-		go provider.lookupTracksBatch(batch, isLastBatch, tracksProgress)
-		utils.SleepFor(trackLookupInterval)
+		batchesWaitGroup.Add(1)
+		go func(batch []csv.TrackInput) {
+			defer batchesWaitGroup.Done()
+			provider.lookupTracksBatch(ctx, batch, tracksProgress)
+			<-inFlight
+		}(batch)
+		if batch = nextBatch(); len(batch) == 0 {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(trackLookupInterval) * time.Second):
+		case <-ctx.Done():
+			return
+		}
 	}
+	log.Println("tracksSearchedNum", tracksSearchedNum)
+	// batches may finish out of order, done is sent after every result
+	batchesWaitGroup.Wait()
+	if err = inputTracks.Err(); err != nil {
+		done(&LookupError{Cause: apierror.InvalidCSV, Err: err})
+		return
+	}
+	done(nil)
 }
 
 func (track SearchResult) String() string {
@@ -116,7 +200,6 @@ func (track SearchResult) String() string {
 
 func (provider *SpotifyProvider) request(req *http.Request) (response *http.Response, err error) {
 	const funcName = "request"
-	nextRequestDelaySec := 5
 	url := req.URL.String()
 
 	// in case the first req fails
@@ -136,23 +219,20 @@ func (provider *SpotifyProvider) request(req *http.Request) (response *http.Resp
 		}
 	}()
 
-	req.Header.Set("Content-Type", "application/json")
+	// e.g. cover images are uploaded as image/jpeg
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", provider.accessToken))
-	response, err = provider.client.Do(req)
+	response, err = provider.api.Do(req)
 	if err != nil {
 		logger("request: response: %v", err)
 		return nil, err
 	}
 
-	if provider.maxRetries == provider.actualRetries {
-		err = fmt.Errorf("%s: too many retries for url: %s", funcName, url)
-		logger("%s: %v", funcName, err)
-		response.Body.Close()
-		return nil, err
-	}
 	logger("%s: url: %s statusCode: %d", funcName, url, response.StatusCode)
-	if response.StatusCode >= http.StatusBadRequest && response.StatusCode < http.StatusInternalServerError && provider.maxRetries > provider.actualRetries {
+	if response.StatusCode >= http.StatusBadRequest && response.StatusCode < http.StatusInternalServerError {
 		bodyBytes, err := ioutil.ReadAll(response.Body)
 		if err != nil {
 			logger("%s: url: %s ioutil.ReadAll: %v", funcName, url, err)
@@ -160,10 +240,45 @@ func (provider *SpotifyProvider) request(req *http.Request) (response *http.Resp
 			logger("%s: url: %s response body: %s", funcName, url, string(bodyBytes))
 		}
 		response.Body.Close()
-		provider.actualRetries++
-		utils.SleepFor(nextRequestDelaySec)
+		// only an expired access token and the rate limit are retried,
+		// other client errors e.g. 404 are left to the caller
+		isExpired := response.StatusCode == http.StatusUnauthorized
+		if !isExpired && response.StatusCode != http.StatusTooManyRequests {
+			response.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+			return response, nil
+		}
+		// the retries budget is shared by all requests of the provider
+		provider.mutex.Lock()
+		revoked := provider.revoked
+		isRetryAllowed := revoked == nil && provider.maxRetries > provider.actualRetries
+		if isRetryAllowed {
+			provider.actualRetries++
+		}
+		provider.mutex.Unlock()
+		if revoked != nil {
+			// a new access token can't be got anymore
+			return nil, revoked
+		}
+		if !isRetryAllowed {
+			err = fmt.Errorf("%s: too many retries for url: %s", funcName, url)
+			if !isExpired {
+				err = fmt.Errorf("%s: url: %s: %w", funcName, url, ErrRateLimited)
+			}
+			logger("%s: %v", funcName, err)
+			return nil, err
+		}
+		if !isExpired {
+			time.Sleep(provider.retryWait(response))
+			return provider.request(clonedReq)
+		}
+		// an expired access token is refreshed at once
 		err = provider.setAccessToken()
 		if err != nil {
+			if errors.Is(err, ErrTokenRevoked) {
+				provider.mutex.Lock()
+				provider.revoked = err
+				provider.mutex.Unlock()
+			}
 			return nil, err
 		}
 		return provider.request(clonedReq)
@@ -172,6 +287,26 @@ func (provider *SpotifyProvider) request(req *http.Request) (response *http.Resp
 	return response, err
 }
 
+// retryWait returns the wait before a rate limited request is retried,
+// the Retry-After header of the response or retryDelay when it's missing
+func (provider *SpotifyProvider) retryWait(response *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return provider.retryDelay
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Authorize refreshes the access token, it's required before
+// requests which aren't made by GetSearchResults
+func (provider *SpotifyProvider) Authorize() error {
+	err := provider.setAccessToken()
+	if err != nil {
+		return tokenRefreshError(err)
+	}
+	return nil
+}
+
 // SetUserData sets user token
 func (provider *SpotifyProvider) SetUserData(user *db.SpotifyUser) {
 	provider.refreshToken = user.RefreshToken
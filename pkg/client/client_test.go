@@ -1,15 +1,29 @@
 package client
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client/clienttest"
 	"github.com/yossisp/csv-to-spotify/pkg/csv"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
 )
 
+// TestClient runs against the Spotify API, the other tests run against clienttest.Server
 func TestClient(t *testing.T) {
+	if conf.TestRefreshToken == "" {
+		t.Skip("TEST_REFRESH_TOKEN isn't set")
+	}
 	provider := NewSpotifyProvider()
 	provider.refreshToken = conf.TestRefreshToken
 	const testRequestPositive = "TestRequestNoAccessTokenPositive"
@@ -19,7 +33,7 @@ func TestClient(t *testing.T) {
 			Artist: "The Beatles",
 			Track:  "Yesterday",
 		}
-		lookupURL := fmt.Sprintf("%s%s", apiBaseURL, lookupTrackRoute)
+		lookupURL := provider.api.URL(lookupTrackRoute)
 		parsedURL, err := url.Parse(lookupURL)
 		if err != nil {
 			t.Errorf("%s: NewRequest: %v", funcName, err)
@@ -28,7 +42,7 @@ func TestClient(t *testing.T) {
 		query.Add("q", fmt.Sprintf("artist:%s track:%s", track.Artist, track.Track))
 		query.Add("type", "track")
 		query.Add("limit", "1")
-		query.Add("market", "IL")
+		query.Add("market", conf.Market)
 		parsedURL.RawQuery = query.Encode()
 		req, err := http.NewRequest(http.MethodGet, parsedURL.String(), nil)
 		if err != nil {
@@ -48,8 +62,900 @@ func TestClient(t *testing.T) {
 			Track:  "Yesterday",
 		}
 		track := provider.lookupTrack(inputTrack)
-		if track == nil {
-			t.Errorf("%s: couldn't find track", testLookupTrackPositive)
+		if track.Outcome == OutcomeErrored {
+			t.Errorf("%s: couldn't look up track: %s", testLookupTrackPositive, track.Reason)
+		}
+	})
+}
+
+func TestMatch(t *testing.T) {
+	const testNormalize = "TestNormalize"
+	t.Run(testNormalize, func(t *testing.T) {
+		cases := map[string]string{
+			"Yesterday - Remastered 2009":       "yesterday",
+			"Hey Jude (Remastered)":             "hey jude",
+			"Don't Stop Me Now":                 "don t stop me now",
+			"Stay feat. Someone":                "stay",
+			"(Reprise)":                         "reprise",
+			"  Sultans   of Swing [Live] ":      "sultans of swing",
+			"Sailing to Philadelphia - Live at": "sailing to philadelphia",
+		}
+		for input, expected := range cases {
+			if actual := Normalize(input, false); actual != expected {
+				t.Errorf("%s: Normalize(%q) = %q, expected %q", testNormalize, input, actual, expected)
+			}
+		}
+		versions := map[string]string{
+			"  Sultans   of Swing [Live] ": "sultans of swing live",
+			"Yesterday - Remastered 2009":  "yesterday remastered 2009",
+			"Don't Stop Me Now":            "don t stop me now",
+		}
+		for input, expected := range versions {
+			if actual := Normalize(input, true); actual != expected {
+				t.Errorf("%s: Normalize(%q, true) = %q, expected %q", testNormalize, input, actual, expected)
+			}
+		}
+	})
+
+	const testBestCandidate = "TestBestCandidate"
+	t.Run(testBestCandidate, func(t *testing.T) {
+		input := csv.TrackInput{Artist: "The Beatles", Track: "Yesterday"}
+		candidates := []trackMetaData{
+			{ID: "cover", Name: "Yesterday", Artists: []artistData{{Name: "Tribute Band"}}},
+			{ID: "original", Name: "Yesterday - Remastered 2009", Artists: []artistData{{Name: "The Beatles"}}},
+			{ID: "other", Name: "Let It Be", Artists: []artistData{{Name: "The Beatles"}}},
+		}
+		best, confidence := bestCandidate(input, candidates)
+		if best.ID != "original" {
+			t.Errorf("%s: expected original, got %s", testBestCandidate, best.ID)
+		}
+		if confidence < minConfidence {
+			t.Errorf("%s: confidence %f is below %f", testBestCandidate, confidence, minConfidence)
+		}
+	})
+
+	const testLowConfidence = "TestLowConfidence"
+	t.Run(testLowConfidence, func(t *testing.T) {
+		input := csv.TrackInput{Artist: "Mark Knopfler", Track: "Darling Pretty"}
+		candidates := []trackMetaData{
+			{ID: "unrelated", Name: "Pretty Woman", Artists: []artistData{{Name: "Roy Orbison"}}},
+		}
+		if _, confidence := bestCandidate(input, candidates); confidence >= minConfidence {
+			t.Errorf("%s: confidence %f should be below %f", testLowConfidence, confidence, minConfidence)
+		}
+	})
+}
+
+func TestGetSearchResultsTerminates(t *testing.T) {
+	const funcName = "TestGetSearchResultsTerminates"
+	server := clienttest.NewServer()
+	defer server.Close()
+	provider := newFakeProvider(server)
+	provider.refreshToken = "revoked"
+	tracksProgress := TracksLookupProgress{
+		Results: make(chan SearchResult),
+		Done:    make(chan error),
+	}
+	tracks := []csv.TrackInput{{Artist: "The Beatles", Track: "Yesterday"}}
+	go provider.GetSearchResults(context.Background(), tracksProgress, tracks)
+	select {
+	case result := <-tracksProgress.Results:
+		t.Errorf("%s: unexpected result: %v", funcName, result)
+	case err := <-tracksProgress.Done:
+		var lookupErr *LookupError
+		// the fake Spotify answers invalid_grant for unknown refresh tokens
+		if !errors.As(err, &lookupErr) || lookupErr.Cause != apierror.TokenRevoked || !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("%s: expected %s, got: %v", funcName, apierror.TokenRevoked, err)
+		}
+	case <-time.After(time.Duration(conf.ClientTimeout) * time.Second):
+		t.Errorf("%s: lookup didn't terminate", funcName)
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	tracks := []FoundTrack{
+		{Index: 0, URI: "spotify:track:a"},
+		{Index: 1, URI: "spotify:track:b"},
+		{Index: 2, URI: "spotify:track:a"},
+		{Index: 3, URI: "spotify:track:c"},
+	}
+
+	const testURIsToAdd = "TestURIsToAdd"
+	t.Run(testURIsToAdd, func(t *testing.T) {
+		if uris, _ := urisToAdd(tracks, nil, false); len(uris) != len(tracks) {
+			t.Errorf("%s: without existing uris expected %d uris, got %v", testURIsToAdd, len(tracks), uris)
+		}
+		existing := newTrackSet()
+		existing.add("spotify:track:b", "", DuplicateInDestination)
+		uris, skipped := urisToAdd(tracks, existing, false)
+		if len(uris) != 2 || uris[0] != "spotify:track:a" || uris[1] != "spotify:track:c" {
+			t.Errorf("%s: merge expected [a c], got %v", testURIsToAdd, uris)
+		}
+		if skipped[DuplicateInDestination] != 1 || skipped[DuplicateMatch] != 1 {
+			t.Errorf("%s: unexpected skipped duplicates: %v", testURIsToAdd, skipped)
+		}
+		existing = newTrackSet()
+		existing.add("spotify:track:b", "", DuplicateInDestination)
+		uris, skipped = urisToAdd(tracks, existing, true)
+		if strings.Join(uris, ",") != "spotify:track:a,spotify:track:a,spotify:track:c" {
+			t.Errorf("%s: merge which keeps repeats expected [a a c], got %v", testURIsToAdd, uris)
+		}
+		if skipped[DuplicateInDestination] != 1 || skipped[DuplicateMatch] != 0 {
+			t.Errorf("%s: unexpected skipped duplicates of merge which keeps repeats: %v", testURIsToAdd, skipped)
+		}
+	})
+
+	const testRelinked = "TestRelinked"
+	t.Run(testRelinked, func(t *testing.T) {
+		existing := newTrackSet()
+		existing.add("spotify:track:us", "GBAYE0601498", DuplicateInDestination)
+		uris, skipped := urisToAdd([]FoundTrack{
+			{Index: 0, URI: "spotify:track:il", ISRC: "GBAYE0601498"},
+			{Index: 1, URI: "spotify:track:d", ISRC: "USSM18100116"},
+			{Index: 2, URI: "spotify:track:e", ISRC: "USSM18100116"},
+			{Index: 3, URI: "spotify:track:f"},
+		}, existing, false)
+		if len(uris) != 2 || uris[0] != "spotify:track:d" || uris[1] != "spotify:track:f" {
+			t.Errorf("%s: expected [d f], got %v", testRelinked, uris)
+		}
+		if skipped[DuplicateRelinked] != 1 || skipped[DuplicateMatch] != 1 {
+			t.Errorf("%s: unexpected skipped duplicates: %v", testRelinked, skipped)
+		}
+	})
+
+	const testChunkStrings = "TestChunkStrings"
+	t.Run(testChunkStrings, func(t *testing.T) {
+		uris := make([]string, 2*playlistItemsLimit+1)
+		chunks := chunkStrings(uris, playlistItemsLimit)
+		if len(chunks) != 3 || len(chunks[0]) != playlistItemsLimit || len(chunks[2]) != 1 {
+			t.Errorf("%s: unexpected chunks of %d uris: %d", testChunkStrings, len(uris), len(chunks))
+		}
+		if chunks := chunkStrings(nil, playlistItemsLimit); len(chunks) != 0 {
+			t.Errorf("%s: expected no chunks, got %d", testChunkStrings, len(chunks))
+		}
+	})
+}
+
+func TestIsImportMode(t *testing.T) {
+	for _, mode := range ImportModes {
+		if !IsImportMode(mode) {
+			t.Errorf("TestIsImportMode: %s should be supported", mode)
+		}
+	}
+	if IsImportMode("overwrite") {
+		t.Errorf("TestIsImportMode: overwrite shouldn't be supported")
+	}
+}
+
+// applyDiff applies diff to playlist the way Spotify applies remove, add and reorder requests
+func applyDiff(playlist []string, diff PlaylistDiff) []string {
+	isRemoved := make(map[int]bool)
+	for _, chunk := range removalChunks(diff.removedPositions, 2) {
+		for _, removal := range chunk {
+			for _, position := range removal["positions"].([]int) {
+				isRemoved[position] = true
+			}
+		}
+	}
+	var result []string
+	for position, uri := range playlist {
+		if !isRemoved[position] {
+			result = append(result, uri)
+		}
+	}
+	result = append(result, diff.Added...)
+	for _, move := range diff.Moved {
+		uri := result[move.From]
+		result = append(result[:move.From], result[move.From+1:]...)
+		result = append(result[:move.To], append([]string{uri}, result[move.To:]...)...)
+	}
+	return result
+}
+
+func TestDiffPlaylist(t *testing.T) {
+	const funcName = "TestDiffPlaylist"
+	cases := []struct {
+		current []string
+		desired []string
+	}{
+		{current: []string{}, desired: []string{"a", "b"}},
+		{current: []string{"a", "b", "c"}, desired: []string{}},
+		{current: []string{"a", "b", "c"}, desired: []string{"a", "b", "c"}},
+		{current: []string{"a", "x", "b", "a", "y"}, desired: []string{"b", "z", "a"}},
+		{current: []string{"d", "c", "b", "a"}, desired: []string{"a", "b", "c", "d", "e"}},
+		// unavailable tracks are kept after the desired tracks
+		{current: []string{"a", "", "x", "b", "", "c"}, desired: []string{"c", "b", "a"}},
+	}
+	for _, testCase := range cases {
+		diff := diffPlaylist(testCase.current, testCase.desired)
+		result := applyDiff(testCase.current, diff)
+		expected := append([]string{}, testCase.desired...)
+		for _, uri := range testCase.current {
+			if uri == "" {
+				expected = append(expected, uri)
+			}
+		}
+		if strings.Join(result, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: %v -> %v: got %v with diff %+v", funcName, testCase.current, testCase.desired, result, diff)
+		}
+	}
+	diff := diffPlaylist([]string{"a", "b", "c"}, []string{"a", "b", "c"})
+	if len(diff.Added)+len(diff.Removed)+len(diff.Moved) != 0 {
+		t.Errorf("%s: expected an empty diff, got %+v", funcName, diff)
+	}
+}
+
+func TestPageIterator(t *testing.T) {
+	const funcName = "TestPageIterator"
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/first":
+			fmt.Fprintf(w, `{"items": [{"track": {"uri": "a"}}, {"track": null}], "next": "%s/second"}`, server.URL)
+		case "/second":
+			fmt.Fprint(w, `{"items": [{"track": {"uri": "b"}}], "next": null}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	provider := NewSpotifyProvider()
+
+	uris, err := provider.getTrackURIs(server.URL + "/first")
+	if err != nil || strings.Join(uris, ",") != "a,b" {
+		t.Errorf("%s: expected [a b], got %v err: %v", funcName, uris, err)
+	}
+	if _, err = provider.getTrackURIs(server.URL + "/broken"); err == nil {
+		t.Errorf("%s: expected an error for a failed page", funcName)
+	}
+}
+
+func TestIsDestination(t *testing.T) {
+	for _, destination := range Destinations {
+		if !IsDestination(destination) {
+			t.Errorf("TestIsDestination: %s should be supported", destination)
+		}
+	}
+	if IsDestination("podcasts") {
+		t.Errorf("TestIsDestination: podcasts shouldn't be supported")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	const funcName = "TestRenderTemplate"
+	values := map[string]string{"file": "road trip", "found": "9"}
+	rendered := RenderTemplate("{file}: {found} found {other}", values)
+	if rendered != "road trip: 9 found {other}" {
+		t.Errorf("%s: unexpected rendering: %s", funcName, rendered)
+	}
+}
+
+func TestValidateCoverImage(t *testing.T) {
+	const funcName = "TestValidateCoverImage"
+	jpeg := base64.StdEncoding.EncodeToString([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+	if err := ValidateCoverImage(jpeg); err != nil {
+		t.Errorf("%s: expected a valid image, got: %v", funcName, err)
+	}
+	png := base64.StdEncoding.EncodeToString([]byte{0x89, 'P', 'N', 'G'})
+	if err := ValidateCoverImage(png); err != ErrCoverImageNotJPEG {
+		t.Errorf("%s: expected ErrCoverImageNotJPEG, got: %v", funcName, err)
+	}
+	if err := ValidateCoverImage(strings.Repeat("A", maxCoverImageSize+4)); err != ErrCoverImageTooLarge {
+		t.Errorf("%s: expected ErrCoverImageTooLarge, got: %v", funcName, err)
+	}
+}
+
+func TestReview(t *testing.T) {
+	input := csv.TrackInput{Index: 4, Artist: "Dire Straits", Track: "Brothers in Arms"}
+
+	const testAmbiguous = "TestAmbiguous"
+	t.Run(testAmbiguous, func(t *testing.T) {
+		remasters := rankCandidates(input, []trackMetaData{
+			{ID: "album", Name: "Brothers in Arms", Artists: []artistData{{Name: "Dire Straits"}}},
+			{ID: "remaster", Name: "Brothers in Arms - Remastered 1996", Artists: []artistData{{Name: "Dire Straits"}}},
+		})
+		if isAmbiguous(remasters) {
+			t.Errorf("%s: releases of the same track shouldn't be ambiguous", testAmbiguous)
+		}
+		hurt := csv.TrackInput{Artist: "Johnny Cash", Track: "Hurt"}
+		versions := rankCandidates(hurt, []trackMetaData{
+			{ID: "cash", Name: "Hurt", Artists: []artistData{{Name: "Johnny Cash"}}},
+			{ID: "duet", Name: "Hurt (feat. Johnny Cash)", Artists: []artistData{{Name: "Nine Inch Nails"}, {Name: "Johnny Cash"}}},
+		})
+		if !isAmbiguous(versions) {
+			t.Errorf("%s: different tracks with close scores should be ambiguous", testAmbiguous)
+		}
+	})
+
+	const testReviewResult = "TestReviewResult"
+	t.Run(testReviewResult, func(t *testing.T) {
+		var album trackMetaData
+		album.ID = "album"
+		album.Name = "Brothers in Arms"
+		album.Artists = []artistData{{ID: "dire", Name: "Dire Straits"}}
+		album.Album.Images = []struct {
+			URL string `json:"url"`
+		}{{URL: "https://i.scdn.co/image/large"}, {URL: "https://i.scdn.co/image/small"}}
+		ranked := mergeCandidates([]scoredCandidate{
+			{track: trackMetaData{ID: "a"}, score: 0.3},
+			{track: album, score: 0.45},
+			{track: trackMetaData{ID: "b"}, score: 0.35},
+			{track: album, score: 0.4},
+			{track: trackMetaData{ID: "c"}, score: 0.2},
+		})
+		result := newReviewResult(input, ranked, reasonLowConfidence, nil)
+		if result.Outcome != OutcomeReview || result.IsFound || len(result.Candidates) != reviewCandidatesLimit {
+			t.Fatalf("%s: unexpected result: %v", testReviewResult, result)
+		}
+		best := result.Candidates[0]
+		if best.TrackID != "album" || best.ImageURL != "https://i.scdn.co/image/large" || result.Candidates[1].TrackID != "b" {
+			t.Errorf("%s: unexpected candidates: %v", testReviewResult, result.Candidates)
+		}
+
+		provider := NewSpotifyProvider()
+		found := provider.AddReviewedTrack(result, best)
+		if !found.IsFound || found.Index != input.Index || found.Strategy != strategyReview || len(provider.LookedUpTracks) != 1 {
+			t.Errorf("%s: unexpected reviewed track: %v", testReviewResult, found)
+		}
+	})
+}
+
+// memoryMatchCache is a matchCache which doesn't need mongo
+type memoryMatchCache map[string]db.CachedMatch
+
+func (cache memoryMatchCache) find(key string) *db.CachedMatch {
+	match, found := cache[key]
+	if !found || !match.ExpiresAt.After(time.Now()) {
+		return nil
+	}
+	return &match
+}
+
+func (cache memoryMatchCache) save(match db.CachedMatch) {
+	cache[match.Key] = match
+}
+
+func TestMatchCache(t *testing.T) {
+	const funcName = "TestMatchCache"
+	cache := make(memoryMatchCache)
+	provider := NewSpotifyProvider()
+	provider.cache = cache
+	input := csv.TrackInput{Index: 7, Artist: "The Beatles", Track: "Yesterday - Remastered 2009"}
+	if matchCacheKey(input, "us") != matchCacheKey(csv.TrackInput{Artist: "the beatles", Track: "Yesterday (Remastered 2009)"}, "US") {
+		t.Errorf("%s: keys of the same normalised track should be equal", funcName)
+	}
+	if matchCacheKey(csv.TrackInput{Artist: "Derek & The Dominos", Track: "Layla (Live)"}, "US") == matchCacheKey(csv.TrackInput{Artist: "Derek & The Dominos", Track: "Layla"}, "US") {
+		t.Errorf("%s: versions of a track should have keys of their own", funcName)
+	}
+
+	hits, misses := cacheHits.Value(), cacheMisses.Value()
+	if _, found := provider.cachedResult(input, "US"); found || cacheMisses.Value() != misses+1 {
+		t.Fatalf("%s: expected a miss", funcName)
+	}
+	provider.cacheResult(SearchResult{
+		Index:      3,
+		Input:      input,
+		IsFound:    true,
+		Outcome:    OutcomeFound,
+		URI:        "spotify:track:yesterday",
+		Confidence: 0.9,
+		Strategy:   strategyArtistTrack,
+	}, "US")
+	result, found := provider.cachedResult(input, "US")
+	if !found || !result.Cached || result.URI != "spotify:track:yesterday" || result.Index != input.Index || cacheHits.Value() != hits+1 {
+		t.Errorf("%s: unexpected hit: %v", funcName, result)
+	}
+	if _, found = provider.cachedResult(input, "IL"); found {
+		t.Errorf("%s: matches are cached per market", funcName)
+	}
+
+	missing := csv.TrackInput{Artist: "Mark Knopfler", Track: "Darling Prety"}
+	provider.cacheResult(SearchResult{Input: missing, Outcome: OutcomeNotFound, Reason: reasonLowConfidence}, "US")
+	ttl := time.Until(cache[matchCacheKey(missing, "US")].ExpiresAt)
+	if ttl > notFoundCacheTTL || ttl < notFoundCacheTTL-time.Minute {
+		t.Errorf("%s: unexpected negative TTL: %v", funcName, ttl)
+	}
+	if result, found = provider.cachedResult(missing, "US"); !found || result.IsFound || result.Reason != reasonLowConfidence {
+		t.Errorf("%s: unexpected negative hit: %v", funcName, result)
+	}
+	ambiguous := csv.TrackInput{Artist: "Dire Straits", Track: "Walk of Life"}
+	provider.cacheResult(SearchResult{Input: ambiguous, IsFound: true, Outcome: OutcomeFound, URI: "spotify:track:walkoflife", Confidence: 0.8, Ambiguous: true}, "US")
+	if _, found = provider.cachedResult(ambiguous, "US"); !found {
+		t.Errorf("%s: ambiguous matches should be reused outside of review mode", funcName)
+	}
+	provider.EnableReview()
+	if _, found = provider.cachedResult(missing, "US"); found {
+		t.Errorf("%s: review mode should search for candidates of tracks which weren't found", funcName)
+	}
+	if _, found = provider.cachedResult(ambiguous, "US"); found {
+		t.Errorf("%s: review mode should search for candidates of ambiguous matches", funcName)
+	}
+	if _, found = provider.cachedResult(input, "US"); !found {
+		t.Errorf("%s: review mode should reuse confident matches", funcName)
+	}
+
+	errored := csv.TrackInput{Artist: "Dire Straits", Track: "Tunnel of Love"}
+	provider.cacheResult(newErroredResult(errored, reasonRequestFailed), "US")
+	if _, found = cache[matchCacheKey(errored, "US")]; found {
+		t.Errorf("%s: errored results shouldn't be cached", funcName)
+	}
+}
+
+func TestMarkets(t *testing.T) {
+	const funcName = "TestMarkets"
+	markets := ParseMarkets(" us,gb,,USA,us,1l, de ")
+	if !reflect.DeepEqual(markets, []string{"US", "GB", "DE"}) {
+		t.Errorf("%s: unexpected markets: %v", funcName, markets)
+	}
+	if IsMarket("il") || !IsMarket("IL") {
+		t.Errorf("%s: markets are upper case country codes", funcName)
+	}
+
+	playable, unplayable := true, false
+	tracks := playableTracks([]trackMetaData{{ID: "a", IsPlayable: &playable}, {ID: "b", IsPlayable: &unplayable}, {ID: "c"}})
+	if len(tracks) != 2 || tracks[0].ID != "a" || tracks[1].ID != "c" {
+		t.Errorf("%s: unexpected playable tracks: %v", funcName, tracks)
+	}
+
+	const testFallback = "TestFallback"
+	t.Run(testFallback, func(t *testing.T) {
+		cache := make(memoryMatchCache)
+		provider := NewSpotifyProvider()
+		provider.cache = cache
+		provider.SetMarkets([]string{"IL", "US"})
+		input := csv.TrackInput{Artist: "Dire Straits", Track: "Sultans of Swing"}
+		provider.cacheResult(SearchResult{Input: input, Outcome: OutcomeNotFound, Reason: reasonNoResults}, "IL")
+		provider.cacheResult(SearchResult{Input: input, IsFound: true, Outcome: OutcomeFound, URI: "spotify:track:sultans"}, "US")
+		result := provider.lookupTrack(input)
+		if !result.IsFound || result.Market != "US" || result.URI != "spotify:track:sultans" {
+			t.Errorf("%s: expected a match in the fallback market: %v", testFallback, result)
+		}
+	})
+}
+
+func TestPreferences(t *testing.T) {
+	const funcName = "TestPreferences"
+	if _, err := NewPreferences("dirty", nil, nil, false); err == nil {
+		t.Errorf("%s: unknown explicit preference should fail", funcName)
+	}
+	if _, err := NewPreferences(PreferClean, []string{VersionLive, "bootleg"}, nil, false); err == nil {
+		t.Errorf("%s: unknown version should fail", funcName)
+	}
+	if (Preferences{}).key(csv.TrackInput{Track: "Layla (Live)"}) != "" {
+		t.Errorf("%s: no preferences shouldn't change match cache keys", funcName)
+	}
+	provider := NewSpotifyProvider()
+	provider.SetPreferences(Preferences{Exclude: []string{VersionLive}})
+	studio, live := csv.TrackInput{Artist: "Eric Clapton", Track: "Layla"}, csv.TrackInput{Artist: "Eric Clapton", Track: "Layla (Live)"}
+	if provider.matchCacheKey(studio, "US") == provider.matchCacheKey(live, "US") {
+		t.Errorf("%s: a title which asks for an excluded version should have its own match cache key", funcName)
+	}
+
+	track := func(id, name, album, albumType string, explicit bool) trackMetaData {
+		candidate := trackMetaData{ID: id, Name: name, Artists: []artistData{{Name: "Eric Clapton"}}, Explicit: explicit}
+		candidate.Album.Name = album
+		candidate.Album.AlbumType = albumType
+		return candidate
+	}
+	candidates := []trackMetaData{
+		track("live", "Layla - Live at the Royal Albert Hall", "Live at the Royal Albert Hall", "album", false),
+		track("compilation", "Layla", "Clapton Chronicles: The Best of Eric Clapton", "compilation", false),
+		track("explicit", "Layla", "Layla and Other Assorted Love Songs", "album", true),
+		track("karaoke", "Layla (Karaoke Version)", "Karaoke Hits", "compilation", false),
+	}
+	input := csv.TrackInput{Artist: "Eric Clapton", Track: "Layla"}
+
+	cases := []struct {
+		preferences Preferences
+		input       csv.TrackInput
+		expected    string
+	}{
+		{Preferences{}, input, "live"},
+		{Preferences{Exclude: []string{VersionLive, VersionKaraoke}}, input, "compilation"},
+		{Preferences{Exclude: []string{VersionLive}, OriginalAlbum: true}, input, "explicit"},
+		{Preferences{Exclude: []string{VersionLive}, Explicit: PreferClean}, input, "compilation"},
+		{Preferences{Explicit: PreferExplicit}, input, "explicit"},
+		{Preferences{Prefer: []string{VersionKaraoke}}, input, "karaoke"},
+		{Preferences{Exclude: []string{VersionLive}}, csv.TrackInput{Artist: "Eric Clapton", Track: "Layla (Live)"}, "live"},
+	}
+	for _, testCase := range cases {
+		candidates := testCase.preferences.filter(testCase.input, candidates)
+		if best, _ := testCase.preferences.pick(testCase.input, candidates); best.ID != testCase.expected {
+			t.Errorf("%s: %+v: expected %s, got %s", funcName, testCase.preferences, testCase.expected, best.ID)
+		}
+	}
+
+	excluded := (Preferences{Exclude: []string{VersionKaraoke, VersionTribute}}).filter(input, []trackMetaData{
+		track("karaoke", "Layla", "Sing Like Clapton: Karaoke", "album", false),
+		{ID: "tribute", Name: "Layla", Artists: []artistData{{Name: "Tribute to Eric Clapton"}}},
+	})
+	if len(excluded) != 0 {
+		t.Errorf("%s: versions should be detected in album and artist names: %v", funcName, excluded)
+	}
+}
+
+// newFakeProvider returns an uncached provider of the user of the fake server which retries at once
+func newFakeProvider(server *clienttest.Server) *SpotifyProvider {
+	provider := NewSpotifyProviderWithAPI(NewSpotifyAPI(server.APIURL(), server.AccountsURL()))
+	provider.SetUserData(&db.SpotifyUser{RefreshToken: server.RefreshToken, UserID: server.UserID})
+	provider.cache = nil
+	provider.retryDelay = 0
+	return provider
+}
+
+var fakeCatalogue = []clienttest.Track{
+	{ID: "yesterday", Name: "Yesterday - Remastered 2009", Artists: []string{"The Beatles"}, Album: "Help!", ISRC: "GBAYE0601477"},
+	{ID: "letitbe", Name: "Let It Be", Artists: []string{"The Beatles"}, Album: "Let It Be", ISRC: "GBAYE0601713"},
+	{ID: "heyjude", Name: "Hey Jude", Artists: []string{"The Beatles"}, Album: "Hey Jude", ISRC: "GBAYE0601690", Markets: []string{"GB"}},
+	{ID: "heyjude-relinked", Name: "Hey Jude", Artists: []string{"The Beatles"}, Album: "1", AlbumType: "compilation", ISRC: "GBAYE0601690", Markets: []string{"DE"}},
+}
+
+func TestFakeImport(t *testing.T) {
+	const funcName = "TestFakeImport"
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(fakeCatalogue...)
+	provider := newFakeProvider(server)
+	provider.SetMarkets([]string{"US", "GB"})
+
+	tracksProgress := TracksLookupProgress{
+		Results: make(chan SearchResult),
+		Done:    make(chan error),
+	}
+	tracks := []csv.TrackInput{
+		{Index: 0, Artist: "The Beatles", Track: "Yesterday"},
+		{Index: 1, Artist: "the beatles", Track: "Let it be"},
+		{Index: 2, Artist: "The Beatles", Track: "Hey Jude"},
+	}
+	go provider.GetSearchResults(context.Background(), tracksProgress, tracks)
+	results := make(map[int]SearchResult)
+	for done := false; !done; {
+		select {
+		case result := <-tracksProgress.Results:
+			results[result.Index] = result
+		case err := <-tracksProgress.Done:
+			if err != nil {
+				t.Fatalf("%s: lookup failed: %v", funcName, err)
+			}
+			done = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: lookup didn't terminate", funcName)
+		}
+	}
+	for _, track := range tracks {
+		if !results[track.Index].IsFound {
+			t.Errorf("%s: %s wasn't found: %v", funcName, track.Track, results[track.Index])
+		}
+	}
+	if result := results[2]; result.URI != "spotify:track:heyjude" || result.Market != "GB" {
+		t.Errorf("%s: expected the GB release in the fallback market, got %s in %s", funcName, result.URI, result.Market)
+	}
+
+	err := provider.SetTargetPlaylist(ImportCreate, "", PlaylistDetails{Name: "road trip", Description: "{file}"})
+	if err != nil {
+		t.Fatalf("%s: SetTargetPlaylist: %v", funcName, err)
+	}
+	if err = provider.AddItemsToPlaylist(); err != nil {
+		t.Fatalf("%s: AddItemsToPlaylist: %v", funcName, err)
+	}
+	playlist, found := server.Playlist(provider.PlaylistID())
+	expected := "spotify:track:yesterday,spotify:track:letitbe,spotify:track:heyjude"
+	if !found || playlist.Name != "road trip" || playlist.OwnerID != server.UserID || strings.Join(playlist.URIs, ",") != expected {
+		t.Errorf("%s: unexpected playlist: %+v", funcName, playlist)
+	}
+}
+
+func TestTrackURIs(t *testing.T) {
+	const funcName = "TestTrackURIs"
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(fakeCatalogue...)
+	provider := newFakeProvider(server)
+	provider.SetMarkets([]string{"US", "GB"})
+	if err := provider.Authorize(); err != nil {
+		t.Fatalf("%s: Authorize: %v", funcName, err)
+	}
+
+	batch := []csv.TrackInput{
+		{Index: 0, Artist: "Someone", Track: "Garbled", URI: "spotify:track:letitbe"},
+		{Index: 1, URI: "spotify:track:heyjude"},
+		{Index: 2, Artist: "The Beatles", Track: "Yesterday", URI: "spotify:track:deleted"},
+		{Index: 3, Artist: "The Beatles", Track: "Let It Be"},
+	}
+	requests := server.Requests(http.MethodGet, "/v1/tracks")
+	resolved := provider.resolveTrackURIs(batch)
+	if result := resolved[0]; result.URI != "spotify:track:letitbe" || result.TrackName != "Let It Be" || result.Strategy != strategyURI || result.Market != "US" {
+		t.Errorf("%s: expected the track of the URI, got %+v", funcName, result)
+	}
+	if result := resolved[1]; result.URI != "spotify:track:heyjude" || result.Market != "GB" {
+		t.Errorf("%s: expected the track in the market it's playable in, got %s in %s", funcName, result.URI, result.Market)
+	}
+	if _, found := resolved[2]; found || len(resolved) != 2 {
+		t.Errorf("%s: expected unknown URIs and rows without URI to be left out, got %v", funcName, resolved)
+	}
+	if server.Requests(http.MethodGet, "/v1/tracks") != requests+2 {
+		t.Errorf("%s: expected a request per market", funcName)
+	}
+	if result := provider.lookupTrack(batch[2]); result.URI != "spotify:track:yesterday" {
+		t.Errorf("%s: expected a track of an unknown URI to be searched, got %v", funcName, result)
+	}
+
+	malformed := []csv.TrackInput{
+		{Index: 0, URI: "spotify:track:letitbe"},
+		{Index: 1, URI: "spotify:track:not a track"},
+	}
+	if resolved := provider.resolveTrackURIs(malformed); len(resolved) != 0 {
+		t.Errorf("%s: expected the tracks of a failed request to be searched, got %v", funcName, resolved)
+	}
+	if provider.actualRetries != 0 {
+		t.Errorf("%s: a malformed URI shouldn't use up retries", funcName)
+	}
+}
+
+func TestStreamInvalidCSV(t *testing.T) {
+	const funcName = "TestStreamInvalidCSV"
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(fakeCatalogue...)
+	provider := newFakeProvider(server)
+
+	tracksProgress := TracksLookupProgress{
+		Results: make(chan SearchResult),
+		Done:    make(chan error),
+	}
+	reader, err := csv.NewReader(strings.NewReader("Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles,1970\n"))
+	if err != nil {
+		t.Fatalf("%s: csv.NewReader: %v", funcName, err)
+	}
+	go provider.StreamSearchResults(context.Background(), tracksProgress, reader)
+	var results []SearchResult
+	for done := false; !done; {
+		select {
+		case result := <-tracksProgress.Results:
+			results = append(results, result)
+		case err = <-tracksProgress.Done:
+			done = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: lookup didn't terminate", funcName)
+		}
+	}
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) || lookupErr.Cause != apierror.InvalidCSV {
+		t.Errorf("%s: expected %s, got %v", funcName, apierror.InvalidCSV, err)
+	}
+	if len(results) != 1 || !results[0].IsFound {
+		t.Errorf("%s: the rows before the malformed one should be looked up: %+v", funcName, results)
+	}
+}
+
+func TestFakeFailures(t *testing.T) {
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(fakeCatalogue...)
+	provider := newFakeProvider(server)
+	if err := provider.Authorize(); err != nil {
+		t.Fatalf("TestFakeFailures: Authorize: %v", err)
+	}
+	yesterday := csv.TrackInput{Artist: "The Beatles", Track: "Yesterday"}
+
+	const testTokenExpiry = "TestTokenExpiry"
+	t.Run(testTokenExpiry, func(t *testing.T) {
+		server.ExpireTokens()
+		tokens := server.Requests(http.MethodPost, "/api/token")
+		if result := provider.lookupTrack(yesterday); !result.IsFound {
+			t.Errorf("%s: expected a match with a refreshed token: %v", testTokenExpiry, result)
+		}
+		if server.Requests(http.MethodPost, "/api/token") != tokens+1 {
+			t.Errorf("%s: expected the access token to be refreshed once", testTokenExpiry)
+		}
+	})
+
+	const testRateLimit = "TestRateLimit"
+	t.Run(testRateLimit, func(t *testing.T) {
+		server.Fail("/v1/search", http.StatusTooManyRequests, 2)
+		searches := server.Requests(http.MethodGet, "/v1/search")
+		// Retry-After is honoured instead of the delay
+		provider.retryDelay = time.Hour
+		result := provider.lookupTrack(yesterday)
+		provider.retryDelay = 0
+		if !result.IsFound {
+			t.Errorf("%s: expected a match once the rate limit passes: %v", testRateLimit, result)
+		}
+		if server.Requests(http.MethodGet, "/v1/search") != searches+3 {
+			t.Errorf("%s: expected 2 retries", testRateLimit)
+		}
+	})
+
+	const testServerError = "TestServerError"
+	t.Run(testServerError, func(t *testing.T) {
+		server.Fail("/v1/search", http.StatusServiceUnavailable, 1)
+		if result := provider.lookupTrack(yesterday); result.Outcome != OutcomeErrored || result.Reason != reasonRequestFailed {
+			t.Errorf("%s: expected an errored result, got %s: %s", testServerError, result.Outcome, result.Reason)
+		}
+	})
+
+	const testRetriesBudget = "TestRetriesBudget"
+	t.Run(testRetriesBudget, func(t *testing.T) {
+		server.Fail("/v1/search", http.StatusTooManyRequests, provider.maxRetries+1)
+		if result := provider.lookupTrack(yesterday); result.Outcome != OutcomeErrored {
+			t.Errorf("%s: expected an errored result once retries run out, got %s", testRetriesBudget, result.Outcome)
+		}
+	})
+
+	const testRateLimited = "TestRateLimited"
+	t.Run(testRateLimited, func(t *testing.T) {
+		server.Fail("/v1/users", http.StatusTooManyRequests, provider.maxRetries+1)
+		_, err := provider.CreatePlaylistWithDetails(PlaylistDetails{Name: "mix"})
+		if !errors.Is(err, ErrRateLimited) || Cause(err, apierror.PlaylistCreateFailed) != apierror.RateLimited {
+			t.Errorf("%s: expected %s once retries run out, got %v", testRateLimited, apierror.RateLimited, err)
+		}
+	})
+
+	// the last subtest, the token stays revoked
+	const testTokenRevoked = "TestTokenRevoked"
+	t.Run(testTokenRevoked, func(t *testing.T) {
+		// the delay applies to failures other than 401
+		provider.retryDelay = time.Hour
+		provider.actualRetries = 0
+		server.RevokeToken()
+		server.ExpireTokens()
+		tokens := server.Requests(http.MethodPost, "/api/token")
+		for range []int{0, 1} {
+			if _, err := provider.GetSavedTrackURIs(); !errors.Is(err, ErrTokenRevoked) {
+				t.Errorf("%s: expected %v, got %v", testTokenRevoked, ErrTokenRevoked, err)
+			}
+		}
+		if server.Requests(http.MethodPost, "/api/token") != tokens+1 || provider.actualRetries != 1 {
+			t.Errorf("%s: requests shouldn't be retried once the token refresh found the token revoked", testTokenRevoked)
+		}
+	})
+}
+
+func TestFakePlaylists(t *testing.T) {
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(fakeCatalogue...)
+	server.PageSize = 2
+	found := func(uris ...string) []FoundTrack {
+		results := make([]FoundTrack, len(uris))
+		for i, uri := range uris {
+			results[i] = FoundTrack{Index: i, URI: uri}
+		}
+		return results
+	}
+
+	const testMerge = "TestMerge"
+	t.Run(testMerge, func(t *testing.T) {
+		playlistID := server.AddPlaylist(clienttest.Playlist{
+			Name: "mix",
+			URIs: []string{"spotify:track:a", "spotify:track:b", "spotify:track:heyjude-relinked", "spotify:track:c", "spotify:track:d"},
+		})
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testMerge, err)
+		}
+		pages := server.Requests(http.MethodGet, "/v1/playlists/"+playlistID+"/tracks")
+		if err := provider.SetTargetPlaylist(ImportMerge, "", PlaylistDetails{Name: "mix"}); err != nil {
+			t.Fatalf("%s: SetTargetPlaylist: %v", testMerge, err)
+		}
+		if server.Requests(http.MethodGet, "/v1/playlists/"+playlistID+"/tracks") != pages+3 {
+			t.Errorf("%s: expected the playlist tracks in 3 pages", testMerge)
+		}
+		provider.LookedUpTracks = found("spotify:track:b", "spotify:track:letitbe", "spotify:track:heyjude")
+		provider.LookedUpTracks[2].ISRC = "GBAYE0601690"
+		if err := provider.AddItemsToPlaylist(); err != nil {
+			t.Fatalf("%s: AddItemsToPlaylist: %v", testMerge, err)
+		}
+		playlist, _ := server.Playlist(playlistID)
+		if len(playlist.URIs) != 6 || playlist.URIs[5] != "spotify:track:letitbe" {
+			t.Errorf("%s: expected only letitbe to be appended, got %v", testMerge, playlist.URIs)
+		}
+		skipped := provider.DuplicatesSkipped()
+		if skipped[DuplicateInDestination] != 1 || skipped[DuplicateRelinked] != 1 {
+			t.Errorf("%s: unexpected skipped duplicates: %v", testMerge, skipped)
+		}
+	})
+
+	const testSync = "TestSync"
+	t.Run(testSync, func(t *testing.T) {
+		playlistID := server.AddPlaylist(clienttest.Playlist{
+			Name: "sync",
+			URIs: []string{"spotify:track:a", "spotify:track:b", "spotify:track:c", "spotify:track:b"},
+		})
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testSync, err)
+		}
+		if err := provider.SetTargetPlaylist(ImportSync, playlistID, PlaylistDetails{}); err != nil {
+			t.Fatalf("%s: SetTargetPlaylist: %v", testSync, err)
+		}
+		provider.LookedUpTracks = found("spotify:track:c", "spotify:track:a", "spotify:track:e")
+		if _, err := provider.SyncPlaylist(false); err != nil {
+			t.Fatalf("%s: SyncPlaylist: %v", testSync, err)
+		}
+		playlist, _ := server.Playlist(playlistID)
+		if strings.Join(playlist.URIs, ",") != "spotify:track:c,spotify:track:a,spotify:track:e" {
+			t.Errorf("%s: expected [c a e], got %v", testSync, playlist.URIs)
+		}
+	})
+
+	const testSyncUnavailable = "TestSyncUnavailable"
+	t.Run(testSyncUnavailable, func(t *testing.T) {
+		playlistID := server.AddPlaylist(clienttest.Playlist{
+			Name: "unavailable",
+			URIs: []string{"spotify:track:a", "", "spotify:track:b", "spotify:track:c", "", "spotify:track:d"},
+		})
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testSyncUnavailable, err)
+		}
+		if err := provider.SetTargetPlaylist(ImportSync, playlistID, PlaylistDetails{}); err != nil {
+			t.Fatalf("%s: SetTargetPlaylist: %v", testSyncUnavailable, err)
+		}
+		provider.LookedUpTracks = found("spotify:track:d", "spotify:track:b", "spotify:track:e")
+		if _, err := provider.SyncPlaylist(false); err != nil {
+			t.Fatalf("%s: SyncPlaylist: %v", testSyncUnavailable, err)
+		}
+		playlist, _ := server.Playlist(playlistID)
+		if strings.Join(playlist.URIs, ",") != "spotify:track:d,spotify:track:b,spotify:track:e,," {
+			t.Errorf("%s: expected [d b e] followed by the unavailable tracks, got %v", testSyncUnavailable, playlist.URIs)
+		}
+	})
+
+	const testNotOwned = "TestNotOwned"
+	t.Run(testNotOwned, func(t *testing.T) {
+		playlistID := server.AddPlaylist(clienttest.Playlist{Name: "shared", OwnerID: "someone"})
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testNotOwned, err)
+		}
+		if err := provider.SetTargetPlaylist(ImportAppend, playlistID, PlaylistDetails{}); !errors.Is(err, ErrPlaylistNotOwned) {
+			t.Errorf("%s: expected ErrPlaylistNotOwned, got %v", testNotOwned, err)
+		}
+		if err := provider.SetTargetPlaylist(ImportAppend, "missing", PlaylistDetails{}); err == nil {
+			t.Errorf("%s: expected an error for a missing playlist", testNotOwned)
+		}
+	})
+
+	const testUnknownPlaylist = "TestUnknownPlaylist"
+	t.Run(testUnknownPlaylist, func(t *testing.T) {
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testUnknownPlaylist, err)
+		}
+		// 404 isn't retried
+		provider.retryDelay = time.Hour
+		requests := server.Requests(http.MethodGet, "/v1/playlists/unknown")
+		if err := provider.SetTargetPlaylist(ImportReplace, "unknown", PlaylistDetails{}); !errors.Is(err, ErrPlaylistNotFound) {
+			t.Errorf("%s: expected ErrPlaylistNotFound, got %v", testUnknownPlaylist, err)
+		}
+		if server.Requests(http.MethodGet, "/v1/playlists/unknown") != requests+1 {
+			t.Errorf("%s: expected a single request", testUnknownPlaylist)
+		}
+		if provider.actualRetries != 0 {
+			t.Errorf("%s: expected the retries budget to be left, %d retries used", testUnknownPlaylist, provider.actualRetries)
+		}
+	})
+
+	const testLibrary = "TestLibrary"
+	t.Run(testLibrary, func(t *testing.T) {
+		provider := newFakeProvider(server)
+		if err := provider.Authorize(); err != nil {
+			t.Fatalf("%s: Authorize: %v", testLibrary, err)
+		}
+		// the albums and artists are looked up by the URIs of the found tracks
+		provider.LookedUpTracks = found("spotify:track:letitbe", "spotify:track:yesterday", "spotify:track:letitbe", "spotify:track:gone")
+		if err := provider.AddToLibrary(DestinationAlbums); err != nil {
+			t.Fatalf("%s: AddToLibrary: %v", testLibrary, err)
+		}
+		if albums := server.SavedAlbums(); strings.Join(albums, ",") != "album-let-it-be,album-help!" {
+			t.Errorf("%s: expected the albums in CSV order, got %v", testLibrary, albums)
+		}
+		if err := provider.AddToLibrary(DestinationArtists); err != nil {
+			t.Fatalf("%s: AddToLibrary: %v", testLibrary, err)
+		}
+		if artists := server.FollowedArtists(); strings.Join(artists, ",") != "artist-the-beatles" {
+			t.Errorf("%s: expected the artist once, got %v", testLibrary, artists)
 		}
 	})
 }
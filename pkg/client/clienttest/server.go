@@ -0,0 +1,833 @@
+/*
+Package clienttest provides a fake Spotify Web API and accounts service so that
+the lookups and playlist flows of the client package can be tested offline:
+
+	server := clienttest.NewServer()
+	defer server.Close()
+	server.AddTracks(clienttest.Track{ID: "yesterday", Name: "Yesterday", Artists: []string{"The Beatles"}})
+	provider := client.NewSpotifyProviderWithAPI(client.NewSpotifyAPI(server.APIURL(), server.AccountsURL()))
+*/
+package clienttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// apiPrefix is the path of the Web API, the accounts service is served at the root
+	apiPrefix = "/v1"
+	// defaultLimit is the page size of lists which aren't requested with a limit
+	defaultLimit = 20
+)
+
+// Track is a track of the fake catalogue
+type Track struct {
+	ID        string
+	Name      string
+	Artists   []string
+	Album     string
+	AlbumType string
+	ISRC      string
+	Explicit  bool
+	// Markets the track is playable in, it's playable everywhere if there're none
+	Markets []string
+}
+
+// URI returns the Spotify URI of the track
+func (track Track) URI() string {
+	return "spotify:track:" + track.ID
+}
+
+// Playlist is a playlist of the fake server
+type Playlist struct {
+	ID            string
+	Name          string
+	OwnerID       string
+	Description   string
+	Public        bool
+	Collaborative bool
+	// URIs are the tracks of the playlist, an empty URI is a track
+	// which is no longer available (its item has a null track)
+	URIs []string
+	// CoverImage is the last uploaded base64 encoded cover
+	CoverImage string
+}
+
+// grant is an issued access token, userID is empty for client credentials tokens
+type grant struct {
+	userID string
+	expiry time.Time
+	isWeb  bool // issued by IssueToken
+}
+
+// failure is an injected error response of the requests whose path starts with path
+type failure struct {
+	path   string
+	status int
+	count  int
+}
+
+// Server is a fake Spotify Web API and accounts service, it's safe for concurrent use
+type Server struct {
+	*httptest.Server
+	// RefreshToken is the refresh token of UserID, the accounts service accepts
+	// it and the refresh tokens of the users added by AddUser
+	RefreshToken string
+	// UserID and Country are the profile of the user, see GET /me
+	UserID  string
+	Country string
+	// PageSize caps the page size of lists (lower than the requested limit) to exercise pagination
+	PageSize int
+	// TokenTTL is how long issued access tokens are valid
+	TokenTTL time.Duration
+
+	mutex       sync.Mutex
+	tracks      []Track
+	playlists   []*Playlist
+	savedTracks map[string][]string // Liked Songs by user id
+	savedAlbums []string
+	followed    []string
+	tokens      map[string]grant
+	users       map[string]string // ids of the users added by AddUser by refresh token
+	failures    []failure
+	requests    map[string]int
+	lastID      int
+	// held is closed by Release, requests wait for it while it's set
+	held chan struct{}
+	// revoked - RefreshToken was revoked, see RevokeToken
+	revoked bool
+}
+
+// NewServer starts a fake Spotify with an empty catalogue, it should be closed by Close
+func NewServer() *Server {
+	server := &Server{
+		RefreshToken: "refresh-token",
+		UserID:       "user",
+		Country:      "US",
+		TokenTTL:     time.Hour,
+		savedTracks:  make(map[string][]string),
+		tokens:       make(map[string]grant),
+		users:        make(map[string]string),
+		requests:     make(map[string]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server
+}
+
+// APIURL returns the base URL of the fake Web API
+func (server *Server) APIURL() string {
+	return server.URL + apiPrefix
+}
+
+// AccountsURL returns the base URL of the fake accounts service
+func (server *Server) AccountsURL() string {
+	return server.URL
+}
+
+// AddTracks adds tracks to the catalogue
+func (server *Server) AddTracks(tracks ...Track) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.tracks = append(server.tracks, tracks...)
+}
+
+// AddPlaylist adds a playlist (owned by UserID if OwnerID isn't set) and returns its id
+func (server *Server) AddPlaylist(playlist Playlist) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if playlist.ID == "" {
+		playlist.ID = server.newID("playlist")
+	}
+	if playlist.OwnerID == "" {
+		playlist.OwnerID = server.UserID
+	}
+	server.playlists = append(server.playlists, &playlist)
+	return playlist.ID
+}
+
+// Playlist returns a copy of the playlist with id
+func (server *Server) Playlist(id string) (Playlist, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	playlist := server.findPlaylist(id)
+	if playlist == nil {
+		return Playlist{}, false
+	}
+	copied := *playlist
+	copied.URIs = append([]string{}, playlist.URIs...)
+	return copied, true
+}
+
+// Playlists returns copies of all the playlists in creation order
+func (server *Server) Playlists() []Playlist {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	playlists := make([]Playlist, len(server.playlists))
+	for i, playlist := range server.playlists {
+		playlists[i] = *playlist
+		playlists[i].URIs = append([]string{}, playlist.URIs...)
+	}
+	return playlists
+}
+
+// AddUser adds a user whose refresh token the accounts service accepts,
+// e.g. the target account of a migration
+func (server *Server) AddUser(userID string, refreshToken string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.users[refreshToken] = userID
+}
+
+// SaveTracks saves the URIs to the Liked Songs of the user in order, the last one is listed first
+func (server *Server) SaveTracks(userID string, uris ...string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, uri := range uris {
+		server.savedTracks[userID] = append([]string{uri}, server.savedTracks[userID]...)
+	}
+}
+
+// SavedTracks returns the URIs of the user's Liked Songs, the most recently saved first
+func (server *Server) SavedTracks(userID string) []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.savedTracks[userID]...)
+}
+
+// SavedAlbums returns the ids of the saved albums in save order
+func (server *Server) SavedAlbums() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.savedAlbums...)
+}
+
+// FollowedArtists returns the ids of the followed artists in follow order
+func (server *Server) FollowedArtists() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.followed...)
+}
+
+// Fail makes the next count requests whose path starts with path (e.g. "/v1/search")
+// fail with status, 429 responses ask to retry at once
+func (server *Server) Fail(path string, status int, count int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.failures = append(server.failures, failure{path: path, status: status, count: count})
+}
+
+// RevokeToken revokes the refresh token like a user who removed the application access,
+// access tokens can't be refreshed anymore
+func (server *Server) RevokeToken() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.revoked = true
+}
+
+// ExpireTokens expires the issued access tokens, the next Web API requests get 401
+func (server *Server) ExpireTokens() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for token, issued := range server.tokens {
+		issued.expiry = time.Time{}
+		server.tokens[token] = issued
+	}
+}
+
+// IssueToken returns a new access token of the user like the web client
+// gets when the user logs in, GET /me returns the profile of its user
+func (server *Server) IssueToken(userID string) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	token := server.issueToken(userID)
+	issued := server.tokens[token]
+	issued.isWeb = true
+	server.tokens[token] = issued
+	return token
+}
+
+func (server *Server) issueToken(userID string) string {
+	token := server.newID("token")
+	server.tokens[token] = grant{userID: userID, expiry: time.Now().Add(server.TokenTTL)}
+	return token
+}
+
+// Hold makes requests wait until Release is called, e.g. to observe a job before its
+// lookups start. Requests with tokens of IssueToken (the web client's) aren't held.
+// Held requests should be released before the server is closed.
+func (server *Server) Hold() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.held == nil {
+		server.held = make(chan struct{})
+	}
+}
+
+// Release serves the held requests and the following ones
+func (server *Server) Release() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.held != nil {
+		close(server.held)
+		server.held = nil
+	}
+}
+
+// Requests returns how many requests were made with method to path e.g. Requests("GET", "/v1/search")
+func (server *Server) Requests(method string, path string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.requests[method+" "+path]
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	held := server.held
+	if server.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")].isWeb {
+		held = nil
+	}
+	server.mutex.Unlock()
+	if held != nil {
+		<-held
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.requests[req.Method+" "+req.URL.Path]++
+	if status, failed := server.injectedFailure(req.URL.Path); failed {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		writeError(w, status, http.StatusText(status))
+		return
+	}
+	if req.Method == http.MethodPost && req.URL.Path == "/api/token" {
+		server.serveToken(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, apiPrefix+"/") {
+		http.NotFound(w, req)
+		return
+	}
+	issued, found := server.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+	if !found {
+		writeError(w, http.StatusUnauthorized, "Invalid access token")
+		return
+	}
+	if !time.Now().Before(issued.expiry) {
+		writeError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+	server.serveAPI(w, req, issued.userID, strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, apiPrefix), "/"), "/"))
+}
+
+// injectedFailure returns the status of the first failure of path which is left
+func (server *Server) injectedFailure(path string) (status int, failed bool) {
+	for i := range server.failures {
+		injected := &server.failures[i]
+		if injected.count > 0 && strings.HasPrefix(path, injected.path) {
+			injected.count--
+			return injected.status, true
+		}
+	}
+	return 0, false
+}
+
+// serveToken issues access tokens by the refresh token and client credentials grants
+func (server *Server) serveToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	var userID string
+	switch req.PostForm.Get("grant_type") {
+	case "client_credentials":
+	case "refresh_token":
+		refreshToken := req.PostForm.Get("refresh_token")
+		userID = server.users[refreshToken]
+		if refreshToken == server.RefreshToken && !server.revoked {
+			userID = server.UserID
+		}
+		if userID == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "Refresh token revoked"})
+			return
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	token := server.issueToken(userID)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(server.TokenTTL.Seconds()),
+	})
+}
+
+// serveAPI routes the Web API requests of the token's user by the path segments after /v1
+func (server *Server) serveAPI(w http.ResponseWriter, req *http.Request, userID string, segments []string) {
+	route := req.Method + " /" + strings.Join(segments, "/")
+	switch {
+	case route == "GET /search":
+		server.serveSearch(w, req)
+	case route == "GET /me":
+		writeJSON(w, http.StatusOK, map[string]string{"id": userID, "country": server.Country})
+	case route == "GET /tracks":
+		server.serveTracks(w, req)
+	case route == "GET /me/tracks":
+		server.servePage(w, req, trackItems(server.savedTracks[userID], server.catalogueByURI(), ""))
+	case route == "PUT /me/tracks":
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		if !decodeBody(w, req, &body) {
+			return
+		}
+		for _, id := range body.IDs {
+			// Liked Songs lists the most recently saved first
+			server.savedTracks[userID] = append([]string{"spotify:track:" + id}, server.savedTracks[userID]...)
+		}
+		w.WriteHeader(http.StatusOK)
+	case route == "PUT /me/albums" || route == "PUT /me/following":
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		if !decodeBody(w, req, &body) {
+			return
+		}
+		if segments[1] == "albums" {
+			server.savedAlbums = append(server.savedAlbums, body.IDs...)
+		} else {
+			server.followed = append(server.followed, body.IDs...)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 3 && segments[0] == "users" && segments[2] == "playlists":
+		server.serveUserPlaylists(w, req, segments[1])
+	case len(segments) >= 2 && segments[0] == "playlists":
+		playlist := server.findPlaylist(segments[1])
+		if playlist == nil {
+			writeError(w, http.StatusNotFound, "Not found.")
+			return
+		}
+		server.servePlaylist(w, req, playlist, segments[2:])
+	default:
+		writeError(w, http.StatusNotFound, "Service not found")
+	}
+}
+
+// serveSearch searches the catalogue by the `isrc:`, `artist:` and `track:` field
+// filters or by free text, every word of which must be in the track or artist names
+func (server *Server) serveSearch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("type") != "track" {
+		writeError(w, http.StatusBadRequest, "Unsupported type")
+		return
+	}
+	limit := queryInt(query, "limit", defaultLimit)
+	market := query.Get("market")
+	var matches func(track Track) bool
+	q := strings.ToLower(query.Get("q"))
+	switch {
+	case strings.HasPrefix(q, "isrc:"):
+		isrc := strings.TrimPrefix(q, "isrc:")
+		matches = func(track Track) bool { return strings.ToLower(track.ISRC) == isrc }
+	case strings.HasPrefix(q, "artist:") && strings.Contains(q, " track:"):
+		filters := strings.SplitN(strings.TrimPrefix(q, "artist:"), " track:", 2)
+		artist, name := strings.TrimSpace(filters[0]), strings.TrimSpace(filters[1])
+		matches = func(track Track) bool {
+			return strings.Contains(strings.ToLower(track.Name), name) &&
+				strings.Contains(strings.ToLower(strings.Join(track.Artists, ", ")), artist)
+		}
+	default:
+		words := strings.Fields(q)
+		matches = func(track Track) bool {
+			text := strings.ToLower(track.Name + " " + strings.Join(track.Artists, " "))
+			for _, word := range words {
+				if !strings.Contains(text, word) {
+					return false
+				}
+			}
+			return len(words) > 0
+		}
+	}
+	items := []map[string]interface{}{}
+	total := 0
+	for _, track := range server.tracks {
+		if !matches(track) {
+			continue
+		}
+		total++
+		if len(items) < limit {
+			items = append(items, trackJSON(track, market))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tracks": map[string]interface{}{"items": items, "total": total, "next": nil},
+	})
+}
+
+// serveTracks returns the tracks of the ids query, unknown tracks are null,
+// a malformed id fails the request
+func (server *Server) serveTracks(w http.ResponseWriter, req *http.Request) {
+	byURI := server.catalogueByURI()
+	tracks := []interface{}{}
+	for _, id := range strings.Split(req.URL.Query().Get("ids"), ",") {
+		if !isID(id) {
+			writeError(w, http.StatusBadRequest, "invalid id")
+			return
+		}
+		if track, found := byURI["spotify:track:"+id]; found {
+			tracks = append(tracks, trackJSON(track, req.URL.Query().Get("market")))
+		} else {
+			tracks = append(tracks, nil)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tracks": tracks})
+}
+
+// isID reports whether id looks like an id of the catalogue
+func isID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, char := range id {
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) && char != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// serveUserPlaylists lists the playlists of the user or creates one
+func (server *Server) serveUserPlaylists(w http.ResponseWriter, req *http.Request, userID string) {
+	switch req.Method {
+	case http.MethodGet:
+		items := []interface{}{}
+		for _, playlist := range server.playlists {
+			if playlist.OwnerID == userID || playlist.Collaborative {
+				items = append(items, playlistJSON(playlist))
+			}
+		}
+		server.servePage(w, req, items)
+	case http.MethodPost:
+		var body struct {
+			Name          string `json:"name"`
+			Description   string `json:"description"`
+			Public        bool   `json:"public"`
+			Collaborative bool   `json:"collaborative"`
+		}
+		if !decodeBody(w, req, &body) {
+			return
+		}
+		if body.Name == "" {
+			writeError(w, http.StatusBadRequest, "Missing required field: name")
+			return
+		}
+		playlist := &Playlist{
+			ID:            server.newID("playlist"),
+			Name:          body.Name,
+			OwnerID:       userID,
+			Description:   body.Description,
+			Public:        body.Public,
+			Collaborative: body.Collaborative,
+		}
+		server.playlists = append(server.playlists, playlist)
+		writeJSON(w, http.StatusCreated, playlistJSON(playlist))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// servePlaylist serves /playlists/{id}, /playlists/{id}/tracks and /playlists/{id}/images
+func (server *Server) servePlaylist(w http.ResponseWriter, req *http.Request, playlist *Playlist, segments []string) {
+	route := req.Method + " /" + strings.Join(segments, "/")
+	switch route {
+	case "GET /":
+		writeJSON(w, http.StatusOK, playlistJSON(playlist))
+	case "PUT /":
+		var body map[string]interface{}
+		if !decodeBody(w, req, &body) {
+			return
+		}
+		if name, ok := body["name"].(string); ok {
+			playlist.Name = name
+		}
+		if description, ok := body["description"].(string); ok {
+			playlist.Description = description
+		}
+		if public, ok := body["public"].(bool); ok {
+			playlist.Public = public
+		}
+		if collaborative, ok := body["collaborative"].(bool); ok {
+			playlist.Collaborative = collaborative
+		}
+		w.WriteHeader(http.StatusOK)
+	case "PUT /images":
+		cover, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		playlist.CoverImage = string(cover)
+		w.WriteHeader(http.StatusAccepted)
+	case "GET /tracks":
+		server.servePage(w, req, trackItems(playlist.URIs, server.catalogueByURI(), req.URL.Query().Get("market")))
+	case "POST /tracks":
+		var body struct {
+			URIs     []string `json:"uris"`
+			Position *int     `json:"position"`
+		}
+		if !decodeBody(w, req, &body) {
+			return
+		}
+		position := len(playlist.URIs)
+		if body.Position != nil && *body.Position >= 0 && *body.Position < position {
+			position = *body.Position
+		}
+		uris := append(append(append([]string{}, playlist.URIs[:position]...), body.URIs...), playlist.URIs[position:]...)
+		playlist.URIs = uris
+		writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": server.newID("snapshot")})
+	case "PUT /tracks":
+		server.replaceOrReorder(w, req, playlist)
+	case "DELETE /tracks":
+		server.removeTracks(w, req, playlist)
+	default:
+		writeError(w, http.StatusNotFound, "Service not found")
+	}
+}
+
+// replaceOrReorder replaces the tracks of the playlist with `uris` or moves
+// `range_length` tracks from `range_start` before `insert_before`
+func (server *Server) replaceOrReorder(w http.ResponseWriter, req *http.Request, playlist *Playlist) {
+	var body struct {
+		URIs         []string `json:"uris"`
+		RangeStart   *int     `json:"range_start"`
+		InsertBefore *int     `json:"insert_before"`
+		RangeLength  *int     `json:"range_length"`
+	}
+	if !decodeBody(w, req, &body) {
+		return
+	}
+	if body.RangeStart == nil {
+		playlist.URIs = append([]string{}, body.URIs...)
+		writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": server.newID("snapshot")})
+		return
+	}
+	start, before, length := *body.RangeStart, len(playlist.URIs), 1
+	if body.InsertBefore != nil {
+		before = *body.InsertBefore
+	}
+	if body.RangeLength != nil {
+		length = *body.RangeLength
+	}
+	if start < 0 || length < 1 || start+length > len(playlist.URIs) || before < 0 || before > len(playlist.URIs) {
+		writeError(w, http.StatusBadRequest, "Invalid range")
+		return
+	}
+	moved := append([]string{}, playlist.URIs[start:start+length]...)
+	rest := append(append([]string{}, playlist.URIs[:start]...), playlist.URIs[start+length:]...)
+	if before > start {
+		before -= length
+		if before < start {
+			before = start
+		}
+	}
+	playlist.URIs = append(append(append([]string{}, rest[:before]...), moved...), rest[before:]...)
+	writeJSON(w, http.StatusOK, map[string]string{"snapshot_id": server.newID("snapshot")})
+}
+
+// removeTracks removes the `tracks` of the body: every occurrence of the uri or only its `positions`
+func (server *Server) removeTracks(w http.ResponseWriter, req *http.Request, playlist *Playlist) {
+	var body struct {
+		Tracks []struct {
+			URI       string `json:"uri"`
+			Positions []int  `json:"positions"`
+		} `json:"tracks"`
+	}
+	if !decodeBody(w, req, &body) {
+		return
+	}
+	isRemoved := make(map[int]bool)
+	for _, removed := range body.Tracks {
+		if len(removed.Positions) == 0 {
+			for position, uri := range playlist.URIs {
+				if uri == removed.URI {
+					isRemoved[position] = true
+				}
+			}
+			continue
+		}
+		for _, position := range removed.Positions {
+			if position < 0 || position >= len(playlist.URIs) || playlist.URIs[position] != removed.URI {
+				writeError(w, http.StatusBadRequest, "Invalid track uri and position")
+				return
+			}
+			isRemoved[position] = true
+		}
+	}
+	uris := make([]string, 0, len(playlist.URIs))
+	for position, uri := range playlist.URIs {
+		if !isRemoved[position] {
+			uris = append(uris, uri)
+		}
+	}
+	playlist.URIs = uris
+	writeJSON(w, http.StatusOK, map[string]string{"snapshot_id": server.newID("snapshot")})
+}
+
+// servePage serves a page of items by the offset and limit query, next is the URL of the following page
+func (server *Server) servePage(w http.ResponseWriter, req *http.Request, items []interface{}) {
+	query := req.URL.Query()
+	offset, limit := queryInt(query, "offset", 0), queryInt(query, "limit", defaultLimit)
+	if server.PageSize > 0 && server.PageSize < limit {
+		limit = server.PageSize
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	var next interface{}
+	if end < len(items) {
+		query.Set("offset", strconv.Itoa(end))
+		query.Set("limit", strconv.Itoa(limit))
+		next = server.URL + req.URL.Path + "?" + query.Encode()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":  items[offset:end],
+		"offset": offset,
+		"limit":  limit,
+		"total":  len(items),
+		"next":   next,
+	})
+}
+
+func (server *Server) findPlaylist(id string) *Playlist {
+	for _, playlist := range server.playlists {
+		if playlist.ID == id {
+			return playlist
+		}
+	}
+	return nil
+}
+
+func (server *Server) catalogueByURI() map[string]Track {
+	byURI := make(map[string]Track, len(server.tracks))
+	for _, track := range server.tracks {
+		byURI[track.URI()] = track
+	}
+	return byURI
+}
+
+func (server *Server) newID(prefix string) string {
+	server.lastID++
+	return fmt.Sprintf("%s%d", prefix, server.lastID)
+}
+
+// trackItems returns the list items of uris, tracks which aren't in the catalogue only have
+// a uri and unavailable tracks (empty URIs) are null
+func trackItems(uris []string, byURI map[string]Track, market string) []interface{} {
+	items := make([]interface{}, len(uris))
+	for i, uri := range uris {
+		if uri == "" {
+			items[i] = map[string]interface{}{"track": nil}
+		} else if track, found := byURI[uri]; found {
+			items[i] = map[string]interface{}{"track": trackJSON(track, market)}
+		} else {
+			items[i] = map[string]interface{}{"track": map[string]interface{}{"uri": uri}}
+		}
+	}
+	return items
+}
+
+// trackJSON returns the track object of the Web API, is_playable is only set for requests with a market
+func trackJSON(track Track, market string) map[string]interface{} {
+	artists := make([]map[string]string, len(track.Artists))
+	for i, artist := range track.Artists {
+		artists[i] = map[string]string{"id": slug("artist", artist), "name": artist}
+	}
+	albumType := track.AlbumType
+	if albumType == "" {
+		albumType = "album"
+	}
+	trackObject := map[string]interface{}{
+		"id":      track.ID,
+		"uri":     track.URI(),
+		"name":    track.Name,
+		"artists": artists,
+		"album": map[string]interface{}{
+			"id":         slug("album", track.Album),
+			"name":       track.Album,
+			"album_type": albumType,
+			"images":     []interface{}{},
+		},
+		"external_ids": map[string]string{"isrc": track.ISRC},
+		"explicit":     track.Explicit,
+		"preview_url":  nil,
+	}
+	if market != "" {
+		isPlayable := len(track.Markets) == 0
+		for _, playableMarket := range track.Markets {
+			isPlayable = isPlayable || strings.EqualFold(playableMarket, market)
+		}
+		trackObject["is_playable"] = isPlayable
+	}
+	return trackObject
+}
+
+func playlistJSON(playlist *Playlist) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            playlist.ID,
+		"name":          playlist.Name,
+		"description":   playlist.Description,
+		"public":        playlist.Public,
+		"collaborative": playlist.Collaborative,
+		"owner":         map[string]string{"id": playlist.OwnerID},
+		"tracks":        map[string]int{"total": len(playlist.URIs)},
+	}
+}
+
+// slug returns the id of a named artist or album
+func slug(prefix string, name string) string {
+	return prefix + "-" + strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+func queryInt(query url.Values, key string, defaultValue int) int {
+	value, err := strconv.Atoi(query.Get(key))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func decodeBody(w http.ResponseWriter, req *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		writeError(w, http.StatusBadRequest, "Error parsing JSON.")
+		return false
+	}
+	return true
+}
+
+// writeError writes the error object of the Web API
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"status": status, "message": message},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,87 @@
+package client
+
+// duplicates modes, they decide whether repeated tracks are written more than once
+const (
+	// DuplicatesKeepFirst writes only the first of repeated rows and matches
+	DuplicatesKeepFirst = "keep_first"
+	// DuplicatesKeepAll writes every row
+	DuplicatesKeepAll = "keep_all"
+)
+
+// reasons tracks are skipped as duplicates, see SpotifyProvider.DuplicatesSkipped
+const (
+	// DuplicateRow - the CSV repeats the row
+	DuplicateRow = "same_row"
+	// DuplicateTrack - the CSV repeats the artist and track name in a different case or punctuation
+	DuplicateTrack = "same_track"
+	// DuplicateMatch - different rows matched the same track (or a release with the same ISRC)
+	DuplicateMatch = "same_match"
+	// DuplicateInDestination - the track is in the target playlist
+	DuplicateInDestination = "in_destination"
+	// DuplicateRelinked - a release of the track with the same ISRC is in the target playlist
+	DuplicateRelinked = "relinked"
+)
+
+// DuplicatesModes are the supported duplicates modes
+var DuplicatesModes = []string{DuplicatesKeepFirst, DuplicatesKeepAll}
+
+// IsDuplicatesMode reports whether mode is a supported duplicates mode
+func IsDuplicatesMode(mode string) bool {
+	for _, duplicatesMode := range DuplicatesModes {
+		if duplicatesMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// trackSet holds tracks by URI and ISRC (Spotify relinks a track to releases
+// with different URIs in different markets, their ISRC is the same)
+type trackSet struct {
+	// uris and isrcs map the tracks to the reason their repeats are skipped for
+	uris  map[string]string
+	isrcs map[string]string
+}
+
+func newTrackSet() *trackSet {
+	return &trackSet{
+		uris:  make(map[string]string),
+		isrcs: make(map[string]string),
+	}
+}
+
+// add adds the track, its repeats are skipped for reason
+func (set *trackSet) add(uri string, isrc string, reason string) {
+	if _, found := set.uris[uri]; !found {
+		set.uris[uri] = reason
+	}
+	if _, found := set.isrcs[isrc]; isrc != "" && !found {
+		set.isrcs[isrc] = reason
+	}
+}
+
+// find returns the reason the track is skipped for, found is false if it's not in the set
+func (set *trackSet) find(uri string, isrc string) (reason string, found bool) {
+	if reason, found = set.uris[uri]; found {
+		return
+	}
+	if isrc == "" {
+		return
+	}
+	if reason, found = set.isrcs[isrc]; found && reason == DuplicateInDestination {
+		reason = DuplicateRelinked
+	}
+	return
+}
+
+// KeepDuplicates makes AddItemsToPlaylist add tracks which were matched by several
+// rows as many times and, in ImportAppend mode, add the tracks which are in the target
+// playlist, the target playlist tracks are still skipped in ImportMerge mode
+func (provider *SpotifyProvider) KeepDuplicates() {
+	provider.keepDuplicates = true
+}
+
+// DuplicatesSkipped returns how many found tracks weren't added by Duplicate* reason
+func (provider *SpotifyProvider) DuplicatesSkipped() map[string]int {
+	return provider.duplicatesSkipped
+}
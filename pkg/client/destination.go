@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// destinations of the found tracks
+const (
+	// DestinationPlaylist adds the tracks to a playlist, see SetTargetPlaylist
+	DestinationPlaylist = "playlist"
+	// DestinationLikedSongs saves the tracks to the user's Liked Songs
+	DestinationLikedSongs = "liked_songs"
+	// DestinationAlbums saves the albums of the tracks to the user's library
+	DestinationAlbums = "albums"
+	// DestinationArtists follows the artists of the tracks
+	DestinationArtists = "artists"
+)
+
+// Destinations are the supported destinations
+var Destinations = []string{DestinationPlaylist, DestinationLikedSongs, DestinationAlbums, DestinationArtists}
+
+// IsDestination reports whether destination is a supported destination
+func IsDestination(destination string) bool {
+	for _, knownDestination := range Destinations {
+		if knownDestination == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// AddToLibrary saves the found tracks (or their albums) to the user's library or
+// follows their artists, destination is one of Destinations except DestinationPlaylist.
+// Liked Songs lists the most recently saved first so the tracks are saved from the last one.
+func (provider *SpotifyProvider) AddToLibrary(destination string) error {
+	const funcName = "AddToLibrary"
+	tracks := provider.LookedUpTracks
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Index < tracks[j].Index
+	})
+	if destination == DestinationLikedSongs {
+		uris, _ := urisToAdd(tracks, newTrackSet(), false)
+		for left, right := 0, len(uris)-1; left < right; left, right = left+1, right-1 {
+			uris[left], uris[right] = uris[right], uris[left]
+		}
+		return provider.SaveTracks(uris)
+	}
+
+	var ids []string
+	isAdded := make(map[string]bool)
+	err := provider.forEachTrackDetails(tracks, func(track trackMetaData) {
+		trackIDs := artistIDs(track)
+		if destination == DestinationAlbums {
+			trackIDs = []string{track.Album.ID}
+		}
+		for _, id := range trackIDs {
+			if id != "" && !isAdded[id] {
+				isAdded[id] = true
+				ids = append(ids, id)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	switch destination {
+	case DestinationAlbums:
+		err = provider.putIDs(provider.api.URL(savedAlbumsRoute), ids, savedAlbumsLimit)
+	case DestinationArtists:
+		err = provider.putIDs(fmt.Sprintf("%s?type=artist", provider.api.URL(followedArtistsRoute)), ids, followedArtistsLimit)
+	default:
+		err = fmt.Errorf("%s: unknown destination: %s", funcName, destination)
+	}
+	if err == nil {
+		logger("%s: added %d %s", funcName, len(ids), destination)
+	}
+	return err
+}
+
+// putIDs sends ids to route in chunks of size ids
+func (provider *SpotifyProvider) putIDs(route string, ids []string, size int) error {
+	for _, chunk := range chunkStrings(ids, size) {
+		body := map[string]interface{}{
+			"ids": chunk,
+		}
+		response, err := provider.sendJSONRequest(http.MethodPut, body, route)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+	}
+	return nil
+}
+
+// forEachTrackDetails gets the album and artists of the tracks in chunks and calls
+// apply for every track once in order, the found tracks keep only their URI
+func (provider *SpotifyProvider) forEachTrackDetails(tracks []FoundTrack, apply func(track trackMetaData)) error {
+	isListed := make(map[string]bool)
+	var ids []string
+	for _, track := range tracks {
+		id := strings.TrimPrefix(track.URI, trackURIPrefix)
+		if id == track.URI || isListed[id] {
+			continue
+		}
+		isListed[id] = true
+		ids = append(ids, id)
+	}
+	details, err := provider.getTracks(ids, "")
+	if err != nil {
+		return err
+	}
+	for _, track := range details {
+		// unknown ids are null
+		if track != nil {
+			apply(*track)
+		}
+	}
+	return nil
+}
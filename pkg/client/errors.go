@@ -0,0 +1,77 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+var (
+	// ErrTokenRevoked - the user revoked the access of the application to the account
+	ErrTokenRevoked = errors.New("refresh token revoked")
+	// ErrRateLimited - Spotify kept answering 429 after the retries
+	ErrRateLimited = errors.New("rate limited by Spotify")
+)
+
+const (
+	// OutcomeFound - the track was matched
+	OutcomeFound = "found"
+	// OutcomeNotFound - the search returned no good enough candidate
+	OutcomeNotFound = "not_found"
+	// OutcomeErrored - the search couldn't be made
+	OutcomeErrored = "errored"
+	// OutcomeReview - the user picks one of the candidates or skips the track, see EnableReview
+	OutcomeReview = "review"
+
+	reasonRequestFailed = "request_failed"
+	reasonInternalError = "internal_error"
+)
+
+// LookupError is a failure which stops the lookup of all tracks,
+// Cause is an apierror code
+type LookupError struct {
+	Cause string
+	Err   error
+}
+
+func (err *LookupError) Error() string {
+	return fmt.Sprintf("%s: %v", err.Cause, err.Err)
+}
+
+func (err *LookupError) Unwrap() error {
+	return err.Err
+}
+
+// Cause returns the apierror code of a failed request or lookup,
+// fallback if the failure has no code of its own
+func Cause(err error, fallback string) string {
+	var lookupErr *LookupError
+	switch {
+	case errors.Is(err, ErrTokenRevoked):
+		return apierror.TokenRevoked
+	case errors.Is(err, ErrRateLimited):
+		return apierror.RateLimited
+	case errors.As(err, &lookupErr):
+		return lookupErr.Cause
+	}
+	return fallback
+}
+
+// tokenRefreshError returns the LookupError of a failed access token refresh
+func tokenRefreshError(err error) *LookupError {
+	return &LookupError{Cause: Cause(err, apierror.TokenRefreshFailed), Err: err}
+}
+
+// newErroredResult returns the result of a track which couldn't be looked up,
+// queries are the search queries made before the error
+func newErroredResult(track csv.TrackInput, reason string, queries ...string) SearchResult {
+	return SearchResult{
+		Index:   track.Index,
+		Input:   track,
+		Outcome: OutcomeErrored,
+		Reason:  reason,
+		Queries: queries,
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// playlistTrackFields are the fields of playlist items needed for export
+const playlistTrackFields = "items(added_at,track(name,uri,duration_ms,external_ids(isrc),album(name),artists(name))),next"
+
+// PlaylistTrack is a track of an exported playlist
+type PlaylistTrack struct {
+	Name       string `json:"name"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album"`
+	ISRC       string `json:"isrc,omitempty"`
+	DurationMs int    `json:"durationMs"`
+	AddedAt    string `json:"addedAt"`
+	URI        string `json:"uri"`
+}
+
+// ExportedPlaylist is a playlist with all its tracks
+type ExportedPlaylist struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
+	Tracks []PlaylistTrack `json:"tracks"`
+}
+
+type playlistTrackItem struct {
+	AddedAt string `json:"added_at"`
+	// Track is null for tracks which are no longer available
+	Track *struct {
+		Name        string `json:"name"`
+		URI         string `json:"uri"`
+		DurationMs  int    `json:"duration_ms"`
+		ExternalIDs struct {
+			ISRC string `json:"isrc"`
+		} `json:"external_ids"`
+		Album struct {
+			Name string `json:"name"`
+		} `json:"album"`
+		Artists []artistData `json:"artists"`
+	} `json:"track"`
+}
+
+// ExportPlaylist returns the playlist with playlistID and all its tracks
+func (provider *SpotifyProvider) ExportPlaylist(playlistID string) (ExportedPlaylist, error) {
+	const funcName = "ExportPlaylist"
+	err := provider.Authorize()
+	if err != nil {
+		return ExportedPlaylist{}, err
+	}
+	playlist, err := provider.getPlaylist(playlistID)
+	if err != nil {
+		return ExportedPlaylist{}, err
+	}
+	exported := ExportedPlaylist{
+		ID:     playlist.ID,
+		Name:   playlist.Name,
+		Tracks: []PlaylistTrack{},
+	}
+	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", url.PathEscape(playlist.ID), 1)
+	route := fmt.Sprintf("%s?fields=%s&limit=%d", provider.api.URL(path), url.QueryEscape(playlistTrackFields), playlistItemsLimit)
+	items := provider.newPageIterator(route)
+	for items.Next() {
+		var item playlistTrackItem
+		if err := items.Decode(&item); err != nil {
+			logger("%s: Decode: %v", funcName, err)
+			return ExportedPlaylist{}, err
+		}
+		if item.Track == nil {
+			continue
+		}
+		exported.Tracks = append(exported.Tracks, PlaylistTrack{
+			Name:       item.Track.Name,
+			Artist:     artistNames(trackMetaData{Artists: item.Track.Artists}),
+			Album:      item.Track.Album.Name,
+			ISRC:       item.Track.ExternalIDs.ISRC,
+			DurationMs: item.Track.DurationMs,
+			AddedAt:    item.AddedAt,
+			URI:        item.Track.URI,
+		})
+	}
+	return exported, items.Err()
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// meRoute returns the profile of the user, country requires the user-read-private scope
+const meRoute = "/me"
+
+// ErrInvalidAccessToken - the access token expired or wasn't issued by Spotify
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// userProfile is the part of the user profile the lookups need
+type userProfile struct {
+	ID      string `json:"id"`
+	Country string `json:"country"`
+}
+
+// IsMarket reports whether market is an ISO 3166-1 alpha-2 country code
+func IsMarket(market string) bool {
+	if len(market) != 2 {
+		return false
+	}
+	for _, r := range market {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseMarkets returns the markets of a comma separated list in upper case,
+// invalid and repeated markets are dropped
+func ParseMarkets(markets string) []string {
+	var parsed []string
+	isParsed := make(map[string]bool)
+	for _, market := range strings.Split(markets, ",") {
+		market = strings.ToUpper(strings.TrimSpace(market))
+		if IsMarket(market) && !isParsed[market] {
+			isParsed[market] = true
+			parsed = append(parsed, market)
+		}
+	}
+	return parsed
+}
+
+// SetMarkets sets the markets tracks are searched in, the next one is tried when
+// a track isn't found (e.g. it's not playable) in the previous ones
+func (provider *SpotifyProvider) SetMarkets(markets []string) {
+	provider.markets = markets
+}
+
+// JobMarkets returns the search markets of a job: market (the MARKET env var
+// if it's empty) followed by the FALLBACK_MARKETS env var markets
+func JobMarkets(market string) []string {
+	if market == "" {
+		market = conf.Market
+	}
+	return ParseMarkets(market + "," + conf.FallbackMarkets)
+}
+
+// searchMarkets returns the markets of the provider or the MARKET env var if there're none
+func (provider *SpotifyProvider) searchMarkets() []string {
+	if len(provider.markets) == 0 {
+		return []string{conf.Market}
+	}
+	return provider.markets
+}
+
+// FetchCountry returns the country of the user's account
+func (provider *SpotifyProvider) FetchCountry() (string, error) {
+	const funcName = "FetchCountry"
+	req, err := http.NewRequest(http.MethodGet, provider.api.URL(meRoute), nil)
+	if err != nil {
+		logger("%s: NewRequest: %v", funcName, err)
+		return "", err
+	}
+	response, err := provider.request(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		logger("%v", err)
+		return "", err
+	}
+	var profile userProfile
+	err = json.NewDecoder(response.Body).Decode(&profile)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		return "", err
+	}
+	if !IsMarket(profile.Country) {
+		return "", fmt.Errorf("%s: unknown country: %q", funcName, profile.Country)
+	}
+	return profile.Country, nil
+}
+
+// TokenUserID returns the id of the Spotify user accessToken was issued to,
+// it's how requests prove that they're made by the user
+func TokenUserID(accessToken string) (string, error) {
+	const funcName = "TokenUserID"
+	req, err := http.NewRequest(http.MethodGet, spotifyAPI.URL(meRoute), nil)
+	if err != nil {
+		logger("%s: NewRequest: %v", funcName, err)
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	response, err := spotifyAPI.Do(req)
+	if err != nil {
+		logger("%s: Do: %v", funcName, err)
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return "", ErrInvalidAccessToken
+	}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		logger("%v", err)
+		return "", err
+	}
+	var profile userProfile
+	err = json.NewDecoder(response.Body).Decode(&profile)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		return "", err
+	}
+	if profile.ID == "" {
+		// tokens of the client credentials flow have no user
+		return "", ErrInvalidAccessToken
+	}
+	return profile.ID, nil
+}
+
+// playableTracks drops the tracks which can't be played in the search market
+func playableTracks(tracks []trackMetaData) []trackMetaData {
+	playable := tracks[:0]
+	for _, track := range tracks {
+		if track.IsPlayable == nil || *track.IsPlayable {
+			playable = append(playable, track)
+		}
+	}
+	return playable
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+const (
+	// strategyURI takes the Spotify URI of the input track once it was checked, no search is made
+	strategyURI = "uri"
+	// strategyISRC searches with `isrc:` field filter, the first result is the match
+	strategyISRC = "isrc"
+	// strategyArtistTrack searches with `artist:` and `track:` field filters
+	strategyArtistTrack = "artist_track"
+	// strategyFreeText searches for artist and track name without filters
+	strategyFreeText = "free_text"
+
+	reasonNoResults     = "no_results"
+	reasonLowConfidence = "low_confidence"
+
+	// minConfidence is the lowest candidate score accepted as a match
+	minConfidence = 0.5
+	// searchCandidatesLimit is how many search results are scored per query
+	searchCandidatesLimit = 5
+	titleWeight           = 0.6
+	artistWeight          = 0.4
+)
+
+var (
+	// matches "(Remastered 2009)", "[Live]" etc.
+	bracketsRegexp = regexp.MustCompile(`[(\[][^)\]]*[)\]]`)
+	// matches " - Remastered 2009", " - Live at Wembley" etc.
+	dashSuffixRegexp = regexp.MustCompile(`\s+-\s+.*$`)
+	// matches "feat. Someone", "ft. Someone"
+	featuringRegexp = regexp.MustCompile(`\b(feat|ft|featuring)\b\.?.*$`)
+)
+
+// searchStrategy builds a search query for an input track
+type searchStrategy struct {
+	name  string
+	query func(track csv.TrackInput) string
+}
+
+// trackURIPrefix is the prefix of Spotify track URIs
+const trackURIPrefix = "spotify:track:"
+
+// searchStrategies are tried in order until a confident match is found
+var searchStrategies = []searchStrategy{
+	{
+		name: strategyArtistTrack,
+		query: func(track csv.TrackInput) string {
+			return "artist:" + track.Artist + " track:" + track.Track
+		},
+	},
+	{
+		name: strategyFreeText,
+		query: func(track csv.TrackInput) string {
+			return Normalize(track.Artist, false) + " " + Normalize(track.Track, false)
+		},
+	},
+}
+
+// Normalize lowercases s and strips punctuation and decorations such as "(Remastered)"
+// or "feat. X" so that names can be compared. keepVersions keeps the decorations where
+// versions such as "(Live)" are different tracks, e.g. to find repeated CSV rows.
+func Normalize(s string, keepVersions bool) string {
+	lowered := strings.ToLower(s)
+	stripped := lowered
+	if !keepVersions {
+		stripped = bracketsRegexp.ReplaceAllString(stripped, " ")
+		stripped = dashSuffixRegexp.ReplaceAllString(stripped, "")
+		stripped = featuringRegexp.ReplaceAllString(stripped, "")
+		if strings.TrimSpace(stripped) == "" {
+			// the whole name was a decoration, keep it
+			stripped = lowered
+		}
+	}
+	mapped := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, stripped)
+	return strings.Join(strings.Fields(mapped), " ")
+}
+
+// similarity returns the Dice coefficient of the word sets of a and b
+func similarity(a, b string) float64 {
+	a, b = Normalize(a, false), Normalize(b, false)
+	if a == b {
+		return 1
+	}
+	aWords, bWords := strings.Fields(a), strings.Fields(b)
+	if len(aWords) == 0 || len(bWords) == 0 {
+		return 0
+	}
+	bSet := make(map[string]bool, len(bWords))
+	for _, word := range bWords {
+		bSet[word] = true
+	}
+	common := 0
+	for _, word := range aWords {
+		if bSet[word] {
+			common++
+			delete(bSet, word)
+		}
+	}
+	return 2 * float64(common) / float64(len(aWords)+len(bWords))
+}
+
+// scoreCandidate rates how well a search result matches the input track
+func scoreCandidate(input csv.TrackInput, candidate trackMetaData) float64 {
+	titleScore := similarity(input.Track, candidate.Name)
+	artistScore := 0.0
+	for _, artist := range candidate.Artists {
+		if score := similarity(input.Artist, artist.Name); score > artistScore {
+			artistScore = score
+		}
+	}
+	// the input may list several artists e.g. "Simon & Garfunkel"
+	if score := similarity(input.Artist, artistNames(candidate)); score > artistScore {
+		artistScore = score
+	}
+	return titleWeight*titleScore + artistWeight*artistScore
+}
+
+// bestCandidate returns the highest scoring candidate and its score
+func bestCandidate(input csv.TrackInput, candidates []trackMetaData) (best trackMetaData, bestScore float64) {
+	for _, candidate := range candidates {
+		if score := scoreCandidate(input, candidate); score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return
+}
+
+// artistIDs returns the ids of the track artists which have one
+func artistIDs(track trackMetaData) []string {
+	var ids []string
+	for _, artist := range track.Artists {
+		if artist.ID != "" {
+			ids = append(ids, artist.ID)
+		}
+	}
+	return ids
+}
+
+func artistNames(track trackMetaData) string {
+	names := make([]string, len(track.Artists))
+	for i, artist := range track.Artists {
+		names[i] = artist.Name
+	}
+	return strings.Join(names, ", ")
+}
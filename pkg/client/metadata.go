@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultPlaylistDescription is the description of created playlists if none was given
+	DefaultPlaylistDescription = createdPlaylistDescription
+	// maxCoverImageSize is the max size of base64 encoded cover images accepted by the API
+	maxCoverImageSize  = 256 * 1024
+	playlistImageRoute = "/playlists/{playlist_id}/images"
+)
+
+var (
+	// ErrCoverImageTooLarge - the cover image is larger than the API allows
+	ErrCoverImageTooLarge = errors.New("cover image is larger than 256KB")
+	// ErrCoverImageNotJPEG - the cover image isn't a base64 encoded JPEG image
+	ErrCoverImageNotJPEG = errors.New("cover image must be a base64 encoded JPEG image")
+	// jpegMagic are the first bytes of JPEG images
+	jpegMagic = []byte{0xFF, 0xD8, 0xFF}
+)
+
+// RenderTemplate replaces {name} placeholders of template with values,
+// unknown placeholders are kept as is
+func RenderTemplate(template string, values map[string]string) string {
+	oldNew := make([]string, 0, 2*len(values))
+	for name, value := range values {
+		oldNew = append(oldNew, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(oldNew...).Replace(template)
+}
+
+// ValidateCoverImage checks that coverImage is a base64 encoded JPEG
+// image which can be uploaded as a playlist cover
+func ValidateCoverImage(coverImage string) error {
+	if len(coverImage) > maxCoverImageSize {
+		return ErrCoverImageTooLarge
+	}
+	image, err := base64.StdEncoding.DecodeString(coverImage)
+	if err != nil || !bytes.HasPrefix(image, jpegMagic) {
+		return ErrCoverImageNotJPEG
+	}
+	return nil
+}
+
+// UpdatePlaylistDescription replaces the description of the playlist
+func (provider *SpotifyProvider) UpdatePlaylistDescription(playlistID string, description string) error {
+	path := strings.Replace(getPlaylistRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := provider.api.URL(path)
+	body := map[string]interface{}{
+		"description": description,
+	}
+	response, err := provider.sendJSONRequest(http.MethodPut, body, route)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// UploadCoverImage sets the cover of the playlist, coverImage is a base64 encoded JPEG image
+func (provider *SpotifyProvider) UploadCoverImage(playlistID string, coverImage string) error {
+	const funcName = "UploadCoverImage"
+	if err := ValidateCoverImage(coverImage); err != nil {
+		return err
+	}
+	path := strings.Replace(playlistImageRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := provider.api.URL(path)
+	req, err := http.NewRequest(http.MethodPut, route, strings.NewReader(coverImage))
+	if err != nil {
+		logger("%s: NewRequest: %v", funcName, err)
+		return err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	response, err := provider.request(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		logger("%v", err)
+		return err
+	}
+	return nil
+}
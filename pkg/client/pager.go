@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pageRequestInterval is the minimal delay between page requests of a list,
+// long lists would hit Spotify API rate limits otherwise
+const pageRequestInterval = 200 * time.Millisecond
+
+// page is the paging object returned by Spotify list endpoints
+type page struct {
+	Items []json.RawMessage `json:"items"`
+	Next  string            `json:"next"`
+}
+
+// pageIterator iterates over the items of a list endpoint following `next` links:
+//
+//	items := provider.newPageIterator(route)
+//	for items.Next() {
+//		err := items.Decode(&item)
+//	}
+//	err := items.Err()
+type pageIterator struct {
+	provider    *SpotifyProvider
+	nextURL     string
+	items       []json.RawMessage
+	item        json.RawMessage
+	err         error
+	lastRequest time.Time
+}
+
+// newPageIterator returns an iterator over the items of route and its following pages
+func (provider *SpotifyProvider) newPageIterator(route string) *pageIterator {
+	return &pageIterator{
+		provider: provider,
+		nextURL:  route,
+	}
+}
+
+// Next advances to the next item, it returns false when there are no
+// more items or a page request failed, see Err
+func (iterator *pageIterator) Next() bool {
+	for len(iterator.items) == 0 {
+		if iterator.err != nil || iterator.nextURL == "" {
+			return false
+		}
+		iterator.err = iterator.fetch()
+	}
+	iterator.item, iterator.items = iterator.items[0], iterator.items[1:]
+	return true
+}
+
+// Decode unmarshals the current item into v
+func (iterator *pageIterator) Decode(v interface{}) error {
+	return json.Unmarshal(iterator.item, v)
+}
+
+// Err returns the error which stopped the iteration
+func (iterator *pageIterator) Err() error {
+	return iterator.err
+}
+
+// fetch requests the next page, it waits for pageRequestInterval since the last request
+func (iterator *pageIterator) fetch() error {
+	const funcName = "pageIterator.fetch"
+	if wait := time.Until(iterator.lastRequest.Add(pageRequestInterval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	iterator.lastRequest = time.Now()
+	req, err := http.NewRequest(http.MethodGet, iterator.nextURL, nil)
+	if err != nil {
+		logger("%s: NewRequest: %v", funcName, err)
+		return err
+	}
+	response, err := iterator.provider.request(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: url: %s statusCode: %d", funcName, iterator.nextURL, response.StatusCode)
+		logger("%v", err)
+		return err
+	}
+	var payload page
+	err = json.NewDecoder(response.Body).Decode(&payload)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		return err
+	}
+	iterator.items = payload.Items
+	iterator.nextURL = payload.Next
+	return nil
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// import modes, they decide which playlist the found tracks are added to
+const (
+	// ImportCreate always creates a new playlist
+	ImportCreate = "create"
+	// ImportAppend adds the tracks to an existing playlist, tracks which are in it are
+	// skipped unless duplicates are kept, see KeepDuplicates
+	ImportAppend = "append"
+	// ImportReplace replaces the tracks of an existing playlist
+	ImportReplace = "replace"
+	// ImportMerge adds only the tracks which aren't in an existing playlist yet, even if
+	// duplicates are kept
+	ImportMerge = "merge"
+	// ImportSync makes an existing playlist mirror the found tracks, see SyncPlaylist
+	ImportSync = "sync"
+
+	// playlistItemsLimit is the max number of tracks per add/replace request
+	playlistItemsLimit = 100
+)
+
+var (
+	// ImportModes are the supported import modes
+	ImportModes = []string{ImportCreate, ImportAppend, ImportReplace, ImportMerge, ImportSync}
+	// ErrPlaylistNotFound - the target playlist doesn't exist
+	ErrPlaylistNotFound = errors.New("playlist not found")
+	// ErrPlaylistNotOwned - the target playlist belongs to another user
+	ErrPlaylistNotOwned = errors.New("playlist is not owned by the user")
+)
+
+// IsImportMode reports whether mode is a supported import mode
+func IsImportMode(mode string) bool {
+	for _, importMode := range ImportModes {
+		if importMode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTargetPlaylist sets the playlist AddItemsToPlaylist/SyncPlaylist modify.
+// ImportCreate creates a playlist with details. Other modes target
+// an existing playlist: by playlistID if it's set, by details.Name otherwise,
+// the playlist must be owned by the user.
+func (provider *SpotifyProvider) SetTargetPlaylist(mode string, playlistID string, details PlaylistDetails) error {
+	const funcName = "SetTargetPlaylist"
+	provider.importMode = mode
+	if mode == ImportCreate {
+		createdID, err := provider.CreatePlaylistWithDetails(details)
+		if err != nil {
+			return err
+		}
+		provider.playlistID = createdID
+		return nil
+	}
+	playlist, err := provider.findPlaylist(playlistID, details.Name)
+	if err != nil {
+		return err
+	}
+	if playlist.Owner.ID != provider.userID {
+		logger("%s: playlist id %s is owned by %s", funcName, playlist.ID, playlist.Owner.ID)
+		return ErrPlaylistNotOwned
+	}
+	provider.playlistID = playlist.ID
+	if mode == ImportMerge || mode == ImportAppend {
+		route := fmt.Sprintf("%s?limit=%d", provider.api.URL(strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", provider.playlistID, 1)), playlistItemsLimit)
+		items, err := provider.getTrackItems(route)
+		if err != nil {
+			return err
+		}
+		provider.existing = newTrackSet()
+		for _, item := range items {
+			provider.existing.add(item.Track.URI, item.Track.ExternalIDs.ISRC, DuplicateInDestination)
+		}
+	}
+	return nil
+}
+
+// PlaylistID returns the id of the target playlist
+func (provider *SpotifyProvider) PlaylistID() string {
+	return provider.playlistID
+}
+
+// GetOwnedPlaylists returns the details of all the playlists the user owns
+func (provider *SpotifyProvider) GetOwnedPlaylists() ([]PlaylistDetails, error) {
+	userPlaylists, err := provider.getUserPlaylists()
+	if err != nil {
+		return nil, err
+	}
+	var owned []PlaylistDetails
+	for _, playlist := range userPlaylists {
+		if playlist.Owner.ID != provider.userID {
+			continue
+		}
+		// descriptions are returned HTML escaped
+		owned = append(owned, PlaylistDetails{
+			ID:          playlist.ID,
+			Name:        playlist.Name,
+			Description: html.UnescapeString(playlist.Description),
+			Public:      playlist.Public,
+		})
+	}
+	return owned, nil
+}
+
+// findPlaylist returns the playlist with playlistID or the user playlist named playlistName,
+// a playlist owned by the user is preferred when several playlists have the same name
+func (provider *SpotifyProvider) findPlaylist(playlistID string, playlistName string) (*playlistData, error) {
+	if playlistID != "" {
+		return provider.getPlaylist(playlistID)
+	}
+	userPlaylists, err := provider.getUserPlaylists()
+	if err != nil {
+		return nil, err
+	}
+	var found *playlistData
+	for i, playlist := range userPlaylists {
+		if playlist.Name != playlistName {
+			continue
+		}
+		if playlist.Owner.ID == provider.userID {
+			return &userPlaylists[i], nil
+		}
+		if found == nil {
+			found = &userPlaylists[i]
+		}
+	}
+	if found == nil {
+		return nil, ErrPlaylistNotFound
+	}
+	return found, nil
+}
+
+// urisToAdd returns the URIs of the found tracks in input order, tracks of existing
+// and, unless keepRepeats, repeated tracks (by URI or ISRC) are skipped if existing isn't nil.
+// skipped counts the skipped tracks by Duplicate* reason.
+func urisToAdd(tracks []FoundTrack, existing *trackSet, keepRepeats bool) (uris []string, skipped map[string]int) {
+	uris = make([]string, 0, len(tracks))
+	skipped = make(map[string]int)
+	for _, track := range tracks {
+		if existing != nil {
+			if reason, found := existing.find(track.URI, track.ISRC); found {
+				skipped[reason]++
+				continue
+			}
+			if !keepRepeats {
+				existing.add(track.URI, track.ISRC, DuplicateMatch)
+			}
+		}
+		uris = append(uris, track.URI)
+	}
+	return uris, skipped
+}
+
+// chunkStrings splits values (URIs or ids) into chunks of at most size values
+func chunkStrings(values []string, size int) (chunks [][]string) {
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		chunks = append(chunks, values)
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+const (
+	// PreferExplicit and PreferClean are the Explicit preferences, any version is fine if it's empty
+	PreferExplicit = "explicit"
+	PreferClean    = "clean"
+
+	// Version* are the kinds of track versions the preferences exclude or prefer
+	VersionLive         = "live"
+	VersionRemix        = "remix"
+	VersionExtended     = "extended"
+	VersionKaraoke      = "karaoke"
+	VersionTribute      = "tribute"
+	VersionInstrumental = "instrumental"
+	VersionAcoustic     = "acoustic"
+
+	// reasonExcluded - every candidate was a version the preferences exclude
+	reasonExcluded = "excluded_version"
+
+	// preferenceMargin - candidates which score closer than this to the
+	// best one are picked by the preferences instead of by the score
+	preferenceMargin = 0.1
+	// compilationAlbumType is the album_type of "Greatest Hits" like albums
+	compilationAlbumType = "compilation"
+)
+
+// Versions are the supported version kinds
+var Versions = []string{
+	VersionLive,
+	VersionRemix,
+	VersionExtended,
+	VersionKaraoke,
+	VersionTribute,
+	VersionInstrumental,
+	VersionAcoustic,
+}
+
+// versionRegexps match the version kinds in lower case track, album and artist names
+var versionRegexps = map[string]*regexp.Regexp{
+	VersionLive:         regexp.MustCompile(`\blive\b`),
+	VersionRemix:        regexp.MustCompile(`\b(remix|rmx)\b`),
+	VersionExtended:     regexp.MustCompile(`\bextended\b`),
+	VersionKaraoke:      regexp.MustCompile(`\bkaraoke\b`),
+	VersionTribute:      regexp.MustCompile(`\b(tribute to|in the style of|originally performed by|made famous by)\b`),
+	VersionInstrumental: regexp.MustCompile(`\binstrumental\b`),
+	VersionAcoustic:     regexp.MustCompile(`\b(acoustic|unplugged)\b`),
+}
+
+// Preferences are the rules a match is picked by among the search candidates of a track.
+// Candidates of Exclude versions are dropped unless the input title asks for the
+// version (e.g. "Layla (Live)"), Prefer versions, the Explicit preference and
+// OriginalAlbum (albums and singles over compilations) pick among the candidates
+// which score about as well as the best one. Matches by ISRC or URI are exact so
+// the preferences don't apply to them.
+type Preferences struct {
+	Explicit      string
+	Exclude       []string
+	Prefer        []string
+	OriginalAlbum bool
+}
+
+// NewPreferences returns the preferences or an error if a rule is unknown
+func NewPreferences(explicit string, exclude []string, prefer []string, originalAlbum bool) (Preferences, error) {
+	if explicit != "" && explicit != PreferExplicit && explicit != PreferClean {
+		return Preferences{}, fmt.Errorf("unknown explicit preference: %s", explicit)
+	}
+	for _, version := range append(append([]string{}, exclude...), prefer...) {
+		if !IsVersion(version) {
+			return Preferences{}, fmt.Errorf("unknown version: %s", version)
+		}
+	}
+	return Preferences{
+		Explicit:      explicit,
+		Exclude:       exclude,
+		Prefer:        prefer,
+		OriginalAlbum: originalAlbum,
+	}, nil
+}
+
+// IsVersion reports whether version is one of Versions
+func IsVersion(version string) bool {
+	for _, supported := range Versions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPreferences sets the rules matches are picked by
+func (provider *SpotifyProvider) SetPreferences(preferences Preferences) {
+	provider.preferences = preferences
+}
+
+// key identifies the preferences in match cache keys of the input, it's empty if there're none.
+// Excluded versions which the input title asks for are marked since they're allowed for the
+// input: "Layla (Live)" and "Layla" share the normalized title but not the match.
+func (preferences Preferences) key(input csv.TrackInput) string {
+	exclude := make([]string, 0, len(preferences.Exclude))
+	for _, kind := range preferences.Exclude {
+		if asksFor(input, kind) {
+			kind += "=asked"
+		}
+		exclude = append(exclude, kind)
+	}
+	prefer := append([]string{}, preferences.Prefer...)
+	sort.Strings(exclude)
+	sort.Strings(prefer)
+	key := preferences.Explicit + "|" + strings.Join(exclude, ",") + "|" + strings.Join(prefer, ",")
+	if preferences.OriginalAlbum {
+		key += "|original"
+	}
+	if key == "||" {
+		return ""
+	}
+	return key
+}
+
+// isVersion reports whether the track is a version of kind
+func isVersion(track trackMetaData, kind string) bool {
+	versionRegexp := versionRegexps[kind]
+	return versionRegexp.MatchString(strings.ToLower(track.Name)) ||
+		versionRegexp.MatchString(strings.ToLower(track.Album.Name)) ||
+		versionRegexp.MatchString(strings.ToLower(artistNames(track)))
+}
+
+// asksFor reports whether the input title asks for a version of kind
+func asksFor(input csv.TrackInput, kind string) bool {
+	return versionRegexps[kind].MatchString(strings.ToLower(input.Track))
+}
+
+// filter drops the candidates of excluded versions
+func (preferences Preferences) filter(input csv.TrackInput, candidates []trackMetaData) []trackMetaData {
+	if len(preferences.Exclude) == 0 {
+		return candidates
+	}
+	var allowed []trackMetaData
+	for _, candidate := range candidates {
+		isExcluded := false
+		for _, kind := range preferences.Exclude {
+			if isVersion(candidate, kind) && !asksFor(input, kind) {
+				isExcluded = true
+				break
+			}
+		}
+		if !isExcluded {
+			allowed = append(allowed, candidate)
+		}
+	}
+	return allowed
+}
+
+// points rates how many of the preferences the candidate meets
+func (preferences Preferences) points(candidate trackMetaData) int {
+	points := 0
+	if (preferences.Explicit == PreferExplicit && candidate.Explicit) ||
+		(preferences.Explicit == PreferClean && !candidate.Explicit) {
+		points++
+	}
+	for _, kind := range preferences.Prefer {
+		if isVersion(candidate, kind) {
+			points++
+		}
+	}
+	if preferences.OriginalAlbum && candidate.Album.AlbumType != compilationAlbumType {
+		points++
+	}
+	return points
+}
+
+// pick returns the match of the input and its score: the candidate which meets the
+// most preferences among the confident ones which score about as well as the best
+func (preferences Preferences) pick(input csv.TrackInput, candidates []trackMetaData) (best trackMetaData, bestScore float64) {
+	ranked := rankCandidates(input, candidates)
+	if len(ranked) == 0 {
+		return
+	}
+	picked, pickedPoints := ranked[0], preferences.points(ranked[0].track)
+	for _, candidate := range ranked[1:] {
+		if candidate.score < minConfidence || ranked[0].score-candidate.score >= preferenceMargin {
+			break
+		}
+		if points := preferences.points(candidate.track); points > pickedPoints {
+			picked, pickedPoints = candidate, points
+		}
+	}
+	return picked.track, picked.score
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+const (
+	// strategyReview - the user picked the match from the review candidates
+	strategyReview = "review"
+
+	reasonAmbiguous = "ambiguous"
+
+	// reviewMinConfidence is the lowest score of a candidate which is worth a review
+	reviewMinConfidence = 0.3
+	// ambiguityMargin - candidates of different tracks which score closer than
+	// this to the best one make the match ambiguous
+	ambiguityMargin = 0.05
+	// reviewCandidatesLimit is how many candidates the user picks from
+	reviewCandidatesLimit = 3
+)
+
+// Candidate is a possible match of a track which needs review
+type Candidate struct {
+	TrackID    string
+	URI        string
+	ISRC       string
+	Name       string
+	Artist     string
+	Album      string
+	AlbumID    string
+	ArtistIDs  []string
+	ImageURL   string
+	PreviewURL string
+	Confidence float64
+}
+
+// scoredCandidate is a search result and its scoreCandidate score
+type scoredCandidate struct {
+	track trackMetaData
+	score float64
+}
+
+// EnableReview makes ambiguous matches and the best low confidence candidates
+// results with OutcomeReview instead of found/not found, they aren't added to
+// LookedUpTracks until AddReviewedTrack is called
+func (provider *SpotifyProvider) EnableReview() {
+	provider.reviewMatches = true
+}
+
+// AddReviewedTrack adds the candidate the user picked for a track which
+// needed review to the looked up tracks and returns the found result
+func (provider *SpotifyProvider) AddReviewedTrack(result SearchResult, candidate Candidate) SearchResult {
+	found := SearchResult{
+		Index:       result.Index,
+		Input:       result.Input,
+		IsFound:     true,
+		Outcome:     OutcomeFound,
+		TrackID:     candidate.TrackID,
+		TrackName:   candidate.Name,
+		TrackArtist: candidate.Artist,
+		URI:         candidate.URI,
+		ISRC:        candidate.ISRC,
+		AlbumID:     candidate.AlbumID,
+		ArtistIDs:   candidate.ArtistIDs,
+		Confidence:  candidate.Confidence,
+		Strategy:    strategyReview,
+		Queries:     result.Queries,
+	}
+	provider.mutex.Lock()
+	provider.LookedUpTracks = append(provider.LookedUpTracks, found.foundTrack())
+	provider.mutex.Unlock()
+	return found
+}
+
+// rankCandidates scores the candidates, the best one first
+func rankCandidates(input csv.TrackInput, candidates []trackMetaData) []scoredCandidate {
+	ranked := make([]scoredCandidate, len(candidates))
+	for i, candidate := range candidates {
+		ranked[i] = scoredCandidate{track: candidate, score: scoreCandidate(input, candidate)}
+	}
+	// ties keep the search order like bestCandidate
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].score > ranked[j].score
+	})
+	return ranked
+}
+
+// mergeCandidates ranks the candidates of several searches, repeated tracks are dropped
+func mergeCandidates(candidates []scoredCandidate) []scoredCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	merged := make([]scoredCandidate, 0, len(candidates))
+	isAdded := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		if !isAdded[candidate.track.ID] {
+			isAdded[candidate.track.ID] = true
+			merged = append(merged, candidate)
+		}
+	}
+	return merged
+}
+
+// isAmbiguous reports whether a candidate of a different track scores about
+// as well as the best one. Releases of the same track (e.g. remasters) aren't
+// ambiguous since their names are the same once normalized.
+func isAmbiguous(ranked []scoredCandidate) bool {
+	best := ranked[0]
+	for _, candidate := range ranked[1:] {
+		if best.score-candidate.score >= ambiguityMargin {
+			return false
+		}
+		if Normalize(candidate.track.Name, false) != Normalize(best.track.Name, false) ||
+			Normalize(artistNames(candidate.track), false) != Normalize(artistNames(best.track), false) {
+			return true
+		}
+	}
+	return false
+}
+
+// newReviewResult returns the result of a track the user picks the match of
+func newReviewResult(track csv.TrackInput, ranked []scoredCandidate, reason string, queries []string) SearchResult {
+	if len(ranked) > reviewCandidatesLimit {
+		ranked = ranked[:reviewCandidatesLimit]
+	}
+	candidates := make([]Candidate, len(ranked))
+	for i, scored := range ranked {
+		candidates[i] = Candidate{
+			TrackID:    scored.track.ID,
+			URI:        scored.track.URI,
+			ISRC:       scored.track.ExternalIDs.ISRC,
+			Name:       scored.track.Name,
+			Artist:     artistNames(scored.track),
+			Album:      scored.track.Album.Name,
+			AlbumID:    scored.track.Album.ID,
+			ArtistIDs:  artistIDs(scored.track),
+			PreviewURL: scored.track.PreviewURL,
+			Confidence: scored.score,
+		}
+		if len(scored.track.Album.Images) > 0 {
+			candidates[i].ImageURL = scored.track.Album.Images[0].URL
+		}
+	}
+	return SearchResult{
+		Index:      track.Index,
+		Input:      track,
+		Outcome:    OutcomeReview,
+		Reason:     reason,
+		Queries:    queries,
+		Candidates: candidates,
+	}
+}
@@ -7,59 +7,277 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/yossisp/csv-to-spotify/pkg/csv"
 )
 
 const (
-	spotifyAccessTokenRoute    = "https://accounts.spotify.com/api/token"
-	apiBaseURL                 = "https://api.spotify.com/v1"
 	lookupTrackRoute           = "/search"
 	playlistRoute              = "/users/{user_id}/playlists"
 	createdPlaylistDescription = "Created by csv-to-spotify"
 	addItemsToPlaylistRoute    = "/playlists/{playlist_id}/tracks"
+	getPlaylistRoute           = "/playlists/{playlist_id}"
+	savedTracksRoute           = "/me/tracks"
+	savedAlbumsRoute           = "/me/albums"
+	followedArtistsRoute       = "/me/following"
+	tracksRoute                = "/tracks"
+	// page sizes of list endpoints, the max values allowed by the API
+	userPlaylistsLimit = 50
+	savedTracksLimit   = 50
+	// max ids per save albums, follow artists and get tracks requests
+	savedAlbumsLimit     = 20
+	followedArtistsLimit = 50
+	tracksLimit          = 50
 )
 
+// lookupTrack returns the cached outcome of the track or searches for it
+// and caches the outcome, see resolveTrackURIs for tracks with a Spotify URI.
+// Markets are tried in order until the track is found in one of them.
+func (provider *SpotifyProvider) lookupTrack(track csv.TrackInput) SearchResult {
+	var result SearchResult
+	for _, market := range provider.searchMarkets() {
+		var found bool
+		result, found = provider.cachedResult(track, market)
+		if !found {
+			result = provider.searchTrack(track, market)
+			provider.cacheResult(result, market)
+		}
+		result.Market = market
+		// errored and review results aren't retried in other markets
+		if result.Outcome != OutcomeNotFound {
+			return result
+		}
+	}
+	return result
+}
+
+// resolveTrackURIs returns by index the results of the tracks of batch which have a Spotify URI,
+// the URIs are checked by the several tracks endpoint in the search markets in order.
+// Tracks whose URI is unknown, malformed or not playable in any market are left out
+// so they're searched by ISRC and name like the other tracks.
+func (provider *SpotifyProvider) resolveTrackURIs(batch []csv.TrackInput) map[int]SearchResult {
+	const funcName = "resolveTrackURIs"
+	tracksByID := make(map[string][]csv.TrackInput)
+	var ids []string
+	for _, track := range batch {
+		if !strings.HasPrefix(track.URI, trackURIPrefix) {
+			continue
+		}
+		id := strings.TrimPrefix(track.URI, trackURIPrefix)
+		if _, found := tracksByID[id]; !found {
+			ids = append(ids, id)
+		}
+		tracksByID[id] = append(tracksByID[id], track)
+	}
+	resolved := make(map[int]SearchResult)
+	for _, market := range provider.searchMarkets() {
+		if len(ids) == 0 {
+			break
+		}
+		matches, err := provider.getTracks(ids, market)
+		if err != nil {
+			// e.g. a malformed id fails the whole request
+			logger("%s: getTracks: %v", funcName, err)
+			return resolved
+		}
+		var unresolved []string
+		for i, match := range matches {
+			if match == nil || (match.IsPlayable != nil && !*match.IsPlayable) {
+				unresolved = append(unresolved, ids[i])
+				continue
+			}
+			for _, track := range tracksByID[ids[i]] {
+				result := newExactResult(track, *match, strategyURI)
+				result.Market = market
+				resolved[track.Index] = result
+			}
+		}
+		ids = unresolved
+	}
+	return resolved
+}
+
+// getTracks returns the tracks of ids in the order of ids, unknown ids are nil.
+// They're requested in chunks the several tracks endpoint accepts, with is_playable
+// set for market unless it's empty.
+func (provider *SpotifyProvider) getTracks(ids []string, market string) ([]*trackMetaData, error) {
+	const funcName = "getTracks"
+	tracks := make([]*trackMetaData, 0, len(ids))
+	for _, chunk := range chunkStrings(ids, tracksLimit) {
+		route := fmt.Sprintf("%s?ids=%s", provider.api.URL(tracksRoute), url.QueryEscape(strings.Join(chunk, ",")))
+		if market != "" {
+			route += "&market=" + url.QueryEscape(market)
+		}
+		req, err := http.NewRequest(http.MethodGet, route, nil)
+		if err != nil {
+			logger("%s: NewRequest: %v", funcName, err)
+			return nil, err
+		}
+		response, err := provider.request(req)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+			logger("%v", err)
+			return nil, err
+		}
+		var payload tracksResponse
+		err = json.NewDecoder(response.Body).Decode(&payload)
+		response.Body.Close()
+		if err != nil {
+			logger("%s: json.NewDecoder: %v", funcName, err)
+			return nil, err
+		}
+		if len(payload.Tracks) != len(chunk) {
+			err = fmt.Errorf("%s: expected %d tracks, got %d", funcName, len(chunk), len(payload.Tracks))
+			logger("%v", err)
+			return nil, err
+		}
+		tracks = append(tracks, payload.Tracks...)
+	}
+	return tracks, nil
+}
+
 /*
 https://developer.spotify.com/documentation/web-api/reference/search/search/
-TODO: set user country via `market` param dynamically
+only tracks playable in market are matched
 */
-func (provider *SpotifyProvider) lookupTrack(track csv.TrackInput) *SearchResult {
-	const funcName = "lookupTrack"
-	market := conf.Market
-	lookupURL := fmt.Sprintf("%s%s", apiBaseURL, lookupTrackRoute)
+func (provider *SpotifyProvider) searchTrack(track csv.TrackInput, market string) SearchResult {
+	result := SearchResult{
+		Index:   track.Index,
+		Input:   track,
+		Outcome: OutcomeNotFound,
+		Reason:  reasonNoResults,
+	}
+	if track.ISRC != "" {
+		searchQuery := "isrc:" + track.ISRC
+		result.Queries = append(result.Queries, searchQuery)
+		candidates, err := provider.searchTracks(searchQuery, market)
+		if err != nil {
+			return newErroredResult(track, reasonRequestFailed, result.Queries...)
+		}
+		if len(candidates) > 0 {
+			exact := newExactResult(track, candidates[0], strategyISRC)
+			exact.Queries = result.Queries
+			return exact
+		}
+	}
+	var lowConfidenceCandidates []scoredCandidate
+	for _, strategy := range searchStrategies {
+		searchQuery := strategy.query(track)
+		result.Queries = append(result.Queries, searchQuery)
+		candidates, err := provider.searchTracks(searchQuery, market)
+		if err != nil {
+			return newErroredResult(track, reasonRequestFailed, result.Queries...)
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		candidates = provider.preferences.filter(track, candidates)
+		if len(candidates) == 0 {
+			result.Reason = reasonExcluded
+			continue
+		}
+		best, confidence := provider.preferences.pick(track, candidates)
+		if confidence >= minConfidence {
+			// the ambiguity is cached for jobs in review mode
+			ranked := rankCandidates(track, candidates)
+			ambiguous := isAmbiguous(ranked)
+			if provider.reviewMatches && ambiguous {
+				return newReviewResult(track, ranked, reasonAmbiguous, result.Queries)
+			}
+			result.IsFound = true
+			result.Outcome = OutcomeFound
+			result.TrackID = best.ID
+			result.TrackName = best.Name
+			result.TrackArtist = artistNames(best)
+			result.URI = best.URI
+			result.ISRC = best.ExternalIDs.ISRC
+			result.AlbumID = best.Album.ID
+			result.ArtistIDs = artistIDs(best)
+			result.Confidence = confidence
+			result.Ambiguous = ambiguous
+			result.Strategy = strategy.name
+			result.Reason = ""
+			return result
+		}
+		result.Reason = reasonLowConfidence
+		if provider.reviewMatches {
+			lowConfidenceCandidates = append(lowConfidenceCandidates, rankCandidates(track, candidates)...)
+		}
+	}
+	if provider.reviewMatches {
+		ranked := mergeCandidates(lowConfidenceCandidates)
+		if len(ranked) > 0 && ranked[0].score >= reviewMinConfidence {
+			return newReviewResult(track, ranked, reasonLowConfidence, result.Queries)
+		}
+	}
+	return result
+}
+
+// newExactResult returns a found result of a match by track identifier
+func newExactResult(track csv.TrackInput, match trackMetaData, strategy string) SearchResult {
+	return SearchResult{
+		Index:       track.Index,
+		Input:       track,
+		IsFound:     true,
+		Outcome:     OutcomeFound,
+		TrackID:     match.ID,
+		TrackName:   match.Name,
+		TrackArtist: artistNames(match),
+		URI:         match.URI,
+		ISRC:        match.ExternalIDs.ISRC,
+		AlbumID:     match.Album.ID,
+		ArtistIDs:   artistIDs(match),
+		Confidence:  1,
+		Strategy:    strategy,
+	}
+}
+
+// searchTracks returns the track candidates of a search query which are playable in market
+func (provider *SpotifyProvider) searchTracks(searchQuery string, market string) ([]trackMetaData, error) {
+	const funcName = "searchTracks"
+	lookupURL := provider.api.URL(lookupTrackRoute)
 	parsedURL, err := url.Parse(lookupURL)
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
-		return nil
+		return nil, err
 	}
 	query, _ := url.ParseQuery(parsedURL.RawQuery)
-	query.Add("q", fmt.Sprintf("artist:%s track:%s", track.Artist, track.Track))
+	query.Add("q", searchQuery)
 	query.Add("type", "track")
-	query.Add("limit", "1")
+	query.Add("limit", strconv.Itoa(searchCandidatesLimit))
 	query.Add("market", market)
 	parsedURL.RawQuery = query.Encode()
 	log.Println("making request to: ", parsedURL)
 	req, err := http.NewRequest(http.MethodGet, parsedURL.String(), nil)
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
-		return nil
+		return nil, err
 	}
 
 	response, err := provider.request(req)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer response.Body.Close()
-	payload := SearchResult{}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		logger("%v", err)
+		return nil, err
+	}
+	payload := searchResponse{}
 	err = json.NewDecoder(response.Body).Decode(&payload)
 	if err != nil {
 		logger("%s: json.NewDecoder: %v", funcName, err)
-		return nil
+		return nil, err
 	}
-	payload.IsFound = payload.Tracks.Total > 0
-	return &payload
+	return playableTracks(payload.Tracks.Items), nil
 }
 
 /*
@@ -70,14 +288,14 @@ func (provider *SpotifyProvider) setAccessTokenClientFlow() {
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
 
-	req, err := http.NewRequest(http.MethodPost, spotifyAccessTokenRoute, strings.NewReader(data.Encode()))
+	req, err := http.NewRequest(http.MethodPost, provider.api.TokenURL(), strings.NewReader(data.Encode()))
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
 		return
 	}
 	req.Header.Set("Authorization", "Basic "+conf.SpotifySecret)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	response, err := provider.client.Do(req)
+	response, err := provider.api.Do(req)
 	if err != nil {
 		logger("%s: response: %v", funcName, err)
 		return
@@ -101,124 +319,288 @@ func (provider *SpotifyProvider) setAccessToken() error {
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", provider.refreshToken)
 
-	req, err := http.NewRequest(http.MethodPost, spotifyAccessTokenRoute, strings.NewReader(data.Encode()))
+	req, err := http.NewRequest(http.MethodPost, provider.api.TokenURL(), strings.NewReader(data.Encode()))
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
 		return err
 	}
 	req.Header.Set("Authorization", "Basic "+conf.SpotifySecret)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	response, err := provider.client.Do(req)
+	response, err := provider.api.Do(req)
 	if err != nil {
 		logger("%s: response: %v", funcName, err)
 		return err
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		// e.g. the user revoked the application access
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		failure := tokenError{}
+		if json.NewDecoder(response.Body).Decode(&failure) == nil && failure.Error == "invalid_grant" {
+			err = fmt.Errorf("%s: %s: %w", funcName, failure.Description, ErrTokenRevoked)
+		}
+		logger("%v", err)
+		return err
+	}
 	result := accessToken{}
-	json.NewDecoder(response.Body).Decode(&result)
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		return err
+	}
 	provider.accessToken = result.Token
 	// log.Println("setAccessToken: ", provider.accessToken)
 	return nil
 }
 
 func (provider *SpotifyProvider) sendJSONPayload(payload map[string]interface{}, apiRoute string) (response *http.Response, err error) {
-	const funcName = "sendJSONPayload"
+	return provider.sendJSONRequest(http.MethodPost, payload, apiRoute)
+}
+
+func (provider *SpotifyProvider) sendJSONRequest(method string, payload map[string]interface{}, apiRoute string) (response *http.Response, err error) {
+	const funcName = "sendJSONRequest"
 	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
 		logger("%s: json.Marshal: %v", funcName, err)
 		return
 	}
-	req, err := http.NewRequest(http.MethodPost, apiRoute, bytes.NewBuffer(payloadJSON))
+	req, err := http.NewRequest(method, apiRoute, bytes.NewBuffer(payloadJSON))
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
 		return
 	}
 	response, err = provider.request(req)
+	if err != nil {
+		return
+	}
+	if response.StatusCode >= http.StatusMultipleChoices {
+		response.Body.Close()
+		err = fmt.Errorf("%s: url: %s statusCode: %d", funcName, apiRoute, response.StatusCode)
+		logger("%v", err)
+		return nil, err
+	}
 	return
 }
 
-// getUserPlaylists get the list of user playlists
-func (provider *SpotifyProvider) getUserPlaylists() *userPlaylists {
+// getUserPlaylists returns all the playlists of the user
+func (provider *SpotifyProvider) getUserPlaylists() ([]playlistData, error) {
 	const funcName = "getUserPlaylists"
 	path := strings.Replace(playlistRoute, "{user_id}", provider.userID, 1)
-	route := fmt.Sprintf("%s%s", apiBaseURL, path)
+	route := fmt.Sprintf("%s?limit=%d", provider.api.URL(path), userPlaylistsLimit)
+	var playlists []playlistData
+	items := provider.newPageIterator(route)
+	for items.Next() {
+		var playlist playlistData
+		if err := items.Decode(&playlist); err != nil {
+			logger("%s: Decode: %v", funcName, err)
+			return nil, err
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists, items.Err()
+}
+
+// getPlaylist returns the playlist with playlistID
+func (provider *SpotifyProvider) getPlaylist(playlistID string) (*playlistData, error) {
+	const funcName = "getPlaylist"
+	path := strings.Replace(getPlaylistRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := fmt.Sprintf("%s?fields=id,name,owner(id)", provider.api.URL(path))
 	req, err := http.NewRequest(http.MethodGet, route, nil)
 	if err != nil {
 		logger("%s: NewRequest: %v", funcName, err)
-		return nil
+		return nil, err
 	}
 	response, err := provider.request(req)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer response.Body.Close()
-	var payload userPlaylists
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrPlaylistNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: statusCode: %d", funcName, response.StatusCode)
+		logger("%v", err)
+		return nil, err
+	}
+	var payload playlistData
 	err = json.NewDecoder(response.Body).Decode(&payload)
 	if err != nil {
 		logger("%s: json.NewDecoder: %v", funcName, err)
-		return nil
+		return nil, err
 	}
-	return &payload
+	return &payload, nil
 }
 
-// CreatePlaylist creates new playlist
-func (provider *SpotifyProvider) CreatePlaylist(playlistName string) (hasCreated bool) {
-	const funcName = "CreatePlaylist"
-	hasCreated = false
-	logger("%s: desired playlist name: %s", funcName, playlistName)
-	userPlaylists := provider.getUserPlaylists()
-	if userPlaylists != nil {
-		for _, playlist := range userPlaylists.Items {
-			if playlist.Name == playlistName {
-				logger("%s: playlist with name: %s already exists", funcName, playlistName)
-				provider.playlistID = playlist.ID
-				return
-			}
+// GetPlaylistTrackURIs returns the URIs of all the tracks of the playlist
+func (provider *SpotifyProvider) GetPlaylistTrackURIs(playlistID string) ([]string, error) {
+	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := fmt.Sprintf("%s?fields=items(track(uri)),next&limit=%d", provider.api.URL(path), playlistItemsLimit)
+	return provider.getTrackURIs(route)
+}
+
+// GetSavedTrackURIs returns the URIs of all the tracks the user saved (liked songs),
+// the most recently saved first
+func (provider *SpotifyProvider) GetSavedTrackURIs() ([]string, error) {
+	route := fmt.Sprintf("%s?limit=%d", provider.api.URL(savedTracksRoute), savedTracksLimit)
+	return provider.getTrackURIs(route)
+}
+
+// getTrackURIs returns the track URIs of a playlist tracks or saved tracks list
+func (provider *SpotifyProvider) getTrackURIs(route string) ([]string, error) {
+	trackItems, err := provider.getTrackItems(route)
+	if err != nil {
+		return nil, err
+	}
+	uris := make([]string, len(trackItems))
+	for i, item := range trackItems {
+		uris[i] = item.Track.URI
+	}
+	return uris, nil
+}
+
+// getTrackItems returns the available tracks of a playlist tracks or saved tracks list
+func (provider *SpotifyProvider) getTrackItems(route string) ([]trackItem, error) {
+	const funcName = "getTrackItems"
+	var trackItems []trackItem
+	items := provider.newPageIterator(route)
+	for items.Next() {
+		var item trackItem
+		if err := items.Decode(&item); err != nil {
+			logger("%s: Decode: %v", funcName, err)
+			return nil, err
+		}
+		if item.Track != nil {
+			trackItems = append(trackItems, item)
 		}
 	}
+	return trackItems, items.Err()
+}
 
+// CreatePlaylist creates new playlist
+func (provider *SpotifyProvider) CreatePlaylist(playlistName string) error {
+	playlistID, err := provider.CreatePlaylistWithDetails(PlaylistDetails{
+		Name:        playlistName,
+		Description: createdPlaylistDescription,
+	})
+	if err != nil {
+		return err
+	}
+	provider.playlistID = playlistID
+	return nil
+}
+
+// CreatePlaylistWithDetails creates new playlist and returns its id
+func (provider *SpotifyProvider) CreatePlaylistWithDetails(details PlaylistDetails) (string, error) {
+	const funcName = "CreatePlaylistWithDetails"
+	logger("%s: desired playlist name: %s", funcName, details.Name)
 	path := strings.Replace(playlistRoute, "{user_id}", provider.userID, 1)
-	route := fmt.Sprintf("%s%s", apiBaseURL, path)
+	route := provider.api.URL(path)
 	body := map[string]interface{}{
-		"name":        playlistName,
-		"public":      false,
-		"description": createdPlaylistDescription,
+		"name":          details.Name,
+		"public":        details.Public,
+		"collaborative": details.Collaborative,
+		"description":   details.Description,
 	}
 	response, err := provider.sendJSONPayload(body, route)
 	if err != nil {
-		return
+		return "", err
 	}
 	defer response.Body.Close()
 	result := createdPlaylist{}
-	json.NewDecoder(response.Body).Decode(&result)
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		return "", err
+	}
 	log.Println("created playlist id: ", result)
-	provider.playlistID = result.ID
-	hasCreated = true
-	return
+	return result.ID, nil
+}
+
+// AddTracksToPlaylist appends tracks to the playlist in chunks the API accepts
+func (provider *SpotifyProvider) AddTracksToPlaylist(playlistID string, uris []string) error {
+	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := provider.api.URL(path)
+	for _, chunk := range chunkStrings(uris, playlistItemsLimit) {
+		body := map[string]interface{}{
+			"uris": chunk,
+		}
+		response, err := provider.sendJSONPayload(body, route)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+	}
+	return nil
+}
+
+// SaveTracks saves tracks to the user's Liked Songs, tracks saved later are listed first
+func (provider *SpotifyProvider) SaveTracks(uris []string) error {
+	route := provider.api.URL(savedTracksRoute)
+	for _, chunk := range chunkStrings(uris, savedTracksLimit) {
+		ids := make([]string, len(chunk))
+		for i, uri := range chunk {
+			ids[i] = strings.TrimPrefix(uri, trackURIPrefix)
+		}
+		body := map[string]interface{}{
+			"ids": ids,
+		}
+		response, err := provider.sendJSONRequest(http.MethodPut, body, route)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+	}
+	return nil
 }
 
-// AddItemsToPlaylist adds tracks to a playlist
+// AddItemsToPlaylist adds the found tracks to the target playlist, see SetTargetPlaylist.
+// In ImportReplace mode the first request replaces the playlist tracks.
 // TODO: when there are more than 10.000 items in the playlist, returns error 403 Forbidden.
-func (provider *SpotifyProvider) AddItemsToPlaylist() (hasAdded bool) {
+func (provider *SpotifyProvider) AddItemsToPlaylist() error {
 	const funcName = "AddItemsToPlaylist"
 	tracks := provider.LookedUpTracks
-	hasAdded = false
+	isReplace := provider.importMode == ImportReplace
+	if len(tracks) == 0 && !isReplace {
+		logger("%s: no tracks to add to playlist id %s", funcName, provider.playlistID)
+		return nil
+	}
+	// batches are looked up concurrently so restore the CSV order
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Index < tracks[j].Index
+	})
 	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", provider.playlistID, 1)
-	route := fmt.Sprintf("%s%s", apiBaseURL, path)
+	route := provider.api.URL(path)
 
-	spotifyURIs := make([]string, len(tracks))
-	for i, track := range tracks {
-		spotifyURIs[i] = track.Tracks.Items[0].URI
+	existing := provider.existing
+	switch {
+	case provider.keepDuplicates && provider.importMode != ImportMerge:
+		// only ImportMerge skips the playlist tracks when duplicates are kept
+		existing = nil
+	case existing == nil && !provider.keepDuplicates:
+		existing = newTrackSet()
 	}
-	body := map[string]interface{}{
-		"uris": spotifyURIs,
+	spotifyURIs, skipped := urisToAdd(tracks, existing, provider.keepDuplicates)
+	provider.duplicatesSkipped = skipped
+	chunks := chunkStrings(spotifyURIs, playlistItemsLimit)
+	if isReplace && len(chunks) == 0 {
+		// clears the playlist
+		chunks = [][]string{{}}
 	}
-	response, err := provider.sendJSONPayload(body, route)
-	if err != nil {
-		return
+	for i, chunk := range chunks {
+		method := http.MethodPost
+		if isReplace && i == 0 {
+			method = http.MethodPut
+		}
+		body := map[string]interface{}{
+			"uris": chunk,
+		}
+		response, err := provider.sendJSONRequest(method, body, route)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
 	}
-	defer response.Body.Close()
-	logger("%s: added %d items to playlist id %s", funcName, len(tracks), provider.playlistID)
-	hasAdded = true
-	return
+	logger("%s: added %d items to playlist id %s", funcName, len(spotifyURIs), provider.playlistID)
+	return nil
 }
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PlaylistDiff is what it takes to make a playlist mirror the found tracks.
+// It's applied in order: removals, additions (appended) and then moves.
+type PlaylistDiff struct {
+	Added   []string       `json:"added"`
+	Removed []string       `json:"removed"`
+	Moved   []PlaylistMove `json:"moved"`
+	// removedPositions are the positions of Removed tracks in the current playlist
+	removedPositions map[string][]int
+}
+
+// PlaylistMove moves the track at From to To, positions are
+// of the playlist after the previous moves were applied
+type PlaylistMove struct {
+	URI  string `json:"uri"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// diffPlaylist returns the diff which turns current into desired,
+// desired must not have repeated tracks. Tracks which aren't desired
+// and repeated tracks of current are removed. Unavailable tracks of current
+// (empty URIs) can't be removed by URI so they're kept and end up after
+// the desired tracks.
+func diffPlaylist(current []string, desired []string) PlaylistDiff {
+	diff := PlaylistDiff{
+		Added:            []string{},
+		Removed:          []string{},
+		Moved:            []PlaylistMove{},
+		removedPositions: make(map[string][]int),
+	}
+	isDesired := make(map[string]bool, len(desired))
+	for _, uri := range desired {
+		isDesired[uri] = true
+	}
+	kept := make([]string, 0, len(current))
+	isKept := make(map[string]bool, len(current))
+	for position, uri := range current {
+		if uri == "" {
+			kept = append(kept, uri)
+			continue
+		}
+		if isDesired[uri] && !isKept[uri] {
+			kept = append(kept, uri)
+			isKept[uri] = true
+			continue
+		}
+		if _, found := diff.removedPositions[uri]; !found {
+			diff.Removed = append(diff.Removed, uri)
+		}
+		diff.removedPositions[uri] = append(diff.removedPositions[uri], position)
+	}
+	for _, uri := range desired {
+		if !isKept[uri] {
+			diff.Added = append(diff.Added, uri)
+			kept = append(kept, uri)
+		}
+	}
+	// kept has the desired tracks now, every move puts the next track in place
+	for to, uri := range desired {
+		if kept[to] == uri {
+			continue
+		}
+		from := to + 1
+		for kept[from] != uri {
+			from++
+		}
+		copy(kept[to+1:from+1], kept[to:from])
+		kept[to] = uri
+		diff.Moved = append(diff.Moved, PlaylistMove{URI: uri, From: from, To: to})
+	}
+	return diff
+}
+
+// SyncPlaylist makes the target playlist mirror the found tracks in input order
+// and returns the diff, the playlist isn't changed if dryRun is set
+func (provider *SpotifyProvider) SyncPlaylist(dryRun bool) (PlaylistDiff, error) {
+	const funcName = "SyncPlaylist"
+	tracks := provider.LookedUpTracks
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Index < tracks[j].Index
+	})
+	current, err := provider.playlistPositions(provider.playlistID)
+	if err != nil {
+		return PlaylistDiff{}, err
+	}
+	uris, _ := urisToAdd(tracks, newTrackSet(), false)
+	diff := diffPlaylist(current, uris)
+	logger("%s: playlist id %s added: %d removed: %d moved: %d dry run: %t",
+		funcName, provider.playlistID, len(diff.Added), len(diff.Removed), len(diff.Moved), dryRun)
+	if dryRun {
+		return diff, nil
+	}
+	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", provider.playlistID, 1)
+	route := provider.api.URL(path)
+	for _, chunk := range removalChunks(diff.removedPositions, playlistItemsLimit) {
+		body := map[string]interface{}{
+			"tracks": chunk,
+		}
+		response, err := provider.sendJSONRequest(http.MethodDelete, body, route)
+		if err != nil {
+			return diff, err
+		}
+		response.Body.Close()
+	}
+	err = provider.AddTracksToPlaylist(provider.playlistID, diff.Added)
+	if err != nil {
+		return diff, err
+	}
+	for _, move := range diff.Moved {
+		body := map[string]interface{}{
+			"range_start":   move.From,
+			"insert_before": move.To,
+			"range_length":  1,
+		}
+		response, err := provider.sendJSONRequest(http.MethodPut, body, route)
+		if err != nil {
+			return diff, err
+		}
+		response.Body.Close()
+	}
+	return diff, nil
+}
+
+// playlistPositions returns the track URIs of the playlist by position,
+// unavailable tracks (null track items) are empty URIs so that the
+// positions of the following tracks are right
+func (provider *SpotifyProvider) playlistPositions(playlistID string) ([]string, error) {
+	const funcName = "playlistPositions"
+	path := strings.Replace(addItemsToPlaylistRoute, "{playlist_id}", url.PathEscape(playlistID), 1)
+	route := fmt.Sprintf("%s?fields=items(track(uri)),next&limit=%d", provider.api.URL(path), playlistItemsLimit)
+	var uris []string
+	items := provider.newPageIterator(route)
+	for items.Next() {
+		var item trackItem
+		if err := items.Decode(&item); err != nil {
+			logger("%s: Decode: %v", funcName, err)
+			return nil, err
+		}
+		var uri string
+		if item.Track != nil {
+			uri = item.Track.URI
+		}
+		uris = append(uris, uri)
+	}
+	return uris, items.Err()
+}
+
+// removalChunks returns the bodies of remove requests with at most size positions each.
+// Positions are removed from the end of the playlist so that positions of the following
+// requests stay valid.
+func removalChunks(removedPositions map[string][]int, size int) (chunks [][]map[string]interface{}) {
+	type removal struct {
+		uri      string
+		position int
+	}
+	var removals []removal
+	for uri, positions := range removedPositions {
+		for _, position := range positions {
+			removals = append(removals, removal{uri: uri, position: position})
+		}
+	}
+	sort.Slice(removals, func(i, j int) bool {
+		return removals[i].position > removals[j].position
+	})
+	for len(removals) > 0 {
+		n := size
+		if n > len(removals) {
+			n = len(removals)
+		}
+		positionsByURI := make(map[string][]int)
+		var uris []string
+		for _, removal := range removals[:n] {
+			if _, found := positionsByURI[removal.uri]; !found {
+				uris = append(uris, removal.uri)
+			}
+			positionsByURI[removal.uri] = append(positionsByURI[removal.uri], removal.position)
+		}
+		chunk := make([]map[string]interface{}, len(uris))
+		for i, uri := range uris {
+			chunk[i] = map[string]interface{}{
+				"uri":       uri,
+				"positions": positionsByURI[uri],
+			}
+		}
+		chunks = append(chunks, chunk)
+		removals = removals[n:]
+	}
+	return
+}
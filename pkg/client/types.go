@@ -1,33 +1,116 @@
 package client
 
-import "net/http"
+import (
+	"sync"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
 
 // SpotifyProvider holds auth state
 type SpotifyProvider struct {
-	client           *http.Client
-	accessToken      string
-	refreshToken     string
-	maxRetries       int
-	actualRetries    int
+	api           SpotifyAPI
+	accessToken   string
+	refreshToken  string
+	maxRetries    int
+	actualRetries int
+	// retryDelay is the wait before a rate limited request without Retry-After is retried
+	retryDelay time.Duration
+	// revoked is the error of the token refresh which found the refresh token revoked,
+	// requests fail with it instead of being retried
+	revoked          error
 	userID           string
-	LookedUpTracks   []SearchResult
+	LookedUpTracks   []FoundTrack
 	trackIsFoundChan chan bool
 	playlistID       string
+	// importMode is one of the Import* modes, see SetTargetPlaylist
+	importMode string
+	// existing are the tracks of the target playlist in ImportMerge and ImportAppend modes
+	existing *trackSet
+	// keepDuplicates adds repeated matches as many times, see KeepDuplicates
+	keepDuplicates bool
+	// duplicatesSkipped counts the tracks AddItemsToPlaylist skipped by Duplicate* reason
+	duplicatesSkipped map[string]int
+	// reviewMatches parks ambiguous and low confidence matches, see EnableReview
+	reviewMatches bool
+	// cache holds the lookup outcomes shared by all users, lookups skip it if it's nil
+	cache matchCache
+	// markets are the search markets in order, see SetMarkets
+	markets []string
+	// preferences pick the match among the search candidates, see SetPreferences
+	preferences Preferences
+	// mutex guards LookedUpTracks, actualRetries and revoked
+	// which are updated by concurrent lookups
+	mutex sync.Mutex
 }
 
-// SearchResult contains track metadata
+// SearchResult is the outcome of looking up a single input track
 type SearchResult struct {
-	Tracks struct {
-		Items []trackMetaData `json:"items"`
-		Total int             `json:"total"`
-	} `json:"tracks"`
+	Index   int
+	Input   csv.TrackInput
 	IsFound bool
+	// Outcome is one of OutcomeFound, OutcomeNotFound, OutcomeErrored, OutcomeReview
+	Outcome     string
+	TrackID     string
+	TrackName   string
+	TrackArtist string
+	URI         string
+	// ISRC of the match, duplicates are detected by it
+	ISRC string
+	// AlbumID and ArtistIDs of the match, albums and artists destinations save them
+	AlbumID   string
+	ArtistIDs []string
+	// Confidence is in the range [0, 1], see scoreCandidate
+	Confidence float64
+	// Ambiguous is set for found matches which review mode parks, see isAmbiguous
+	Ambiguous bool
+	// Strategy is the search query strategy which produced the match
+	Strategy string
+	// Reason explains why the track was not found, errored or needs review
+	Reason string
+	// Queries are the search queries made in order, the last one produced the match
+	Queries []string
+	// Cached is set if the outcome was taken from the match cache without a search
+	Cached bool
+	// Market is the market the track was (last) looked up in
+	Market string
+	// Candidates are the best matches of OutcomeReview results
+	Candidates []Candidate
+}
+
+// FoundTrack is what writing a found track needs, LookedUpTracks holds only
+// these so that the lookup results of large files aren't kept until the write
+type FoundTrack struct {
+	// Index is the CSV index, the tracks are written in its order
+	Index int
+	URI   string
+	// ISRC of the match, duplicates are detected by it
+	ISRC string
+}
+
+// foundTrack returns what writing the found result needs
+func (track SearchResult) foundTrack() FoundTrack {
+	return FoundTrack{Index: track.Index, URI: track.URI, ISRC: track.ISRC}
 }
 
 // TracksLookupProgress struct
 type TracksLookupProgress struct {
-	IsFound chan bool
-	Quit    chan bool
+	Results chan SearchResult
+	// Done receives nil once every result was sent or the error which stopped the lookup
+	Done chan error
+}
+
+// tracksResponse is the payload returned by the several tracks endpoint
+type tracksResponse struct {
+	Tracks []*trackMetaData `json:"tracks"`
+}
+
+// searchResponse is the payload returned by the search endpoint
+type searchResponse struct {
+	Tracks struct {
+		Items []trackMetaData `json:"items"`
+		Total int             `json:"total"`
+	} `json:"tracks"`
 }
 
 type accessToken struct {
@@ -35,19 +118,75 @@ type accessToken struct {
 	ExpiresIn int    `json:"expires_in"`
 }
 
+// tokenError is the body of a failed access token request,
+// Error is "invalid_grant" if the refresh token was revoked
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
 type createdPlaylist struct {
 	ID string `json:"id"`
 }
 
-type userPlaylists struct {
-	Items []struct {
-		Name string `json:"name"`
-		ID   string `json:"id"`
-	} `json:"items"`
+type playlistData struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+	Owner       struct {
+		ID string `json:"id"`
+	} `json:"owner"`
+}
+
+// PlaylistDetails are the user editable properties of a playlist,
+// a collaborative playlist can't be public
+type PlaylistDetails struct {
+	ID            string
+	Name          string
+	Description   string
+	Public        bool
+	Collaborative bool
+}
+
+// trackItem is an item of playlist tracks and saved tracks lists
+type trackItem struct {
+	// Track is null for tracks which are no longer available
+	Track *struct {
+		URI         string `json:"uri"`
+		ExternalIDs struct {
+			ISRC string `json:"isrc"`
+		} `json:"external_ids"`
+	} `json:"track"`
 }
 
 type trackMetaData struct {
+	ID      string       `json:"id"`
+	URI     string       `json:"uri"`
+	Name    string       `json:"name"`
+	Artists []artistData `json:"artists"`
+	Album   struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		// AlbumType is album, single or compilation
+		AlbumType string `json:"album_type"`
+		// Images are ordered by size, the widest first
+		Images []struct {
+			URL string `json:"url"`
+		} `json:"images"`
+	} `json:"album"`
+	// PreviewURL is a 30 seconds sample, it's null for some tracks
+	PreviewURL string `json:"preview_url"`
+	// IsPlayable is set by searches with a market
+	IsPlayable *bool `json:"is_playable"`
+	Explicit   bool  `json:"explicit"`
+	// ExternalIDs are set by searches, the tracks of another market with the same ISRC are relinked
+	ExternalIDs struct {
+		ISRC string `json:"isrc"`
+	} `json:"external_ids"`
+}
+
+type artistData struct {
 	ID   string `json:"id"`
-	URI  string `json:"uri"`
 	Name string `json:"name"`
 }
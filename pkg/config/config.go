@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
 
@@ -28,8 +29,11 @@ func init() {
 type Config struct {
 	// base64 encoded client_id:client_secret
 	SpotifySecret           string
+	SpotifyAPIURL           string
+	SpotifyAccountsURL      string
 	Env                     string
 	Market                  string
+	FallbackMarkets         string
 	MongoDBName             string
 	MongoConnectionString   string
 	KafkaBrokers            string
@@ -43,14 +47,19 @@ type Config struct {
 	AllowedOrigins          string
 	TrackLookupInterval     string
 	TestRefreshToken        string
+	// InstanceID tells apart the server instances which share the db, the host name by default
+	InstanceID string
 }
 
 // NewConfig returns config
 func NewConfig() Config {
 	return Config{
 		SpotifySecret:           getEnvVar("SPOTIFY_CLIENT_ID_SECRET_BASE64", ""),
+		SpotifyAPIURL:           getEnvVar("SPOTIFY_API_URL", "https://api.spotify.com/v1"),
+		SpotifyAccountsURL:      getEnvVar("SPOTIFY_ACCOUNTS_URL", "https://accounts.spotify.com"),
 		Env:                     getEnvVar("ENV", "development"),
 		Market:                  getEnvVar("MARKET", "US"),
+		FallbackMarkets:         getEnvVar("FALLBACK_MARKETS", ""),
 		MongoDBName:             getEnvVar("MONGO_DB_NAME", ""),
 		MongoConnectionString:   getEnvVar("MONGO_ATLAS_CONNECTION", ""),
 		KafkaBrokers:            getEnvVar("KAFKA_BROKERS", ""),
@@ -64,9 +73,29 @@ func NewConfig() Config {
 		AllowedOrigins:          getEnvVar("ALLOWED_ORIGINS", "http://localhost:3000"),
 		TrackLookupInterval:     getEnvVar("TRACK_LOOKUP_INTERVAL", "5"),
 		TestRefreshToken:        getEnvVar("TEST_REFRESH_TOKEN", ""),
+		InstanceID:              getEnvVar("INSTANCE_ID", hostname()),
 	}
 }
 
+// IsAllowedOrigin reports whether origin is one of the comma separated ALLOWED_ORIGINS
+func (conf Config) IsAllowedOrigin(origin string) bool {
+	for _, allowedOrigin := range strings.Split(conf.AllowedOrigins, ",") {
+		if strings.TrimSpace(allowedOrigin) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		logger("hostname: %v", err)
+		return ""
+	}
+	return name
+}
+
 func getEnvVar(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -0,0 +1,20 @@
+package config
+
+import "testing"
+
+func TestIsAllowedOrigin(t *testing.T) {
+	conf := Config{AllowedOrigins: "http://localhost:3000, https://csv-to-spotify.example.com"}
+	cases := map[string]bool{
+		"http://localhost:3000":              true,
+		"https://csv-to-spotify.example.com": true,
+		"http://localhost":                   false,
+		"https://example.com":                false,
+		"":                                   false,
+		"http://localhost:3000.evil.example": false,
+	}
+	for origin, expected := range cases {
+		if actual := conf.IsAllowedOrigin(origin); actual != expected {
+			t.Errorf("TestIsAllowedOrigin: IsAllowedOrigin(%q) = %v, expected %v", origin, actual, expected)
+		}
+	}
+}
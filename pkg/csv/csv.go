@@ -2,6 +2,8 @@ package csv
 
 import (
 	"encoding/csv"
+	"fmt"
+	"io"
 	"strings"
 
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
@@ -11,44 +13,231 @@ var (
 	logger = utils.NewLogger("csv")
 )
 
+// Column names of exported playlists. The first column is the track name and
+// the second one is the artist (as in iTunes exports), the other columns are
+// optional and found by their header name.
+const (
+	ColumnName      = "Name"
+	ColumnArtist    = "Artist"
+	ColumnAlbum     = "Album"
+	ColumnISRC      = "ISRC"
+	ColumnDuration  = "Duration (ms)"
+	ColumnDateAdded = "Date Added"
+	ColumnURI       = "Spotify URI"
+	// ColumnReason and ColumnQueries are appended to the input columns by unmatched tracks reports
+	ColumnReason  = "Reason"
+	ColumnQueries = "Queries"
+)
+
+// Header is the header row of exported playlists
+var Header = []string{ColumnName, ColumnArtist, ColumnAlbum, ColumnISRC, ColumnDuration, ColumnDateAdded, ColumnURI}
+
 // TrackInput type
 type TrackInput struct {
+	// Index is the zero-based position of the track in the CSV file (header excluded)
+	Index  int
 	Artist string
 	Track  string
+	// Album, ISRC and URI are set if the CSV has the matching optional columns
+	Album string
+	ISRC  string
+	URI   string
+	// Record is the CSV row of the track as is
+	Record []string
 }
 
-type trackInputChannelData struct {
-	track TrackInput
-	index int
+// TrackIterator iterates over input tracks, see Reader:
+//
+//	for tracks.Next() {
+//		track := tracks.Track()
+//	}
+//	err := tracks.Err()
+type TrackIterator interface {
+	// Next advances to the next track, it returns false after the last one or an error
+	Next() bool
+	// Track returns the current track
+	Track() TrackInput
+	// Err returns the error which stopped the iteration, nil at the end of the tracks
+	Err() error
 }
 
-// GetInputTracks converts CSV records to an array of TrackInput
-func GetInputTracks(csvFile string) (tracks []TrackInput, err error) {
-	const funcName = "GetInputTracks"
-	csvReader := csv.NewReader(strings.NewReader(csvFile))
+// Reader reads the tracks of a CSV file one row at a time, only the current
+// row is held in memory whatever the size of the file
+type Reader struct {
+	csvReader *csv.Reader
+	header    []string
+	columns   columnIndexes
+	track     TrackInput
+	index     int
+	err       error
+}
+
+// NewReader reads the header row of the CSV file r, a file without rows
+// has no header and no tracks. It returns an error if the header can't be read.
+func NewReader(r io.Reader) (*Reader, error) {
+	const funcName = "NewReader"
+	csvReader := csv.NewReader(r)
 	csvReader.LazyQuotes = true
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		logger("%s: csvReader.ReadAll: %v", funcName, err)
+	reader := &Reader{csvReader: csvReader}
+	header, err := csvReader.Read()
+	switch {
+	case err == io.EOF:
+		reader.err = io.EOF
+	case err != nil:
+		logger("%s: csvReader.Read: %v", funcName, err)
 		return nil, err
+	default:
+		reader.header = header
+		reader.columns = optionalColumns(header)
 	}
+	return reader, nil
+}
 
-	// disregard header
-	if len(records) > 1 {
-		records = records[1:]
-		tracks = make([]TrackInput, len(records))
-		trackChannel := make(chan trackInputChannelData)
-		for index, record := range records {
-			index, record := index, record
-			go func() {
-				trackChannel <- trackInputChannelData{track: TrackInput{Track: record[0], Artist: record[1]}, index: index}
-			}()
+// Header returns the header row, it's nil if the file has no rows
+func (reader *Reader) Header() []string {
+	return reader.header
+}
+
+// Next reads the next row, it returns false at the end of the file or if a row is malformed, see Err
+func (reader *Reader) Next() bool {
+	const funcName = "Next"
+	if reader.err != nil {
+		return false
+	}
+	record, err := reader.csvReader.Read()
+	if err == nil && len(record) < 2 {
+		err = fmt.Errorf("row %d: expected the track name and artist columns", reader.index+1)
+	}
+	if err != nil {
+		if err != io.EOF {
+			logger("%s: csvReader.Read: %v", funcName, err)
 		}
+		reader.err = err
+		return false
+	}
+	reader.track = TrackInput{
+		Index:  reader.index,
+		Track:  record[0],
+		Artist: record[1],
+		Album:  reader.columns.value(record, ColumnAlbum),
+		ISRC:   reader.columns.value(record, ColumnISRC),
+		URI:    reader.columns.value(record, ColumnURI),
+		Record: record,
+	}
+	reader.index++
+	return true
+}
+
+// Track returns the track of the current row
+func (reader *Reader) Track() TrackInput {
+	return reader.track
+}
+
+// Err returns the error which stopped reading, nil at the end of the file
+func (reader *Reader) Err() error {
+	if reader.err == io.EOF {
+		return nil
+	}
+	return reader.err
+}
+
+// sliceIterator iterates over tracks in memory
+type sliceIterator struct {
+	tracks []TrackInput
+	track  TrackInput
+}
+
+// NewSliceIterator returns an iterator over tracks
+func NewSliceIterator(tracks []TrackInput) TrackIterator {
+	return &sliceIterator{tracks: tracks}
+}
+
+func (iterator *sliceIterator) Next() bool {
+	if len(iterator.tracks) == 0 {
+		return false
+	}
+	iterator.track, iterator.tracks = iterator.tracks[0], iterator.tracks[1:]
+	return true
+}
+
+func (iterator *sliceIterator) Track() TrackInput {
+	return iterator.track
+}
 
-		for range records {
-			record := <-trackChannel
-			tracks[record.index] = record.track
+func (iterator *sliceIterator) Err() error {
+	return nil
+}
+
+// filterIterator skips the tracks of an iterator which keep rejects
+type filterIterator struct {
+	TrackIterator
+	keep func(TrackInput) bool
+}
+
+// Filter returns the tracks for which keep returns true,
+// keep is called once per track in order as the tracks are read
+func Filter(tracks TrackIterator, keep func(TrackInput) bool) TrackIterator {
+	return &filterIterator{TrackIterator: tracks, keep: keep}
+}
+
+func (iterator *filterIterator) Next() bool {
+	for iterator.TrackIterator.Next() {
+		if iterator.keep(iterator.Track()) {
+			return true
 		}
 	}
-	return
+	return false
+}
+
+// GetInputTracks converts CSV records to an array of TrackInput,
+// Reader reads large files without holding all their tracks in memory
+func GetInputTracks(csvFile string) (tracks []TrackInput, err error) {
+	reader, err := NewReader(strings.NewReader(csvFile))
+	if err != nil {
+		return nil, err
+	}
+	for reader.Next() {
+		tracks = append(tracks, reader.Track())
+	}
+	if err = reader.Err(); err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+// ReadHeader returns the header row of the CSV file
+func ReadHeader(csvFile string) ([]string, error) {
+	reader, err := NewReader(strings.NewReader(csvFile))
+	if err != nil {
+		return nil, err
+	}
+	if reader.Header() == nil {
+		return nil, io.EOF
+	}
+	return reader.Header(), nil
+}
+
+// columnIndexes maps optional column names to their positions
+type columnIndexes map[string]int
+
+// optionalColumns finds the optional columns in the header row
+func optionalColumns(header []string) columnIndexes {
+	columns := make(columnIndexes)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		switch name {
+		case ColumnAlbum, ColumnISRC, ColumnURI:
+			columns[name] = i
+		}
+	}
+	return columns
+}
+
+// value returns the value of the column in record or "" if there's no such column
+func (columns columnIndexes) value(record []string, name string) string {
+	i, found := columns[name]
+	if !found || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
 }
@@ -1,6 +1,10 @@
 package csv
 
 import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -17,4 +21,219 @@ func TestGetInputTracksPositive(t *testing.T) {
 	if len(tracks) != 3 {
 		t.Errorf("TestGetInputTracksPositive: len(tracks) != 3")
 	}
+
+	for index, track := range tracks {
+		if track.Index != index {
+			t.Errorf("TestGetInputTracksPositive: tracks[%d].Index = %d", index, track.Index)
+		}
+	}
+}
+
+func TestGetInputTracksOptionalColumns(t *testing.T) {
+	const funcName = "TestGetInputTracksOptionalColumns"
+	csvFile := `Name,Artist,Album,ISRC,Duration (ms),Date Added,Spotify URI
+Yesterday - Remastered 2009,The Beatles,Help! (Remastered),GBAYE0601477,125666,2020-05-16T09:27:00Z,spotify:track:3BQHpFgAp4l80e1XslIjNI`
+	tracks, err := GetInputTracks(csvFile)
+	if err != nil {
+		t.Fatalf("%s: %v", funcName, err)
+	}
+	if len(tracks) != 1 {
+		t.Fatalf("%s: len(tracks) != 1", funcName)
+	}
+	track := tracks[0]
+	if track.Track != "Yesterday - Remastered 2009" || track.Artist != "The Beatles" || track.Album != "Help! (Remastered)" ||
+		track.ISRC != "GBAYE0601477" || track.URI != "spotify:track:3BQHpFgAp4l80e1XslIjNI" {
+		t.Errorf("%s: unexpected track: %+v", funcName, track)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	const funcName = "TestReadHeader"
+	csvFile := `Name,Artist,Genre
+Darling Pretty,Mark Knopfler,Folk`
+	header, err := ReadHeader(csvFile)
+	if err != nil || len(header) != 3 || header[2] != "Genre" {
+		t.Errorf("%s: unexpected header: %v err: %v", funcName, header, err)
+	}
+	tracks, err := GetInputTracks(csvFile)
+	if err != nil || len(tracks) != 1 || len(tracks[0].Record) != 3 || tracks[0].Record[2] != "Folk" {
+		t.Errorf("%s: the row should be kept: %+v err: %v", funcName, tracks, err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	const funcName = "TestReader"
+	csvFile := `Name,Artist,Album,ISRC,Duration (ms),Date Added,Spotify URI
+Yesterday - Remastered 2009,The Beatles,Help! (Remastered),GBAYE0601477,125666,2020-05-16T09:27:00Z,spotify:track:3BQHpFgAp4l80e1XslIjNI
+Let It Be,The Beatles,Let It Be,,,,`
+	expected, _ := GetInputTracks(csvFile)
+	reader, err := NewReader(strings.NewReader(csvFile))
+	if err != nil || len(reader.Header()) != 7 {
+		t.Fatalf("%s: unexpected header: %v err: %v", funcName, reader.Header(), err)
+	}
+	var tracks []TrackInput
+	for reader.Next() {
+		tracks = append(tracks, reader.Track())
+	}
+	if reader.Err() != nil || len(tracks) != 2 || fmt.Sprint(tracks) != fmt.Sprint(expected) {
+		t.Errorf("%s: unexpected tracks: %+v err: %v", funcName, tracks, reader.Err())
+	}
+
+	const testReaderMalformed = "TestReaderMalformed"
+	t.Run(testReaderMalformed, func(t *testing.T) {
+		reader, err := NewReader(strings.NewReader("Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles,1970\nHey Jude,The Beatles\n"))
+		if err != nil {
+			t.Fatalf("%s: NewReader: %v", testReaderMalformed, err)
+		}
+		rows := 0
+		for reader.Next() {
+			rows++
+		}
+		if rows != 1 || reader.Err() == nil {
+			t.Errorf("%s: expected an error after the first row, got %d rows err: %v", testReaderMalformed, rows, reader.Err())
+		}
+	})
+
+	const testReaderEmpty = "TestReaderEmpty"
+	t.Run(testReaderEmpty, func(t *testing.T) {
+		reader, err := NewReader(strings.NewReader(""))
+		if err != nil || reader.Header() != nil || reader.Next() || reader.Err() != nil {
+			t.Errorf("%s: an empty file should have no header and no tracks, err: %v", testReaderEmpty, err)
+		}
+	})
+
+	const testReaderOneColumn = "TestReaderOneColumn"
+	t.Run(testReaderOneColumn, func(t *testing.T) {
+		reader, _ := NewReader(strings.NewReader("Name\nYesterday\n"))
+		if reader.Next() || reader.Err() == nil {
+			t.Errorf("%s: rows without artist should be an error", testReaderOneColumn)
+		}
+	})
+
+	const testFilter = "TestFilter"
+	t.Run(testFilter, func(t *testing.T) {
+		reader, _ := NewReader(&rowsReader{rows: 10})
+		tracks := Filter(reader, func(track TrackInput) bool {
+			return track.Index%2 == 0
+		})
+		var indexes []int
+		for tracks.Next() {
+			indexes = append(indexes, tracks.Track().Index)
+		}
+		if fmt.Sprint(indexes) != "[0 2 4 6 8]" || tracks.Err() != nil {
+			t.Errorf("%s: unexpected tracks: %v err: %v", testFilter, indexes, tracks.Err())
+		}
+	})
+}
+
+// TestReaderMemory checks that the memory held while a file is read doesn't depend on its size
+func TestReaderMemory(t *testing.T) {
+	const funcName = "TestReaderMemory"
+	const maxHeapGrowth = 1 << 20
+	if growth := heapGrowth(readHalf(200000)); growth > maxHeapGrowth {
+		t.Errorf("%s: the heap grew by %.0f bytes while reading", funcName, growth)
+	}
+}
+
+// rowsReader generates a CSV file of rows tracks without holding the file in memory
+type rowsReader struct {
+	rows    int
+	row     int
+	pending []byte
+}
+
+func (reader *rowsReader) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		switch {
+		case reader.row > reader.rows:
+			return 0, io.EOF
+		case reader.row == 0:
+			reader.pending = []byte(strings.Join(Header, ",") + "\n")
+		default:
+			reader.pending = []byte(fmt.Sprintf("Track %[1]d,Artist %[1]d,Album %[1]d,USRC1%07[1]d,180000,2020-05-16T09:27:00Z,spotify:track:%022[1]d\n", reader.row))
+		}
+		reader.row++
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+// benchmarkSizes are the numbers of rows of the benchmarked files
+var benchmarkSizes = []int{1000, 10000, 50000}
+
+// liveHeap returns the size of the reachable heap objects
+func liveHeap() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// heapGrowth returns how much the live heap grows while what read returns is held
+func heapGrowth(read func() interface{}) float64 {
+	before := liveHeap()
+	held := read()
+	after := liveHeap()
+	runtime.KeepAlive(held)
+	if after < before {
+		return 0
+	}
+	return float64(after - before)
+}
+
+// readHalf reads half of a generated file of rows tracks and returns the reader
+func readHalf(rows int) func() interface{} {
+	return func() interface{} {
+		reader, _ := NewReader(&rowsReader{rows: rows})
+		for i := 0; i < rows/2 && reader.Next(); i++ {
+		}
+		return reader
+	}
+}
+
+// BenchmarkReader streams generated files, live-B (the heap held halfway through
+// the file) stays the same whatever the number of rows. ns/op and allocs/op
+// include generating the rows.
+func BenchmarkReader(b *testing.B) {
+	for _, rows := range benchmarkSizes {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			growth := heapGrowth(readHalf(rows))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader, _ := NewReader(&rowsReader{rows: rows})
+				for reader.Next() {
+				}
+				if reader.Err() != nil {
+					b.Fatal(reader.Err())
+				}
+			}
+			b.ReportMetric(growth, "live-B")
+		})
+	}
+}
+
+// BenchmarkGetInputTracks parses the same files held in memory,
+// live-B (the heap held by the returned tracks) grows with the number of rows
+func BenchmarkGetInputTracks(b *testing.B) {
+	for _, rows := range benchmarkSizes {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			builder := &strings.Builder{}
+			io.Copy(builder, &rowsReader{rows: rows})
+			csvFile := builder.String()
+			growth := heapGrowth(func() interface{} {
+				tracks, _ := GetInputTracks(csvFile)
+				return tracks
+			})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := GetInputTracks(csvFile); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(growth, "live-B")
+		})
+	}
 }
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const accountLinksCollection = "accountLinks"
+
+// LinkAccounts asks to allow migrating the account of userID to linkedUserID,
+// the link is pending until linkedUserID confirms it (see ConfirmAccountLink)
+func LinkAccounts(userID string, linkedUserID string) bool {
+	return store.InsertAccountLink(AccountLink{
+		UserID:       userID,
+		LinkedUserID: linkedUserID,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// ConfirmAccountLink confirms the pending link of userID to linkedUserID,
+// it returns false if userID didn't ask to link the accounts
+func ConfirmAccountLink(userID string, linkedUserID string) bool {
+	return store.ConfirmAccountLink(userID, linkedUserID)
+}
+
+// IsLinkedAccount reports whether the account of userID may be migrated to linkedUserID
+func IsLinkedAccount(userID string, linkedUserID string) bool {
+	return store.IsLinkedAccount(userID, linkedUserID)
+}
+
+// FindAccountLinks returns the links of the account of userID, the accounts it may be
+// migrated to and the accounts which asked to be migrated to it
+func FindAccountLinks(userID string) []AccountLink {
+	return store.FindAccountLinks(userID)
+}
+
+func accountLinkFilter(userID string, linkedUserID string) bson.D {
+	return bson.D{{Key: "userId", Value: userID}, {Key: "linkedUserId", Value: linkedUserID}}
+}
+
+func (mongoStore) InsertAccountLink(link AccountLink) bool {
+	const funcName = "InsertAccountLink"
+	collection := client.Database(conf.MongoDBName).Collection(accountLinksCollection)
+	// an existing link (and its confirmation) is kept
+	update := bson.D{{Key: "$setOnInsert", Value: link}}
+	opts := options.Update().SetUpsert(true)
+	_, err := collection.UpdateOne(ctx, accountLinkFilter(link.UserID, link.LinkedUserID), update, opts)
+	if err != nil {
+		logger("%s UpdateOne: %v", funcName, err)
+		return false
+	}
+	return true
+}
+
+func (mongoStore) ConfirmAccountLink(userID string, linkedUserID string) bool {
+	const funcName = "ConfirmAccountLink"
+	collection := client.Database(conf.MongoDBName).Collection(accountLinksCollection)
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "confirmed", Value: true}}}}
+	result, err := collection.UpdateOne(ctx, accountLinkFilter(userID, linkedUserID), update)
+	if err != nil {
+		logger("%s UpdateOne: %v", funcName, err)
+		return false
+	}
+	return result.MatchedCount > 0
+}
+
+func (mongoStore) IsLinkedAccount(userID string, linkedUserID string) bool {
+	const funcName = "IsLinkedAccount"
+	collection := client.Database(conf.MongoDBName).Collection(accountLinksCollection)
+	filter := append(accountLinkFilter(userID, linkedUserID), bson.E{Key: "confirmed", Value: true})
+	err := collection.FindOne(ctx, filter).Err()
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (mongoStore) FindAccountLinks(userID string) []AccountLink {
+	const funcName = "FindAccountLinks"
+	collection := client.Database(conf.MongoDBName).Collection(accountLinksCollection)
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "userId", Value: userID}},
+		bson.D{{Key: "linkedUserId", Value: userID}},
+	}}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	links := []AccountLink{}
+	err = cursor.All(ctx, &links)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return links
+}
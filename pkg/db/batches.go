@@ -0,0 +1,76 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const batchesCollection = "batches"
+
+// CreateBatch inserts a new batch and returns it with its id set
+func CreateBatch(batch Batch) *Batch {
+	batch.ID = primitive.NewObjectID().Hex()
+	batch.CreatedAt = time.Now()
+	if !store.InsertBatch(batch) {
+		return nil
+	}
+	return &batch
+}
+
+// FindBatch finds batch by id
+func FindBatch(batchID string) *Batch {
+	return store.FindBatch(batchID)
+}
+
+// FindBatchJobs returns the jobs of a batch in the order of the archive entries
+func FindBatchJobs(batchID string) []Job {
+	return store.FindBatchJobs(batchID)
+}
+
+func (mongoStore) InsertBatch(batch Batch) bool {
+	const funcName = "InsertBatch"
+	collection := client.Database(conf.MongoDBName).Collection(batchesCollection)
+	_, err := collection.InsertOne(ctx, batch)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+		return false
+	}
+	return true
+}
+
+func (mongoStore) FindBatch(batchID string) *Batch {
+	const funcName = "FindBatch"
+	collection := client.Database(conf.MongoDBName).Collection(batchesCollection)
+	var batch Batch
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: batchID}}).Decode(&batch)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &batch
+}
+
+func (mongoStore) FindBatchJobs(batchID string) []Job {
+	const funcName = "FindBatchJobs"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	// ids break the ties of jobs created in the same millisecond
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "batchId", Value: batchID}}, opts)
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	jobs := []Job{}
+	err = cursor.All(ctx, &jobs)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return jobs
+}
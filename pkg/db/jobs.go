@@ -0,0 +1,277 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	jobsCollection      = "jobs"
+	jobTracksCollection = "jobTracks"
+	exportsCollection   = "exports"
+	coversCollection    = "coverImages"
+)
+
+// CreateJob inserts job as a new running job, an import job if its type isn't set
+func CreateJob(job Job) *Job {
+	now := time.Now()
+	job.ID = primitive.NewObjectID().Hex()
+	job.Status = JobRunning
+	if job.Type == "" {
+		job.Type = JobTypeImport
+	}
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	if !store.InsertJob(job) {
+		return nil
+	}
+	return &job
+}
+
+// UpdateJob saves the job state
+func UpdateJob(job Job) {
+	job.UpdatedAt = time.Now()
+	store.ReplaceJob(job)
+}
+
+// UpdateJobIfStatus saves the job state only if the stored job is still in status and
+// reports whether it was saved. Of concurrent requests which change the status of
+// a job (e.g. to resume or commit it) only one succeeds.
+func UpdateJobIfStatus(job Job, status JobStatus) bool {
+	job.UpdatedAt = time.Now()
+	return store.ReplaceJobIfStatus(job, status)
+}
+
+// TouchJob records that the running job is still run by the server instance
+func TouchJob(jobID string, instanceID string) {
+	store.TouchJob(jobID, instanceID, time.Now())
+}
+
+// FindJobsByStatus returns the jobs in status
+func FindJobsByStatus(status JobStatus) []Job {
+	return store.FindJobsByStatus(status)
+}
+
+// FindJob finds job by id
+func FindJob(jobID string) *Job {
+	return store.FindJob(jobID)
+}
+
+// FindLatestJob finds the most recently created job of the user
+func FindLatestJob(userID string) *Job {
+	return store.FindLatestJob(userID)
+}
+
+// InsertJobTrack adds the lookup outcome of a single track
+func InsertJobTrack(track JobTrack) {
+	store.InsertJobTrack(track)
+}
+
+// UpdateJobTrack replaces the outcome of a track of a job, e.g. once it was reviewed
+func UpdateJobTrack(track JobTrack) {
+	store.ReplaceJobTrack(track)
+}
+
+// FindJobTracks returns the looked up tracks of a job ordered by CSV position
+func FindJobTracks(jobID string) []JobTrack {
+	return store.FindJobTracks(jobID)
+}
+
+// InsertExport saves the file produced by an export job
+func InsertExport(export Export) {
+	store.InsertExport(export)
+}
+
+// FindExport finds the file produced by an export job
+func FindExport(jobID string) *Export {
+	return store.FindExport(jobID)
+}
+
+// InsertCoverImage saves the cover of the playlist created by a job
+func InsertCoverImage(cover CoverImage) {
+	store.InsertCoverImage(cover)
+}
+
+// FindCoverImage finds the cover of the playlist created by a job
+func FindCoverImage(jobID string) *CoverImage {
+	return store.FindCoverImage(jobID)
+}
+
+func (mongoStore) InsertJob(job Job) bool {
+	const funcName = "InsertJob"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	_, err := collection.InsertOne(ctx, job)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+		return false
+	}
+	return true
+}
+
+func (mongoStore) ReplaceJob(job Job) {
+	const funcName = "ReplaceJob"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	_, err := collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: job.ID}}, job)
+	if err != nil {
+		logger("%s ReplaceOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) ReplaceJobIfStatus(job Job, status JobStatus) bool {
+	const funcName = "ReplaceJobIfStatus"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	filter := bson.D{{Key: "_id", Value: job.ID}, {Key: "status", Value: status}}
+	result, err := collection.ReplaceOne(ctx, filter, job)
+	if err != nil {
+		logger("%s ReplaceOne: %v", funcName, err)
+		return false
+	}
+	return result.MatchedCount > 0
+}
+
+func (mongoStore) TouchJob(jobID string, instanceID string, updatedAt time.Time) {
+	const funcName = "TouchJob"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	filter := bson.D{{Key: "_id", Value: jobID}, {Key: "status", Value: JobRunning}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "instanceId", Value: instanceID},
+		{Key: "updatedAt", Value: updatedAt},
+	}}}
+	_, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		logger("%s UpdateOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindJobsByStatus(status JobStatus) []Job {
+	const funcName = "FindJobsByStatus"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	cursor, err := collection.Find(ctx, bson.D{{Key: "status", Value: status}})
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	jobs := []Job{}
+	err = cursor.All(ctx, &jobs)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return jobs
+}
+
+func (mongoStore) FindJob(jobID string) *Job {
+	const funcName = "FindJob"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	var job Job
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: jobID}}).Decode(&job)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &job
+}
+
+func (mongoStore) FindLatestJob(userID string) *Job {
+	const funcName = "FindLatestJob"
+	collection := client.Database(conf.MongoDBName).Collection(jobsCollection)
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	var job Job
+	err := collection.FindOne(ctx, bson.D{{Key: "userId", Value: userID}}, opts).Decode(&job)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &job
+}
+
+func (mongoStore) InsertJobTrack(track JobTrack) {
+	const funcName = "InsertJobTrack"
+	collection := client.Database(conf.MongoDBName).Collection(jobTracksCollection)
+	_, err := collection.InsertOne(ctx, track)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) ReplaceJobTrack(track JobTrack) {
+	const funcName = "ReplaceJobTrack"
+	collection := client.Database(conf.MongoDBName).Collection(jobTracksCollection)
+	filter := bson.D{{Key: "jobId", Value: track.JobID}, {Key: "index", Value: track.Index}}
+	_, err := collection.ReplaceOne(ctx, filter, track)
+	if err != nil {
+		logger("%s ReplaceOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindJobTracks(jobID string) []JobTrack {
+	const funcName = "FindJobTracks"
+	collection := client.Database(conf.MongoDBName).Collection(jobTracksCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "index", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{{Key: "jobId", Value: jobID}}, opts)
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	tracks := []JobTrack{}
+	err = cursor.All(ctx, &tracks)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return tracks
+}
+
+func (mongoStore) InsertExport(export Export) {
+	const funcName = "InsertExport"
+	collection := client.Database(conf.MongoDBName).Collection(exportsCollection)
+	_, err := collection.InsertOne(ctx, export)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindExport(jobID string) *Export {
+	const funcName = "FindExport"
+	collection := client.Database(conf.MongoDBName).Collection(exportsCollection)
+	var export Export
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: jobID}}).Decode(&export)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &export
+}
+
+func (mongoStore) InsertCoverImage(cover CoverImage) {
+	const funcName = "InsertCoverImage"
+	collection := client.Database(conf.MongoDBName).Collection(coversCollection)
+	_, err := collection.InsertOne(ctx, cover)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindCoverImage(jobID string) *CoverImage {
+	const funcName = "FindCoverImage"
+	collection := client.Database(conf.MongoDBName).Collection(coversCollection)
+	var cover CoverImage
+	err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: jobID}}).Decode(&cover)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &cover
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const matchCacheCollection = "matchCache"
+
+// matchCacheIndexOnce creates the TTL index of the match cache once per process
+var matchCacheIndexOnce sync.Once
+
+// ensureMatchCacheIndex makes mongo remove cached matches once they expire
+func ensureMatchCacheIndex(collection *mongo.Collection) {
+	const funcName = "ensureMatchCacheIndex"
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		logger("%s CreateOne: %v", funcName, err)
+	}
+}
+
+// FindCachedMatch finds the cached match of key unless it has expired
+func FindCachedMatch(key string) *CachedMatch {
+	return store.FindCachedMatch(key, time.Now())
+}
+
+// SaveCachedMatch adds/replaces the cached match of match.Key
+func SaveCachedMatch(match CachedMatch) {
+	store.SaveCachedMatch(match)
+}
+
+func (mongoStore) FindCachedMatch(key string, now time.Time) *CachedMatch {
+	const funcName = "FindCachedMatch"
+	collection := client.Database(conf.MongoDBName).Collection(matchCacheCollection)
+	// the TTL monitor removes expired documents only once a minute
+	filter := bson.D{
+		{Key: "_id", Value: key},
+		{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: now}}},
+	}
+	var match CachedMatch
+	err := collection.FindOne(ctx, filter).Decode(&match)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			logger("%s FindOne: %v", funcName, err)
+		}
+		return nil
+	}
+	return &match
+}
+
+func (mongoStore) SaveCachedMatch(match CachedMatch) {
+	const funcName = "SaveCachedMatch"
+	collection := client.Database(conf.MongoDBName).Collection(matchCacheCollection)
+	matchCacheIndexOnce.Do(func() {
+		ensureMatchCacheIndex(collection)
+	})
+	opts := options.Replace().SetUpsert(true)
+	_, err := collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: match.Key}}, match, opts)
+	if err != nil {
+		logger("%s ReplaceOne: %v", funcName, err)
+	}
+}
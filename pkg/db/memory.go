@@ -0,0 +1,444 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryStore keeps the documents in memory, it's meant for tests which run without
+// MongoDB. Documents are copied through BSON on the way in and out like they're
+// in a MongoDB round trip, so callers never share them and omitempty fields are
+// dropped the same way.
+type MemoryStore struct {
+	users      []SpotifyUser
+	jobs       []Job
+	jobTracks  []JobTrack
+	batches    []Batch
+	exports    []Export
+	covers     []CoverImage
+	links      []AccountLink
+	matches    map[string]CachedMatch
+	webhooks   []Webhook
+	deliveries []WebhookDelivery
+	mutex      sync.Mutex
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{matches: make(map[string]CachedMatch)}
+}
+
+// copyDocument copies src to dst through BSON
+func copyDocument(src interface{}, dst interface{}) {
+	const funcName = "copyDocument"
+	raw, err := bson.Marshal(src)
+	if err == nil {
+		err = bson.Unmarshal(raw, dst)
+	}
+	if err != nil {
+		logger("%s: %v", funcName, err)
+	}
+}
+
+func (memory *MemoryStore) UpsertSpotifyUser(user SpotifyUser) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.users {
+		if memory.users[i].UserID != user.UserID {
+			continue
+		}
+		// $set keeps the fields the update omits
+		existing, update := bson.M{}, bson.M{}
+		copyDocument(memory.users[i], &existing)
+		copyDocument(user, &update)
+		for key, value := range update {
+			existing[key] = value
+		}
+		var merged SpotifyUser
+		copyDocument(existing, &merged)
+		memory.users[i] = merged
+		return
+	}
+	var inserted SpotifyUser
+	copyDocument(user, &inserted)
+	memory.users = append(memory.users, inserted)
+}
+
+func (memory *MemoryStore) SetUserCountry(userID string, country string) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.users {
+		if memory.users[i].UserID == userID {
+			memory.users[i].Country = country
+		}
+	}
+}
+
+func (memory *MemoryStore) FindSpotifyUser(userID string) *SpotifyUser {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, user := range memory.users {
+		if user.UserID == userID {
+			var found SpotifyUser
+			copyDocument(user, &found)
+			return &found
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) InsertJob(job Job) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, existing := range memory.jobs {
+		if existing.ID == job.ID {
+			logger("InsertJob: duplicate job id: %s", job.ID)
+			return false
+		}
+	}
+	var inserted Job
+	copyDocument(job, &inserted)
+	memory.jobs = append(memory.jobs, inserted)
+	return true
+}
+
+func (memory *MemoryStore) ReplaceJob(job Job) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.jobs {
+		if memory.jobs[i].ID == job.ID {
+			var replaced Job
+			copyDocument(job, &replaced)
+			memory.jobs[i] = replaced
+			return
+		}
+	}
+}
+
+func (memory *MemoryStore) ReplaceJobIfStatus(job Job, status JobStatus) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.jobs {
+		if memory.jobs[i].ID == job.ID {
+			if memory.jobs[i].Status != status {
+				return false
+			}
+			var replaced Job
+			copyDocument(job, &replaced)
+			memory.jobs[i] = replaced
+			return true
+		}
+	}
+	return false
+}
+
+func (memory *MemoryStore) TouchJob(jobID string, instanceID string, updatedAt time.Time) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.jobs {
+		if memory.jobs[i].ID == jobID && memory.jobs[i].Status == JobRunning {
+			memory.jobs[i].InstanceID = instanceID
+			memory.jobs[i].UpdatedAt = updatedAt
+			return
+		}
+	}
+}
+
+func (memory *MemoryStore) FindJobsByStatus(status JobStatus) []Job {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	jobs := []Job{}
+	for _, job := range memory.jobs {
+		if job.Status == status {
+			var found Job
+			copyDocument(job, &found)
+			jobs = append(jobs, found)
+		}
+	}
+	return jobs
+}
+
+func (memory *MemoryStore) FindJob(jobID string) *Job {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, job := range memory.jobs {
+		if job.ID == jobID {
+			var found Job
+			copyDocument(job, &found)
+			return &found
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) FindLatestJob(userID string) *Job {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var latest *Job
+	for i, job := range memory.jobs {
+		if job.UserID == userID && (latest == nil || !job.CreatedAt.Before(latest.CreatedAt)) {
+			latest = &memory.jobs[i]
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	var found Job
+	copyDocument(*latest, &found)
+	return &found
+}
+
+func (memory *MemoryStore) InsertJobTrack(track JobTrack) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted JobTrack
+	copyDocument(track, &inserted)
+	memory.jobTracks = append(memory.jobTracks, inserted)
+}
+
+func (memory *MemoryStore) ReplaceJobTrack(track JobTrack) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i := range memory.jobTracks {
+		if memory.jobTracks[i].JobID == track.JobID && memory.jobTracks[i].Index == track.Index {
+			var replaced JobTrack
+			copyDocument(track, &replaced)
+			memory.jobTracks[i] = replaced
+			return
+		}
+	}
+}
+
+func (memory *MemoryStore) FindJobTracks(jobID string) []JobTrack {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	tracks := []JobTrack{}
+	for _, track := range memory.jobTracks {
+		if track.JobID == jobID {
+			var found JobTrack
+			copyDocument(track, &found)
+			tracks = append(tracks, found)
+		}
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].Index < tracks[j].Index
+	})
+	return tracks
+}
+
+func (memory *MemoryStore) InsertBatch(batch Batch) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted Batch
+	copyDocument(batch, &inserted)
+	memory.batches = append(memory.batches, inserted)
+	return true
+}
+
+func (memory *MemoryStore) FindBatch(batchID string) *Batch {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, batch := range memory.batches {
+		if batch.ID == batchID {
+			var found Batch
+			copyDocument(batch, &found)
+			return &found
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) FindBatchJobs(batchID string) []Job {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	jobs := []Job{}
+	for _, job := range memory.jobs {
+		if job.BatchID == batchID {
+			var found Job
+			copyDocument(job, &found)
+			jobs = append(jobs, found)
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+func (memory *MemoryStore) InsertExport(export Export) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted Export
+	copyDocument(export, &inserted)
+	memory.exports = append(memory.exports, inserted)
+}
+
+func (memory *MemoryStore) FindExport(jobID string) *Export {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, export := range memory.exports {
+		if export.JobID == jobID {
+			var found Export
+			copyDocument(export, &found)
+			return &found
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) InsertCoverImage(cover CoverImage) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted CoverImage
+	copyDocument(cover, &inserted)
+	memory.covers = append(memory.covers, inserted)
+}
+
+func (memory *MemoryStore) FindCoverImage(jobID string) *CoverImage {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for _, cover := range memory.covers {
+		if cover.JobID == jobID {
+			var found CoverImage
+			copyDocument(cover, &found)
+			return &found
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) InsertAccountLink(link AccountLink) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	if memory.findAccountLink(link.UserID, link.LinkedUserID) != nil {
+		return true
+	}
+	var inserted AccountLink
+	copyDocument(link, &inserted)
+	memory.links = append(memory.links, inserted)
+	return true
+}
+
+func (memory *MemoryStore) ConfirmAccountLink(userID string, linkedUserID string) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	link := memory.findAccountLink(userID, linkedUserID)
+	if link == nil {
+		return false
+	}
+	link.Confirmed = true
+	return true
+}
+
+func (memory *MemoryStore) IsLinkedAccount(userID string, linkedUserID string) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	link := memory.findAccountLink(userID, linkedUserID)
+	return link != nil && link.Confirmed
+}
+
+// findAccountLink returns the link of the accounts, the mutex must be held
+func (memory *MemoryStore) findAccountLink(userID string, linkedUserID string) *AccountLink {
+	for i := range memory.links {
+		if memory.links[i].UserID == userID && memory.links[i].LinkedUserID == linkedUserID {
+			return &memory.links[i]
+		}
+	}
+	return nil
+}
+
+func (memory *MemoryStore) FindAccountLinks(userID string) []AccountLink {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	links := []AccountLink{}
+	for _, link := range memory.links {
+		if link.UserID == userID || link.LinkedUserID == userID {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func (memory *MemoryStore) FindCachedMatch(key string, now time.Time) *CachedMatch {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	match, found := memory.matches[key]
+	if !found || !match.ExpiresAt.After(now) {
+		return nil
+	}
+	var cached CachedMatch
+	copyDocument(match, &cached)
+	return &cached
+}
+
+func (memory *MemoryStore) SaveCachedMatch(match CachedMatch) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var saved CachedMatch
+	copyDocument(match, &saved)
+	memory.matches[match.Key] = saved
+}
+
+func (memory *MemoryStore) InsertWebhook(webhook Webhook) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted Webhook
+	copyDocument(webhook, &inserted)
+	memory.webhooks = append(memory.webhooks, inserted)
+	return true
+}
+
+func (memory *MemoryStore) FindWebhooks(userID string) []Webhook {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	webhooks := []Webhook{}
+	for _, webhook := range memory.webhooks {
+		if webhook.UserID == userID {
+			var found Webhook
+			copyDocument(webhook, &found)
+			webhooks = append(webhooks, found)
+		}
+	}
+	return webhooks
+}
+
+func (memory *MemoryStore) DeleteWebhook(userID string, webhookID string) bool {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for i, webhook := range memory.webhooks {
+		if webhook.ID == webhookID && webhook.UserID == userID {
+			memory.webhooks = append(memory.webhooks[:i], memory.webhooks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (memory *MemoryStore) InsertWebhookDelivery(delivery WebhookDelivery) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	var inserted WebhookDelivery
+	copyDocument(delivery, &inserted)
+	memory.deliveries = append(memory.deliveries, inserted)
+}
+
+func (memory *MemoryStore) FindWebhookDeliveries(webhookID string, limit int) []WebhookDelivery {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	deliveries := []WebhookDelivery{}
+	for i := len(memory.deliveries) - 1; i >= 0; i-- {
+		if memory.deliveries[i].WebhookID == webhookID {
+			deliveries = append(deliveries, memory.deliveries[i])
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
@@ -4,8 +4,293 @@ import "time"
 
 // SpotifyUser contains spotify user data
 type SpotifyUser struct {
-	RefreshToken string    `json:"refreshToken" bson:"refreshToken"`
-	AccessToken  string    `json:"accessToken" bson:"accessToken"`
+	RefreshToken string `json:"refreshToken" bson:"refreshToken"`
+	AccessToken  string `json:"accessToken" bson:"accessToken"`
+	UserID       string `json:"userId" bson:"userId"`
+	Country      string `json:"country,omitempty" bson:"country,omitempty"`
+	// Preferences are the match preferences of the user's jobs
+	Preferences *MatchPreferences `json:"preferences,omitempty" bson:"preferences,omitempty"`
+	UpdatedAt   time.Time         `bson:"updatedAt"`
+}
+
+// MatchPreferences are the rules a match is picked by among the search candidates
+// of a track, see client.Preferences. Explicit is "explicit", "clean" or empty,
+// Exclude and Prefer are client.Versions.
+type MatchPreferences struct {
+	Explicit      string   `json:"explicit,omitempty" bson:"explicit,omitempty"`
+	Exclude       []string `json:"exclude,omitempty" bson:"exclude,omitempty"`
+	Prefer        []string `json:"prefer,omitempty" bson:"prefer,omitempty"`
+	OriginalAlbum bool     `json:"originalAlbum,omitempty" bson:"originalAlbum,omitempty"`
+}
+
+// JobStatus is the state of a playlist copy job
+type JobStatus string
+
+const (
+	// JobRunning - tracks are being looked up
+	JobRunning JobStatus = "running"
+	// JobFinished - the playlist was created
+	JobFinished JobStatus = "finished"
+	// JobFailed - the job stopped before the playlist was created
+	JobFailed JobStatus = "failed"
+	// JobCancelled - the user cancelled the job
+	JobCancelled JobStatus = "cancelled"
+	// JobPreviewed - the tracks of a preview job were looked up, nothing was written
+	// to the user's library until the job is committed
+	JobPreviewed JobStatus = "previewed"
+)
+
+// JobType is the kind of work a job does
+type JobType string
+
+const (
+	// JobTypeImport - creates/updates a playlist from a CSV file
+	JobTypeImport JobType = "import"
+	// JobTypeExport - writes a playlist to a file
+	JobTypeExport JobType = "export"
+	// JobTypeMigration - copies the playlists and Liked Songs of the user to a linked account
+	JobTypeMigration JobType = "migration"
+)
+
+// Job is the current state of a playlist copy job.
+// Seq is the sequence number of the last event published for the job,
+// clients use it to detect missed events.
+type Job struct {
+	ID       string  `json:"id" bson:"_id"`
+	UserID   string  `json:"userId" bson:"userId"`
+	Type     JobType `json:"type" bson:"type"`
+	FileName string  `json:"fileName" bson:"fileName"`
+	// CSVHeader is the header row of the uploaded file, unmatched tracks reports keep its layout
+	CSVHeader []string `json:"-" bson:"csvHeader,omitempty"`
+	// BatchID is the batch of the job if its file is an entry of an uploaded archive
+	BatchID string `json:"batchId,omitempty" bson:"batchId,omitempty"`
+	// RetryOf is the job whose unmatched tracks this job retries, rows matched by it
+	// (or by the jobs it retried) aren't looked up again
+	RetryOf string `json:"retryOf,omitempty" bson:"retryOf,omitempty"`
+	// Destination is where the found tracks are added, see client.Destinations
+	Destination string `json:"destination,omitempty" bson:"destination,omitempty"`
+	// ImportMode is how tracks are added to the playlist, see client.ImportModes
+	ImportMode string `json:"importMode" bson:"importMode"`
+	// PlaylistOptions are the properties of the playlist created by the job
+	PlaylistOptions *PlaylistOptions `json:"playlistOptions,omitempty" bson:"playlistOptions,omitempty"`
+	// PlaylistID is the target playlist, it's set once the playlist is created/found
+	// or by the payload of preview jobs
+	PlaylistID string `json:"playlistId,omitempty" bson:"playlistId,omitempty"`
+	// Preview - the job stops in JobPreviewed status after the lookups,
+	// the approved tracks are written once the job is committed
+	Preview bool `json:"preview,omitempty" bson:"preview,omitempty"`
+	// Review - ambiguous and low confidence matches wait for the user to pick a candidate
+	Review bool `json:"review,omitempty" bson:"review,omitempty"`
+	// AwaitingReview - the lookups are done and the job waits for the review of TracksInReview tracks
+	AwaitingReview bool `json:"awaitingReview,omitempty" bson:"awaitingReview,omitempty"`
+	// Market overrides the country of the user as the search market
+	Market string `json:"market,omitempty" bson:"market,omitempty"`
+	// Markets are the search markets in order, the fallback markets follow the first one
+	Markets []string `json:"markets,omitempty" bson:"markets,omitempty"`
+	// Duplicates is one of client.DuplicatesModes
+	Duplicates string `json:"duplicates,omitempty" bson:"duplicates,omitempty"`
+	// DuplicatesSkipped counts the rows and matches which weren't written by client.Duplicate* reason
+	DuplicatesSkipped map[string]int `json:"duplicatesSkipped,omitempty" bson:"duplicatesSkipped,omitempty"`
+	// Preferences of the job or of the user pick the matches
+	Preferences *MatchPreferences `json:"preferences,omitempty" bson:"preferences,omitempty"`
+	// DryRun - sync jobs only compute SyncDiff without changing the playlist
+	DryRun bool `json:"dryRun,omitempty" bson:"dryRun,omitempty"`
+	// SyncDiff is set once a sync job has computed it
+	SyncDiff *SyncDiff `json:"syncDiff,omitempty" bson:"syncDiff,omitempty"`
+	// Migration is the state of migration jobs
+	Migration *Migration `json:"migration,omitempty" bson:"migration,omitempty"`
+	// ExportFormat is the file format of export jobs
+	ExportFormat   string    `json:"exportFormat,omitempty" bson:"exportFormat,omitempty"`
+	Status         JobStatus `json:"status" bson:"status"`
+	TracksAdded    int       `json:"tracksAdded" bson:"tracksAdded"`
+	TracksNotAdded int       `json:"tracksNotAdded" bson:"tracksNotAdded"`
+	TracksInReview int       `json:"tracksInReview,omitempty" bson:"tracksInReview,omitempty"`
+	// TracksSkipped rows of retry jobs were already matched by a previous job
+	// (duplicates aren't counted)
+	TracksSkipped int `json:"tracksSkipped,omitempty" bson:"tracksSkipped,omitempty"`
+	Seq           int `json:"seq" bson:"seq"`
+	// FailureCause is the apierror code of JobFailed status
+	FailureCause   string `json:"failureCause,omitempty" bson:"failureCause,omitempty"`
+	FailureMessage string `json:"failureMessage,omitempty" bson:"failureMessage,omitempty"`
+	// InstanceID is the server instance which runs the job, see runner.StartHeartbeat
+	InstanceID string    `json:"-" bson:"instanceId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	// UpdatedAt is refreshed by the instance which runs the job while it's running
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// PlaylistOptions are the properties of a playlist created by a job.
+// NameTemplate and Description may have placeholders, see runner.CSVPayload.
+type PlaylistOptions struct {
+	NameTemplate  string `json:"nameTemplate,omitempty" bson:"nameTemplate,omitempty"`
+	Description   string `json:"description,omitempty" bson:"description,omitempty"`
+	Public        bool   `json:"public" bson:"public"`
+	Collaborative bool   `json:"collaborative" bson:"collaborative"`
+	// HasCoverImage is set if the job has a CoverImage, it's kept apart from the job
+	HasCoverImage bool `json:"-" bson:"hasCoverImage,omitempty"`
+}
+
+// SyncDiff is what a sync job changed (or would change in dry run) in the playlist
+type SyncDiff struct {
+	Added   []string       `json:"added" bson:"added"`
+	Removed []string       `json:"removed" bson:"removed"`
+	Moved   []PlaylistMove `json:"moved" bson:"moved"`
+	DryRun  bool           `json:"dryRun" bson:"dryRun"`
+}
+
+// PlaylistMove moves a track of the playlist from one position to another
+type PlaylistMove struct {
+	URI  string `json:"uri" bson:"uri"`
+	From int    `json:"from" bson:"from"`
+	To   int    `json:"to" bson:"to"`
+}
+
+// Batch groups the jobs of the playlist files of an uploaded archive,
+// every job refers to its batch by BatchID
+type Batch struct {
+	ID     string `json:"id" bson:"_id"`
+	UserID string `json:"userId" bson:"userId"`
+	// FileName is the name of the archive
+	FileName  string    `json:"fileName" bson:"fileName"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Migration is the progress of copying the playlists of a user to a linked account
+type Migration struct {
+	TargetUserID string              `json:"targetUserId" bson:"targetUserId"`
+	Playlists    []MigrationPlaylist `json:"playlists" bson:"playlists"`
+}
+
+// MigrationStatus is the state of a single migrated playlist
+type MigrationStatus string
+
+const (
+	// MigrationPending - the playlist wasn't copied yet
+	MigrationPending MigrationStatus = "pending"
+	// MigrationCopying - some of the tracks were copied
+	MigrationCopying MigrationStatus = "copying"
+	// MigrationCopied - all the tracks were copied
+	MigrationCopied MigrationStatus = "copied"
+)
+
+// MigrationPlaylist is a source playlist (or Liked Songs) and its copy in the target account.
+// TracksCopied tracks were added to TargetID so a resumed migration continues from there.
+type MigrationPlaylist struct {
+	SourceID     string          `json:"sourceId,omitempty" bson:"sourceId,omitempty"`
+	LikedSongs   bool            `json:"likedSongs,omitempty" bson:"likedSongs,omitempty"`
+	Name         string          `json:"name" bson:"name"`
+	Description  string          `json:"description,omitempty" bson:"description,omitempty"`
+	Public       bool            `json:"public" bson:"public"`
+	TargetID     string          `json:"targetId,omitempty" bson:"targetId,omitempty"`
+	TracksTotal  int             `json:"tracksTotal" bson:"tracksTotal"`
+	TracksCopied int             `json:"tracksCopied" bson:"tracksCopied"`
+	Status       MigrationStatus `json:"status" bson:"status"`
+}
+
+// AccountLink allows migrating the accounts of UserID to LinkedUserID
+// once LinkedUserID confirmed it
+type AccountLink struct {
 	UserID       string    `json:"userId" bson:"userId"`
-	UpdatedAt    time.Time `bson:"updatedAt"`
+	LinkedUserID string    `json:"linkedUserId" bson:"linkedUserId"`
+	Confirmed    bool      `json:"confirmed" bson:"confirmed"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Export is the file produced by an export job
+type Export struct {
+	JobID       string `bson:"_id"`
+	FileName    string `bson:"fileName"`
+	ContentType string `bson:"contentType"`
+	Content     []byte `bson:"content"`
+}
+
+// CoverImage is the base64 encoded JPEG cover of the playlist created by a job,
+// it's saved apart from the job so that job updates don't rewrite it
+type CoverImage struct {
+	JobID string `bson:"_id"`
+	Image string `bson:"image"`
+}
+
+// JobTrack is the lookup outcome of a single input track of a job
+type JobTrack struct {
+	JobID       string  `json:"-" bson:"jobId"`
+	Seq         int     `json:"seq" bson:"seq"`
+	Index       int     `json:"index" bson:"index"`
+	Artist      string  `json:"artist" bson:"artist"`
+	Title       string  `json:"title" bson:"title"`
+	IsFound     bool    `json:"isFound" bson:"isFound"`
+	Outcome     string  `json:"outcome" bson:"outcome"`
+	TrackID     string  `json:"trackId,omitempty" bson:"trackId,omitempty"`
+	TrackName   string  `json:"trackName,omitempty" bson:"trackName,omitempty"`
+	TrackArtist string  `json:"trackArtist,omitempty" bson:"trackArtist,omitempty"`
+	URI         string  `json:"uri,omitempty" bson:"uri,omitempty"`
+	ISRC        string  `json:"isrc,omitempty" bson:"isrc,omitempty"`
+	Confidence  float64 `json:"confidence,omitempty" bson:"confidence,omitempty"`
+	Strategy    string  `json:"strategy,omitempty" bson:"strategy,omitempty"`
+	Reason      string  `json:"reason,omitempty" bson:"reason,omitempty"`
+	Market      string  `json:"market,omitempty" bson:"market,omitempty"`
+	// Record is the uploaded CSV row of the track
+	Record []string `json:"-" bson:"record,omitempty"`
+	// Queries are the search queries which were made for the track
+	Queries []string `json:"queries,omitempty" bson:"queries,omitempty"`
+	// Candidates are the matches the user picks from when Outcome is "review"
+	Candidates []Candidate `json:"candidates,omitempty" bson:"candidates,omitempty"`
+}
+
+// Candidate is a possible match of a track which needs review
+type Candidate struct {
+	TrackID    string   `json:"trackId" bson:"trackId"`
+	URI        string   `json:"uri" bson:"uri"`
+	Name       string   `json:"name" bson:"name"`
+	Artist     string   `json:"artist" bson:"artist"`
+	Album      string   `json:"album,omitempty" bson:"album,omitempty"`
+	AlbumID    string   `json:"-" bson:"albumId,omitempty"`
+	ArtistIDs  []string `json:"-" bson:"artistIds,omitempty"`
+	ImageURL   string   `json:"imageUrl,omitempty" bson:"imageUrl,omitempty"`
+	PreviewURL string   `json:"previewUrl,omitempty" bson:"previewUrl,omitempty"`
+	Confidence float64  `json:"confidence" bson:"confidence"`
+}
+
+// CachedMatch is the lookup outcome of a normalised input track in a market which is
+// shared by all users, IsFound is false for negative entries which expire sooner
+type CachedMatch struct {
+	Key         string    `bson:"_id"`
+	IsFound     bool      `bson:"isFound"`
+	URI         string    `bson:"uri,omitempty"`
+	ISRC        string    `bson:"isrc,omitempty"`
+	TrackID     string    `bson:"trackId,omitempty"`
+	TrackName   string    `bson:"trackName,omitempty"`
+	TrackArtist string    `bson:"trackArtist,omitempty"`
+	AlbumID     string    `bson:"albumId,omitempty"`
+	ArtistIDs   []string  `bson:"artistIds,omitempty"`
+	Confidence  float64   `bson:"confidence,omitempty"`
+	Ambiguous   bool      `bson:"ambiguous,omitempty"`
+	Strategy    string    `bson:"strategy,omitempty"`
+	Reason      string    `bson:"reason,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+// Webhook is a URL notified about job events of the user.
+// Payloads are signed with Secret (HMAC-SHA256).
+type Webhook struct {
+	ID        string    `json:"id" bson:"_id"`
+	UserID    string    `json:"userId" bson:"userId"`
+	URL       string    `json:"url" bson:"url"`
+	Secret    string    `json:"secret,omitempty" bson:"secret"`
+	Events    []string  `json:"events" bson:"events"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// WebhookDelivery is a single attempt to deliver a job event to a webhook
+type WebhookDelivery struct {
+	ID         string    `json:"id" bson:"_id"`
+	WebhookID  string    `json:"webhookId" bson:"webhookId"`
+	JobID      string    `json:"jobId" bson:"jobId"`
+	Event      string    `json:"event" bson:"event"`
+	Attempt    int       `json:"attempt" bson:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	Success    bool      `json:"success" bson:"success"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
 }
@@ -20,6 +20,9 @@ var (
 	logger               = utils.NewLogger("mongoClient")
 )
 
+// mongoStore keeps the documents in the collections of conf.MongoDBName
+type mongoStore struct{}
+
 func initMongoConnection() {
 	clientOptions := options.Client().ApplyURI(conf.MongoConnectionString)
 	var err error
@@ -33,31 +36,56 @@ func initMongoConnection() {
 	}
 }
 
-func init() {
+// MongoStore connects to MONGO_CONNECTION_STRING and returns its store
+func MongoStore() Store {
 	initMongoConnection()
+	return mongoStore{}
 }
 
 // InsertSpotifyUser adds/updates spotify user data
 func InsertSpotifyUser(user SpotifyUser) {
-	const funcName = "InsertSpotifyUser"
+	user.UpdatedAt = time.Now()
+	store.UpsertSpotifyUser(user)
+}
+
+// SetUserCountry saves the country of the user's account
+func SetUserCountry(userID string, country string) {
+	store.SetUserCountry(userID, country)
+}
+
+// FindSpotifyUser finds spotify user
+func FindSpotifyUser(userID string) *SpotifyUser {
+	return store.FindSpotifyUser(userID)
+}
+
+func (mongoStore) UpsertSpotifyUser(user SpotifyUser) {
+	const funcName = "UpsertSpotifyUser"
 	opts := options.Update().SetUpsert(true)
 	collection := client.Database(conf.MongoDBName).Collection("test")
 
-	user.UpdatedAt = time.Now()
-	_, err := collection.UpdateOne(ctx, bson.D{{"userId", user.UserID}},
-		bson.D{{"$set", user}}, opts)
+	_, err := collection.UpdateOne(ctx, bson.D{{Key: "userId", Value: user.UserID}},
+		bson.D{{Key: "$set", Value: user}}, opts)
 
 	if err != nil {
 		logger("%s UpdateOne: %v", funcName, err)
 	}
 }
 
-// FindSpotifyUser finds spotify user
-func FindSpotifyUser(userID string) *SpotifyUser {
+func (mongoStore) SetUserCountry(userID string, country string) {
+	const funcName = "SetUserCountry"
+	collection := client.Database(conf.MongoDBName).Collection("test")
+	_, err := collection.UpdateOne(ctx, bson.D{{Key: "userId", Value: userID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "country", Value: country}}}})
+	if err != nil {
+		logger("%s UpdateOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindSpotifyUser(userID string) *SpotifyUser {
 	const funcName = "FindSpotifyUser"
 	collection := client.Database(conf.MongoDBName).Collection("test")
 	var user SpotifyUser
-	err := collection.FindOne(ctx, bson.D{{"userId", userID}}).Decode(&user)
+	err := collection.FindOne(ctx, bson.D{{Key: "userId", Value: userID}}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil
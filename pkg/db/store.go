@@ -0,0 +1,70 @@
+package db
+
+import "time"
+
+// Store keeps the documents of the db package, MongoStore() in production and
+// NewMemoryStore() in tests. The package functions set ids and timestamps so
+// stores only save and query documents.
+type Store interface {
+	UpsertSpotifyUser(user SpotifyUser)
+	SetUserCountry(userID string, country string)
+	FindSpotifyUser(userID string) *SpotifyUser
+
+	InsertJob(job Job) bool
+	ReplaceJob(job Job)
+	// ReplaceJobIfStatus replaces the job only if the stored job is in status
+	ReplaceJobIfStatus(job Job, status JobStatus) bool
+	FindJob(jobID string) *Job
+	// TouchJob sets instanceID and updatedAt of the job if it's running
+	TouchJob(jobID string, instanceID string, updatedAt time.Time)
+	// FindJobsByStatus returns the jobs in status
+	FindJobsByStatus(status JobStatus) []Job
+	// FindLatestJob finds the most recently created job of the user
+	FindLatestJob(userID string) *Job
+	InsertJobTrack(track JobTrack)
+	// ReplaceJobTrack replaces the track with the same job id and index
+	ReplaceJobTrack(track JobTrack)
+	// FindJobTracks returns the tracks of the job ordered by index
+	FindJobTracks(jobID string) []JobTrack
+	InsertBatch(batch Batch) bool
+	FindBatch(batchID string) *Batch
+	// FindBatchJobs returns the jobs of the batch in creation order
+	FindBatchJobs(batchID string) []Job
+	InsertExport(export Export)
+	FindExport(jobID string) *Export
+	InsertCoverImage(cover CoverImage)
+	FindCoverImage(jobID string) *CoverImage
+
+	// InsertAccountLink adds the link unless the accounts are already linked
+	InsertAccountLink(link AccountLink) bool
+	// ConfirmAccountLink confirms the link of the accounts, it returns false if there's none
+	ConfirmAccountLink(userID string, linkedUserID string) bool
+	// IsLinkedAccount reports whether the accounts have a confirmed link
+	IsLinkedAccount(userID string, linkedUserID string) bool
+	// FindAccountLinks returns the links of userID on either side
+	FindAccountLinks(userID string) []AccountLink
+
+	// FindCachedMatch finds the match of key if it expires after now
+	FindCachedMatch(key string, now time.Time) *CachedMatch
+	SaveCachedMatch(match CachedMatch)
+
+	InsertWebhook(webhook Webhook) bool
+	FindWebhooks(userID string) []Webhook
+	DeleteWebhook(userID string, webhookID string) bool
+	InsertWebhookDelivery(delivery WebhookDelivery)
+	// FindWebhookDeliveries returns at most limit deliveries of the webhook, the latest first
+	FindWebhookDeliveries(webhookID string, limit int) []WebhookDelivery
+}
+
+// store is set by Connect or UseStore before the server starts
+var store Store
+
+// Connect connects to MongoDB and makes it the store of the package
+func Connect() {
+	UseStore(MongoStore())
+}
+
+// UseStore makes s the store of the package
+func UseStore(s Store) {
+	store = s
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhooksCollection          = "webhooks"
+	webhookDeliveriesCollection = "webhookDeliveries"
+	// maxWebhookDeliveries limits the returned delivery log
+	maxWebhookDeliveries = 100
+)
+
+// InsertWebhook adds a webhook and returns it with its id set
+func InsertWebhook(webhook Webhook) *Webhook {
+	webhook.ID = primitive.NewObjectID().Hex()
+	webhook.CreatedAt = time.Now()
+	if !store.InsertWebhook(webhook) {
+		return nil
+	}
+	return &webhook
+}
+
+// FindWebhooks returns the webhooks of the user
+func FindWebhooks(userID string) []Webhook {
+	return store.FindWebhooks(userID)
+}
+
+// FindWebhook finds a webhook of the user by id
+func FindWebhook(userID string, webhookID string) *Webhook {
+	for _, webhook := range FindWebhooks(userID) {
+		if webhook.ID == webhookID {
+			return &webhook
+		}
+	}
+	return nil
+}
+
+// DeleteWebhook removes a webhook of the user, returns false if it wasn't found
+func DeleteWebhook(userID string, webhookID string) bool {
+	return store.DeleteWebhook(userID, webhookID)
+}
+
+// InsertWebhookDelivery adds a delivery attempt to the delivery log
+func InsertWebhookDelivery(delivery WebhookDelivery) {
+	if delivery.ID == "" {
+		delivery.ID = primitive.NewObjectID().Hex()
+	}
+	store.InsertWebhookDelivery(delivery)
+}
+
+// FindWebhookDeliveries returns the latest delivery attempts of a webhook
+func FindWebhookDeliveries(webhookID string) []WebhookDelivery {
+	return store.FindWebhookDeliveries(webhookID, maxWebhookDeliveries)
+}
+
+func (mongoStore) InsertWebhook(webhook Webhook) bool {
+	const funcName = "InsertWebhook"
+	collection := client.Database(conf.MongoDBName).Collection(webhooksCollection)
+	_, err := collection.InsertOne(ctx, webhook)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+		return false
+	}
+	return true
+}
+
+func (mongoStore) FindWebhooks(userID string) []Webhook {
+	const funcName = "FindWebhooks"
+	collection := client.Database(conf.MongoDBName).Collection(webhooksCollection)
+	cursor, err := collection.Find(ctx, bson.D{{Key: "userId", Value: userID}})
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	webhooks := []Webhook{}
+	err = cursor.All(ctx, &webhooks)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return webhooks
+}
+
+func (mongoStore) DeleteWebhook(userID string, webhookID string) bool {
+	const funcName = "DeleteWebhook"
+	collection := client.Database(conf.MongoDBName).Collection(webhooksCollection)
+	result, err := collection.DeleteOne(ctx, bson.D{
+		{Key: "_id", Value: webhookID},
+		{Key: "userId", Value: userID},
+	})
+	if err != nil {
+		logger("%s DeleteOne: %v", funcName, err)
+		return false
+	}
+	return result.DeletedCount > 0
+}
+
+func (mongoStore) InsertWebhookDelivery(delivery WebhookDelivery) {
+	const funcName = "InsertWebhookDelivery"
+	collection := client.Database(conf.MongoDBName).Collection(webhookDeliveriesCollection)
+	_, err := collection.InsertOne(ctx, delivery)
+	if err != nil {
+		logger("%s InsertOne: %v", funcName, err)
+	}
+}
+
+func (mongoStore) FindWebhookDeliveries(webhookID string, limit int) []WebhookDelivery {
+	const funcName = "FindWebhookDeliveries"
+	collection := client.Database(conf.MongoDBName).Collection(webhookDeliveriesCollection)
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, bson.D{{Key: "webhookId", Value: webhookID}}, opts)
+	if err != nil {
+		logger("%s Find: %v", funcName, err)
+		return nil
+	}
+	deliveries := []WebhookDelivery{}
+	err = cursor.All(ctx, &deliveries)
+	if err != nil {
+		logger("%s cursor.All: %v", funcName, err)
+		return nil
+	}
+	return deliveries
+}
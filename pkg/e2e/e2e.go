@@ -0,0 +1,267 @@
+/*
+Package e2e runs the whole server in-process for end-to-end tests. The routes of
+the server package are served by httptest with an in-memory db store, an in-memory
+kafkahelper bus and a fake Spotify (clienttest.Server), so a test drives uploads and
+websocket sessions like the web client does without MongoDB, kafka or Spotify:
+
+	harness := e2e.NewHarness(t)
+	harness.Spotify.AddTracks(clienttest.Track{ID: "yesterday", Name: "Yesterday", Artists: []string{"The Beatles"}})
+	userID := harness.AddUser()
+	harness.Spotify.Hold()
+	jobID := harness.Upload(runner.CSVPayload{UserID: &userID, CSVFile: &csvFile, FileName: &fileName})
+	session := harness.Connect(userID)
+	snapshot := session.Next()
+	harness.Spotify.Release()
+	events := session.Events()
+
+Holding the fake Spotify until the session got its snapshot makes the job messages
+the session gets deterministic. The store, the bus and the Spotify API are package
+state of db, kafkahelper and client so harnesses mustn't run in parallel, the jobs
+which are still running when a test ends are cancelled and waited for.
+*/
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/client/clienttest"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/hub"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+	"github.com/yossisp/csv-to-spotify/pkg/server"
+)
+
+const (
+	// MessageUser answers the USER message of a session, see websocket.go
+	MessageUser = "USER"
+	// MessageSnapshot carries the job state a session starts (or resyncs) from
+	MessageSnapshot = "SNAPSHOT"
+	// readTimeout is how long a session waits for a message
+	readTimeout = 10 * time.Second
+	// retryDelay is the wait of the jobs before failed Spotify requests are retried
+	retryDelay = 10 * time.Millisecond
+)
+
+// bus is shared by the harnesses since the hub consumes the bus it was started with
+var bus = kafkahelper.NewMemoryBus()
+
+// Harness is a server with an in-memory store and bus which talks to a fake Spotify
+type Harness struct {
+	// Spotify is the fake Spotify of the jobs
+	Spotify *clienttest.Server
+	// Store is the db store of the server
+	Store  *db.MemoryStore
+	server *httptest.Server
+	t      testing.TB
+}
+
+// Event is a websocket message as the client gets it
+type Event struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	JobID   string          `json:"jobId,omitempty"`
+	Seq     int             `json:"seq,omitempty"`
+}
+
+// Session is a websocket connection of a user
+type Session struct {
+	conn *websocket.Conn
+	t    testing.TB
+}
+
+// NewHarness starts a server with an empty store and an empty fake Spotify,
+// they're closed when the test (or benchmark) ends
+func NewHarness(t testing.TB) *Harness {
+	spotify := clienttest.NewServer()
+	store := db.NewMemoryStore()
+	db.UseStore(store)
+	kafkahelper.UseBus(bus)
+	client.UseAPI(client.NewSpotifyAPI(spotify.APIURL(), spotify.AccountsURL()))
+	client.UseRetryDelay(retryDelay)
+	// files of any size are looked up at once
+	client.UseLookupInterval(0)
+	hub.Start()
+	harness := &Harness{
+		Spotify: spotify,
+		Store:   store,
+		server:  httptest.NewServer(server.NewHandler()),
+		t:       t,
+	}
+	t.Cleanup(func() {
+		harness.Spotify.Release()
+		harness.server.Close()
+		// the next harness replaces the store and the API the jobs use
+		runner.Shutdown()
+		harness.Spotify.Close()
+	})
+	return harness
+}
+
+// URL returns the URL of route e.g. URL("/csv")
+func (harness *Harness) URL(route string) string {
+	return harness.server.URL + route
+}
+
+// Post sends body as JSON to route and returns the response status and body
+func (harness *Harness) Post(route string, body interface{}) (int, []byte) {
+	harness.t.Helper()
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		harness.t.Fatalf("Post: json.Marshal: %v", err)
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	return harness.Request(http.MethodPost, route, header, bytes.NewReader(bodyJSON))
+}
+
+// Request sends a request with header and body (which may be nil) to route
+// and returns the response status and body
+func (harness *Harness) Request(method string, route string, header http.Header, body io.Reader) (int, []byte) {
+	harness.t.Helper()
+	req, err := http.NewRequest(method, harness.URL(route), body)
+	if err != nil {
+		harness.t.Fatalf("Request: http.NewRequest: %v", err)
+	}
+	if header != nil {
+		req.Header = header
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		harness.t.Fatalf("Request %s %s: %v", method, route, err)
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		harness.t.Fatalf("Request %s %s: ioutil.ReadAll: %v", method, route, err)
+	}
+	return response.StatusCode, responseBody
+}
+
+// AuthHeader returns the headers of a JSON request made by the user, it carries
+// an access token of the fake Spotify like the web client once the user logs in
+func (harness *Harness) AuthHeader(userID string) http.Header {
+	return http.Header{
+		"Content-Type":  {"application/json"},
+		"Authorization": {"Bearer " + harness.Spotify.IssueToken(userID)},
+	}
+}
+
+// AddUser registers the user of the fake Spotify like the web client does
+// after the user logs in and returns the user id
+func (harness *Harness) AddUser() string {
+	harness.t.Helper()
+	user := db.SpotifyUser{
+		UserID:       harness.Spotify.UserID,
+		RefreshToken: harness.Spotify.RefreshToken,
+	}
+	if status, body := harness.Post("/user", user); status != http.StatusOK {
+		harness.t.Fatalf("AddUser: status: %d: %s", status, body)
+	}
+	return user.UserID
+}
+
+// AddAccount adds another user to the fake Spotify and registers it like AddUser,
+// e.g. the target account of a migration, and returns the user id
+func (harness *Harness) AddAccount(userID string) string {
+	harness.t.Helper()
+	user := db.SpotifyUser{
+		UserID:       userID,
+		RefreshToken: userID + "-refresh-token",
+	}
+	harness.Spotify.AddUser(user.UserID, user.RefreshToken)
+	if status, body := harness.Post("/user", user); status != http.StatusOK {
+		harness.t.Fatalf("AddAccount: status: %d: %s", status, body)
+	}
+	return user.UserID
+}
+
+// Upload starts a job of the user by the /csv route and returns its id,
+// the request carries an access token of the user like the web client's
+func (harness *Harness) Upload(payload runner.CSVPayload) string {
+	harness.t.Helper()
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		harness.t.Fatalf("Upload: json.Marshal: %v", err)
+	}
+	status, body := harness.Request(http.MethodPost, "/csv", harness.AuthHeader(*payload.UserID), bytes.NewReader(payloadJSON))
+	if status != http.StatusOK {
+		harness.t.Fatalf("Upload: status: %d: %s", status, body)
+	}
+	var response struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.JobID == "" {
+		harness.t.Fatalf("Upload: unexpected response: %s", body)
+	}
+	return response.JobID
+}
+
+// Connect opens a websocket session of the user, it returns once the user was found
+func (harness *Harness) Connect(userID string) *Session {
+	harness.t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(harness.URL("/websocket"), "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		harness.t.Fatalf("Connect: Dial: %v", err)
+	}
+	session := &Session{conn: conn, t: harness.t}
+	harness.t.Cleanup(session.Close)
+	session.Send(MessageUser, userID)
+	if event := session.Next(); event.Type != MessageUser || string(event.Payload) != "true" {
+		harness.t.Fatalf("Connect: user %s wasn't found: %+v", userID, event)
+	}
+	return session
+}
+
+// Send sends a message to the server e.g. Send("RESYNC", jobID)
+func (session *Session) Send(messageType string, payload interface{}) {
+	session.t.Helper()
+	err := session.conn.WriteJSON(map[string]interface{}{
+		"type":    messageType,
+		"payload": payload,
+	})
+	if err != nil {
+		session.t.Fatalf("Send %s: %v", messageType, err)
+	}
+}
+
+// Next returns the next message of the session
+func (session *Session) Next() Event {
+	session.t.Helper()
+	var event Event
+	session.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err := session.conn.ReadJSON(&event); err != nil {
+		session.t.Fatalf("Next: ReadJSON: %v", err)
+	}
+	return event
+}
+
+// Events returns the messages of the session up to the last message of a job,
+// after which the server closes the connection
+func (session *Session) Events() []Event {
+	session.t.Helper()
+	var events []Event
+	for {
+		event := session.Next()
+		events = append(events, event)
+		switch event.Type {
+		case hub.MessageJobFinished, hub.MessageJobFailed, hub.MessageJobCancelled, hub.MessagePreviewReady:
+			return events
+		}
+	}
+}
+
+// Close closes the connection, it's safe to call more than once
+func (session *Session) Close() {
+	session.conn.Close()
+}
@@ -0,0 +1,1099 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/client/clienttest"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/hub"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+)
+
+var catalogue = []clienttest.Track{
+	{ID: "yesterday", Name: "Yesterday - Remastered 2009", Artists: []string{"The Beatles"}, Album: "Help!", ISRC: "GBAYE0601477"},
+	{ID: "letitbe", Name: "Let It Be", Artists: []string{"The Beatles"}, Album: "Let It Be", ISRC: "GBAYE0601713"},
+}
+
+// lookupEvents are the messages of a track lookup
+var lookupEvents = []string{hub.MessageTrackResult, hub.MessageUpdate}
+
+// startJob uploads the payload while the fake Spotify is held and connects sessions
+// of the user which get the snapshot of the job before its lookups start
+func startJob(t *testing.T, harness *Harness, payload runner.CSVPayload, sessionsNum int) (string, []*Session) {
+	t.Helper()
+	harness.Spotify.Hold()
+	jobID := harness.Upload(payload)
+	sessions := make([]*Session, sessionsNum)
+	for i := range sessions {
+		sessions[i] = harness.Connect(*payload.UserID)
+		if snapshot := sessions[i].Next(); snapshot.Type != MessageSnapshot || snapshot.JobID != jobID || snapshot.Seq != 0 {
+			t.Fatalf("startJob: unexpected snapshot: %+v", snapshot)
+		}
+	}
+	harness.Spotify.Release()
+	return jobID, sessions
+}
+
+// checkEvents checks the message types of a job and that their sequence numbers follow the snapshot's
+func checkEvents(t *testing.T, jobID string, events []Event, expected []string) {
+	t.Helper()
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+		if event.JobID != jobID || event.Seq != i+1 {
+			t.Errorf("unexpected job id or seq of message %d: %+v", i, event)
+		}
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected messages %v, got %v", expected, types)
+	}
+}
+
+func TestImport(t *testing.T) {
+	const funcName = "TestImport"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles\nNo Such Song,Nobody\n"
+	fileName := "road trip.csv"
+	jobID, sessions := startJob(t, harness, runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+	}, 2)
+
+	var expected []string
+	for range []int{0, 1, 2} {
+		expected = append(expected, lookupEvents...)
+	}
+	expected = append(expected, hub.MessageJobFinished)
+	// every tab of the user gets the job messages
+	for _, session := range sessions {
+		checkEvents(t, jobID, session.Events(), expected)
+	}
+
+	job := db.FindJob(jobID)
+	if job == nil || job.Status != db.JobFinished || job.TracksAdded != 2 || job.TracksNotAdded != 1 {
+		t.Fatalf("%s: unexpected job: %+v", funcName, job)
+	}
+	if job.Markets[0] != harness.Spotify.Country {
+		t.Errorf("%s: expected the market of the user's country, got %v", funcName, job.Markets)
+	}
+	if user := db.FindSpotifyUser(userID); user == nil || user.Country != harness.Spotify.Country {
+		t.Errorf("%s: the user's country wasn't saved: %+v", funcName, user)
+	}
+	if tracks := db.FindJobTracks(jobID); len(tracks) != 3 || !tracks[0].IsFound || tracks[2].IsFound {
+		t.Errorf("%s: unexpected job tracks: %+v", funcName, tracks)
+	}
+	playlists := harness.Spotify.Playlists()
+	if len(playlists) != 1 || playlists[0].ID != job.PlaylistID || playlists[0].Name != "road trip" {
+		t.Fatalf("%s: unexpected playlists: %+v", funcName, playlists)
+	}
+	if uris := strings.Join(playlists[0].URIs, ","); uris != "spotify:track:yesterday,spotify:track:letitbe" {
+		t.Errorf("%s: unexpected playlist tracks: %s", funcName, uris)
+	}
+
+	// a new session starts from the snapshot of the finished job
+	snapshot := harness.Connect(userID).Next()
+	var payload struct {
+		Job    db.Job        `json:"job"`
+		Tracks []db.JobTrack `json:"tracks"`
+	}
+	if err := json.Unmarshal(snapshot.Payload, &payload); err != nil {
+		t.Fatalf("%s: json.Unmarshal: %v", funcName, err)
+	}
+	if snapshot.Type != MessageSnapshot || snapshot.Seq != len(expected) || payload.Job.Status != db.JobFinished || len(payload.Tracks) != 3 {
+		t.Errorf("%s: unexpected snapshot: %+v", funcName, snapshot)
+	}
+}
+
+func TestPlaylistCover(t *testing.T) {
+	const funcName = "TestPlaylistCover"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "covered.csv"
+	cover := base64.StdEncoding.EncodeToString([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+	jobID := harness.Upload(runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+		Playlist: &runner.PlaylistPayload{CoverImage: &cover},
+	})
+	job := waitJob(t, jobID)
+	if job.Status != db.JobFinished || !job.PlaylistOptions.HasCoverImage {
+		t.Fatalf("%s: unexpected job: %+v", funcName, job)
+	}
+	if saved := db.FindCoverImage(jobID); saved == nil || saved.Image != cover {
+		t.Errorf("%s: the cover should be saved apart from the job", funcName)
+	}
+	if playlist, _ := harness.Spotify.Playlist(job.PlaylistID); playlist.CoverImage != cover {
+		t.Errorf("%s: the cover wasn't uploaded", funcName)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const funcName = "TestMerge"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	playlistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "favourites", URIs: []string{"spotify:track:letitbe"}})
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles\nYesterday,The Beatles\n"
+	fileName := "favourites.csv"
+	mode := client.ImportMerge
+	jobID, sessions := startJob(t, harness, runner.CSVPayload{
+		UserID:     &userID,
+		CSVFile:    &csvFile,
+		FileName:   &fileName,
+		Mode:       &mode,
+		PlaylistID: &playlistID,
+	}, 1)
+
+	// the repeated row isn't looked up
+	expected := append(append(append([]string{}, lookupEvents...), lookupEvents...), hub.MessageJobFinished)
+	checkEvents(t, jobID, sessions[0].Events(), expected)
+
+	job := db.FindJob(jobID)
+	expectedSkipped := map[string]int{client.DuplicateRow: 1, client.DuplicateInDestination: 1}
+	if job == nil || job.Status != db.JobFinished || !reflect.DeepEqual(job.DuplicatesSkipped, expectedSkipped) {
+		t.Fatalf("%s: unexpected job: %+v", funcName, job)
+	}
+	playlist, _ := harness.Spotify.Playlist(playlistID)
+	if uris := strings.Join(playlist.URIs, ","); uris != "spotify:track:letitbe,spotify:track:yesterday" {
+		t.Errorf("%s: unexpected playlist tracks: %s", funcName, uris)
+	}
+	if len(harness.Spotify.Playlists()) != 1 {
+		t.Errorf("%s: expected no new playlist", funcName)
+	}
+}
+
+func TestUploadAuthorization(t *testing.T) {
+	const funcName = "TestUploadAuthorization"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	playlistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "favourites", URIs: []string{"spotify:track:letitbe"}})
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "favourites.csv"
+	mode := client.ImportReplace
+	payload := runner.CSVPayload{
+		UserID:     &userID,
+		CSVFile:    &csvFile,
+		FileName:   &fileName,
+		Mode:       &mode,
+		PlaylistID: &playlistID,
+	}
+	requests := []struct {
+		name   string
+		header http.Header
+		status int
+		code   string
+	}{
+		{name: "no access token", header: http.Header{"Content-Type": {"application/json"}}, status: http.StatusUnauthorized, code: apierror.Unauthorized},
+		{name: "token of another user", header: harness.AuthHeader("someone"), status: http.StatusForbidden, code: apierror.Forbidden},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			status, body := harness.Request(http.MethodPost, "/csv", request.header, jsonBody(t, payload))
+			if failure := apiError(t, body); status != request.status || failure.Code != request.code {
+				t.Errorf("%s: expected %d %s, got %d: %s", funcName, request.status, request.code, status, body)
+			}
+		})
+	}
+	if playlist, _ := harness.Spotify.Playlist(playlistID); strings.Join(playlist.URIs, ",") != "spotify:track:letitbe" {
+		t.Errorf("%s: the playlist shouldn't change, got %v", funcName, playlist.URIs)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	const funcName = "TestDuplicates"
+	csvFile := "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles\nYesterday - Remastered 2009,The Beatles\n"
+	cases := []struct {
+		mode       string
+		duplicates string
+		uris       string
+		skipped    map[string]int
+	}{
+		{client.ImportAppend, client.DuplicatesKeepFirst, "letitbe,yesterday", map[string]int{client.DuplicateInDestination: 1, client.DuplicateMatch: 1}},
+		{client.ImportAppend, client.DuplicatesKeepAll, "letitbe,yesterday,letitbe,yesterday", nil},
+		{client.ImportMerge, client.DuplicatesKeepAll, "letitbe,yesterday,yesterday", map[string]int{client.DuplicateInDestination: 1}},
+	}
+	for _, testCase := range cases {
+		harness := NewHarness(t)
+		harness.Spotify.AddTracks(catalogue...)
+		playlistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "favourites", URIs: []string{"spotify:track:letitbe"}})
+		userID := harness.AddUser()
+		mode, duplicates, fileName := testCase.mode, testCase.duplicates, "favourites.csv"
+		jobID := harness.Upload(runner.CSVPayload{
+			UserID:     &userID,
+			CSVFile:    &csvFile,
+			FileName:   &fileName,
+			Mode:       &mode,
+			Duplicates: &duplicates,
+			PlaylistID: &playlistID,
+		})
+		job := waitJob(t, jobID)
+		if job.Status != db.JobFinished || !reflect.DeepEqual(job.DuplicatesSkipped, testCase.skipped) {
+			t.Errorf("%s: %s %s: unexpected job: %s: %v", funcName, mode, duplicates, job.Status, job.DuplicatesSkipped)
+		}
+		playlist, _ := harness.Spotify.Playlist(playlistID)
+		uris := strings.ReplaceAll(strings.Join(playlist.URIs, ","), "spotify:track:", "")
+		if uris != testCase.uris {
+			t.Errorf("%s: %s %s: expected %s, got %s", funcName, mode, duplicates, testCase.uris, uris)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	const funcName = "TestFailure"
+	harness := NewHarness(t)
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "road trip.csv"
+	unknownMode := "shuffle"
+	status, _ := harness.Post("/csv", runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+		Mode:     &unknownMode,
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("%s: expected 400 for an unknown mode, got %d", funcName, status)
+	}
+
+	// the access token can't be refreshed so no track is looked up and the playlist isn't created
+	harness.Spotify.Fail("/api/token", http.StatusBadRequest, 100)
+	jobID, sessions := startJob(t, harness, runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+	}, 1)
+	events := sessions[0].Events()
+	checkEvents(t, jobID, events, []string{hub.MessageJobFailed})
+	var failure struct {
+		Cause string `json:"cause"`
+	}
+	json.Unmarshal(events[0].Payload, &failure)
+	job := db.FindJob(jobID)
+	if job == nil || job.Status != db.JobFailed || job.FailureCause != failure.Cause || failure.Cause != apierror.TokenRefreshFailed {
+		t.Errorf("%s: unexpected job: %+v failure: %+v", funcName, job, failure)
+	}
+	if playlists := harness.Spotify.Playlists(); len(playlists) != 0 {
+		t.Errorf("%s: the failed job left playlists: %+v", funcName, playlists)
+	}
+}
+
+func TestPlaylistCreateFailed(t *testing.T) {
+	const funcName = "TestPlaylistCreateFailed"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	// the playlist is created once the tracks were looked up
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "road trip.csv"
+	harness.Spotify.Fail("/v1/users", http.StatusInternalServerError, 100)
+	jobID := harness.Upload(runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+	})
+	if job := waitJob(t, jobID); job.FailureCause != apierror.PlaylistCreateFailed || job.TracksAdded != 1 {
+		t.Errorf("%s: unexpected job: %+v", funcName, job)
+	}
+}
+
+func TestMalformedRow(t *testing.T) {
+	const funcName = "TestMalformedRow"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	// rows are looked up as they're read so the rows before the malformed one are reported
+	csvFile := "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles,1970\nHey Jude,The Beatles\n"
+	fileName := "road trip.csv"
+	jobID, sessions := startJob(t, harness, runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+	}, 1)
+	checkEvents(t, jobID, sessions[0].Events(), append(append([]string{}, lookupEvents...), hub.MessageJobFailed))
+	if job := db.FindJob(jobID); job == nil || job.FailureCause != apierror.InvalidCSV || job.TracksAdded != 1 {
+		t.Errorf("%s: unexpected job: %+v", funcName, job)
+	}
+	// the playlist is created once the tracks are written
+	if playlists := harness.Spotify.Playlists(); len(playlists) != 0 {
+		t.Errorf("%s: the failed job left playlists: %+v", funcName, playlists)
+	}
+}
+
+// waitJob waits until the job isn't running and returns it
+func waitJob(t testing.TB, jobID string) db.Job {
+	t.Helper()
+	deadline := time.Now().Add(readTimeout)
+	for time.Now().Before(deadline) {
+		if job := db.FindJob(jobID); job != nil && job.Status != db.JobRunning {
+			return *job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("waitJob: job %s is still running", jobID)
+	return db.Job{}
+}
+
+// gzipped compresses content
+func gzipped(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(content); err != nil {
+		t.Fatalf("gzipped: Write: %v", err)
+	}
+	writer.Close()
+	return compressed.Bytes()
+}
+
+// uploadQuery returns the /csv route of a raw upload of the user's file
+func uploadQuery(userID string, fileName string) string {
+	return "/csv?" + url.Values{"userId": {userID}, "uploadFileName": {fileName}}.Encode()
+}
+
+func TestUploads(t *testing.T) {
+	const funcName = "TestUploads"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+	csvFile := "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles\n"
+
+	var multipartBody bytes.Buffer
+	writer := multipart.NewWriter(&multipartBody)
+	writer.WriteField("payload", `{"userId": "`+userID+`", "duplicates": "keep_all"}`)
+	filePart, _ := writer.CreateFormFile("file", "multipart.csv")
+	filePart.Write([]byte(csvFile))
+	writer.Close()
+
+	requests := []struct {
+		name     string
+		route    string
+		header   http.Header
+		body     []byte
+		playlist string
+		// duplicates is set by the payload of the multipart upload
+		duplicates string
+	}{
+		{
+			name:       "multipart",
+			route:      "/csv",
+			header:     http.Header{"Content-Type": {writer.FormDataContentType()}},
+			body:       multipartBody.Bytes(),
+			playlist:   "multipart",
+			duplicates: client.DuplicatesKeepAll,
+		},
+		{
+			name:       "gzip encoded",
+			route:      uploadQuery(userID, "encoded.csv"),
+			header:     http.Header{"Content-Type": {"text/csv"}, "Content-Encoding": {"gzip"}},
+			body:       gzipped(t, []byte(csvFile)),
+			playlist:   "encoded",
+			duplicates: client.DuplicatesKeepFirst,
+		},
+		{
+			name:       "gzip file",
+			route:      uploadQuery(userID, "compressed.csv.gz"),
+			header:     http.Header{"Content-Type": {"application/gzip"}},
+			body:       gzipped(t, []byte(csvFile)),
+			playlist:   "compressed",
+			duplicates: client.DuplicatesKeepFirst,
+		},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			status, body := harness.Request(http.MethodPost, request.route, request.header, bytes.NewReader(request.body))
+			var response struct {
+				JobID string `json:"jobId"`
+			}
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("%s: unexpected response: %d: %s", funcName, status, body)
+			}
+			job := waitJob(t, response.JobID)
+			if job.Status != db.JobFinished || job.TracksAdded != 2 || job.FileName != request.playlist || job.Duplicates != request.duplicates {
+				t.Errorf("%s: unexpected job: %+v", funcName, job)
+			}
+		})
+	}
+	// a small body which decompresses past the limit
+	bomb := gzipped(t, make([]byte, 40<<20))
+	status, body := harness.Request(http.MethodPost, uploadQuery(userID, "bomb.csv"),
+		http.Header{"Content-Type": {"text/csv"}, "Content-Encoding": {"gzip"}}, bytes.NewReader(bomb))
+	if status != http.StatusRequestEntityTooLarge || apiError(t, body).Code != apierror.PayloadTooLarge {
+		t.Errorf("%s: expected 413 for a decompressed body over the limit, got %d: %s", funcName, status, body)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	const funcName = "TestArchive"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	entries := []struct {
+		name    string
+		content string
+	}{
+		{"playlists/road trip.csv", "Name,Artist\nYesterday,The Beatles\nLet It Be,The Beatles\n"},
+		{"playlists/chill.CSV", "Name,Artist\nLet It Be,The Beatles\n"},
+		// entries which aren't playlist files are ignored
+		{"__MACOSX/playlists/._road trip.csv", "metadata"},
+		{"playlists/notes.txt", "notes"},
+	}
+	for _, entry := range entries {
+		entryWriter, _ := writer.Create(entry.name)
+		entryWriter.Write([]byte(entry.content))
+	}
+	writer.Close()
+
+	session := harness.Connect(userID)
+	harness.Spotify.Hold()
+	status, body := harness.Request(http.MethodPost, uploadQuery(userID, "playlists.zip"),
+		http.Header{"Content-Type": {"application/zip"}}, bytes.NewReader(archive.Bytes()))
+	harness.Spotify.Release()
+	var response struct {
+		BatchID string   `json:"batchId"`
+		JobIDs  []string `json:"jobIds"`
+	}
+	if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || len(response.JobIDs) != 2 {
+		t.Fatalf("%s: unexpected response: %d: %s", funcName, status, body)
+	}
+
+	// the jobs run one after another and the session gets the messages of both
+	var jobIDs []string
+	for finished := 0; finished < 2; {
+		event := session.Next()
+		jobIDs = append(jobIDs, event.JobID)
+		switch event.Type {
+		case hub.MessageJobFinished, hub.MessageJobFailed, hub.MessageJobCancelled:
+			finished++
+		}
+	}
+	if first := jobIDs[0]; first != response.JobIDs[0] || jobIDs[len(jobIDs)-1] != response.JobIDs[1] {
+		t.Errorf("%s: expected the jobs in the order of the files, got messages of %v", funcName, jobIDs)
+	}
+	for i := 1; i < len(jobIDs); i++ {
+		if jobIDs[i] == response.JobIDs[0] && jobIDs[i-1] == response.JobIDs[1] {
+			t.Errorf("%s: expected the jobs to run one after another, got messages of %v", funcName, jobIDs)
+			break
+		}
+	}
+	session.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if _, _, err := session.conn.ReadMessage(); err == nil {
+		t.Errorf("%s: expected the connection to be closed once the batch finished", funcName)
+	}
+	for i, tracksAdded := range []int{2, 1} {
+		if job := waitJob(t, response.JobIDs[i]); job.Status != db.JobFinished || job.TracksAdded != tracksAdded {
+			t.Errorf("%s: unexpected job %d: %+v", funcName, i, job)
+		}
+	}
+
+	status, body = harness.Request(http.MethodGet, "/batches/"+response.BatchID+"?userId="+userID, nil, nil)
+	var batch struct {
+		Batch db.Batch `json:"batch"`
+		Jobs  []db.Job `json:"jobs"`
+	}
+	if err := json.Unmarshal(body, &batch); status != http.StatusOK || err != nil {
+		t.Fatalf("%s: unexpected batch response: %d: %s", funcName, status, body)
+	}
+	if batch.Batch.FileName != "playlists" || len(batch.Jobs) != 2 || batch.Jobs[0].FileName != "road trip" ||
+		batch.Jobs[1].FileName != "chill" || batch.Jobs[1].BatchID != response.BatchID {
+		t.Errorf("%s: unexpected batch: %+v", funcName, batch)
+	}
+	var names []string
+	for _, playlist := range harness.Spotify.Playlists() {
+		names = append(names, playlist.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "chill,road trip" {
+		t.Errorf("%s: unexpected playlists: %v", funcName, names)
+	}
+	if status, _ = harness.Request(http.MethodGet, "/batches/"+response.BatchID+"?userId=someone", nil, nil); status != http.StatusNotFound {
+		t.Errorf("%s: expected 404 for the batch of another user, got %d", funcName, status)
+	}
+}
+
+// apiError returns the error of a failed response body
+func apiError(t *testing.T, body []byte) apierror.Error {
+	t.Helper()
+	var response struct {
+		Error apierror.Error `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("apiError: json.Unmarshal: %v: %s", err, body)
+	}
+	return response.Error
+}
+
+func TestErrors(t *testing.T) {
+	const funcName = "TestErrors"
+	harness := NewHarness(t)
+	userID := harness.AddUser()
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "road trip.csv"
+	unknownUser := "nobody"
+	badMode, badMarket := "shuffle", "Atlantis"
+
+	requests := []struct {
+		name   string
+		method string
+		route  string
+		body   interface{}
+		status int
+		code   string
+		fields []string
+	}{
+		{
+			name:   "missing fields",
+			method: http.MethodPost,
+			route:  "/csv",
+			body:   runner.CSVPayload{},
+			status: http.StatusBadRequest,
+			code:   apierror.ValidationFailed,
+			fields: []string{"userId", "csvFile", "uploadFileName"},
+		},
+		{
+			name:   "invalid fields",
+			method: http.MethodPost,
+			route:  "/csv",
+			body:   runner.CSVPayload{UserID: &userID, CSVFile: &csvFile, FileName: &fileName, Mode: &badMode, Market: &badMarket},
+			status: http.StatusBadRequest,
+			code:   apierror.ValidationFailed,
+			fields: []string{"mode", "market"},
+		},
+		{
+			name:   "unknown user",
+			method: http.MethodPost,
+			route:  "/csv",
+			body:   runner.CSVPayload{UserID: &unknownUser, CSVFile: &csvFile, FileName: &fileName},
+			status: http.StatusNotFound,
+			code:   apierror.UnknownUser,
+		},
+		{
+			name:   "malformed body",
+			method: http.MethodPost,
+			route:  "/csv",
+			body:   "{",
+			status: http.StatusBadRequest,
+			code:   apierror.InvalidRequest,
+		},
+		{
+			name:   "unknown job",
+			method: http.MethodGet,
+			route:  "/jobs/nope/preview?userId=" + userID,
+			status: http.StatusNotFound,
+			code:   apierror.NotFound,
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			route:  "/jobs/nope/cancel",
+			status: http.StatusMethodNotAllowed,
+			code:   apierror.MethodNotAllowed,
+		},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			var body io.Reader
+			switch requestBody := request.body.(type) {
+			case nil:
+			case string:
+				body = strings.NewReader(requestBody)
+			default:
+				bodyJSON, _ := json.Marshal(requestBody)
+				body = bytes.NewReader(bodyJSON)
+			}
+			status, responseBody := harness.Request(request.method, request.route, nil, body)
+			failure := apiError(t, responseBody)
+			if status != request.status || failure.Code != request.code || failure.Message == "" {
+				t.Errorf("%s: expected %d %s, got %d: %s", funcName, request.status, request.code, status, responseBody)
+			}
+			var fields []string
+			for _, field := range failure.Fields {
+				fields = append(fields, field.Field)
+			}
+			if !reflect.DeepEqual(fields, request.fields) {
+				t.Errorf("%s: expected fields %v, got %v", funcName, request.fields, fields)
+			}
+		})
+	}
+}
+
+func TestExportAuthorization(t *testing.T) {
+	const funcName = "TestExportAuthorization"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	playlistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "private", URIs: []string{"spotify:track:letitbe"}})
+	userID := harness.AddUser()
+	route := "/playlists/" + playlistID + "/export?userId=" + userID
+
+	requests := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+		code   string
+	}{
+		{name: "no access token", method: http.MethodGet, status: http.StatusUnauthorized, code: apierror.Unauthorized},
+		{name: "token of another user", method: http.MethodGet, header: harness.AuthHeader("someone"), status: http.StatusForbidden, code: apierror.Forbidden},
+		{name: "export job without access token", method: http.MethodPost, status: http.StatusUnauthorized, code: apierror.Unauthorized},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			status, body := harness.Request(request.method, route, request.header, nil)
+			if failure := apiError(t, body); status != request.status || failure.Code != request.code {
+				t.Errorf("%s: expected %d %s, got %d: %s", funcName, request.status, request.code, status, body)
+			}
+		})
+	}
+	status, body := harness.Request(http.MethodGet, route, harness.AuthHeader(userID), nil)
+	if status != http.StatusOK || !strings.Contains(string(body), "spotify:track:letitbe") {
+		t.Errorf("%s: expected the playlist of the user, got %d: %s", funcName, status, body)
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	const funcName = "TestTokenRevoked"
+	harness := NewHarness(t)
+	playlistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "favourites"})
+	userID := harness.AddUser()
+	harness.Spotify.RevokeToken()
+
+	// requests and jobs fail with the same code
+	status, body := harness.Request(http.MethodGet, "/playlists/"+playlistID+"/export?userId="+userID, harness.AuthHeader(userID), nil)
+	if failure := apiError(t, body); status != http.StatusUnauthorized || failure.Code != apierror.TokenRevoked {
+		t.Errorf("%s: expected 401 %s, got %d: %s", funcName, apierror.TokenRevoked, status, body)
+	}
+
+	csvFile := "Name,Artist\nYesterday,The Beatles\n"
+	fileName := "road trip.csv"
+	jobID, sessions := startJob(t, harness, runner.CSVPayload{
+		UserID:   &userID,
+		CSVFile:  &csvFile,
+		FileName: &fileName,
+	}, 1)
+	events := sessions[0].Events()
+	checkEvents(t, jobID, events, []string{hub.MessageJobFailed})
+	var failure struct {
+		Cause string `json:"cause"`
+	}
+	json.Unmarshal(events[0].Payload, &failure)
+	if failure.Cause != apierror.TokenRevoked {
+		t.Errorf("%s: expected the %s cause, got %+v", funcName, apierror.TokenRevoked, failure)
+	}
+}
+
+// jsonBody returns the JSON body of a request
+func jsonBody(t *testing.T, body interface{}) io.Reader {
+	t.Helper()
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("jsonBody: json.Marshal: %v", err)
+	}
+	return bytes.NewReader(bodyJSON)
+}
+
+func TestWebhookRegistration(t *testing.T) {
+	const funcName = "TestWebhookRegistration"
+	harness := NewHarness(t)
+	userID := harness.AddUser()
+	register := func(header http.Header, url string) (int, []byte) {
+		return harness.Request(http.MethodPost, "/webhooks", header, jsonBody(t, map[string]string{"userId": userID, "url": url}))
+	}
+	const publicURL = "https://93.184.216.34/hooks/jobs"
+
+	requests := []struct {
+		name   string
+		header http.Header
+		url    string
+		status int
+		code   string
+	}{
+		{name: "no access token", header: http.Header{"Content-Type": {"application/json"}}, url: publicURL, status: http.StatusUnauthorized, code: apierror.Unauthorized},
+		{name: "invalid access token", header: http.Header{"Authorization": {"Bearer forged"}}, url: publicURL, status: http.StatusUnauthorized, code: apierror.Unauthorized},
+		{name: "token of another user", header: harness.AuthHeader("someone"), url: publicURL, status: http.StatusForbidden, code: apierror.Forbidden},
+		{name: "loopback url", header: harness.AuthHeader(userID), url: "http://localhost:8080/hooks", status: http.StatusBadRequest, code: apierror.ValidationFailed},
+		{name: "metadata url", header: harness.AuthHeader(userID), url: "http://169.254.169.254/latest/meta-data/", status: http.StatusBadRequest, code: apierror.ValidationFailed},
+		{name: "private url", header: harness.AuthHeader(userID), url: "http://10.0.0.8/hooks", status: http.StatusBadRequest, code: apierror.ValidationFailed},
+	}
+	for _, request := range requests {
+		t.Run(request.name, func(t *testing.T) {
+			status, body := register(request.header, request.url)
+			if failure := apiError(t, body); status != request.status || failure.Code != request.code {
+				t.Errorf("%s: expected %d %s, got %d: %s", funcName, request.status, request.code, status, body)
+			}
+		})
+	}
+
+	if status, body := register(harness.AuthHeader(userID), publicURL); status != http.StatusCreated {
+		t.Fatalf("%s: expected the webhook to be registered, got %d: %s", funcName, status, body)
+	}
+	if status, _ := harness.Request(http.MethodGet, "/webhooks?userId="+userID, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("%s: expected 401 for listing without an access token, got %d", funcName, status)
+	}
+	status, body := harness.Request(http.MethodGet, "/webhooks?userId="+userID, harness.AuthHeader(userID), nil)
+	var webhooks []db.Webhook
+	if err := json.Unmarshal(body, &webhooks); status != http.StatusOK || err != nil || len(webhooks) != 1 || webhooks[0].URL != publicURL {
+		t.Errorf("%s: unexpected webhooks: %d: %s", funcName, status, body)
+	}
+}
+
+func TestAccountLinks(t *testing.T) {
+	const funcName = "TestAccountLinks"
+	harness := NewHarness(t)
+	sourceID := harness.AddUser()
+	targetID := "target"
+	if status, body := harness.Post("/user", db.SpotifyUser{UserID: targetID, RefreshToken: "target-refresh-token"}); status != http.StatusOK {
+		t.Fatalf("%s: /user: %d: %s", funcName, status, body)
+	}
+	link := map[string]string{"userId": sourceID, "linkedUserId": targetID}
+	migration := map[string]string{"userId": sourceID, "targetUserId": targetID}
+	requests := []struct {
+		name   string
+		route  string
+		header http.Header
+		body   map[string]string
+		status int
+	}{
+		{name: "link of another user", route: "/accounts/links", header: harness.AuthHeader("mallory"), body: link, status: http.StatusForbidden},
+		{name: "link", route: "/accounts/links", header: harness.AuthHeader(sourceID), body: link, status: http.StatusCreated},
+		{name: "migration of a pending link", route: "/migrations", header: harness.AuthHeader(sourceID), body: migration, status: http.StatusForbidden},
+		{name: "confirmation by the source", route: "/accounts/links/confirm", header: harness.AuthHeader(sourceID), body: link, status: http.StatusForbidden},
+		{name: "confirmation without a request", route: "/accounts/links/confirm", header: harness.AuthHeader(sourceID),
+			body: map[string]string{"userId": targetID, "linkedUserId": sourceID}, status: http.StatusNotFound},
+		{name: "confirmation", route: "/accounts/links/confirm", header: harness.AuthHeader(targetID), body: link, status: http.StatusNoContent},
+	}
+	for _, request := range requests {
+		status, body := harness.Request(http.MethodPost, request.route, request.header, jsonBody(t, request.body))
+		if status != request.status {
+			t.Errorf("%s: %s: expected %d, got %d: %s", funcName, request.name, request.status, status, body)
+		}
+	}
+	status, body := harness.Request(http.MethodGet, "/accounts/links?userId="+targetID, harness.AuthHeader(targetID), nil)
+	var links []db.AccountLink
+	if err := json.Unmarshal(body, &links); status != http.StatusOK || err != nil || len(links) != 1 || !links[0].Confirmed || links[0].UserID != sourceID {
+		t.Errorf("%s: unexpected links of the target: %d: %s", funcName, status, body)
+	}
+	if !db.IsLinkedAccount(sourceID, targetID) || db.IsLinkedAccount(targetID, sourceID) {
+		t.Errorf("%s: only %s should be linked to %s", funcName, sourceID, targetID)
+	}
+}
+
+func TestInterruptedJob(t *testing.T) {
+	const funcName = "TestInterruptedJob"
+	harness := NewHarness(t)
+	userID := harness.AddUser()
+	// the job of a server instance which stopped in the middle of it, it wasn't refreshed since
+	job := db.CreateJob(db.Job{UserID: userID, Type: db.JobTypeMigration, Migration: &db.Migration{TargetUserID: "target"},
+		InstanceID: "stopped-instance"})
+	job.UpdatedAt = time.Now().Add(-time.Hour)
+	harness.Store.ReplaceJob(*job)
+	// the job of another instance which is still running it, it was refreshed recently
+	running := db.CreateJob(db.Job{UserID: "other-user", InstanceID: "running-instance"})
+	running.UpdatedAt = time.Now().Add(-time.Minute)
+	harness.Store.ReplaceJob(*running)
+	runner.FailInterruptedJobs()
+	interrupted := waitJob(t, job.ID)
+	if interrupted.Status != db.JobFailed || interrupted.FailureCause != apierror.Interrupted {
+		t.Fatalf("%s: expected an interrupted job, got %s: %s", funcName, interrupted.Status, interrupted.FailureCause)
+	}
+	if job := db.FindJob(running.ID); job.Status != db.JobRunning {
+		t.Errorf("%s: the job of a running instance shouldn't fail, got %s: %s", funcName, job.Status, job.FailureCause)
+	}
+	db.TouchJob(running.ID, "running-instance")
+	if job := db.FindJob(running.ID); !job.UpdatedAt.After(running.UpdatedAt) {
+		t.Errorf("%s: expected a refreshed job, got %v", funcName, job.UpdatedAt)
+	}
+
+	// of concurrent status changes only one is saved
+	const requestsNum = 10
+	saved := make(chan bool, requestsNum)
+	for i := 0; i < requestsNum; i++ {
+		go func() {
+			running := interrupted
+			running.Status = db.JobRunning
+			saved <- db.UpdateJobIfStatus(running, db.JobFailed)
+		}()
+	}
+	savedNum := 0
+	for i := 0; i < requestsNum; i++ {
+		if <-saved {
+			savedNum++
+		}
+	}
+	if savedNum != 1 {
+		t.Errorf("%s: expected a single saved status change, got %d", funcName, savedNum)
+	}
+	if _, err := runner.ResumeRunner(job.ID, db.FindSpotifyUser(userID)); err != runner.ErrJobNotResumable {
+		t.Errorf("%s: a running job shouldn't be resumable, got %v", funcName, err)
+	}
+
+	// an interrupted migration is resumed, it fails since the target account never logged in
+	db.UpdateJob(interrupted)
+	status, body := harness.Post("/jobs/"+job.ID+"/resume?userId="+userID, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("%s: resume: %d: %s", funcName, status, body)
+	}
+	if resumed := waitJob(t, job.ID); resumed.FailureCause != apierror.TargetUserNotFound {
+		t.Errorf("%s: expected the resumed job to fail with %s, got %s", funcName, apierror.TargetUserNotFound, resumed.FailureCause)
+	}
+}
+
+// BenchmarkImport measures a raw upload of a large file through the lookups and
+// the playlist write, run it with -benchmem to see the memory per job
+func BenchmarkImport(b *testing.B) {
+	const tracksNum = 500
+	harness := NewHarness(b)
+	userID := harness.AddUser()
+	var csvFile strings.Builder
+	csvFile.WriteString("Name,Artist\n")
+	for i := 0; i < tracksNum; i++ {
+		name := "Song " + strconv.Itoa(i)
+		harness.Spotify.AddTracks(clienttest.Track{ID: "song" + strconv.Itoa(i), Name: name, Artists: []string{"The Band"}})
+		csvFile.WriteString(name + ",The Band\n")
+	}
+	header := http.Header{"Content-Type": {"text/csv"}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		status, body := harness.Request(http.MethodPost, uploadQuery(userID, "benchmark.csv"), header, strings.NewReader(csvFile.String()))
+		var response struct {
+			JobID string `json:"jobId"`
+		}
+		if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+			b.Fatalf("BenchmarkImport: unexpected response: %d: %s", status, body)
+		}
+		if job := waitJob(b, response.JobID); job.Status != db.JobFinished || job.TracksAdded != tracksNum {
+			b.Fatalf("BenchmarkImport: unexpected job: %+v", job)
+		}
+	}
+}
+
+// migrationAccounts registers the user and a linked target account of migrations,
+// the source playlist has more tracks than a copied chunk
+func migrationAccounts(t *testing.T, harness *Harness) (sourceID string, targetID string, uris []string) {
+	t.Helper()
+	sourceID = harness.AddUser()
+	targetID = harness.AddAccount("target")
+	if !db.LinkAccounts(sourceID, targetID) || !db.ConfirmAccountLink(sourceID, targetID) {
+		t.Fatalf("migrationAccounts: couldn't link %s to %s", sourceID, targetID)
+	}
+	uris = make([]string, 250)
+	for i := range uris {
+		uris[i] = "spotify:track:t" + strconv.Itoa(i)
+	}
+	harness.Spotify.SaveTracks(sourceID, "spotify:track:a", "spotify:track:b", "spotify:track:c")
+	return sourceID, targetID, uris
+}
+
+func TestMigration(t *testing.T) {
+	const funcName = "TestMigration"
+	harness := NewHarness(t)
+	sourceID, targetID, uris := migrationAccounts(t, harness)
+	// local files exist only on the source user's devices so they aren't copied
+	harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "road trip", URIs: append(append([]string{}, uris...), "spotify:local:band:album:song:180")})
+
+	// the user has no jobs yet so the session gets every message of the migration
+	session := harness.Connect(sourceID)
+	status, body := harness.Request(http.MethodPost, "/migrations", harness.AuthHeader(sourceID),
+		jsonBody(t, map[string]string{"userId": sourceID, "targetUserId": targetID}))
+	var response struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.Unmarshal(body, &response); status != http.StatusAccepted || err != nil {
+		t.Fatalf("%s: unexpected response: %d: %s", funcName, status, body)
+	}
+	// the progress of the playlist is published after every chunk of 100 tracks
+	var progress []int
+	for _, event := range session.Events() {
+		var msg kafkahelper.MigrationProgressMsg
+		if event.Type == hub.MessageMigrationProgress && json.Unmarshal(event.Payload, &msg) == nil && msg.Index == 0 {
+			progress = append(progress, msg.TracksCopied)
+		}
+	}
+	if !reflect.DeepEqual(progress, []int{100, 200, 250, 250}) {
+		t.Errorf("%s: unexpected progress of the copied playlist: %v", funcName, progress)
+	}
+	job := waitJob(t, response.JobID)
+	if job.Status != db.JobFinished || job.TracksAdded != len(uris)+3 || len(job.Migration.Playlists) != 2 {
+		t.Fatalf("%s: unexpected job: %+v", funcName, job)
+	}
+	copied := job.Migration.Playlists[0]
+	if copied.Status != db.MigrationCopied || copied.TracksTotal != len(uris) || copied.TracksCopied != len(uris) {
+		t.Errorf("%s: unexpected copied playlist: %+v", funcName, copied)
+	}
+	target, found := harness.Spotify.Playlist(copied.TargetID)
+	if !found || target.OwnerID != targetID || strings.Join(target.URIs, ",") != strings.Join(uris, ",") {
+		t.Errorf("%s: unexpected target playlist: %+v", funcName, target)
+	}
+	// Liked Songs are saved from the oldest so the target lists them in the same order
+	source, saved := harness.Spotify.SavedTracks(sourceID), harness.Spotify.SavedTracks(targetID)
+	if strings.Join(saved, ",") != strings.Join(source, ",") {
+		t.Errorf("%s: expected Liked Songs %v, got %v", funcName, source, saved)
+	}
+}
+
+func TestResumeMigration(t *testing.T) {
+	const funcName = "TestResumeMigration"
+	harness := NewHarness(t)
+	sourceID, targetID, uris := migrationAccounts(t, harness)
+	sourcePlaylistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "road trip", URIs: uris})
+	// the first chunk was copied before the job failed
+	targetPlaylistID := harness.Spotify.AddPlaylist(clienttest.Playlist{Name: "road trip", OwnerID: targetID, URIs: uris[:100]})
+	job := db.CreateJob(db.Job{
+		UserID:      sourceID,
+		Type:        db.JobTypeMigration,
+		TracksAdded: 100,
+		Migration: &db.Migration{
+			TargetUserID: targetID,
+			Playlists: []db.MigrationPlaylist{
+				{SourceID: sourcePlaylistID, Name: "road trip", TargetID: targetPlaylistID, TracksTotal: len(uris), TracksCopied: 100, Status: db.MigrationCopying},
+				{LikedSongs: true, Name: "Liked Songs", Status: db.MigrationPending},
+			},
+		},
+	})
+	job.Status = db.JobFailed
+	job.FailureCause = apierror.MigrationFailed
+	db.UpdateJob(*job)
+
+	status, body := harness.Post("/jobs/"+job.ID+"/resume?userId="+sourceID, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("%s: resume: %d: %s", funcName, status, body)
+	}
+	resumed := waitJob(t, job.ID)
+	if resumed.Status != db.JobFinished || resumed.FailureCause != "" || resumed.TracksAdded != len(uris)+3 {
+		t.Fatalf("%s: unexpected resumed job: %+v", funcName, resumed)
+	}
+	// the copy continues after the copied tracks and the playlist isn't created again
+	target, _ := harness.Spotify.Playlist(targetPlaylistID)
+	if strings.Join(target.URIs, ",") != strings.Join(uris, ",") || len(harness.Spotify.Playlists()) != 2 {
+		t.Errorf("%s: unexpected target playlist: %v", funcName, target.URIs)
+	}
+	if requests := harness.Spotify.Requests(http.MethodPost, "/v1/playlists/"+targetPlaylistID+"/tracks"); requests != 2 {
+		t.Errorf("%s: expected the 2 chunks which were left, got %d", funcName, requests)
+	}
+	if saved := harness.Spotify.SavedTracks(targetID); strings.Join(saved, ",") != "spotify:track:c,spotify:track:b,spotify:track:a" {
+		t.Errorf("%s: unexpected Liked Songs: %v", funcName, saved)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	const funcName = "TestPreview"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	userID := harness.AddUser()
+
+	csvFile := "Name,Artist\nLet It Be,The Beatles\nNo Such Song,Nobody\nYesterday,The Beatles\n"
+	fileName := "road trip.csv"
+	preview := true
+	payload := runner.CSVPayload{UserID: &userID, CSVFile: &csvFile, FileName: &fileName, Preview: &preview}
+	commit := func(jobID string, body io.Reader) (int, []byte) {
+		return harness.Request(http.MethodPost, "/jobs/"+jobID+"/commit?userId="+userID, nil, body)
+	}
+
+	jobID := harness.Upload(payload)
+	if job := waitJob(t, jobID); job.Status != db.JobPreviewed || job.TracksAdded != 2 || len(harness.Spotify.Playlists()) != 0 {
+		t.Fatalf("%s: unexpected previewed job: %+v", funcName, job)
+	}
+	status, body := harness.Request(http.MethodGet, "/jobs/"+jobID+"/preview?userId="+userID, nil, nil)
+	var previewed struct {
+		Tracks []db.JobTrack `json:"tracks"`
+	}
+	if err := json.Unmarshal(body, &previewed); status != http.StatusOK || err != nil || len(previewed.Tracks) != 3 {
+		t.Fatalf("%s: unexpected preview: %d: %s", funcName, status, body)
+	}
+	// only found tracks can be approved
+	status, body = commit(jobID, jsonBody(t, map[string][]int{"approved": {1}}))
+	if status != http.StatusBadRequest || apiError(t, body).Code != apierror.ValidationFailed {
+		t.Errorf("%s: expected the approval of a track which wasn't found to fail, got %d: %s", funcName, status, body)
+	}
+	if status, body = commit(jobID, jsonBody(t, map[string][]int{"approved": {2}})); status != http.StatusAccepted {
+		t.Fatalf("%s: commit: %d: %s", funcName, status, body)
+	}
+	job := waitJob(t, jobID)
+	if job.Status != db.JobFinished || job.TracksAdded != 1 || job.TracksNotAdded != 2 {
+		t.Errorf("%s: unexpected committed job: %+v", funcName, job)
+	}
+	if playlist, _ := harness.Spotify.Playlist(job.PlaylistID); strings.Join(playlist.URIs, ",") != "spotify:track:yesterday" {
+		t.Errorf("%s: expected only the approved track, got %v", funcName, playlist.URIs)
+	}
+	if status, body = commit(jobID, nil); status != http.StatusConflict {
+		t.Errorf("%s: expected a committed job not to be committed again, got %d: %s", funcName, status, body)
+	}
+
+	// every found track is approved without a body, the tracks are written in CSV order
+	jobID = harness.Upload(payload)
+	waitJob(t, jobID)
+	if status, body = commit(jobID, nil); status != http.StatusAccepted {
+		t.Fatalf("%s: commit: %d: %s", funcName, status, body)
+	}
+	job = waitJob(t, jobID)
+	playlist, _ := harness.Spotify.Playlist(job.PlaylistID)
+	if job.TracksAdded != 2 || strings.Join(playlist.URIs, ",") != "spotify:track:letitbe,spotify:track:yesterday" {
+		t.Errorf("%s: unexpected job: %+v playlist: %v", funcName, job, playlist.URIs)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	const funcName = "TestRetry"
+	harness := NewHarness(t)
+	harness.Spotify.AddTracks(catalogue...)
+	harness.Spotify.AddTracks(clienttest.Track{ID: "heyjude", Name: "Hey Jude", Artists: []string{"The Beatles"}, Album: "Hey Jude"})
+	userID := harness.AddUser()
+	fileName := "road trip.csv"
+	upload := func(csvFile string, retryOf *string) db.Job {
+		t.Helper()
+		return waitJob(t, harness.Upload(runner.CSVPayload{UserID: &userID, CSVFile: &csvFile, FileName: &fileName, RetryOf: retryOf}))
+	}
+
+	first := upload("Name,Artist\nLet It Be,The Beatles\nYesterday,Nobody\nHey Jude,Nobody\n", nil)
+	if first.Status != db.JobFinished || first.TracksAdded != 1 || first.TracksNotAdded != 2 {
+		t.Fatalf("%s: unexpected job: %+v", funcName, first)
+	}
+	// the fixed file is retried, the rows the first job matched are skipped
+	second := upload("Name,Artist\nLet It Be,The Beatles\nYesterday,The Beatles\nHey Jude,Nobody\n", &first.ID)
+	if second.Status != db.JobFinished || second.TracksSkipped != 1 || second.TracksAdded != 1 || second.PlaylistID != first.PlaylistID {
+		t.Fatalf("%s: unexpected retry: %+v", funcName, second)
+	}
+	// a retry of the retry skips the rows every job of the chain matched
+	// regardless of case and punctuation
+	third := upload("Name,Artist\nLET IT BE!,the beatles\nyesterday,The Beatles\nHey Jude,The Beatles\n", &second.ID)
+	if third.Status != db.JobFinished || third.TracksSkipped != 2 || third.TracksAdded != 1 || third.TracksNotAdded != 0 {
+		t.Errorf("%s: unexpected retry of the retry: %+v", funcName, third)
+	}
+	playlist, _ := harness.Spotify.Playlist(first.PlaylistID)
+	if strings.Join(playlist.URIs, ",") != "spotify:track:letitbe,spotify:track:yesterday,spotify:track:heyjude" || len(harness.Spotify.Playlists()) != 1 {
+		t.Errorf("%s: unexpected playlist: %v", funcName, playlist.URIs)
+	}
+}
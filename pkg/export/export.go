@@ -0,0 +1,104 @@
+/*
+Package export writes Spotify playlists as CSV, JSON or M3U files.
+CSV exports use the column names pkg/csv reads so that they can be
+imported back without losing the exact track matches.
+*/
+package export
+
+import (
+	stdcsv "encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+// supported export formats
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+	FormatM3U  = "m3u"
+)
+
+// contentTypes maps export formats to their MIME types
+var contentTypes = map[string]string{
+	FormatCSV:  "text/csv; charset=utf-8",
+	FormatJSON: "application/json",
+	FormatM3U:  "audio/x-mpegurl",
+}
+
+// IsFormat reports whether format is a supported export format
+func IsFormat(format string) bool {
+	_, found := contentTypes[format]
+	return found
+}
+
+// ContentType returns the MIME type of format
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// FileName returns the download file name of a playlist export
+func FileName(playlistName string, format string) string {
+	if playlistName == "" {
+		playlistName = "playlist"
+	}
+	return playlistName + "." + format
+}
+
+// Write writes the playlist in format to w
+func Write(w io.Writer, format string, playlist client.ExportedPlaylist) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, playlist.Tracks)
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(playlist)
+	case FormatM3U:
+		return writeM3U(w, playlist.Tracks)
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+}
+
+func writeCSV(w io.Writer, tracks []client.PlaylistTrack) error {
+	csvWriter := stdcsv.NewWriter(w)
+	err := csvWriter.Write(csv.Header)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		// the order of csv.Header
+		err = csvWriter.Write([]string{
+			track.Name,
+			track.Artist,
+			track.Album,
+			track.ISRC,
+			strconv.Itoa(track.DurationMs),
+			track.AddedAt,
+			track.URI,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// writeM3U writes an extended M3U playlist, the entries are Spotify URIs
+func writeM3U(w io.Writer, tracks []client.PlaylistTrack) error {
+	_, err := io.WriteString(w, "#EXTM3U\n")
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		_, err = fmt.Fprintf(w, "#EXTINF:%d,%s - %s\n%s\n", track.DurationMs/1000, track.Artist, track.Name, track.URI)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package export
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+var playlist = client.ExportedPlaylist{
+	ID:   "playlist",
+	Name: "Knopfler",
+	Tracks: []client.PlaylistTrack{
+		{
+			Name:       "Sailing to Philadelphia",
+			Artist:     "Mark Knopfler, James Taylor",
+			Album:      "Sailing to Philadelphia",
+			ISRC:       "GBF080000501",
+			DurationMs: 328000,
+			AddedAt:    "2020-05-16T09:27:00Z",
+			URI:        "spotify:track:1",
+		},
+		{
+			Name:       "Darling Pretty",
+			Artist:     "Mark Knopfler",
+			Album:      "Golden Heart",
+			DurationMs: 267000,
+			AddedAt:    "2020-05-16T09:28:00Z",
+			URI:        "spotify:track:2",
+		},
+	},
+}
+
+func TestWriteCSVRoundTrip(t *testing.T) {
+	const funcName = "TestWriteCSVRoundTrip"
+	var buffer bytes.Buffer
+	if err := Write(&buffer, FormatCSV, playlist); err != nil {
+		t.Fatalf("%s: Write: %v", funcName, err)
+	}
+	tracks, err := csv.GetInputTracks(buffer.String())
+	if err != nil {
+		t.Fatalf("%s: GetInputTracks: %v", funcName, err)
+	}
+	if len(tracks) != len(playlist.Tracks) {
+		t.Fatalf("%s: expected %d tracks, got %d", funcName, len(playlist.Tracks), len(tracks))
+	}
+	for i, track := range tracks {
+		exported := playlist.Tracks[i]
+		if track.Track != exported.Name || track.Artist != exported.Artist || track.Album != exported.Album ||
+			track.ISRC != exported.ISRC || track.URI != exported.URI {
+			t.Errorf("%s: track %d: %+v doesn't match %+v", funcName, i, track, exported)
+		}
+	}
+}
+
+func TestWriteM3U(t *testing.T) {
+	const funcName = "TestWriteM3U"
+	var buffer bytes.Buffer
+	if err := Write(&buffer, FormatM3U, playlist); err != nil {
+		t.Fatalf("%s: Write: %v", funcName, err)
+	}
+	expected := "#EXTM3U\n" +
+		"#EXTINF:328,Mark Knopfler, James Taylor - Sailing to Philadelphia\nspotify:track:1\n" +
+		"#EXTINF:267,Mark Knopfler - Darling Pretty\nspotify:track:2\n"
+	if buffer.String() != expected {
+		t.Errorf("%s: unexpected playlist:\n%s", funcName, buffer.String())
+	}
+	if err := Write(&buffer, "xspf", playlist); err == nil || IsFormat("xspf") {
+		t.Errorf("%s: xspf format shouldn't be supported", funcName)
+	}
+	if !strings.HasPrefix(ContentType(FormatCSV), "text/csv") {
+		t.Errorf("%s: unexpected csv content type: %s", funcName, ContentType(FormatCSV))
+	}
+}
+
+func TestWriteUnmatched(t *testing.T) {
+	const funcName = "TestWriteUnmatched"
+	header := []string{"Name", "Artist", "Album"}
+	var buffer bytes.Buffer
+	err := WriteUnmatched(&buffer, header, []UnmatchedTrack{
+		{
+			Record:  []string{"Darling Prety", "Mark Knopfler", "Golden Heart"},
+			Reason:  "low_confidence",
+			Queries: []string{"artist:Mark Knopfler track:Darling Prety", "mark knopfler darling prety"},
+		},
+		// a short row keeps the extra columns aligned
+		{Record: []string{"Romeo and Juliet", "Dire Straits"}, Reason: "no_results"},
+	})
+	if err != nil {
+		t.Fatalf("%s: WriteUnmatched: %v", funcName, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	expected := []string{
+		"Name,Artist,Album,Reason,Queries",
+		"Darling Prety,Mark Knopfler,Golden Heart,low_confidence,artist:Mark Knopfler track:Darling Prety | mark knopfler darling prety",
+		"Romeo and Juliet,Dire Straits,,no_results,",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("%s: unexpected report:\n%s", funcName, buffer.String())
+	}
+
+	// the report can be uploaded again
+	tracks, err := csv.GetInputTracks(buffer.String())
+	if err != nil || len(tracks) != 2 || tracks[0].Track != "Darling Prety" || tracks[1].Album != "" {
+		t.Errorf("%s: unexpected tracks: %v err: %v", funcName, tracks, err)
+	}
+}
@@ -0,0 +1,51 @@
+package export
+
+import (
+	stdcsv "encoding/csv"
+	"io"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+// queriesSeparator joins the queries of a track in a single cell
+const queriesSeparator = " | "
+
+// UnmatchedTrack is a CSV row which wasn't added by a job
+type UnmatchedTrack struct {
+	// Record is the row as it was uploaded
+	Record  []string
+	Reason  string
+	Queries []string
+}
+
+// ReportFileName returns the download file name of the unmatched tracks report of a file
+func ReportFileName(fileName string) string {
+	if fileName == "" {
+		fileName = "playlist"
+	}
+	return fileName + " - unmatched." + FormatCSV
+}
+
+// WriteUnmatched writes the unmatched tracks as CSV in the column layout of header
+// followed by the reason and the queries which were tried, the report can be fixed
+// and uploaded again since the extra columns are ignored
+func WriteUnmatched(w io.Writer, header []string, tracks []UnmatchedTrack) error {
+	csvWriter := stdcsv.NewWriter(w)
+	err := csvWriter.Write(append(append([]string{}, header...), csv.ColumnReason, csv.ColumnQueries))
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		// rows may be shorter than the header, the extra columns must stay aligned
+		row := make([]string, len(header), len(header)+2)
+		copy(row, track.Record)
+		row = append(row, track.Reason, strings.Join(track.Queries, queriesSeparator))
+		err = csvWriter.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
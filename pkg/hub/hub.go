@@ -0,0 +1,352 @@
+/*
+Package hub fans out job messages consumed from kafka to the
+websocket and server-sent events connections of a user
+*/
+package hub
+
+import (
+	"sync"
+
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+	"github.com/yossisp/csv-to-spotify/pkg/utils"
+)
+
+const (
+	// MessageUpdate carries the number of tracks added/not added
+	MessageUpdate = "UPDATE"
+	// MessageTrackResult carries the lookup outcome of a single track
+	MessageTrackResult = "TRACK_RESULT"
+	// MessageSyncDiff carries the playlist changes of a sync job, it precedes MessageJobFinished
+	MessageSyncDiff = "SYNC_DIFF"
+	// MessageMigrationProgress carries the progress of a single playlist of a migration job
+	MessageMigrationProgress = "MIGRATION_PROGRESS"
+	// MessageReviewRequired lists the tracks which wait for the user to pick a candidate,
+	// clients answer with REVIEW_CHOICE websocket messages
+	MessageReviewRequired = "REVIEW_REQUIRED"
+	// MessagePreviewReady is the last message of a preview job until it's committed,
+	// the job continues with the same sequence numbers once it's committed
+	MessagePreviewReady = "PREVIEW_READY"
+	// MessageJobFinished is the last message of a job
+	MessageJobFinished = "JOB_FINISHED"
+	// MessageJobCancelled is the last message of a job cancelled by the user
+	MessageJobCancelled = "JOB_CANCELLED"
+	// MessageJobFailed is the last message of a job which failed, it carries the cause
+	MessageJobFailed = "JOB_FAILED"
+
+	// reviewOutcome is the outcome of tracks which wait for review (client.OutcomeReview)
+	reviewOutcome = "review"
+
+	// subscriptionBufferSize is how many messages a slow connection may lag behind,
+	// further messages are dropped and the connection catches up from the job store,
+	// see Subscription.Stale
+	subscriptionBufferSize = 64
+)
+
+// ClientMessage is a job message as it's sent to clients
+type ClientMessage struct {
+	MessageType    string      `json:"type"`
+	MessagePayload interface{} `json:"payload,omitempty"`
+	JobID          string      `json:"jobId,omitempty"`
+	Seq            int         `json:"seq,omitempty"`
+}
+
+// Subscription receives the job messages of a user
+type Subscription struct {
+	UserID   string
+	Messages chan kafkahelper.Message
+	// Stale receives once messages were dropped because Messages was full,
+	// the subscriber catches up from the job store then (e.g. with Replay)
+	Stale chan struct{}
+}
+
+// registry holds the subscriptions of every user
+type registry struct {
+	subscriptions map[string]map[*Subscription]bool
+	mutex         sync.Mutex
+}
+
+var (
+	msgChan       chan kafkahelper.Message = make(chan kafkahelper.Message)
+	subscriptions *registry                = &registry{subscriptions: make(map[string]map[*Subscription]bool)}
+	startOnce     sync.Once
+	logger        = utils.NewLogger("hub")
+)
+
+// Start consumes the job messages of the kafkahelper bus and dispatches them
+// to the subscriptions, it's safe to call more than once
+func Start() {
+	startOnce.Do(func() {
+		go kafkahelper.ConsumeMessages(msgChan)
+		go subscriptions.dispatch(msgChan)
+	})
+}
+
+// Subscribe starts receiving job messages of the user
+func Subscribe(userID string) *Subscription {
+	subscription := &Subscription{
+		UserID:   userID,
+		Messages: make(chan kafkahelper.Message, subscriptionBufferSize),
+		Stale:    make(chan struct{}, 1),
+	}
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+	if _, found := subscriptions.subscriptions[userID]; !found {
+		subscriptions.subscriptions[userID] = make(map[*Subscription]bool)
+	}
+	subscriptions.subscriptions[userID][subscription] = true
+	return subscription
+}
+
+// Unsubscribe stops receiving job messages, it's safe to call more than once
+func (subscription *Subscription) Unsubscribe() {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+	userSubscriptions := subscriptions.subscriptions[subscription.UserID]
+	delete(userSubscriptions, subscription)
+	if len(userSubscriptions) == 0 {
+		delete(subscriptions.subscriptions, subscription.UserID)
+	}
+}
+
+// dispatch is started by Start()
+// it forwards every kafka message to the subscriptions of its user
+// without blocking on slow subscribers, they're marked stale instead
+func (registry *registry) dispatch(messages <-chan kafkahelper.Message) {
+	for msg := range messages {
+		registry.mutex.Lock()
+		for subscription := range registry.subscriptions[msg.UserID] {
+			select {
+			case subscription.Messages <- msg:
+			default:
+				logger("dispatch: user id: %s dropped message job: %s seq: %d", msg.UserID, msg.JobID, msg.Seq)
+				select {
+				case subscription.Stale <- struct{}{}:
+				default:
+				}
+			}
+		}
+		registry.mutex.Unlock()
+	}
+}
+
+// NewClientMessage converts a kafka message to a client message,
+// isJobFinished is set for the last message of a job
+func NewClientMessage(msg kafkahelper.Message) (clientMessage ClientMessage, isJobFinished bool, ok bool) {
+	clientMessage = ClientMessage{
+		MessagePayload: msg.Msg,
+		JobID:          msg.JobID,
+		Seq:            msg.Seq,
+	}
+	switch msg.MsgType {
+	case kafkahelper.TrackProgress:
+		clientMessage.MessageType = MessageUpdate
+	case kafkahelper.TrackResult:
+		clientMessage.MessageType = MessageTrackResult
+	case kafkahelper.SyncDiff:
+		clientMessage.MessageType = MessageSyncDiff
+	case kafkahelper.MigrationProgress:
+		clientMessage.MessageType = MessageMigrationProgress
+	case kafkahelper.ReviewRequired:
+		clientMessage.MessageType = MessageReviewRequired
+	case kafkahelper.PreviewReady:
+		clientMessage.MessageType = MessagePreviewReady
+		isJobFinished = true
+	case kafkahelper.JobFinished:
+		clientMessage.MessageType = MessageJobFinished
+		isJobFinished = true
+	case kafkahelper.JobFailed:
+		clientMessage.MessageType = MessageJobFailed
+		isJobFinished = true
+	case kafkahelper.JobCancelled:
+		clientMessage.MessageType = MessageJobCancelled
+		isJobFinished = true
+	default:
+		logger("NewClientMessage: unknown message: %v", msg)
+		return clientMessage, false, false
+	}
+	return clientMessage, isJobFinished, true
+}
+
+// Replay rebuilds from the job store the messages of a job published after afterSeq.
+// Track results keep their sequence numbers, the progress message summarises
+// the rest so it carries the job's sequence number unless the job has finished.
+func Replay(job db.Job, tracks []db.JobTrack, afterSeq int) (messages []kafkahelper.Message) {
+	if job.Seq <= afterSeq {
+		return
+	}
+	for _, track := range tracks {
+		if track.Seq <= afterSeq {
+			continue
+		}
+		messages = append(messages, kafkahelper.Message{
+			MsgType: kafkahelper.TrackResult,
+			Msg:     newTrackResultMsg(track),
+			JobID:   job.ID,
+			Seq:     track.Seq,
+			UserID:  job.UserID,
+		})
+	}
+	if job.Migration != nil {
+		// the playlists state summarises their progress messages
+		for i, playlist := range job.Migration.Playlists {
+			messages = append(messages, kafkahelper.Message{
+				MsgType: kafkahelper.MigrationProgress,
+				Msg:     newMigrationProgressMsg(i, playlist),
+				JobID:   job.ID,
+				UserID:  job.UserID,
+			})
+		}
+	}
+	progress := kafkahelper.Message{
+		MsgType: kafkahelper.TrackProgress,
+		Msg: map[string]int{
+			"tracksAdded":    job.TracksAdded,
+			"tracksNotAdded": job.TracksNotAdded,
+		},
+		JobID:  job.ID,
+		UserID: job.UserID,
+	}
+	switch job.Status {
+	case db.JobRunning:
+		if job.AwaitingReview {
+			messages = append(messages, kafkahelper.Message{
+				MsgType: kafkahelper.ReviewRequired,
+				Msg:     newReviewRequiredMsg(tracks),
+				JobID:   job.ID,
+				UserID:  job.UserID,
+			})
+		}
+		progress.Seq = job.Seq
+		messages = append(messages, progress)
+	case db.JobFinished:
+		messages = append(messages, progress)
+		if job.SyncDiff != nil {
+			messages = append(messages, kafkahelper.Message{
+				MsgType: kafkahelper.SyncDiff,
+				Msg:     newSyncDiffMsg(*job.SyncDiff),
+				JobID:   job.ID,
+				UserID:  job.UserID,
+			})
+		}
+		messages = append(messages, kafkahelper.Message{
+			MsgType: kafkahelper.JobFinished,
+			JobID:   job.ID,
+			Seq:     job.Seq,
+			UserID:  job.UserID,
+		})
+	case db.JobPreviewed:
+		messages = append(messages, progress, kafkahelper.Message{
+			MsgType: kafkahelper.PreviewReady,
+			JobID:   job.ID,
+			Seq:     job.Seq,
+			UserID:  job.UserID,
+		})
+	case db.JobCancelled:
+		messages = append(messages, progress, kafkahelper.Message{
+			MsgType: kafkahelper.JobCancelled,
+			JobID:   job.ID,
+			Seq:     job.Seq,
+			UserID:  job.UserID,
+		})
+	case db.JobFailed:
+		messages = append(messages, progress, kafkahelper.Message{
+			MsgType: kafkahelper.JobFailed,
+			Msg: kafkahelper.JobFailedMsg{
+				Cause: job.FailureCause,
+				Error: job.FailureMessage,
+			},
+			JobID:  job.ID,
+			Seq:    job.Seq,
+			UserID: job.UserID,
+		})
+	}
+	return
+}
+
+// IsJobDone reports whether no more messages will be published for the job,
+// previewed jobs publish more messages only once they're committed
+func IsJobDone(job db.Job) bool {
+	return job.Status != db.JobRunning
+}
+
+func newTrackResultMsg(track db.JobTrack) kafkahelper.TrackResultMsg {
+	return kafkahelper.TrackResultMsg{
+		Index:       track.Index,
+		Artist:      track.Artist,
+		Title:       track.Title,
+		IsFound:     track.IsFound,
+		Outcome:     track.Outcome,
+		TrackID:     track.TrackID,
+		TrackName:   track.TrackName,
+		TrackArtist: track.TrackArtist,
+		Confidence:  track.Confidence,
+		Strategy:    track.Strategy,
+		Reason:      track.Reason,
+		Market:      track.Market,
+		Candidates:  newCandidateMsgs(track.Candidates),
+	}
+}
+
+// newCandidateMsgs converts the review candidates of a track to kafka messages
+func newCandidateMsgs(candidates []db.Candidate) []kafkahelper.CandidateMsg {
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidateMsgs := make([]kafkahelper.CandidateMsg, len(candidates))
+	for i, candidate := range candidates {
+		candidateMsgs[i] = kafkahelper.CandidateMsg{
+			TrackID:    candidate.TrackID,
+			URI:        candidate.URI,
+			Name:       candidate.Name,
+			Artist:     candidate.Artist,
+			Album:      candidate.Album,
+			ImageURL:   candidate.ImageURL,
+			PreviewURL: candidate.PreviewURL,
+			Confidence: candidate.Confidence,
+		}
+	}
+	return candidateMsgs
+}
+
+// newReviewRequiredMsg lists the tracks which still wait for review
+func newReviewRequiredMsg(tracks []db.JobTrack) kafkahelper.ReviewRequiredMsg {
+	reviewMsg := kafkahelper.ReviewRequiredMsg{Indexes: []int{}}
+	for _, track := range tracks {
+		if track.Outcome == reviewOutcome {
+			reviewMsg.Indexes = append(reviewMsg.Indexes, track.Index)
+		}
+	}
+	return reviewMsg
+}
+
+func newSyncDiffMsg(diff db.SyncDiff) kafkahelper.SyncDiffMsg {
+	diffMsg := kafkahelper.SyncDiffMsg{
+		Added:   diff.Added,
+		Removed: diff.Removed,
+		Moved:   make([]kafkahelper.PlaylistMoveMsg, len(diff.Moved)),
+		DryRun:  diff.DryRun,
+	}
+	for i, move := range diff.Moved {
+		diffMsg.Moved[i] = kafkahelper.PlaylistMoveMsg{
+			URI:  move.URI,
+			From: move.From,
+			To:   move.To,
+		}
+	}
+	return diffMsg
+}
+
+// newMigrationProgressMsg converts the state of a migrated playlist to a kafka message
+func newMigrationProgressMsg(index int, playlist db.MigrationPlaylist) kafkahelper.MigrationProgressMsg {
+	return kafkahelper.MigrationProgressMsg{
+		Index:        index,
+		SourceID:     playlist.SourceID,
+		LikedSongs:   playlist.LikedSongs,
+		Name:         playlist.Name,
+		TargetID:     playlist.TargetID,
+		TracksTotal:  playlist.TracksTotal,
+		TracksCopied: playlist.TracksCopied,
+		Status:       string(playlist.Status),
+	}
+}
@@ -0,0 +1,165 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+)
+
+func TestDispatchOverflow(t *testing.T) {
+	const funcName = "TestDispatchOverflow"
+	registry := &registry{subscriptions: make(map[string]map[*Subscription]bool)}
+	subscription := &Subscription{
+		UserID:   "user",
+		Messages: make(chan kafkahelper.Message, 1),
+		Stale:    make(chan struct{}, 1),
+	}
+	registry.subscriptions["user"] = map[*Subscription]bool{subscription: true}
+	messages := make(chan kafkahelper.Message)
+	go registry.dispatch(messages)
+	defer close(messages)
+
+	messages <- kafkahelper.Message{MsgType: kafkahelper.TrackProgress, JobID: "job", Seq: 1, UserID: "user"}
+	// the buffer is full, the last messages are dropped
+	messages <- kafkahelper.Message{MsgType: kafkahelper.TrackProgress, JobID: "job", Seq: 2, UserID: "user"}
+	messages <- kafkahelper.Message{MsgType: kafkahelper.JobFinished, JobID: "job", Seq: 3, UserID: "user"}
+	select {
+	case <-subscription.Stale:
+	case <-time.After(time.Second):
+		t.Fatalf("%s: expected the subscription to be marked stale", funcName)
+	}
+	if msg := <-subscription.Messages; msg.Seq != 1 {
+		t.Errorf("%s: expected the first message, got %v", funcName, msg)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tracks := []db.JobTrack{
+		{Index: 0, Seq: 1, IsFound: true},
+		{Index: 1, Seq: 3, IsFound: false},
+	}
+	job := db.Job{ID: "job", UserID: "user", Status: db.JobRunning, TracksAdded: 1, TracksNotAdded: 1, Seq: 4}
+
+	const testReplayRunning = "TestReplayRunning"
+	t.Run(testReplayRunning, func(t *testing.T) {
+		messages := Replay(job, tracks, 2)
+		if len(messages) != 2 {
+			t.Fatalf("%s: expected 2 messages, got %d", testReplayRunning, len(messages))
+		}
+		if messages[0].MsgType != kafkahelper.TrackResult || messages[0].Seq != 3 {
+			t.Errorf("%s: unexpected first message: %v", testReplayRunning, messages[0])
+		}
+		if messages[1].MsgType != kafkahelper.TrackProgress || messages[1].Seq != job.Seq {
+			t.Errorf("%s: unexpected progress message: %v", testReplayRunning, messages[1])
+		}
+	})
+
+	const testReplayUpToDate = "TestReplayUpToDate"
+	t.Run(testReplayUpToDate, func(t *testing.T) {
+		if messages := Replay(job, tracks, job.Seq); len(messages) != 0 {
+			t.Errorf("%s: expected no messages, got %d", testReplayUpToDate, len(messages))
+		}
+	})
+
+	const testReplayFinished = "TestReplayFinished"
+	t.Run(testReplayFinished, func(t *testing.T) {
+		finishedJob := job
+		finishedJob.Status = db.JobFinished
+		finishedJob.Seq = 5
+		messages := Replay(finishedJob, tracks, 0)
+		if len(messages) != 4 {
+			t.Fatalf("%s: expected 4 messages, got %d", testReplayFinished, len(messages))
+		}
+		last := messages[len(messages)-1]
+		if _, isJobFinished, _ := NewClientMessage(last); !isJobFinished || last.Seq != finishedJob.Seq {
+			t.Errorf("%s: unexpected last message: %v", testReplayFinished, last)
+		}
+	})
+
+	const testReplaySyncDiff = "TestReplaySyncDiff"
+	t.Run(testReplaySyncDiff, func(t *testing.T) {
+		syncedJob := job
+		syncedJob.Status = db.JobFinished
+		syncedJob.Seq = 6
+		syncedJob.SyncDiff = &db.SyncDiff{
+			Added: []string{"spotify:track:a"},
+			Moved: []db.PlaylistMove{{URI: "spotify:track:b", From: 1, To: 0}},
+		}
+		messages := Replay(syncedJob, tracks, syncedJob.Seq-1)
+		if len(messages) != 3 || messages[1].MsgType != kafkahelper.SyncDiff {
+			t.Fatalf("%s: expected progress, sync diff and finished messages, got %v", testReplaySyncDiff, messages)
+		}
+		diffMsg, ok := messages[1].Msg.(kafkahelper.SyncDiffMsg)
+		if !ok || len(diffMsg.Moved) != 1 || diffMsg.Moved[0].From != 1 {
+			t.Errorf("%s: unexpected sync diff: %v", testReplaySyncDiff, messages[1].Msg)
+		}
+	})
+
+	const testReplayReview = "TestReplayReview"
+	t.Run(testReplayReview, func(t *testing.T) {
+		reviewTracks := append(tracks, db.JobTrack{
+			Index:      2,
+			Seq:        4,
+			Outcome:    "review",
+			Candidates: []db.Candidate{{TrackID: "a", Name: "Brothers in Arms"}},
+		})
+		reviewJob := job
+		reviewJob.Review = true
+		reviewJob.AwaitingReview = true
+		reviewJob.Seq = 5
+		messages := Replay(reviewJob, reviewTracks, 0)
+		if len(messages) != 5 || messages[3].MsgType != kafkahelper.ReviewRequired {
+			t.Fatalf("%s: expected track results, review and progress messages, got %v", testReplayReview, messages)
+		}
+		resultMsg, ok := messages[2].Msg.(kafkahelper.TrackResultMsg)
+		if !ok || len(resultMsg.Candidates) != 1 || resultMsg.Candidates[0].TrackID != "a" {
+			t.Errorf("%s: unexpected track result: %v", testReplayReview, messages[2].Msg)
+		}
+		reviewMsg, ok := messages[3].Msg.(kafkahelper.ReviewRequiredMsg)
+		if !ok || len(reviewMsg.Indexes) != 1 || reviewMsg.Indexes[0] != 2 {
+			t.Errorf("%s: unexpected review message: %v", testReplayReview, messages[3].Msg)
+		}
+	})
+
+	const testReplayPreview = "TestReplayPreview"
+	t.Run(testReplayPreview, func(t *testing.T) {
+		previewedJob := job
+		previewedJob.Preview = true
+		previewedJob.Status = db.JobPreviewed
+		previewedJob.Seq = 5
+		messages := Replay(previewedJob, tracks, 0)
+		if len(messages) != 4 {
+			t.Fatalf("%s: expected 4 messages, got %d", testReplayPreview, len(messages))
+		}
+		last := messages[len(messages)-1]
+		clientMessage, isJobFinished, _ := NewClientMessage(last)
+		if clientMessage.MessageType != MessagePreviewReady || !isJobFinished || last.Seq != previewedJob.Seq {
+			t.Errorf("%s: unexpected last message: %v", testReplayPreview, last)
+		}
+	})
+
+	const testReplayMigration = "TestReplayMigration"
+	t.Run(testReplayMigration, func(t *testing.T) {
+		migrationJob := db.Job{ID: "migration", UserID: "user", Status: db.JobFailed, Seq: 3}
+		migrationJob.Migration = &db.Migration{
+			TargetUserID: "target",
+			Playlists: []db.MigrationPlaylist{
+				{SourceID: "source", Name: "Knopfler", TargetID: "copy", TracksTotal: 150, TracksCopied: 100, Status: db.MigrationCopying},
+				{LikedSongs: true, Name: "Liked Songs", Status: db.MigrationPending},
+			},
+		}
+		messages := Replay(migrationJob, nil, 0)
+		if len(messages) != 4 {
+			t.Fatalf("%s: expected 4 messages, got %d", testReplayMigration, len(messages))
+		}
+		progressMsg, ok := messages[0].Msg.(kafkahelper.MigrationProgressMsg)
+		if !ok || progressMsg.TracksCopied != 100 || progressMsg.Status != string(db.MigrationCopying) {
+			t.Errorf("%s: unexpected playlist progress: %v", testReplayMigration, messages[0].Msg)
+		}
+		if clientMessage, _, _ := NewClientMessage(messages[1]); clientMessage.MessageType != MessageMigrationProgress {
+			t.Errorf("%s: unexpected message type: %s", testReplayMigration, clientMessage.MessageType)
+		}
+	})
+}
@@ -18,15 +18,29 @@ var (
 	logger                           = utils.NewLogger("kafkahelper")
 )
 
-type messageType int
+// MessageType is the kind of a Message
+type MessageType int
 
 const (
 	// TrackProgress - that the message carries progress information
-	TrackProgress messageType = iota
+	TrackProgress MessageType = iota
 	// JobFinished - that the job is finished
 	JobFinished
-	// CSVFileError - an error with CSV file occurred
-	CSVFileError
+	// JobFailed - the job failed, the failure cause explains why
+	// (e.g. add_tracks_failed, sync_failed, migration_failed, interrupted)
+	JobFailed
+	// TrackResult - that the message carries the lookup outcome of a single track
+	TrackResult
+	// JobCancelled - that the job was cancelled by the user
+	JobCancelled
+	// SyncDiff - that the message carries the playlist changes of a sync job
+	SyncDiff
+	// MigrationProgress - that the message carries the progress of a single migrated playlist
+	MigrationProgress
+	// PreviewReady - that the tracks of a preview job were looked up and wait to be committed
+	PreviewReady
+	// ReviewRequired - that the lookups are done and the job waits for the review of some tracks
+	ReviewRequired
 )
 
 // Producer holds kafka producer
@@ -39,10 +53,13 @@ type Consumer struct {
 	*kafka.Consumer
 }
 
-// Message is used to communicate between producer and consumer
+// Message is used to communicate between producer and consumer.
+// Seq orders the messages of a job, it's incremented by one for every message.
 type Message struct {
-	MsgType messageType `json:"msgType"`
+	MsgType MessageType `json:"msgType"`
 	Msg     interface{} `json:"msg"`
+	JobID   string      `json:"jobId"`
+	Seq     int         `json:"seq"`
 	UserID  string
 }
 
@@ -53,42 +70,200 @@ type trackProgress struct {
 	TracksNotAdded int `json:"tracksNotAdded"`
 }
 
+// TrackResultMsg is used to communicate the lookup outcome
+// of a single input track. Match fields are empty when the track
+// was not found, in which case Reason is set.
+type TrackResultMsg struct {
+	Index       int     `json:"index"`
+	Artist      string  `json:"artist"`
+	Title       string  `json:"title"`
+	IsFound     bool    `json:"isFound"`
+	Outcome     string  `json:"outcome"`
+	TrackID     string  `json:"trackId,omitempty"`
+	TrackName   string  `json:"trackName,omitempty"`
+	TrackArtist string  `json:"trackArtist,omitempty"`
+	Confidence  float64 `json:"confidence,omitempty"`
+	Strategy    string  `json:"strategy,omitempty"`
+	Reason      string  `json:"reason,omitempty"`
+	Market      string  `json:"market,omitempty"`
+	// Candidates are set when Outcome is "review"
+	Candidates []CandidateMsg `json:"candidates,omitempty"`
+}
+
+// CandidateMsg is a possible match of a track which needs review
+type CandidateMsg struct {
+	TrackID    string  `json:"trackId"`
+	URI        string  `json:"uri"`
+	Name       string  `json:"name"`
+	Artist     string  `json:"artist"`
+	Album      string  `json:"album,omitempty"`
+	ImageURL   string  `json:"imageUrl,omitempty"`
+	PreviewURL string  `json:"previewUrl,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ReviewRequiredMsg is used to communicate which tracks (CSV indexes)
+// wait for the user to pick a candidate or skip them
+type ReviewRequiredMsg struct {
+	Indexes []int `json:"indexes"`
+}
+
+// JobFailedMsg is used to communicate why a job failed,
+// Cause is an apierror code e.g. "invalid_csv"
+type JobFailedMsg struct {
+	Cause string `json:"cause"`
+	Error string `json:"error"`
+}
+
+// SyncDiffMsg is used to communicate the playlist changes of a sync job,
+// the playlist wasn't changed if DryRun is set
+type SyncDiffMsg struct {
+	Added   []string          `json:"added"`
+	Removed []string          `json:"removed"`
+	Moved   []PlaylistMoveMsg `json:"moved"`
+	DryRun  bool              `json:"dryRun"`
+}
+
+// PlaylistMoveMsg is a single track move of SyncDiffMsg
+type PlaylistMoveMsg struct {
+	URI  string `json:"uri"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// MigrationProgressMsg is used to communicate the progress of a single
+// playlist of a migration job, Index is its position in the migration
+type MigrationProgressMsg struct {
+	Index        int    `json:"index"`
+	SourceID     string `json:"sourceId,omitempty"`
+	LikedSongs   bool   `json:"likedSongs,omitempty"`
+	Name         string `json:"name"`
+	TargetID     string `json:"targetId,omitempty"`
+	TracksTotal  int    `json:"tracksTotal"`
+	TracksCopied int    `json:"tracksCopied"`
+	Status       string `json:"status"`
+}
+
 // getTrackProgressMsg creates track progress message
-func getTrackProgressMsg(trackData []interface{}) ([]byte, error) {
+func getTrackProgressMsg(trackData []interface{}) (Message, error) {
 	const funcName = "getTrackProgressMsg"
 	tracksAdded, ok := trackData[0].(int)
 	if !ok {
-		return nil, fmt.Errorf("%s: couldn't get tracksAdded", funcName)
+		return Message{}, fmt.Errorf("%s: couldn't get tracksAdded", funcName)
 	}
 	tracksNotAdded, ok := trackData[1].(int)
 	if !ok {
-		return nil, fmt.Errorf("%s: couldn't get tracksNotAdded", funcName)
+		return Message{}, fmt.Errorf("%s: couldn't get tracksNotAdded", funcName)
 	}
 	progressMsg := trackProgress{
 		TracksAdded:    tracksAdded,
 		TracksNotAdded: tracksNotAdded,
 	}
-	return json.Marshal(Message{
+	return Message{
 		MsgType: TrackProgress,
 		Msg:     progressMsg,
-	})
+	}, nil
+}
+
+// getTrackResultMsg creates track result message
+func getTrackResultMsg(trackData []interface{}) (Message, error) {
+	const funcName = "getTrackResultMsg"
+	if len(trackData) == 0 {
+		return Message{}, fmt.Errorf("%s: missing track result", funcName)
+	}
+	resultMsg, ok := trackData[0].(TrackResultMsg)
+	if !ok {
+		return Message{}, fmt.Errorf("%s: couldn't get track result", funcName)
+	}
+	return Message{
+		MsgType: TrackResult,
+		Msg:     resultMsg,
+	}, nil
 }
 
 // getJobFinishedMsg notifies that the job has finished
-func getJobFinishedMsg() ([]byte, error) {
-	return json.Marshal(Message{
+func getJobFinishedMsg() (Message, error) {
+	return Message{
 		MsgType: JobFinished,
-	})
+	}, nil
 }
 
-// getCSVFileErrorMsg notifies that the job has finished
-func getCSVFileErrorMsg() ([]byte, error) {
-	return json.Marshal(Message{
-		MsgType: CSVFileError,
-		Msg: map[string]string{
-			"error": "CSV file error",
-		},
-	})
+// getJobCancelledMsg notifies that the job was cancelled
+func getJobCancelledMsg() (Message, error) {
+	return Message{
+		MsgType: JobCancelled,
+	}, nil
+}
+
+// getReviewRequiredMsg creates review required message
+func getReviewRequiredMsg(reviewData []interface{}) (Message, error) {
+	const funcName = "getReviewRequiredMsg"
+	if len(reviewData) == 0 {
+		return Message{}, fmt.Errorf("%s: missing review", funcName)
+	}
+	reviewMsg, ok := reviewData[0].(ReviewRequiredMsg)
+	if !ok {
+		return Message{}, fmt.Errorf("%s: couldn't get review", funcName)
+	}
+	return Message{
+		MsgType: ReviewRequired,
+		Msg:     reviewMsg,
+	}, nil
+}
+
+// getPreviewReadyMsg notifies that the job waits to be committed
+func getPreviewReadyMsg() (Message, error) {
+	return Message{
+		MsgType: PreviewReady,
+	}, nil
+}
+
+// getJobFailedMsg notifies that the job has failed
+func getJobFailedMsg(failureData []interface{}) (Message, error) {
+	const funcName = "getJobFailedMsg"
+	if len(failureData) == 0 {
+		return Message{}, fmt.Errorf("%s: missing failure", funcName)
+	}
+	failedMsg, ok := failureData[0].(JobFailedMsg)
+	if !ok {
+		return Message{}, fmt.Errorf("%s: couldn't get failure", funcName)
+	}
+	return Message{
+		MsgType: JobFailed,
+		Msg:     failedMsg,
+	}, nil
+}
+
+// getSyncDiffMsg creates sync diff message
+func getSyncDiffMsg(diffData []interface{}) (Message, error) {
+	const funcName = "getSyncDiffMsg"
+	if len(diffData) == 0 {
+		return Message{}, fmt.Errorf("%s: missing diff", funcName)
+	}
+	diffMsg, ok := diffData[0].(SyncDiffMsg)
+	if !ok {
+		return Message{}, fmt.Errorf("%s: couldn't get diff", funcName)
+	}
+	return Message{
+		MsgType: SyncDiff,
+		Msg:     diffMsg,
+	}, nil
+}
+
+// getMigrationProgressMsg creates migration progress message
+func getMigrationProgressMsg(progressData []interface{}) (Message, error) {
+	const funcName = "getMigrationProgressMsg"
+	if len(progressData) == 0 {
+		return Message{}, fmt.Errorf("%s: missing progress", funcName)
+	}
+	progressMsg, ok := progressData[0].(MigrationProgressMsg)
+	if !ok {
+		return Message{}, fmt.Errorf("%s: couldn't get progress", funcName)
+	}
+	return Message{
+		MsgType: MigrationProgress,
+		Msg:     progressMsg,
+	}, nil
 }
 
 // getConfig returns kafka config for producer/consumer
@@ -138,12 +313,71 @@ func NewConsumer() *Consumer {
 	return &Consumer{consumer}
 }
 
-// ProduceMessage produces kafka message
-func (producer *Producer) ProduceMessage(userID string, msgType messageType, msgParams ...interface{}) {
+// Bus carries the JSON encoded job messages keyed by user id from the runners to the hub
+type Bus interface {
+	// Publish sends value keyed by userID, it doesn't wait for the delivery
+	Publish(userID string, value []byte)
+	// ConsumeMessages sends every published message to msgChan, it doesn't return
+	ConsumeMessages(msgChan chan Message)
+}
+
+// kafkaBus publishes to and consumes from KAFKA_TRACK_PROGRESS_TOPIC
+type kafkaBus struct {
+	producer *Producer
+	consumer *Consumer
+}
+
+// bus is set by Connect or UseBus before the server starts
+var bus Bus
+
+// Connect connects to kafka and makes it the bus of the package
+func Connect() {
+	producer := NewProducer()
+	go producer.LogDeliveredMessages()
+	UseBus(&kafkaBus{
+		producer: producer,
+		consumer: NewConsumer(),
+	})
+}
+
+// UseBus makes b the bus of the package
+func UseBus(b Bus) {
+	bus = b
+}
+
+func (kafkaBus *kafkaBus) Publish(userID string, value []byte) {
+	kafkaBus.producer.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{
+		Topic: &trackProgressTopic, Partition: kafka.PartitionAny},
+		Key:       []byte(userID),
+		Value:     value,
+		Timestamp: time.Now(),
+	}, nil)
+}
+
+func (kafkaBus *kafkaBus) ConsumeMessages(msgChan chan Message) {
+	kafkaBus.consumer.ConsumeMessages(msgChan)
+}
+
+// ConsumeMessages sends the job messages of the bus to msgChan, it doesn't return
+func ConsumeMessages(msgChan chan Message) {
+	bus.ConsumeMessages(msgChan)
+}
+
+// decodeMessage decodes a published message, its key is the user id
+func decodeMessage(key []byte, value []byte) (Message, error) {
+	msg := Message{}
+	err := json.Unmarshal(value, &msg)
+	msg.UserID = string(key)
+	return msg, err
+}
+
+// ProduceMessage publishes a job message, seq is the sequence number of the message within the job
+func ProduceMessage(userID string, jobID string, seq int, msgType MessageType, msgParams ...interface{}) {
 	const funcName = "ProduceMessage"
 	var (
-		msg []byte
-		err error
+		msg     Message
+		msgJSON []byte
+		err     error
 	)
 
 	switch msgType {
@@ -151,20 +385,32 @@ func (producer *Producer) ProduceMessage(userID string, msgType messageType, msg
 		msg, err = getTrackProgressMsg(msgParams)
 	case JobFinished:
 		msg, err = getJobFinishedMsg()
-	case CSVFileError:
-		msg, err = getCSVFileErrorMsg()
+	case JobFailed:
+		msg, err = getJobFailedMsg(msgParams)
+	case TrackResult:
+		msg, err = getTrackResultMsg(msgParams)
+	case JobCancelled:
+		msg, err = getJobCancelledMsg()
+	case SyncDiff:
+		msg, err = getSyncDiffMsg(msgParams)
+	case MigrationProgress:
+		msg, err = getMigrationProgressMsg(msgParams)
+	case PreviewReady:
+		msg, err = getPreviewReadyMsg()
+	case ReviewRequired:
+		msg, err = getReviewRequiredMsg(msgParams)
 	default:
-		logger("%s: unknown message type: %v", funcName, msgType)
+		err = fmt.Errorf("unknown message type: %v", msgType)
+	}
+	if err == nil {
+		msg.JobID = jobID
+		msg.Seq = seq
+		msgJSON, err = json.Marshal(msg)
 	}
 	if err != nil {
 		logger("%s: get message %v", funcName, err)
 	} else {
-		producer.Produce(&kafka.Message{TopicPartition: kafka.TopicPartition{
-			Topic: &trackProgressTopic, Partition: kafka.PartitionAny},
-			Key:       []byte(userID),
-			Value:     msg,
-			Timestamp: time.Now(),
-		}, nil)
+		bus.Publish(userID, msgJSON)
 	}
 }
 
@@ -179,12 +425,10 @@ func (consumer *Consumer) ConsumeMessages(msgChan chan Message) {
 		msg, err := consumer.ReadMessage(-1)
 		if err == nil {
 			logger("%s: Message on %s: %s ts: %v", funcName, msg.TopicPartition, string(msg.Value), msg.Timestamp)
-			kafkaMsg := Message{}
-			err = json.Unmarshal(msg.Value, &kafkaMsg)
+			kafkaMsg, err := decodeMessage(msg.Key, msg.Value)
 			if err != nil {
 				logger("%s: json.Unmarshal: %v", funcName, err)
 			} else {
-				kafkaMsg.UserID = string(msg.Key)
 				msgChan <- kafkaMsg
 			}
 		} else {
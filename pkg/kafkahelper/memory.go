@@ -0,0 +1,37 @@
+package kafkahelper
+
+// memoryBusSize is how many messages the in-memory bus holds before Publish blocks
+const memoryBusSize = 1024
+
+// publishedMessage is a message of MemoryBus as it would be produced to kafka
+type publishedMessage struct {
+	key   []byte
+	value []byte
+}
+
+// MemoryBus is an in-memory Bus, it's meant for tests which run without kafka.
+// Messages are delivered in publish order through the same JSON encoding as kafka's.
+type MemoryBus struct {
+	messages chan publishedMessage
+}
+
+// NewMemoryBus returns an empty in-memory bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{messages: make(chan publishedMessage, memoryBusSize)}
+}
+
+func (memoryBus *MemoryBus) Publish(userID string, value []byte) {
+	memoryBus.messages <- publishedMessage{key: []byte(userID), value: value}
+}
+
+func (memoryBus *MemoryBus) ConsumeMessages(msgChan chan Message) {
+	const funcName = "ConsumeMessages"
+	for published := range memoryBus.messages {
+		msg, err := decodeMessage(published.key, published.value)
+		if err != nil {
+			logger("%s: json.Unmarshal: %v", funcName, err)
+			continue
+		}
+		msgChan <- msg
+	}
+}
@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+)
+
+// rowKey identifies a CSV row by its exact values
+func rowKey(track csv.TrackInput) string {
+	return strings.Join([]string{track.Artist, track.Track, track.ISRC, track.URI}, "\x00")
+}
+
+// normalizedTrackKey identifies a CSV row regardless of case, spacing and punctuation,
+// versions such as "(Live)" are kept since they're different tracks
+func normalizedTrackKey(track csv.TrackInput) string {
+	return strings.Join([]string{
+		client.Normalize(track.Artist, true),
+		client.Normalize(track.Track, true),
+		strings.ToUpper(strings.TrimSpace(track.ISRC)),
+		strings.TrimSpace(track.URI),
+	}, "\x00")
+}
+
+// duplicateRows skips the repeated rows of a CSV file, they're counted by Duplicate* reason
+type duplicateRows struct {
+	isRow   map[string]bool
+	isTrack map[string]bool
+	skipped map[string]int
+}
+
+func newDuplicateRows() *duplicateRows {
+	return &duplicateRows{
+		isRow:   make(map[string]bool),
+		isTrack: make(map[string]bool),
+		skipped: make(map[string]int),
+	}
+}
+
+// keep reports whether the track is the first of the repeated rows, it's a csv.Filter
+func (rows *duplicateRows) keep(track csv.TrackInput) bool {
+	row, normalized := rowKey(track), normalizedTrackKey(track)
+	switch {
+	case rows.isRow[row]:
+		rows.skipped[client.DuplicateRow]++
+	case rows.isTrack[normalized]:
+		rows.skipped[client.DuplicateTrack]++
+	default:
+		rows.isRow[row], rows.isTrack[normalized] = true, true
+		return true
+	}
+	return false
+}
+
+// countDuplicates adds the skipped duplicates to the job summary
+func (runner *Runner) countDuplicates(skipped map[string]int) {
+	for reason, count := range skipped {
+		if runner.job.DuplicatesSkipped == nil {
+			runner.job.DuplicatesSkipped = make(map[string]int)
+		}
+		runner.job.DuplicatesSkipped[reason] += count
+	}
+	if len(skipped) > 0 {
+		logger("job: %s skips duplicates: %v", runner.job.ID, skipped)
+	}
+}
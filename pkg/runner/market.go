@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+// setMarkets sets the search markets of the job: the job market, the country of the
+// user (which is fetched on the user's first job) or the MARKET env var, then the fallbacks
+func (runner *Runner) setMarkets(spotifyProvider *client.SpotifyProvider) {
+	market := runner.job.Market
+	if market == "" {
+		market = runner.user.Country
+	}
+	if market == "" {
+		country, err := runner.fetchCountry(spotifyProvider)
+		if err != nil {
+			logger("job: %s couldn't fetch country of user %s: %v", runner.job.ID, runner.user.UserID, err)
+		} else {
+			db.SetUserCountry(runner.user.UserID, country)
+			runner.user.Country = country
+			market = country
+		}
+	}
+	runner.job.Markets = client.JobMarkets(market)
+	spotifyProvider.SetMarkets(runner.job.Markets)
+	db.UpdateJob(runner.job)
+}
+
+// fetchCountry returns the country of the user's account
+func (runner *Runner) fetchCountry(spotifyProvider *client.SpotifyProvider) (string, error) {
+	if err := spotifyProvider.Authorize(); err != nil {
+		return "", err
+	}
+	return spotifyProvider.FetchCountry()
+}
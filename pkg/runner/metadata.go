@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"strconv"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+// defaultNameTemplate names playlists after the uploaded file
+const defaultNameTemplate = "{file}"
+
+// PlaylistPayload sets the properties of the playlist created by the job.
+// NameTemplate ({file} by default) may have {file} and {date} placeholders,
+// Description may also have {found}, {notFound} and {total} match stats placeholders.
+// CoverImage is a base64 encoded JPEG image (256KB at most).
+type PlaylistPayload struct {
+	NameTemplate  *string `json:"nameTemplate"`
+	Description   *string `json:"description"`
+	Public        *bool   `json:"public"`
+	Collaborative *bool   `json:"collaborative"`
+	CoverImage    *string `json:"coverImage"`
+}
+
+// newPlaylistOptions fills in the defaults of the payload
+func newPlaylistOptions(payload *PlaylistPayload) *db.PlaylistOptions {
+	options := &db.PlaylistOptions{
+		NameTemplate: defaultNameTemplate,
+		Description:  client.DefaultPlaylistDescription,
+	}
+	if payload == nil {
+		return options
+	}
+	if payload.NameTemplate != nil && *payload.NameTemplate != "" {
+		options.NameTemplate = *payload.NameTemplate
+	}
+	if payload.Description != nil {
+		options.Description = *payload.Description
+	}
+	if payload.Public != nil {
+		options.Public = *payload.Public
+	}
+	if payload.Collaborative != nil {
+		options.Collaborative = *payload.Collaborative
+	}
+	// the cover is saved apart from the job, see saveCoverImage
+	options.HasCoverImage = payload.CoverImage != nil
+	return options
+}
+
+// saveCoverImage saves the cover of the playlist created by the job
+func saveCoverImage(jobID string, payload *PlaylistPayload) {
+	if payload != nil && payload.CoverImage != nil {
+		db.InsertCoverImage(db.CoverImage{JobID: jobID, Image: *payload.CoverImage})
+	}
+}
+
+// templateValues returns the values of the name and description placeholders
+func (runner *Runner) templateValues() map[string]string {
+	return map[string]string{
+		"file":     runner.job.FileName,
+		"date":     runner.job.CreatedAt.Format("2006-01-02"),
+		"found":    strconv.Itoa(runner.job.TracksAdded),
+		"notFound": strconv.Itoa(runner.job.TracksNotAdded),
+		"total":    strconv.Itoa(runner.job.TracksAdded + runner.job.TracksNotAdded),
+	}
+}
+
+// playlistDetails returns the details of the playlist created by the job
+func (runner *Runner) playlistDetails() client.PlaylistDetails {
+	options := runner.job.PlaylistOptions
+	if options == nil {
+		options = newPlaylistOptions(nil)
+	}
+	values := runner.templateValues()
+	name := client.RenderTemplate(options.NameTemplate, values)
+	if name == "" {
+		name = runner.job.FileName
+	}
+	return client.PlaylistDetails{
+		Name:          name,
+		Description:   client.RenderTemplate(options.Description, values),
+		Public:        options.Public,
+		Collaborative: options.Collaborative,
+	}
+}
+
+// applyPlaylistOptions updates the description of the created playlist with
+// the final match stats and uploads its cover, the tracks were already added
+// so failures are only logged
+func (runner *Runner) applyPlaylistOptions(spotifyProvider *client.SpotifyProvider) {
+	options := runner.job.PlaylistOptions
+	if options == nil {
+		return
+	}
+	description := client.RenderTemplate(options.Description, runner.templateValues())
+	if description != options.Description {
+		err := spotifyProvider.UpdatePlaylistDescription(runner.job.PlaylistID, description)
+		if err != nil {
+			logger("job: %s couldn't update playlist description: %v", runner.job.ID, err)
+		}
+	}
+	if !options.HasCoverImage {
+		return
+	}
+	cover := db.FindCoverImage(runner.job.ID)
+	if cover == nil {
+		logger("job: %s couldn't find playlist cover", runner.job.ID)
+		return
+	}
+	err := spotifyProvider.UploadCoverImage(runner.job.PlaylistID, cover.Image)
+	if err != nil {
+		logger("job: %s couldn't upload playlist cover: %v", runner.job.ID, err)
+	}
+}
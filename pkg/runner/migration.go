@@ -0,0 +1,232 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+)
+
+const (
+	// migrationChunkSize is how many tracks are copied between progress messages
+	migrationChunkSize = 100
+	likedSongsName     = "Liked Songs"
+	// localTrackPrefix is the URI prefix of local files, they can't be copied
+	localTrackPrefix = "spotify:local:"
+)
+
+var (
+	// ErrJobNotFound - there's no such job of the user
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotResumable - only failed (e.g. interrupted) or cancelled migration jobs can be resumed
+	ErrJobNotResumable = errors.New("job can't be resumed")
+)
+
+// NewMigrationRunner creates a job which copies the playlists the user owns
+// and the user's Liked Songs to the linked account of targetUserID
+func NewMigrationRunner(user *db.SpotifyUser, targetUserID string) (*Runner, error) {
+	job := db.CreateJob(db.Job{
+		UserID: user.UserID,
+		Type:   db.JobTypeMigration,
+		Migration: &db.Migration{
+			TargetUserID: targetUserID,
+		},
+	})
+	if job == nil {
+		return nil, errors.New("couldn't create job")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		user:   *user,
+		job:    *job,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// ResumeRunner returns a runner which continues a failed or cancelled
+// migration job of the user from the last copied chunk of tracks.
+// Jobs which were running when a server instance stopped fail with apierror.Interrupted
+// once it starts again or another instance finds them stale (see FailInterruptedJobs)
+// so they can be resumed too.
+func ResumeRunner(jobID string, user *db.SpotifyUser) (*Runner, error) {
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != user.UserID {
+		return nil, ErrJobNotFound
+	}
+	runningJobs.mutex.Lock()
+	_, isRunning := runningJobs.runners[jobID]
+	runningJobs.mutex.Unlock()
+	if job.Type != db.JobTypeMigration || isRunning ||
+		(job.Status != db.JobFailed && job.Status != db.JobCancelled) {
+		return nil, ErrJobNotResumable
+	}
+	previousStatus := job.Status
+	job.Status = db.JobRunning
+	job.FailureCause = ""
+	job.FailureMessage = ""
+	// only one of concurrent resume requests starts a runner
+	if !db.UpdateJobIfStatus(*job, previousStatus) {
+		return nil, ErrJobNotResumable
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		user:   *user,
+		job:    *job,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// runMigration copies the playlists which weren't copied yet
+func (runner *Runner) runMigration() {
+	migration := runner.job.Migration
+	targetUser := db.FindSpotifyUser(migration.TargetUserID)
+	if targetUser == nil {
+		runner.fail(apierror.TargetUserNotFound, fmt.Errorf("user %s not found", migration.TargetUserID))
+		return
+	}
+	source := client.NewSpotifyProvider()
+	source.SetUserData(&runner.user)
+	target := client.NewSpotifyProvider()
+	target.SetUserData(targetUser)
+	for _, provider := range []*client.SpotifyProvider{source, target} {
+		if err := provider.Authorize(); err != nil {
+			runner.fail(apierror.TokenRefreshFailed, err)
+			return
+		}
+	}
+
+	// the playlists are listed once, a resumed job keeps the original list
+	if len(migration.Playlists) == 0 {
+		playlists, err := source.GetOwnedPlaylists()
+		if err != nil {
+			runner.fail(apierror.MigrationFailed, err)
+			return
+		}
+		for _, playlist := range playlists {
+			migration.Playlists = append(migration.Playlists, db.MigrationPlaylist{
+				SourceID:    playlist.ID,
+				Name:        playlist.Name,
+				Description: playlist.Description,
+				Public:      playlist.Public,
+				Status:      db.MigrationPending,
+			})
+		}
+		migration.Playlists = append(migration.Playlists, db.MigrationPlaylist{
+			LikedSongs: true,
+			Name:       likedSongsName,
+			Status:     db.MigrationPending,
+		})
+		db.UpdateJob(runner.job)
+	}
+
+	for i := range migration.Playlists {
+		if migration.Playlists[i].Status == db.MigrationCopied {
+			continue
+		}
+		err := runner.migratePlaylist(source, target, i)
+		if runner.ctx.Err() != nil {
+			runner.finish(db.JobCancelled, kafkahelper.JobCancelled)
+			return
+		}
+		if err != nil {
+			runner.fail(apierror.MigrationFailed, fmt.Errorf("playlist %s: %w", migration.Playlists[i].Name, err))
+			return
+		}
+	}
+	runner.finish(db.JobFinished, kafkahelper.JobFinished)
+}
+
+// migratePlaylist copies the i-th playlist of the migration
+// in chunks and publishes the progress after every chunk
+func (runner *Runner) migratePlaylist(source *client.SpotifyProvider, target *client.SpotifyProvider, i int) error {
+	playlist := &runner.job.Migration.Playlists[i]
+	var (
+		uris []string
+		err  error
+	)
+	if playlist.LikedSongs {
+		uris, err = source.GetSavedTrackURIs()
+		// the most recently saved track is listed first so it's saved last
+		for left, right := 0, len(uris)-1; left < right; left, right = left+1, right-1 {
+			uris[left], uris[right] = uris[right], uris[left]
+		}
+	} else {
+		uris, err = source.GetPlaylistTrackURIs(playlist.SourceID)
+	}
+	if err != nil {
+		return err
+	}
+	uris = copyableURIs(uris)
+	playlist.TracksTotal = len(uris)
+	if !playlist.LikedSongs && playlist.TargetID == "" {
+		playlist.TargetID, err = target.CreatePlaylistWithDetails(client.PlaylistDetails{
+			Name:        playlist.Name,
+			Description: playlist.Description,
+			Public:      playlist.Public,
+		})
+		if err != nil {
+			return err
+		}
+		// a resumed job adds to the created playlist even if the job stops before the first chunk
+		db.UpdateJob(runner.job)
+	}
+	for playlist.TracksCopied < len(uris) {
+		if runner.ctx.Err() != nil {
+			return runner.ctx.Err()
+		}
+		end := playlist.TracksCopied + migrationChunkSize
+		if end > len(uris) {
+			end = len(uris)
+		}
+		chunk := uris[playlist.TracksCopied:end]
+		if playlist.LikedSongs {
+			err = target.SaveTracks(chunk)
+		} else {
+			err = target.AddTracksToPlaylist(playlist.TargetID, chunk)
+		}
+		if err != nil {
+			return err
+		}
+		runner.job.TracksAdded += len(chunk)
+		playlist.TracksCopied = end
+		playlist.Status = db.MigrationCopying
+		runner.publishMigrationProgress(i)
+	}
+	playlist.Status = db.MigrationCopied
+	runner.publishMigrationProgress(i)
+	return nil
+}
+
+// publishMigrationProgress publishes the state of the i-th playlist of the migration
+func (runner *Runner) publishMigrationProgress(i int) {
+	playlist := runner.job.Migration.Playlists[i]
+	runner.job.Seq++
+	runner.publish(kafkahelper.MigrationProgress, kafkahelper.MigrationProgressMsg{
+		Index:        i,
+		SourceID:     playlist.SourceID,
+		LikedSongs:   playlist.LikedSongs,
+		Name:         playlist.Name,
+		TargetID:     playlist.TargetID,
+		TracksTotal:  playlist.TracksTotal,
+		TracksCopied: playlist.TracksCopied,
+		Status:       string(playlist.Status),
+	})
+}
+
+// copyableURIs skips local files which exist only on the source user's devices
+func copyableURIs(uris []string) []string {
+	copyable := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if !strings.HasPrefix(uri, localTrackPrefix) {
+			copyable = append(copyable, uri)
+		}
+	}
+	return copyable
+}
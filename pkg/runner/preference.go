@@ -0,0 +1,25 @@
+package runner
+
+import (
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+// NewPreferences converts stored match preferences, an error is returned if a rule is unknown
+func NewPreferences(preferences *db.MatchPreferences) (client.Preferences, error) {
+	if preferences == nil {
+		return client.Preferences{}, nil
+	}
+	return client.NewPreferences(preferences.Explicit, preferences.Exclude, preferences.Prefer, preferences.OriginalAlbum)
+}
+
+// setPreferences sets the match preferences of the job, unknown rules
+// (which the server rejects) are ignored
+func (runner *Runner) setPreferences(spotifyProvider *client.SpotifyProvider) {
+	preferences, err := NewPreferences(runner.job.Preferences)
+	if err != nil {
+		logger("job: %s preferences are ignored: %v", runner.job.ID, err)
+		return
+	}
+	spotifyProvider.SetPreferences(preferences)
+}
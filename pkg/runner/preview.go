@@ -0,0 +1,95 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+)
+
+var (
+	// ErrJobNotCommittable - only previewed jobs can be committed
+	ErrJobNotCommittable = errors.New("job isn't waiting to be committed")
+	// ErrTrackNotApproved - an approved index isn't a found track of the job
+	ErrTrackNotApproved = errors.New("only found tracks can be approved")
+)
+
+// CommitRunner returns a runner which writes the approved tracks of a previewed
+// job of the user to the job destination. approved are the CSV indexes of the
+// approved tracks, every found track is approved if it's nil.
+func CommitRunner(jobID string, user *db.SpotifyUser, approved []int) (*Runner, error) {
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != user.UserID {
+		return nil, ErrJobNotFound
+	}
+	if !job.Preview || job.Status != db.JobPreviewed {
+		return nil, ErrJobNotCommittable
+	}
+	tracks, err := approvedTracks(db.FindJobTracks(jobID), approved)
+	if err != nil {
+		return nil, err
+	}
+	job.Status = db.JobRunning
+	// only one of concurrent commit requests writes the tracks
+	if !db.UpdateJobIfStatus(*job, db.JobPreviewed) {
+		return nil, ErrJobNotCommittable
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		fileName:       job.FileName,
+		playlistID:     job.PlaylistID,
+		approvedTracks: tracks,
+		user:           *user,
+		job:            *job,
+		ctx:            ctx,
+		cancel:         cancel,
+	}, nil
+}
+
+// approvedTracks returns the approved found tracks in CSV order
+func approvedTracks(tracks []db.JobTrack, approved []int) ([]client.FoundTrack, error) {
+	isFound := make(map[int]bool, len(tracks))
+	for _, track := range tracks {
+		isFound[track.Index] = track.IsFound
+	}
+	isApproved := make(map[int]bool, len(approved))
+	for _, index := range approved {
+		if !isFound[index] {
+			return nil, fmt.Errorf("%w: %d", ErrTrackNotApproved, index)
+		}
+		isApproved[index] = true
+	}
+	results := []client.FoundTrack{}
+	for _, track := range tracks {
+		if !track.IsFound || (approved != nil && !isApproved[track.Index]) {
+			continue
+		}
+		results = append(results, client.FoundTrack{
+			Index: track.Index,
+			URI:   track.URI,
+			ISRC:  track.ISRC,
+		})
+	}
+	return results, nil
+}
+
+// runCommit writes the approved tracks of a previewed job, the tracks which
+// weren't approved are counted as not added
+func (runner *Runner) runCommit() {
+	total := runner.job.TracksAdded + runner.job.TracksNotAdded
+	runner.job.TracksAdded = len(runner.approvedTracks)
+	runner.job.TracksNotAdded = total - runner.job.TracksAdded
+	runner.job.Seq++
+	runner.publish(kafkahelper.TrackProgress, runner.job.TracksAdded, runner.job.TracksNotAdded)
+
+	spotifyProvider := client.NewSpotifyProvider()
+	spotifyProvider.SetUserData(&runner.user)
+	if !runner.setTargetPlaylist(spotifyProvider) {
+		return
+	}
+	spotifyProvider.LookedUpTracks = runner.approvedTracks
+	runner.writeTracks(spotifyProvider)
+}
@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"errors"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+// ErrJobNotRetryable - only finished import jobs which have a destination can be retried
+var ErrJobNotRetryable = errors.New("job can't be retried")
+
+// retriedJob returns the job of the user which a new job retries
+func retriedJob(jobID string, userID string) (*db.Job, error) {
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != userID {
+		return nil, ErrJobNotFound
+	}
+	if job.Type != db.JobTypeImport || job.Status != db.JobFinished || job.DryRun ||
+		(job.Destination == client.DestinationPlaylist && job.PlaylistID == "") {
+		return nil, ErrJobNotRetryable
+	}
+	return job, nil
+}
+
+// trackKey identifies a CSV row by its artist and track name regardless of case, spacing
+// and punctuation, versions such as "(Live)" are kept since they're different tracks
+func trackKey(artist string, track string) string {
+	return client.Normalize(artist, true) + "\x00" + client.Normalize(track, true)
+}
+
+// matchedRows skips the rows which were matched by the retried jobs
+type matchedRows struct {
+	isMatched map[string]bool
+	skipped   int
+}
+
+// newMatchedRows finds the rows which were matched by the jobs the job retries
+func (runner *Runner) newMatchedRows() *matchedRows {
+	rows := &matchedRows{isMatched: make(map[string]bool)}
+	isVisited := make(map[string]bool)
+	// a retry may be retried as well, every job of the chain matched some rows
+	for jobID := runner.job.RetryOf; jobID != "" && !isVisited[jobID]; {
+		isVisited[jobID] = true
+		for _, track := range db.FindJobTracks(jobID) {
+			if track.IsFound {
+				rows.isMatched[trackKey(track.Artist, track.Title)] = true
+			}
+		}
+		job := db.FindJob(jobID)
+		if job == nil {
+			break
+		}
+		jobID = job.RetryOf
+	}
+	return rows
+}
+
+// keep reports whether the track wasn't matched, it's a csv.Filter
+func (rows *matchedRows) keep(track csv.TrackInput) bool {
+	if rows.isMatched[trackKey(track.Artist, track.Track)] {
+		rows.skipped++
+		return false
+	}
+	return true
+}
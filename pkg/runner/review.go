@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+)
+
+const (
+	// reviewTimeout is how long a job waits for the review once the lookups are done,
+	// the tracks which weren't reviewed by then are skipped
+	reviewTimeout = time.Hour
+	// reasonSkipped is the reason of tracks the user skipped in review
+	reasonSkipped = "skipped"
+)
+
+// ErrJobNotReviewable - the job doesn't review matches
+var ErrJobNotReviewable = errors.New("job doesn't review matches")
+
+// reviewChoice is the candidate the user picked for the track at Index,
+// the track is skipped if TrackID is empty
+type reviewChoice struct {
+	Index   int
+	TrackID string
+}
+
+// Review passes the choice of the user for a track which waits for review to the job,
+// trackID is the id of one of the candidates, the track is skipped if it's empty.
+// It returns ErrJobNotFound if the job isn't running on this server instance.
+func Review(jobID string, userID string, index int, trackID string) error {
+	runningJobs.mutex.Lock()
+	runner, found := runningJobs.runners[jobID]
+	runningJobs.mutex.Unlock()
+	if !found || runner.user.UserID != userID {
+		return ErrJobNotFound
+	}
+	if runner.reviewChoices == nil || !runner.job.Review {
+		return ErrJobNotReviewable
+	}
+	select {
+	case runner.reviewChoices <- reviewChoice{Index: index, TrackID: trackID}:
+		return nil
+	case <-runner.ctx.Done():
+		return ErrJobNotFound
+	}
+}
+
+// awaitReview waits until every track which needs review was reviewed,
+// it returns false if the job was cancelled meanwhile
+func (runner *Runner) awaitReview(spotifyProvider *client.SpotifyProvider) bool {
+	if len(runner.reviews) == 0 {
+		return true
+	}
+	indexes := make([]int, 0, len(runner.reviews))
+	for index := range runner.reviews {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	runner.job.AwaitingReview = true
+	runner.job.Seq++
+	runner.publish(kafkahelper.ReviewRequired, kafkahelper.ReviewRequiredMsg{Indexes: indexes})
+
+	timeout := time.NewTimer(reviewTimeout)
+	defer timeout.Stop()
+	for len(runner.reviews) > 0 {
+		select {
+		case choice := <-runner.reviewChoices:
+			runner.applyReviewChoice(spotifyProvider, choice)
+		case <-timeout.C:
+			logger("job: %s review timed out, skipping %d tracks", runner.job.ID, len(runner.reviews))
+			for index := range runner.reviews {
+				runner.applyReviewChoice(spotifyProvider, reviewChoice{Index: index})
+			}
+		case <-runner.ctx.Done():
+			runner.finish(db.JobCancelled, kafkahelper.JobCancelled)
+			return false
+		}
+	}
+	runner.job.AwaitingReview = false
+	return true
+}
+
+// applyReviewChoice adds the picked candidate to the looked up tracks
+// (or skips the track) and publishes the new outcome of the track
+func (runner *Runner) applyReviewChoice(spotifyProvider *client.SpotifyProvider, choice reviewChoice) {
+	result, found := runner.reviews[choice.Index]
+	if !found {
+		logger("job: %s track %d doesn't wait for review", runner.job.ID, choice.Index)
+		return
+	}
+	reviewed := client.SearchResult{
+		Index:   result.Index,
+		Input:   result.Input,
+		Outcome: client.OutcomeNotFound,
+		Reason:  reasonSkipped,
+		Queries: result.Queries,
+	}
+	if choice.TrackID != "" {
+		candidate, isCandidate := findCandidate(result.Candidates, choice.TrackID)
+		if !isCandidate {
+			logger("job: %s track %d has no candidate %s", runner.job.ID, choice.Index, choice.TrackID)
+			return
+		}
+		reviewed = spotifyProvider.AddReviewedTrack(result, candidate)
+		runner.job.TracksAdded++
+	} else {
+		runner.job.TracksNotAdded++
+	}
+	delete(runner.reviews, choice.Index)
+	runner.job.TracksInReview--
+	runner.job.Seq++
+	resultMsg := newTrackResultMsg(reviewed)
+	db.UpdateJobTrack(newJobTrack(runner.job, reviewed, resultMsg))
+	runner.publish(kafkahelper.TrackResult, resultMsg)
+
+	runner.job.Seq++
+	runner.publish(kafkahelper.TrackProgress, runner.job.TracksAdded, runner.job.TracksNotAdded)
+}
+
+// findCandidate returns the candidate with trackID
+func findCandidate(candidates []client.Candidate, trackID string) (client.Candidate, bool) {
+	for _, candidate := range candidates {
+		if candidate.TrackID == trackID {
+			return candidate, true
+		}
+	}
+	return client.Candidate{}, false
+}
@@ -1,88 +1,752 @@
 package runner
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/config"
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
+	"github.com/yossisp/csv-to-spotify/pkg/webhook"
 
 	"github.com/yossisp/csv-to-spotify/pkg/csv"
+	"github.com/yossisp/csv-to-spotify/pkg/export"
 	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
 
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
 	"github.com/yossisp/csv-to-spotify/pkg/client"
 	"github.com/yossisp/csv-to-spotify/pkg/db"
 )
 
-var (
-	producer = kafkahelper.NewProducer()
-	logger   = utils.NewLogger("runner")
+const (
+	// heartbeatInterval is how often the jobs running on this instance refresh UpdatedAt
+	heartbeatInterval = time.Minute
+	// staleJobAge is the age of UpdatedAt after which a running job of another
+	// instance is considered interrupted
+	staleJobAge = 5 * heartbeatInterval
 )
 
-func init() {
-	go producer.LogDeliveredMessages()
-}
+var (
+	// instanceID is saved on the jobs this server instance runs
+	instanceID  = config.NewConfig().InstanceID
+	dispatcher  = webhook.NewDispatcher()
+	logger      = utils.NewLogger("runner")
+	runningJobs = &runnerMap{runners: make(map[string]*Runner)}
+	// webhookEvents maps final job statuses to webhook events
+	webhookEvents = map[db.JobStatus]string{
+		db.JobFinished:  webhook.JobFinished,
+		db.JobFailed:    webhook.JobFailed,
+		db.JobCancelled: webhook.JobCancelled,
+		db.JobPreviewed: webhook.JobPreviewed,
+	}
+)
 
 // Runner starts playlist copy job
 type Runner struct {
-	tracksAdded    int
-	tracksNotAdded int
-	csvFile        string
-	fileName       string
-	user           db.SpotifyUser
+	// csvFile is read as the tracks are looked up and closed once the job ends
+	csvFile  io.ReadCloser
+	fileName string
+	// playlistID targets an existing playlist by id instead of by fileName
+	playlistID string
+	user       db.SpotifyUser
+	// approvedTracks are written by committed preview jobs instead of looking up the CSV file
+	approvedTracks []client.FoundTrack
+	// reviews are the results which wait for review by CSV index
+	reviews map[int]client.SearchResult
+	// reviewChoices receives the choices of the user, see Review
+	reviewChoices chan reviewChoice
+	// job is persisted before every published message so that
+	// clients which (re)connect can get a snapshot of the progress
+	job    db.Job
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// runnerMap holds the runners of this server instance by job id
+type runnerMap struct {
+	runners map[string]*Runner
+	mutex   sync.Mutex
+	// running counts the runners which didn't return yet, see Shutdown
+	running sync.WaitGroup
+}
+
+// add registers the runner unless it's registered already
+func (runners *runnerMap) add(runner *Runner) {
+	runners.mutex.Lock()
+	defer runners.mutex.Unlock()
+	if _, found := runners.runners[runner.job.ID]; !found {
+		runners.running.Add(1)
+		runner.job.InstanceID = instanceID
+		runners.runners[runner.job.ID] = runner
+	}
+}
+
+// has reports whether the job runs on this server instance
+func (runners *runnerMap) has(jobID string) bool {
+	runners.mutex.Lock()
+	defer runners.mutex.Unlock()
+	_, found := runners.runners[jobID]
+	return found
+}
+
+// jobIDs returns the ids of the jobs registered on this server instance
+func (runners *runnerMap) jobIDs() []string {
+	runners.mutex.Lock()
+	defer runners.mutex.Unlock()
+	jobIDs := make([]string, 0, len(runners.runners))
+	for jobID := range runners.runners {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs
+}
+
+// remove unregisters the runner once it returned
+func (runners *runnerMap) remove(runner *Runner) {
+	runners.mutex.Lock()
+	defer runners.mutex.Unlock()
+	if _, found := runners.runners[runner.job.ID]; found {
+		delete(runners.runners, runner.job.ID)
+		runners.running.Done()
+	}
 }
 
-// CSVPayload contains csv file data
+// CSVPayload contains csv file data.
+// Mode is one of client.ImportModes, client.ImportCreate if it's not set.
+// Modes other than client.ImportCreate target the user playlist with PlaylistID
+// or the one named after the file if PlaylistID isn't set.
+// DryRun makes client.ImportSync jobs only report the playlist diff.
+// Preview stops the job after the lookups, see CommitRunner.
+// Review parks ambiguous and low confidence matches until the user picks a candidate, see Review.
+// Market overrides the country of the user's account as the search market.
+// Preferences override the match preferences of the user.
+// Duplicates is one of client.DuplicatesModes, client.DuplicatesKeepFirst if it's not set.
+// RetryOf is the id of a finished job of the user, the job appends to its destination
+// the rows which weren't matched by it, Mode, PlaylistID and Destination are ignored.
+// Destination is one of client.Destinations, client.DestinationPlaylist if it's not set,
+// Mode, PlaylistID and Playlist apply only to playlists.
 type CSVPayload struct {
-	UserID   *string `json:"userId"`
-	CSVFile  *string `json:"csvFile"`
-	FileName *string `json:"uploadFileName"`
+	UserID      *string              `json:"userId"`
+	CSVFile     *string              `json:"csvFile"`
+	FileName    *string              `json:"uploadFileName"`
+	Mode        *string              `json:"mode"`
+	PlaylistID  *string              `json:"playlistId"`
+	DryRun      *bool                `json:"dryRun"`
+	Preview     *bool                `json:"preview"`
+	Review      *bool                `json:"review"`
+	RetryOf     *string              `json:"retryOf"`
+	Market      *string              `json:"market"`
+	Preferences *db.MatchPreferences `json:"preferences"`
+	Duplicates  *string              `json:"duplicates"`
+	Destination *string              `json:"destination"`
+	Playlist    *PlaylistPayload     `json:"playlist"`
+	// File is read instead of CSVFile if it's set so that uploads aren't held in
+	// memory while the job runs, the runner closes it once the job ends
+	File io.ReadCloser `json:"-"`
 }
 
-// NewRunner returns a runner
-func NewRunner(input CSVPayload, user *db.SpotifyUser) *Runner {
+// BatchFile is a playlist file of an uploaded archive
+type BatchFile struct {
+	// Name is the name of the playlist file without its extension
+	Name string
+	// File is closed by the runner of the playlist file once its job ends
+	File io.ReadCloser
+}
+
+// NewRunner creates a job and returns its runner
+func NewRunner(input CSVPayload, user *db.SpotifyUser) (*Runner, error) {
+	return newImportRunner(input, user, "")
+}
+
+// NewBatchRunners creates a batch named after the archive and a job with the options of input
+// for every playlist file of the archive, the runners are returned in the order of files.
+// If a job can't be created the jobs created before it are failed, the caller closes the files.
+func NewBatchRunners(input CSVPayload, archiveName string, files []BatchFile, user *db.SpotifyUser) (*db.Batch, []*Runner, error) {
+	batch := db.CreateBatch(db.Batch{UserID: user.UserID, FileName: archiveName})
+	if batch == nil {
+		return nil, nil, errors.New("couldn't create batch")
+	}
+	runners := make([]*Runner, 0, len(files))
+	for _, file := range files {
+		fileName := file.Name
+		input.File = file.File
+		input.FileName = &fileName
+		runner, err := newImportRunner(input, user, batch.ID)
+		if err != nil {
+			// the jobs which were created never run
+			for _, created := range runners {
+				created.cancel()
+				created.fail(apierror.InternalError, fmt.Errorf("the job of %s couldn't be created: %w", fileName, err))
+			}
+			return nil, nil, err
+		}
+		runners = append(runners, runner)
+	}
+	return batch, runners, nil
+}
+
+// newImportRunner creates an import job of the batch (if batchID isn't empty) and returns its runner
+func newImportRunner(input CSVPayload, user *db.SpotifyUser, batchID string) (*Runner, error) {
+	mode := client.ImportCreate
+	if input.Mode != nil {
+		mode = *input.Mode
+	}
+	destination := client.DestinationPlaylist
+	if input.Destination != nil {
+		destination = *input.Destination
+	}
+	dryRun := input.DryRun != nil && *input.DryRun
+	preview := input.Preview != nil && *input.Preview
+	playlistID := ""
+	if input.PlaylistID != nil {
+		playlistID = *input.PlaylistID
+	}
+	if input.RetryOf != nil {
+		original, err := retriedJob(*input.RetryOf, user.UserID)
+		if err != nil {
+			return nil, err
+		}
+		mode = client.ImportAppend
+		destination = original.Destination
+		playlistID = original.PlaylistID
+	}
+	newJob := db.Job{
+		UserID:          user.UserID,
+		FileName:        *input.FileName,
+		BatchID:         batchID,
+		Destination:     destination,
+		ImportMode:      mode,
+		Preview:         preview,
+		Review:          input.Review != nil && *input.Review,
+		DryRun:          dryRun,
+		PlaylistOptions: newPlaylistOptions(input.Playlist),
+		Preferences:     user.Preferences,
+		Duplicates:      client.DuplicatesKeepFirst,
+	}
+	if input.Duplicates != nil {
+		newJob.Duplicates = *input.Duplicates
+	}
+	if input.Preferences != nil {
+		newJob.Preferences = input.Preferences
+	}
+	if input.RetryOf != nil {
+		newJob.RetryOf = *input.RetryOf
+	}
+	if input.Market != nil {
+		newJob.Market = strings.ToUpper(*input.Market)
+	}
+	if preview {
+		// the playlist is targeted once the job is committed
+		newJob.PlaylistID = playlistID
+	}
+	job := db.CreateJob(newJob)
+	if job == nil {
+		return nil, errors.New("couldn't create job")
+	}
+	saveCoverImage(job.ID, input.Playlist)
+	csvFile := input.File
+	if csvFile == nil {
+		csvFile = ioutil.NopCloser(strings.NewReader(*input.CSVFile))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		csvFile:       csvFile,
+		fileName:      *input.FileName,
+		playlistID:    playlistID,
+		user:          *user,
+		job:           *job,
+		reviews:       make(map[int]client.SearchResult),
+		reviewChoices: make(chan reviewChoice),
+		ctx:           ctx,
+		cancel:        cancel,
+	}, nil
+}
+
+// NewExportRunner creates a job which exports the playlist in format and returns its runner,
+// format is one of the export package formats
+func NewExportRunner(playlistID string, format string, user *db.SpotifyUser) (*Runner, error) {
+	job := db.CreateJob(db.Job{
+		UserID:       user.UserID,
+		Type:         db.JobTypeExport,
+		PlaylistID:   playlistID,
+		ExportFormat: format,
+	})
+	if job == nil {
+		return nil, errors.New("couldn't create job")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Runner{
-		csvFile:  *input.CSVFile,
-		fileName: *input.FileName,
-		user:     *user,
+		playlistID: playlistID,
+		user:       *user,
+		job:        *job,
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
+}
+
+// Cancel stops a running job of the user,
+// it returns false if the job isn't running on this server instance
+func Cancel(jobID string, userID string) bool {
+	runningJobs.mutex.Lock()
+	defer runningJobs.mutex.Unlock()
+	runner, found := runningJobs.runners[jobID]
+	if !found || runner.user.UserID != userID {
+		return false
+	}
+	runner.cancel()
+	return true
+}
+
+// Shutdown cancels the jobs running on this server instance and waits until their
+// runners return, e.g. before the db store they use is replaced. Jobs mustn't be
+// started while it waits.
+func Shutdown() {
+	runningJobs.mutex.Lock()
+	for _, runner := range runningJobs.runners {
+		runner.cancel()
+	}
+	runningJobs.mutex.Unlock()
+	runningJobs.running.Wait()
+}
+
+// JobID returns the id of the job the runner executes
+func (runner *Runner) JobID() string {
+	return runner.job.ID
+}
+
+// publish saves the job and produces the next message of the job
+func (runner *Runner) publish(msgType kafkahelper.MessageType, msgParams ...interface{}) {
+	db.UpdateJob(runner.job)
+	kafkahelper.ProduceMessage(runner.user.UserID, runner.job.ID, runner.job.Seq, msgType, msgParams...)
+}
+
+// addResult records the lookup outcome of a track and publishes it
+func (runner *Runner) addResult(result client.SearchResult) {
+	switch {
+	case result.IsFound:
+		runner.job.TracksAdded++
+	case result.Outcome == client.OutcomeReview:
+		runner.reviews[result.Index] = result
+		runner.job.TracksInReview++
+	default:
+		runner.job.TracksNotAdded++
+	}
+	runner.job.Seq++
+	resultMsg := newTrackResultMsg(result)
+	jobTrack := newJobTrack(runner.job, result, resultMsg)
+	db.InsertJobTrack(jobTrack)
+	runner.publish(kafkahelper.TrackResult, resultMsg)
+
+	runner.job.Seq++
+	runner.publish(kafkahelper.TrackProgress, runner.job.TracksAdded, runner.job.TracksNotAdded)
+}
+
+// publishSyncDiff records the playlist changes of a sync job and publishes them
+func (runner *Runner) publishSyncDiff(diff client.PlaylistDiff) {
+	syncDiff := db.SyncDiff{
+		Added:   diff.Added,
+		Removed: diff.Removed,
+		Moved:   make([]db.PlaylistMove, len(diff.Moved)),
+		DryRun:  runner.job.DryRun,
+	}
+	diffMsg := kafkahelper.SyncDiffMsg{
+		Added:   diff.Added,
+		Removed: diff.Removed,
+		Moved:   make([]kafkahelper.PlaylistMoveMsg, len(diff.Moved)),
+		DryRun:  runner.job.DryRun,
+	}
+	for i, move := range diff.Moved {
+		syncDiff.Moved[i] = db.PlaylistMove{URI: move.URI, From: move.From, To: move.To}
+		diffMsg.Moved[i] = kafkahelper.PlaylistMoveMsg{URI: move.URI, From: move.From, To: move.To}
+	}
+	runner.job.SyncDiff = &syncDiff
+	runner.job.Seq++
+	runner.publish(kafkahelper.SyncDiff, diffMsg)
+}
+
+// finish moves the job to a final status, publishes it and notifies webhooks
+func (runner *Runner) finish(status db.JobStatus, msgType kafkahelper.MessageType, msgParams ...interface{}) {
+	runner.job.Status = status
+	runner.job.Seq++
+	runner.publish(msgType, msgParams...)
+	dispatcher.Notify(webhookEvents[status], runner.job)
+}
+
+// fail moves the job to JobFailed status, cause is an apierror code.
+// A revoked token or the Spotify rate limit are the cause whichever step failed.
+func (runner *Runner) fail(cause string, err error) {
+	cause = client.Cause(err, cause)
+	logger("job: %s failed: %s: %v", runner.job.ID, cause, err)
+	runner.job.FailureCause = cause
+	runner.job.FailureMessage = err.Error()
+	runner.finish(db.JobFailed, kafkahelper.JobFailed, kafkahelper.JobFailedMsg{
+		Cause: cause,
+		Error: err.Error(),
+	})
+}
+
+// FailInterruptedJobs fails the jobs which were left running when a server instance stopped
+// (e.g. it crashed or restarted) with apierror.Interrupted cause, they'd stay running
+// forever otherwise. Instances share the db so only the jobs of this instance which
+// don't run on it and the stale jobs of other instances are failed, see isInterrupted.
+// It should be called when the server starts, before it runs jobs.
+func FailInterruptedJobs() {
+	for _, job := range db.FindJobsByStatus(db.JobRunning) {
+		if !isInterrupted(job) {
+			continue
+		}
+		interrupted := &Runner{
+			user: db.SpotifyUser{UserID: job.UserID},
+			job:  job,
+		}
+		interrupted.fail(apierror.Interrupted, errors.New("the server stopped while the job was running"))
+	}
+}
+
+// isInterrupted reports whether the running job was left by a server instance which stopped:
+// the job of this instance doesn't run on it or UpdatedAt wasn't refreshed for staleJobAge
+func isInterrupted(job db.Job) bool {
+	if runningJobs.has(job.ID) {
+		return false
+	}
+	if job.InstanceID != "" && job.InstanceID == instanceID {
+		return true
 	}
+	return time.Since(job.UpdatedAt) > staleJobAge
+}
+
+// StartHeartbeat refreshes UpdatedAt of the jobs running on this server instance every
+// heartbeatInterval in the background, so other instances don't consider them interrupted,
+// and fails the jobs of instances which stopped since, see FailInterruptedJobs
+func StartHeartbeat() {
+	go func() {
+		for range time.Tick(heartbeatInterval) {
+			for _, jobID := range runningJobs.jobIDs() {
+				db.TouchJob(jobID, instanceID)
+			}
+			FailInterruptedJobs()
+		}
+	}()
+}
+
+// Start runs the job in a new goroutine, see Run. The job can be cancelled
+// and Shutdown waits for it once Start returns.
+func (runner *Runner) Start() {
+	runningJobs.add(runner)
+	go runner.Run()
 }
 
-// Run starts playlist copy job
+// StartBatch runs the jobs of a batch one after another in the background so that
+// a batch searches at the rate of a single job (see TRACK_LOOKUP_INTERVAL).
+// The jobs are registered at once so that queued jobs can be cancelled too.
+func StartBatch(runners []*Runner) {
+	for _, runner := range runners {
+		runningJobs.add(runner)
+	}
+	go func() {
+		for _, runner := range runners {
+			runner.Run()
+		}
+	}()
+}
+
+// Run starts the job, the job always ends
+// with JobFinished, JobFailed or JobCancelled status
 func (runner *Runner) Run() {
 	const funcName = "Run"
-	var (
-		isTrackFound bool
-		isSuccess    bool
-	)
+	runningJobs.add(runner)
+	defer func() {
+		if err := recover(); err != nil {
+			runner.fail(apierror.InternalError, fmt.Errorf("%s: panic: %v", funcName, err))
+		} else if runner.job.Status == db.JobRunning {
+			runner.fail(apierror.InternalError, fmt.Errorf("%s: job stopped unexpectedly", funcName))
+		}
+		// stops lookups which may still be running
+		runner.cancel()
+		if runner.csvFile != nil {
+			runner.csvFile.Close()
+		}
+		runningJobs.remove(runner)
+	}()
+	dispatcher.Notify(webhook.JobStarted, runner.job)
+	switch runner.job.Type {
+	case db.JobTypeExport:
+		runner.runExport()
+	case db.JobTypeMigration:
+		runner.runMigration()
+	default:
+		if runner.approvedTracks != nil {
+			runner.runCommit()
+			return
+		}
+		runner.runImport()
+	}
+}
+
+// runImport looks up the tracks of the CSV file and adds them to the job destination,
+// preview jobs stop after the lookups
+func (runner *Runner) runImport() {
 	tracksProgress := client.TracksLookupProgress{
-		IsFound: make(chan bool),
-		Quit:    make(chan bool),
+		Results: make(chan client.SearchResult),
+		Done:    make(chan error),
 	}
-	tracks, err := csv.GetInputTracks(runner.csvFile)
+	reader, err := csv.NewReader(runner.csvFile)
 	if err != nil {
-		producer.ProduceMessage(runner.user.UserID, kafkahelper.CSVFileError)
+		runner.fail(apierror.InvalidCSV, err)
 		return
 	}
+	// files without rows have no header, their jobs have nothing to report
+	runner.job.CSVHeader = reader.Header()
+	// rows are read and filtered as they're looked up
+	var (
+		tracks     csv.TrackIterator = reader
+		matched    *matchedRows
+		duplicates *duplicateRows
+	)
+	if runner.job.RetryOf != "" {
+		matched = runner.newMatchedRows()
+		tracks = csv.Filter(tracks, matched.keep)
+	}
+	if runner.job.Duplicates != client.DuplicatesKeepAll {
+		duplicates = newDuplicateRows()
+		tracks = csv.Filter(tracks, duplicates.keep)
+	}
 
 	spotifyProvider := client.NewSpotifyProvider()
 	spotifyProvider.SetUserData(&runner.user)
-	spotifyProvider.CreatePlaylist(runner.fileName)
-	go spotifyProvider.GetSearchResults(tracksProgress, tracks)
+	if runner.job.Review {
+		spotifyProvider.EnableReview()
+	}
+	runner.setMarkets(spotifyProvider)
+	runner.setPreferences(spotifyProvider)
+	// the playlist of ImportCreate mode is created once the tracks are written
+	// so that jobs which fail or are cancelled before don't leave empty playlists
+	isCreate := runner.job.ImportMode == client.ImportCreate
+	if !runner.job.Preview && !isCreate && !runner.setTargetPlaylist(spotifyProvider) {
+		return
+	}
+	go spotifyProvider.StreamSearchResults(runner.ctx, tracksProgress, tracks)
 
 	for {
 		select {
-		case isTrackFound = <-tracksProgress.IsFound:
-			if isTrackFound {
-				runner.tracksAdded++
-			} else {
-				runner.tracksNotAdded++
+		case result := <-tracksProgress.Results:
+			runner.addResult(result)
+		case choice := <-runner.reviewChoices:
+			// tracks can be reviewed while the rest are looked up
+			runner.applyReviewChoice(spotifyProvider, choice)
+		case err = <-tracksProgress.Done:
+			// every row was read once the lookups are done
+			runner.countSkippedRows(matched, duplicates)
+			if err != nil {
+				runner.fail(apierror.LookupFailed, err)
+				return
+			}
+			if !runner.awaitReview(spotifyProvider) {
+				return
 			}
-			producer.ProduceMessage(runner.user.UserID, kafkahelper.TrackProgress, runner.tracksAdded, runner.tracksNotAdded)
-		case isSuccess = <-tracksProgress.Quit:
-			if isSuccess {
-				spotifyProvider.AddItemsToPlaylist()
-				producer.ProduceMessage(runner.user.UserID, kafkahelper.JobFinished)
+			if runner.job.Preview {
+				runner.finish(db.JobPreviewed, kafkahelper.PreviewReady)
+				return
 			}
-			close(tracksProgress.Quit)
-			close(tracksProgress.IsFound)
+			if isCreate && !runner.setTargetPlaylist(spotifyProvider) {
+				return
+			}
+			runner.writeTracks(spotifyProvider)
+			return
+		case <-runner.ctx.Done():
+			// lookup goroutines stop sending once ctx is done
+			runner.finish(db.JobCancelled, kafkahelper.JobCancelled)
 			return
 		}
 	}
 }
+
+// countSkippedRows adds the rows the filters of runImport skipped to the job summary
+func (runner *Runner) countSkippedRows(matched *matchedRows, duplicates *duplicateRows) {
+	if matched != nil {
+		runner.job.TracksSkipped += matched.skipped
+		logger("job: %s retry of %s skips %d matched tracks", runner.job.ID, runner.job.RetryOf, matched.skipped)
+	}
+	if duplicates != nil {
+		runner.countDuplicates(duplicates.skipped)
+	}
+}
+
+// setTargetPlaylist creates/finds the playlist of playlist destination jobs,
+// it returns false if the job failed
+func (runner *Runner) setTargetPlaylist(spotifyProvider *client.SpotifyProvider) bool {
+	if runner.job.Destination != client.DestinationPlaylist {
+		return true
+	}
+	err := spotifyProvider.SetTargetPlaylist(runner.job.ImportMode, runner.playlistID, runner.playlistDetails())
+	switch {
+	case errors.Is(err, client.ErrPlaylistNotFound):
+		runner.fail(apierror.PlaylistNotFound, err)
+		return false
+	case errors.Is(err, client.ErrPlaylistNotOwned):
+		runner.fail(apierror.PlaylistNotOwned, err)
+		return false
+	case err != nil:
+		runner.fail(apierror.PlaylistCreateFailed, err)
+		return false
+	}
+	runner.job.PlaylistID = spotifyProvider.PlaylistID()
+	db.UpdateJob(runner.job)
+	return true
+}
+
+// writeTracks adds the looked up tracks of the provider to the job destination and finishes the job
+func (runner *Runner) writeTracks(spotifyProvider *client.SpotifyProvider) {
+	isPlaylist := runner.job.Destination == client.DestinationPlaylist
+	switch {
+	case !isPlaylist:
+		err := spotifyProvider.AddToLibrary(runner.job.Destination)
+		if err != nil {
+			runner.fail(apierror.LibraryUpdateFailed, err)
+			return
+		}
+	case runner.job.ImportMode == client.ImportSync:
+		diff, err := spotifyProvider.SyncPlaylist(runner.job.DryRun)
+		if err != nil {
+			runner.fail(apierror.SyncFailed, err)
+			return
+		}
+		runner.publishSyncDiff(diff)
+	default:
+		if runner.job.Duplicates == client.DuplicatesKeepAll {
+			spotifyProvider.KeepDuplicates()
+		}
+		err := spotifyProvider.AddItemsToPlaylist()
+		if err != nil {
+			runner.fail(apierror.AddTracksFailed, err)
+			return
+		}
+		runner.countDuplicates(spotifyProvider.DuplicatesSkipped())
+	}
+	if isPlaylist && runner.job.ImportMode == client.ImportCreate {
+		runner.applyPlaylistOptions(spotifyProvider)
+	}
+	runner.finish(db.JobFinished, kafkahelper.JobFinished)
+}
+
+// runExport writes the playlist to a file which is saved in the db
+func (runner *Runner) runExport() {
+	spotifyProvider := client.NewSpotifyProvider()
+	spotifyProvider.SetUserData(&runner.user)
+	playlist, err := spotifyProvider.ExportPlaylist(runner.playlistID)
+	if err != nil {
+		switch {
+		case errors.Is(err, client.ErrPlaylistNotFound):
+			runner.fail(apierror.PlaylistNotFound, err)
+		default:
+			runner.fail(apierror.ExportFailed, err)
+		}
+		return
+	}
+	if runner.ctx.Err() != nil {
+		runner.finish(db.JobCancelled, kafkahelper.JobCancelled)
+		return
+	}
+	var content bytes.Buffer
+	err = export.Write(&content, runner.job.ExportFormat, playlist)
+	if err != nil {
+		runner.fail(apierror.ExportFailed, err)
+		return
+	}
+	runner.job.FileName = playlist.Name
+	db.InsertExport(db.Export{
+		JobID:       runner.job.ID,
+		FileName:    export.FileName(playlist.Name, runner.job.ExportFormat),
+		ContentType: export.ContentType(runner.job.ExportFormat),
+		Content:     content.Bytes(),
+	})
+	runner.job.TracksAdded = len(playlist.Tracks)
+	runner.job.Seq++
+	runner.publish(kafkahelper.TrackProgress, runner.job.TracksAdded, runner.job.TracksNotAdded)
+	runner.finish(db.JobFinished, kafkahelper.JobFinished)
+}
+
+// newTrackResultMsg converts a lookup result to a kafka message
+func newTrackResultMsg(result client.SearchResult) kafkahelper.TrackResultMsg {
+	return kafkahelper.TrackResultMsg{
+		Index:       result.Index,
+		Artist:      result.Input.Artist,
+		Title:       result.Input.Track,
+		IsFound:     result.IsFound,
+		Outcome:     result.Outcome,
+		TrackID:     result.TrackID,
+		TrackName:   result.TrackName,
+		TrackArtist: result.TrackArtist,
+		Confidence:  result.Confidence,
+		Strategy:    result.Strategy,
+		Reason:      result.Reason,
+		Market:      result.Market,
+		Candidates:  newCandidateMsgs(result.Candidates),
+	}
+}
+
+// newCandidateMsgs converts the review candidates of a result to kafka messages
+func newCandidateMsgs(candidates []client.Candidate) []kafkahelper.CandidateMsg {
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidateMsgs := make([]kafkahelper.CandidateMsg, len(candidates))
+	for i, candidate := range candidates {
+		candidateMsgs[i] = kafkahelper.CandidateMsg{
+			TrackID:    candidate.TrackID,
+			URI:        candidate.URI,
+			Name:       candidate.Name,
+			Artist:     candidate.Artist,
+			Album:      candidate.Album,
+			ImageURL:   candidate.ImageURL,
+			PreviewURL: candidate.PreviewURL,
+			Confidence: candidate.Confidence,
+		}
+	}
+	return candidateMsgs
+}
+
+// newJobTrack converts a track result message to its stored form,
+// the match URI and candidates are kept for preview and review
+func newJobTrack(job db.Job, result client.SearchResult, resultMsg kafkahelper.TrackResultMsg) db.JobTrack {
+	jobTrack := db.JobTrack{
+		JobID:       job.ID,
+		Seq:         job.Seq,
+		Index:       resultMsg.Index,
+		Artist:      resultMsg.Artist,
+		Title:       resultMsg.Title,
+		IsFound:     resultMsg.IsFound,
+		Outcome:     resultMsg.Outcome,
+		TrackID:     resultMsg.TrackID,
+		TrackName:   resultMsg.TrackName,
+		TrackArtist: resultMsg.TrackArtist,
+		Confidence:  resultMsg.Confidence,
+		Strategy:    resultMsg.Strategy,
+		Reason:      resultMsg.Reason,
+		Market:      resultMsg.Market,
+		URI:         result.URI,
+		ISRC:        result.ISRC,
+		Record:      result.Input.Record,
+		Queries:     result.Queries,
+	}
+	for _, candidate := range result.Candidates {
+		jobTrack.Candidates = append(jobTrack.Candidates, db.Candidate{
+			TrackID:    candidate.TrackID,
+			URI:        candidate.URI,
+			Name:       candidate.Name,
+			Artist:     candidate.Artist,
+			Album:      candidate.Album,
+			AlbumID:    candidate.AlbumID,
+			ArtistIDs:  candidate.ArtistIDs,
+			ImageURL:   candidate.ImageURL,
+			PreviewURL: candidate.PreviewURL,
+			Confidence: candidate.Confidence,
+		})
+	}
+	return jobTrack
+}
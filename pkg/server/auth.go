@@ -0,0 +1,40 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+)
+
+const bearerPrefix = "Bearer "
+
+// authorize reports whether req is made by the user: it must carry a Spotify access token
+// of the user (Authorization: Bearer <token>) like the web client gets when the user logs in.
+// Spotify user ids are public so they don't prove anything by themselves.
+// Unauthorized requests are answered.
+func authorize(w http.ResponseWriter, req *http.Request, userID string) bool {
+	const funcName = "authorize"
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) || len(header) == len(bearerPrefix) {
+		sendError(w, apierror.Unauthorized, "a Spotify access token of the user is required")
+		return false
+	}
+	tokenUserID, err := client.TokenUserID(strings.TrimPrefix(header, bearerPrefix))
+	switch {
+	case errors.Is(err, client.ErrInvalidAccessToken):
+		sendError(w, apierror.Unauthorized, err.Error())
+		return false
+	case err != nil:
+		logger("%s: client.TokenUserID: %v", funcName, err)
+		sendError(w, apierror.SpotifyError, err.Error())
+		return false
+	case tokenUserID != userID:
+		logger("%s: token of %s used for %s", funcName, tokenUserID, userID)
+		sendError(w, apierror.Forbidden, "the access token belongs to another user")
+		return false
+	}
+	return true
+}
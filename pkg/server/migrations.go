@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+)
+
+// accountLinkPayload links the account of UserID to LinkedUserID
+type accountLinkPayload struct {
+	UserID       *string `json:"userId"`
+	LinkedUserID *string `json:"linkedUserId"`
+}
+
+// migrationPayload starts copying the account of UserID to TargetUserID
+type migrationPayload struct {
+	UserID       *string `json:"userId"`
+	TargetUserID *string `json:"targetUserId"`
+}
+
+// readAccountLinkPayload returns the payload of an account link request,
+// failed requests are answered
+func readAccountLinkPayload(w http.ResponseWriter, req *http.Request) (payload accountLinkPayload, ok bool) {
+	const funcName = "readAccountLinkPayload"
+	err := json.NewDecoder(req.Body).Decode(&payload)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		sendError(w, apierror.InvalidRequest, err.Error())
+		return payload, false
+	}
+	var fields []apierror.FieldError
+	if payload.UserID == nil {
+		fields = append(fields, apierror.Missing("userId"))
+	}
+	if payload.LinkedUserID == nil {
+		fields = append(fields, apierror.Missing("linkedUserId"))
+	} else if payload.UserID != nil && *payload.UserID == *payload.LinkedUserID {
+		fields = append(fields, apierror.BadValue("linkedUserId", "an account can't be linked to itself"))
+	}
+	if len(fields) > 0 {
+		apierror.Send(w, apierror.Invalid(fields...))
+		return payload, false
+	}
+	return payload, true
+}
+
+// accountLinksHandler (/accounts/links route) lists (GET) the links of the user and
+// asks (POST) to link the user's account to another one, both users must have logged in.
+// The link is pending until the linked user confirms it with /accounts/links/confirm
+// (POST) so that nobody can copy another user's library or fill another user's account.
+// Requests must carry an access token of the user who makes them, see authorize.
+func accountLinksHandler(w http.ResponseWriter, req *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, "/accounts/links"), "/")
+	switch {
+	case action == "" && req.Method == http.MethodGet:
+		userID := req.URL.Query().Get("userId")
+		if !authorize(w, req, userID) {
+			return
+		}
+		sendJSON(w, http.StatusOK, db.FindAccountLinks(userID))
+	case action == "" && req.Method == http.MethodPost:
+		payload, ok := readAccountLinkPayload(w, req)
+		if !ok || !authorize(w, req, *payload.UserID) {
+			return
+		}
+		for _, userID := range []string{*payload.UserID, *payload.LinkedUserID} {
+			if db.FindSpotifyUser(userID) == nil {
+				sendError(w, apierror.UnknownUser, "user not found: "+userID)
+				return
+			}
+		}
+		if !db.LinkAccounts(*payload.UserID, *payload.LinkedUserID) {
+			sendError(w, apierror.InternalError, "couldn't link accounts")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case action == "confirm" && req.Method == http.MethodPost:
+		payload, ok := readAccountLinkPayload(w, req)
+		// only the linked user confirms the link
+		if !ok || !authorize(w, req, *payload.LinkedUserID) {
+			return
+		}
+		if !db.ConfirmAccountLink(*payload.UserID, *payload.LinkedUserID) {
+			sendError(w, apierror.NotFound, "userId didn't ask to link the accounts")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" || action == "confirm":
+		sendMethodNotAllowed(w)
+	default:
+		sendError(w, apierror.NotFound, "unknown route: "+req.URL.Path)
+	}
+}
+
+// migrationsHandler (/migrations route) starts (POST) a job which copies the playlists
+// the user owns and the user's Liked Songs to a linked account, the request must carry
+// an access token of the user
+func migrationsHandler(w http.ResponseWriter, req *http.Request) {
+	const funcName = "migrationsHandler"
+	if req.Method != http.MethodPost {
+		sendMethodNotAllowed(w)
+		return
+	}
+	payload := migrationPayload{}
+	err := json.NewDecoder(req.Body).Decode(&payload)
+	if err != nil {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		sendError(w, apierror.InvalidRequest, err.Error())
+		return
+	}
+	var fields []apierror.FieldError
+	if payload.UserID == nil {
+		fields = append(fields, apierror.Missing("userId"))
+	}
+	if payload.TargetUserID == nil {
+		fields = append(fields, apierror.Missing("targetUserId"))
+	}
+	if len(fields) > 0 {
+		apierror.Send(w, apierror.Invalid(fields...))
+		return
+	}
+	if !authorize(w, req, *payload.UserID) {
+		return
+	}
+	user := db.FindSpotifyUser(*payload.UserID)
+	if user == nil {
+		sendError(w, apierror.UnknownUser, "user not found: "+*payload.UserID)
+		return
+	}
+	if !db.IsLinkedAccount(*payload.UserID, *payload.TargetUserID) {
+		sendError(w, apierror.Forbidden, "targetUserId isn't a confirmed linked account of userId")
+		return
+	}
+	migrationRunner, err := runner.NewMigrationRunner(user, *payload.TargetUserID)
+	if err != nil {
+		logger("%s: runner.NewMigrationRunner: %v", funcName, err)
+		sendError(w, apierror.InternalError, err.Error())
+		return
+	}
+	migrationRunner.Start()
+	sendJSON(w, http.StatusAccepted, map[string]string{"jobId": migrationRunner.JobID()})
+}
+
+// resumeHandler (/jobs/{id}/resume) continues a failed or cancelled migration job
+func resumeHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	const funcName = "resumeHandler"
+	userID := req.URL.Query().Get("userId")
+	user := db.FindSpotifyUser(userID)
+	if user == nil {
+		sendError(w, apierror.UnknownUser, "user not found: "+userID)
+		return
+	}
+	resumedRunner, err := runner.ResumeRunner(jobID, user)
+	switch {
+	case errors.Is(err, runner.ErrJobNotFound):
+		sendError(w, apierror.NotFound, "job not found")
+		return
+	case errors.Is(err, runner.ErrJobNotResumable):
+		sendError(w, apierror.Conflict, err.Error())
+		return
+	case err != nil:
+		logger("%s: runner.ResumeRunner: %v", funcName, err)
+		sendError(w, apierror.InternalError, err.Error())
+		return
+	}
+	resumedRunner.Start()
+	sendJSON(w, http.StatusAccepted, map[string]string{"jobId": resumedRunner.JobID()})
+}
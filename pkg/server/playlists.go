@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/export"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+)
+
+// playlistsHandler routes /playlists/{id}/export?userId={userId}&format={format}:
+// GET exports the playlist in the response,
+// POST starts an export job, its file is returned by /jobs/{jobId}/export.
+// Requests must carry an access token of the user, see authorize.
+func playlistsHandler(w http.ResponseWriter, req *http.Request) {
+	const funcName = "playlistsHandler"
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/playlists/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "export" {
+		sendError(w, apierror.NotFound, "unknown route: "+req.URL.Path)
+		return
+	}
+	playlistID := parts[0]
+	query := req.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if !export.IsFormat(format) {
+		apierror.Send(w, apierror.Invalid(apierror.BadValue("format", "unknown format: "+format)))
+		return
+	}
+	userID := query.Get("userId")
+	if userID == "" {
+		apierror.Send(w, apierror.Invalid(apierror.Missing("userId")))
+		return
+	}
+	// private playlists are exported too
+	if !authorize(w, req, userID) {
+		return
+	}
+	user := db.FindSpotifyUser(userID)
+	if user == nil {
+		sendError(w, apierror.UnknownUser, "user not found: "+userID)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		spotifyProvider := client.NewSpotifyProvider()
+		spotifyProvider.SetUserData(user)
+		playlist, err := spotifyProvider.ExportPlaylist(playlistID)
+		if errors.Is(err, client.ErrPlaylistNotFound) {
+			sendError(w, apierror.PlaylistNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logger("%s: ExportPlaylist: %v", funcName, err)
+			// a revoked token or the rate limit have codes of their own
+			sendError(w, client.Cause(err, apierror.SpotifyError), err.Error())
+			return
+		}
+		var content bytes.Buffer
+		err = export.Write(&content, format, playlist)
+		if err != nil {
+			logger("%s: export.Write: %v", funcName, err)
+			sendError(w, apierror.InternalError, err.Error())
+			return
+		}
+		sendFile(w, export.FileName(playlist.Name, format), export.ContentType(format), content.Bytes())
+	case http.MethodPost:
+		exportRunner, err := runner.NewExportRunner(playlistID, format, user)
+		if err != nil {
+			logger("%s: runner.NewExportRunner: %v", funcName, err)
+			sendError(w, apierror.InternalError, err.Error())
+			return
+		}
+		exportRunner.Start()
+		sendJSON(w, http.StatusAccepted, map[string]string{"jobId": exportRunner.JobID()})
+	default:
+		sendMethodNotAllowed(w)
+	}
+}
+
+// exportHandler (/jobs/{id}/export) returns the file of a finished export job,
+// the request must carry an access token of the user
+func exportHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	userID := req.URL.Query().Get("userId")
+	if !authorize(w, req, userID) {
+		return
+	}
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != userID || job.Type != db.JobTypeExport {
+		sendError(w, apierror.NotFound, "export job not found")
+		return
+	}
+	if job.Status != db.JobFinished {
+		sendError(w, apierror.Conflict, "job is "+string(job.Status))
+		return
+	}
+	exported := db.FindExport(jobID)
+	if exported == nil {
+		sendError(w, apierror.NotFound, "exported file not found")
+		return
+	}
+	sendFile(w, exported.FileName, exported.ContentType, exported.Content)
+}
+
+// sendFile sends content as a file download
+func sendFile(w http.ResponseWriter, fileName string, contentType string, content []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Write(content)
+}
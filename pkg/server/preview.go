@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+)
+
+// commitPayload lists the CSV indexes of the approved tracks,
+// every found track is approved if Approved is omitted
+type commitPayload struct {
+	Approved []int `json:"approved"`
+}
+
+// previewResponse is the reviewable lookup outcome of a preview job
+type previewResponse struct {
+	Job    db.Job        `json:"job"`
+	Tracks []db.JobTrack `json:"tracks"`
+}
+
+// previewHandler (/jobs/{id}/preview) returns the job and the candidate match of every track
+func previewHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != req.URL.Query().Get("userId") || !job.Preview {
+		sendError(w, apierror.NotFound, "preview job not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, previewResponse{
+		Job:    *job,
+		Tracks: db.FindJobTracks(jobID),
+	})
+}
+
+// commitHandler (/jobs/{id}/commit) writes the approved tracks of a previewed job
+// to its destination, the job continues with the same job id
+func commitHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	const funcName = "commitHandler"
+	userID := req.URL.Query().Get("userId")
+	user := db.FindSpotifyUser(userID)
+	if user == nil {
+		sendError(w, apierror.UnknownUser, "user not found: "+userID)
+		return
+	}
+	payload := commitPayload{}
+	err := json.NewDecoder(req.Body).Decode(&payload)
+	// an empty body approves every found track
+	if err != nil && err != io.EOF {
+		logger("%s: json.NewDecoder: %v", funcName, err)
+		sendError(w, apierror.InvalidRequest, err.Error())
+		return
+	}
+	commitRunner, err := runner.CommitRunner(jobID, user, payload.Approved)
+	switch {
+	case errors.Is(err, runner.ErrJobNotFound):
+		sendError(w, apierror.NotFound, "job not found")
+		return
+	case errors.Is(err, runner.ErrJobNotCommittable):
+		sendError(w, apierror.Conflict, err.Error())
+		return
+	case errors.Is(err, runner.ErrTrackNotApproved):
+		apierror.Send(w, apierror.Invalid(apierror.BadValue("approved", err.Error())))
+		return
+	case err != nil:
+		logger("%s: runner.CommitRunner: %v", funcName, err)
+		sendError(w, apierror.InternalError, err.Error())
+		return
+	}
+	commitRunner.Start()
+	sendJSON(w, http.StatusAccepted, map[string]string{"jobId": commitRunner.JobID()})
+}
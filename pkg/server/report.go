@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/csv"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/export"
+)
+
+// reportHandler (/jobs/{id}/unmatched) returns the rows of an import job which weren't
+// added as CSV, the file can be fixed and uploaded with the job id as retryOf
+func reportHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	const funcName = "reportHandler"
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != req.URL.Query().Get("userId") || job.Type != db.JobTypeImport {
+		sendError(w, apierror.NotFound, "import job not found")
+		return
+	}
+	header := job.CSVHeader
+	if len(header) == 0 {
+		header = []string{csv.ColumnName, csv.ColumnArtist}
+	}
+	var unmatched []export.UnmatchedTrack
+	for _, track := range db.FindJobTracks(jobID) {
+		if track.IsFound {
+			continue
+		}
+		record := track.Record
+		if len(record) == 0 {
+			// tracks stored before rows were kept
+			record = []string{track.Title, track.Artist}
+		}
+		unmatched = append(unmatched, export.UnmatchedTrack{
+			Record:  record,
+			Reason:  track.Reason,
+			Queries: track.Queries,
+		})
+	}
+	var content bytes.Buffer
+	err := export.WriteUnmatched(&content, header, unmatched)
+	if err != nil {
+		logger("%s: export.WriteUnmatched: %v", funcName, err)
+		sendError(w, apierror.InternalError, err.Error())
+		return
+	}
+	sendFile(w, export.ReportFileName(job.FileName), export.ContentType(export.FormatCSV), content.Bytes())
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -9,9 +11,14 @@ import (
 
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
 
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
 	"github.com/yossisp/csv-to-spotify/pkg/config"
 
+	"github.com/yossisp/csv-to-spotify/pkg/hub"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
 	"github.com/yossisp/csv-to-spotify/pkg/runner"
+	"github.com/yossisp/csv-to-spotify/pkg/sse"
 	"github.com/yossisp/csv-to-spotify/pkg/websocket"
 
 	"github.com/rs/cors"
@@ -23,36 +30,49 @@ var (
 	logger = utils.NewLogger("server")
 )
 
-type serverErrorType int
-
-const (
-	csvError serverErrorType = iota + 1
-)
+// sendError sends a failed response with an apierror code
+func sendError(w http.ResponseWriter, code string, message string) {
+	apierror.Send(w, apierror.New(code, message))
+}
 
-type serverError struct {
-	ErrorMessage serverErrorType `json:"errorMessage"`
+// sendMethodNotAllowed answers requests with a method the route doesn't support
+func sendMethodNotAllowed(w http.ResponseWriter) {
+	sendError(w, apierror.MethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 }
 
-func sendError(w http.ResponseWriter, errorType serverErrorType) {
-	const funcName = "sendError"
-	result := serverError{ErrorMessage: errorType}
+func sendJSON(w http.ResponseWriter, statusCode int, result interface{}) {
+	const funcName = "sendJSON"
 	resultJSON, err := json.Marshal(result)
 	if err != nil {
 		logger("%s: json.Marshal: %v", funcName, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendError(w, apierror.InternalError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	http.Error(w, string(resultJSON), http.StatusBadRequest)
+	w.WriteHeader(statusCode)
+	w.Write(resultJSON)
 }
 
-// InitServer starts the server
+// InitServer connects to MongoDB and kafka and starts the server
 func InitServer() {
 	const funcName = "InitServer"
+	db.Connect()
+	kafkahelper.Connect()
+	runner.FailInterruptedJobs()
+	runner.StartHeartbeat()
+	hub.Start()
+	logger("%s: Listing for requests at port %s", funcName, conf.Port)
+	log.Fatal(http.ListenAndServe(":"+conf.Port, NewHandler()))
+}
+
+// NewHandler returns the handler of the server routes. The db store and
+// the kafkahelper bus should be set and the hub started before it's served.
+func NewHandler() http.Handler {
 	cors := cors.New(cors.Options{
-		AllowOriginFunc: func(origin string) bool {
-			return strings.Contains(conf.AllowedOrigins, origin)
-		},
+		AllowOriginFunc: conf.IsAllowedOrigin,
+		// Content-Encoding is set by gzip encoded uploads and Authorization
+		// carries the user's access token, see authorize
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Content-Encoding", "X-Requested-With"},
 	})
 	mux := http.NewServeMux()
 	userHandler := func(w http.ResponseWriter, req *http.Request) {
@@ -62,7 +82,19 @@ func InitServer() {
 		err := json.NewDecoder(req.Body).Decode(&user)
 		if err != nil {
 			logger("%s: json.NewDecoder: %v", funcName, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			sendError(w, apierror.InvalidRequest, err.Error())
+			return
+		}
+		var fields []apierror.FieldError
+		if user.UserID == "" {
+			fields = append(fields, apierror.Missing("userId"))
+		}
+		if _, err = runner.NewPreferences(user.Preferences); err != nil {
+			fields = append(fields, apierror.BadValue("preferences", err.Error()))
+		}
+		if len(fields) > 0 {
+			logger("%s: invalid fields: %v", funcName, fields)
+			apierror.Send(w, apierror.Invalid(fields...))
 			return
 		}
 		db.InsertSpotifyUser(user)
@@ -70,26 +102,118 @@ func InitServer() {
 
 	csvHandler := func(w http.ResponseWriter, req *http.Request) {
 		const funcName = "csvHandler"
-		payload := runner.CSVPayload{}
-		err := json.NewDecoder(req.Body).Decode(&payload)
+		upload, err := readUpload(req)
 		if err != nil {
-			logger("%s: json.NewDecoder: %v", funcName, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logger("%s: readUpload: %v", funcName, err)
+			sendError(w, uploadErrorCode(err), err.Error())
+			return
+		}
+		// the runners close the uploaded files once their jobs end
+		started := false
+		defer func() {
+			if !started {
+				upload.close()
+			}
+		}()
+		if fields := validatePayload(upload); len(fields) > 0 {
+			logger("%s: invalid fields: %v", funcName, fields)
+			apierror.Send(w, apierror.Invalid(fields...))
+			return
+		}
+		payload := upload.payload
+		// modes other than create change existing playlists of the user
+		if payload.Mode != nil && *payload.Mode != client.ImportCreate && !authorize(w, req, *payload.UserID) {
 			return
 		}
-
 		dbUser := db.FindSpotifyUser(*payload.UserID)
-		if payload.UserID == nil || payload.CSVFile == nil || dbUser == nil {
-			errMsg := "missing/bad userId or missing csvFile"
-			logger("%s: %s", funcName, errMsg)
-			sendError(w, csvError)
+		if dbUser == nil {
+			logger("%s: user %s not found", funcName, *payload.UserID)
+			sendError(w, apierror.UnknownUser, "user not found: "+*payload.UserID)
+			return
+		}
+		if upload.files != nil {
+			started = startBatch(w, upload, dbUser)
 			return
 		}
 		fileName := *payload.FileName
 		// client logic enforces that the file is csv
 		*payload.FileName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
-		runner := runner.NewRunner(payload, dbUser)
-		go runner.Run()
+		newRunner, err := runner.NewRunner(payload, dbUser)
+		switch {
+		case errors.Is(err, runner.ErrJobNotFound):
+			sendError(w, apierror.NotFound, "retried job not found")
+			return
+		case errors.Is(err, runner.ErrJobNotRetryable):
+			sendError(w, apierror.Conflict, err.Error())
+			return
+		case err != nil:
+			logger("%s: runner.NewRunner: %v", funcName, err)
+			sendError(w, apierror.InternalError, err.Error())
+			return
+		}
+		started = true
+		newRunner.Start()
+		sendJSON(w, http.StatusOK, map[string]string{"jobId": newRunner.JobID()})
+	}
+	// jobsHandler routes /jobs/{id}/{action}
+	jobsHandler := func(w http.ResponseWriter, req *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 || parts[0] == "" {
+			sendError(w, apierror.NotFound, "unknown route: "+req.URL.Path)
+			return
+		}
+		jobID, action := parts[0], parts[1]
+		switch action {
+		case "events":
+			if req.Method != http.MethodGet {
+				sendMethodNotAllowed(w)
+				return
+			}
+			sse.EventsHandler(w, req, jobID)
+		case "cancel":
+			if req.Method != http.MethodPost {
+				sendMethodNotAllowed(w)
+				return
+			}
+			if !runner.Cancel(jobID, req.URL.Query().Get("userId")) {
+				sendError(w, apierror.NotFound, "running job not found")
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case "export":
+			if req.Method != http.MethodGet {
+				sendMethodNotAllowed(w)
+				return
+			}
+			exportHandler(w, req, jobID)
+		case "resume":
+			if req.Method != http.MethodPost {
+				sendMethodNotAllowed(w)
+				return
+			}
+			resumeHandler(w, req, jobID)
+		case "unmatched":
+			if req.Method != http.MethodGet {
+				sendMethodNotAllowed(w)
+				return
+			}
+			reportHandler(w, req, jobID)
+		case "preview":
+			if req.Method != http.MethodGet {
+				sendMethodNotAllowed(w)
+				return
+			}
+			previewHandler(w, req, jobID)
+		case "commit":
+			if req.Method != http.MethodPost {
+				sendMethodNotAllowed(w)
+				return
+			}
+			commitHandler(w, req, jobID)
+		default:
+			sendError(w, apierror.NotFound, "unknown route: "+req.URL.Path)
+		}
 	}
 	healthHandler := func(w http.ResponseWriter, req *http.Request) {
 		return
@@ -97,8 +221,16 @@ func InitServer() {
 	mux.HandleFunc("/csv", csvHandler)
 	mux.HandleFunc("/user", userHandler)
 	mux.HandleFunc("/websocket", websocket.WSConnectionHandler)
+	mux.HandleFunc("/jobs/", jobsHandler)
+	mux.HandleFunc("/batches/", batchesHandler)
+	mux.HandleFunc("/playlists/", playlistsHandler)
+	mux.HandleFunc("/accounts/links", accountLinksHandler)
+	mux.HandleFunc("/accounts/links/", accountLinksHandler)
+	mux.HandleFunc("/migrations", migrationsHandler)
+	mux.HandleFunc("/webhooks", webhooksHandler)
+	mux.HandleFunc("/webhooks/", webhooksHandler)
 	mux.HandleFunc("/health", healthHandler)
-	handler := cors.Handler(mux)
-	logger("%s: Listing for requests at port %s", funcName, conf.Port)
-	log.Fatal(http.ListenAndServe(":"+conf.Port, handler))
+	// expvar metrics e.g. match cache hit rate
+	mux.Handle("/metrics", expvar.Handler())
+	return cors.Handler(mux)
 }
@@ -0,0 +1,483 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/client"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
+)
+
+const (
+	// maxUploadSize limits the upload body and the decompressed file,
+	// the entries of an archive share the limit
+	maxUploadSize = 32 << 20
+	// maxBatchFiles limits the playlist files of an archive since each of them is a job
+	maxBatchFiles = 20
+	// payloadPart holds the JSON options of multipart uploads
+	payloadPart = "payload"
+	// filePart holds the file of multipart uploads
+	filePart = "file"
+)
+
+var (
+	errUploadTooLarge = fmt.Errorf("the upload is larger than %d bytes", maxUploadSize)
+	// errInvalidFile wraps the failures to read the uploaded file
+	errInvalidFile     = errors.New("the file isn't a CSV file or a zip archive of CSV files")
+	errTooManyFiles    = fmt.Errorf("%w: the archive has more than %d playlist files", errInvalidFile, maxBatchFiles)
+	errNoPlaylistFiles = fmt.Errorf("%w: the archive has no playlist files", errInvalidFile)
+	zipSignature       = []byte("PK\x03\x04")
+	gzipSignature      = []byte{0x1f, 0x8b}
+	// rawUploadTypes are the content types of bodies which are the file itself
+	rawUploadTypes = map[string]bool{
+		"text/csv":                 true,
+		"application/zip":          true,
+		"application/gzip":         true,
+		"application/octet-stream": true,
+	}
+)
+
+// upload is a /csv request, its files are spooled to temporary files which the
+// runners close, see close
+type upload struct {
+	payload runner.CSVPayload
+	// files are the playlist files of a zip archive, they're nil if the upload is
+	// a single file which is payload.File
+	files []runner.BatchFile
+}
+
+// close removes the files of an upload which didn't start jobs
+func (upload upload) close() {
+	if upload.payload.File != nil {
+		upload.payload.File.Close()
+	}
+	for _, file := range upload.files {
+		file.File.Close()
+	}
+}
+
+// spooledFile is a temporary file which is removed once it's closed
+type spooledFile struct {
+	*os.File
+}
+
+func (file spooledFile) Close() error {
+	err := file.File.Close()
+	os.Remove(file.Name())
+	return err
+}
+
+// spool copies reader to a temporary file so that uploads aren't held in memory
+// while their jobs run, the file is read from its start
+func spool(reader io.Reader) (spooledFile, error) {
+	const funcName = "spool"
+	tempFile, err := ioutil.TempFile("", "upload-*.csv")
+	if err != nil {
+		logger("%s: ioutil.TempFile: %v", funcName, err)
+		return spooledFile{}, err
+	}
+	file := spooledFile{File: tempFile}
+	if _, err = io.Copy(file.File, reader); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return spooledFile{}, err
+	}
+	return file, nil
+}
+
+// hasSignature reports whether the buffered content starts with signature
+func hasSignature(reader *bufio.Reader, signature []byte) bool {
+	head, _ := reader.Peek(len(signature))
+	return bytes.Equal(head, signature)
+}
+
+// batchResponse answers the upload of an archive
+type batchResponse struct {
+	BatchID string   `json:"batchId"`
+	JobIDs  []string `json:"jobIds"`
+}
+
+// batchStatusResponse is a batch and the state of its jobs
+type batchStatusResponse struct {
+	Batch db.Batch `json:"batch"`
+	Jobs  []db.Job `json:"jobs"`
+}
+
+// limitedReader fails with errUploadTooLarge once more than remaining bytes are read
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (limited *limitedReader) Read(p []byte) (int, error) {
+	if limited.remaining < 0 {
+		return 0, errUploadTooLarge
+	}
+	// a byte past the limit tells whether there is more to read
+	if int64(len(p)) > limited.remaining+1 {
+		p = p[:limited.remaining+1]
+	}
+	n, err := limited.reader.Read(p)
+	limited.remaining -= int64(n)
+	if limited.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// readUpload reads a /csv request. JSON bodies hold the file in csvFile. Multipart bodies
+// hold the JSON options in the payload part and the file in the file part. Bodies of
+// rawUploadTypes are the file itself and the options are query parameters, see queryPayload.
+// Bodies may be gzip encoded, the file of multipart and raw bodies may be gzip compressed
+// or a zip archive of several playlist files. Files are streamed to temporary files, the
+// caller closes them if it doesn't start jobs for the upload, see upload.close.
+func readUpload(req *http.Request) (upload, error) {
+	body := io.Reader(&limitedReader{reader: req.Body, remaining: maxUploadSize})
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return upload{}, err
+		}
+		defer gzipReader.Close()
+		body = &limitedReader{reader: gzipReader, remaining: maxUploadSize}
+	}
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		return readMultipart(multipart.NewReader(body, params["boundary"]))
+	case rawUploadTypes[mediaType]:
+		payload, err := queryPayload(req.URL.Query())
+		if err != nil {
+			return upload{}, err
+		}
+		file, err := readFile(body)
+		if err != nil {
+			return upload{}, err
+		}
+		return newUpload(payload, file), nil
+	default:
+		payload := runner.CSVPayload{}
+		err := json.NewDecoder(body).Decode(&payload)
+		if err != nil || payload.CSVFile == nil {
+			return upload{payload: payload}, err
+		}
+		// the decoded file is released once the request is answered
+		file, err := spool(strings.NewReader(*payload.CSVFile))
+		if err != nil {
+			return upload{}, err
+		}
+		payload.File = file
+		return upload{payload: payload}, nil
+	}
+}
+
+// readMultipart reads the parts of a multipart upload, the name of the file part
+// is the uploadFileName if the payload doesn't set it
+func readMultipart(reader *multipart.Reader) (upload, error) {
+	payload := runner.CSVPayload{}
+	var file *uploadFile
+	fileName := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch part.FormName() {
+			case payloadPart:
+				err = json.NewDecoder(part).Decode(&payload)
+			case filePart:
+				if file != nil {
+					// only the last file part is imported
+					newUpload(payload, *file).close()
+				}
+				fileName = part.FileName()
+				var partFile uploadFile
+				partFile, err = readFile(part)
+				file = &partFile
+			}
+		}
+		if err != nil {
+			if file != nil {
+				newUpload(payload, *file).close()
+			}
+			return upload{}, err
+		}
+	}
+	if file == nil {
+		return upload{}, errors.New("missing file part")
+	}
+	if payload.FileName == nil && fileName != "" {
+		payload.FileName = &fileName
+	}
+	return newUpload(payload, *file), nil
+}
+
+// queryPayload reads the options of a raw upload, the query parameters are named
+// like the fields of the JSON payload. Preferences and playlist options can't be
+// query parameters, they're sent by JSON and multipart uploads.
+func queryPayload(query url.Values) (runner.CSVPayload, error) {
+	payload := runner.CSVPayload{}
+	stringParams := map[string]**string{
+		"userId":         &payload.UserID,
+		"uploadFileName": &payload.FileName,
+		"mode":           &payload.Mode,
+		"playlistId":     &payload.PlaylistID,
+		"retryOf":        &payload.RetryOf,
+		"market":         &payload.Market,
+		"duplicates":     &payload.Duplicates,
+		"destination":    &payload.Destination,
+	}
+	for name, field := range stringParams {
+		if values, found := query[name]; found {
+			value := values[0]
+			*field = &value
+		}
+	}
+	boolParams := map[string]**bool{
+		"dryRun":  &payload.DryRun,
+		"preview": &payload.Preview,
+		"review":  &payload.Review,
+	}
+	for name, field := range boolParams {
+		if values, found := query[name]; found {
+			value, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return payload, fmt.Errorf("bad %s: %s", name, values[0])
+			}
+			*field = &value
+		}
+	}
+	return payload, nil
+}
+
+// uploadErrorCode returns the apierror code of a readUpload failure
+func uploadErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return apierror.PayloadTooLarge
+	case errors.Is(err, errInvalidFile):
+		return apierror.InvalidCSV
+	}
+	return apierror.InvalidRequest
+}
+
+// invalidFile wraps a failure to read the uploaded file with errInvalidFile
+func invalidFile(err error) error {
+	if errors.Is(err, errUploadTooLarge) || errors.Is(err, errInvalidFile) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errInvalidFile, err)
+}
+
+// uploadFile is the file of a multipart or raw upload
+type uploadFile struct {
+	csvFile io.ReadCloser
+	// files are the playlist files of a zip archive, csvFile is nil if they're set
+	files []runner.BatchFile
+	// compressed is set if the file was gzip compressed
+	compressed bool
+}
+
+// newUpload makes file the file of payload
+func newUpload(payload runner.CSVPayload, file uploadFile) upload {
+	if file.compressed && payload.FileName != nil {
+		fileName := strings.TrimSuffix(*payload.FileName, ".gz")
+		payload.FileName = &fileName
+	}
+	payload.File = file.csvFile
+	return upload{payload: payload, files: file.files}
+}
+
+// readFile spools the uploaded file, or the playlist files if it's a zip archive.
+// A gzip compressed file is decompressed first.
+func readFile(reader io.Reader) (uploadFile, error) {
+	file := uploadFile{}
+	buffered := bufio.NewReader(reader)
+	if hasSignature(buffered, gzipSignature) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return file, invalidFile(err)
+		}
+		defer gzipReader.Close()
+		buffered = bufio.NewReader(&limitedReader{reader: gzipReader, remaining: maxUploadSize})
+		file.compressed = true
+	}
+	isArchive := hasSignature(buffered, zipSignature)
+	spooled, err := spool(buffered)
+	if err != nil {
+		return file, invalidFile(err)
+	}
+	if !isArchive {
+		file.csvFile = spooled
+		return file, nil
+	}
+	defer spooled.Close()
+	file.files, err = readArchive(spooled)
+	if err != nil {
+		return file, invalidFile(err)
+	}
+	return file, nil
+}
+
+// readArchive spools the files of a zip archive which have the input file extension
+func readArchive(archive spooledFile) ([]runner.BatchFile, error) {
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	files := []runner.BatchFile{}
+	closeFiles := func() {
+		for _, file := range files {
+			file.File.Close()
+		}
+	}
+	limited := &limitedReader{remaining: maxUploadSize}
+	for _, entry := range zipReader.File {
+		name := path.Base(entry.Name)
+		// folders, hidden files and the metadata macOS adds to archives aren't playlist files
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") ||
+			!strings.EqualFold(path.Ext(name), conf.InputFileExt) {
+			continue
+		}
+		if len(files) == maxBatchFiles {
+			closeFiles()
+			return nil, errTooManyFiles
+		}
+		entryReader, err := entry.Open()
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		limited.reader = entryReader
+		content, err := spool(limited)
+		entryReader.Close()
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		files = append(files, runner.BatchFile{
+			Name: strings.TrimSuffix(name, path.Ext(name)),
+			File: content,
+		})
+	}
+	if len(files) == 0 {
+		return nil, errNoPlaylistFiles
+	}
+	return files, nil
+}
+
+// validatePayload returns the missing and invalid fields of an upload
+func validatePayload(upload upload) []apierror.FieldError {
+	payload := upload.payload
+	isArchive := upload.files != nil
+	var fields []apierror.FieldError
+	if payload.UserID == nil {
+		fields = append(fields, apierror.Missing("userId"))
+	}
+	if payload.File == nil && !isArchive {
+		fields = append(fields, apierror.Missing("csvFile"))
+	}
+	// the playlists of an archive are named after its files
+	if payload.FileName == nil && !isArchive {
+		fields = append(fields, apierror.Missing("uploadFileName"))
+	}
+	if payload.Mode != nil && !client.IsImportMode(*payload.Mode) {
+		fields = append(fields, apierror.BadValue("mode", "unknown mode: "+*payload.Mode))
+	}
+	if payload.Destination != nil && !client.IsDestination(*payload.Destination) {
+		fields = append(fields, apierror.BadValue("destination", "unknown destination: "+*payload.Destination))
+	}
+	if payload.Duplicates != nil && !client.IsDuplicatesMode(*payload.Duplicates) {
+		fields = append(fields, apierror.BadValue("duplicates", "unknown duplicates mode: "+*payload.Duplicates))
+	}
+	if payload.Market != nil && !client.IsMarket(strings.ToUpper(*payload.Market)) {
+		fields = append(fields, apierror.BadValue("market", "unknown market: "+*payload.Market))
+	}
+	if _, err := runner.NewPreferences(payload.Preferences); err != nil {
+		fields = append(fields, apierror.BadValue("preferences", err.Error()))
+	}
+	if playlist := payload.Playlist; playlist != nil {
+		if playlist.Public != nil && *playlist.Public && playlist.Collaborative != nil && *playlist.Collaborative {
+			fields = append(fields, apierror.BadValue("playlist.collaborative", "collaborative playlists can't be public"))
+		}
+		if playlist.CoverImage != nil {
+			if err := client.ValidateCoverImage(*playlist.CoverImage); err != nil {
+				fields = append(fields, apierror.BadValue("playlist.coverImage", err.Error()))
+			}
+		}
+	}
+	if isArchive && payload.RetryOf != nil {
+		fields = append(fields, apierror.BadValue("retryOf", "archives can't retry a job"))
+	}
+	if isArchive && payload.PlaylistID != nil {
+		fields = append(fields, apierror.BadValue("playlistId", "each file of an archive is imported to its own playlist"))
+	}
+	return fields
+}
+
+// startBatch starts a job for every playlist file of an uploaded archive, each file
+// is imported to its own playlist and the jobs run one after another. It returns
+// false if no job started.
+func startBatch(w http.ResponseWriter, upload upload, user *db.SpotifyUser) bool {
+	const funcName = "startBatch"
+	payload := upload.payload
+	archiveName := ""
+	if payload.FileName != nil {
+		archiveName = strings.TrimSuffix(*payload.FileName, path.Ext(*payload.FileName))
+	}
+	batch, runners, err := runner.NewBatchRunners(payload, archiveName, upload.files, user)
+	if err != nil {
+		logger("%s: runner.NewBatchRunners: %v", funcName, err)
+		sendError(w, apierror.InternalError, err.Error())
+		return false
+	}
+	response := batchResponse{BatchID: batch.ID}
+	for _, batchRunner := range runners {
+		response.JobIDs = append(response.JobIDs, batchRunner.JobID())
+	}
+	runner.StartBatch(runners)
+	sendJSON(w, http.StatusOK, response)
+	return true
+}
+
+// batchesHandler (/batches/{id} route) returns a batch of the user and its jobs
+func batchesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		sendMethodNotAllowed(w)
+		return
+	}
+	batchID := strings.Trim(strings.TrimPrefix(req.URL.Path, "/batches/"), "/")
+	batch := db.FindBatch(batchID)
+	if batch == nil || batch.UserID != req.URL.Query().Get("userId") {
+		sendError(w, apierror.NotFound, "batch not found")
+		return
+	}
+	sendJSON(w, http.StatusOK, batchStatusResponse{
+		Batch: *batch,
+		Jobs:  db.FindBatchJobs(batchID),
+	})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/utils"
+	"github.com/yossisp/csv-to-spotify/pkg/webhook"
+)
+
+// webhookPayload registers a webhook, all events are sent if Events is empty
+type webhookPayload struct {
+	UserID *string  `json:"userId"`
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+}
+
+// validateWebhookPayload returns the missing and invalid fields of the payload,
+// the url must resolve to a public address
+func validateWebhookPayload(ctx context.Context, payload webhookPayload) []apierror.FieldError {
+	var fields []apierror.FieldError
+	if payload.UserID == nil {
+		fields = append(fields, apierror.Missing("userId"))
+	}
+	if payload.URL == nil {
+		fields = append(fields, apierror.Missing("url"))
+	} else if err := webhook.CheckURL(ctx, *payload.URL); err != nil {
+		fields = append(fields, apierror.BadValue("url", err.Error()))
+	}
+	for i, event := range payload.Events {
+		if !webhook.IsEvent(event) {
+			fields = append(fields, apierror.BadValue(fmt.Sprintf("events[%d]", i), "unknown event: "+event))
+		}
+	}
+	return fields
+}
+
+// webhooksHandler (/webhooks route) lists (GET) and registers (POST) webhooks,
+// /webhooks/{id} deletes (DELETE) a webhook and
+// /webhooks/{id}/deliveries returns (GET) its delivery log.
+// The webhook secret is returned only once, when the webhook is registered.
+// Requests must carry an access token of the user, see authorize.
+func webhooksHandler(w http.ResponseWriter, req *http.Request) {
+	const funcName = "webhooksHandler"
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/webhooks"), "/")
+	parts := strings.Split(path, "/")
+	userID := req.URL.Query().Get("userId")
+
+	switch {
+	case path == "" && req.Method == http.MethodGet:
+		if !authorize(w, req, userID) {
+			return
+		}
+		webhooks := db.FindWebhooks(userID)
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		sendJSON(w, http.StatusOK, webhooks)
+	case path == "" && req.Method == http.MethodPost:
+		payload := webhookPayload{}
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil {
+			logger("%s: json.NewDecoder: %v", funcName, err)
+			sendError(w, apierror.InvalidRequest, err.Error())
+			return
+		}
+		// the url is resolved only for authorized requests
+		if payload.UserID != nil && !authorize(w, req, *payload.UserID) {
+			return
+		}
+		if fields := validateWebhookPayload(req.Context(), payload); len(fields) > 0 {
+			logger("%s: invalid fields: %v", funcName, fields)
+			apierror.Send(w, apierror.Invalid(fields...))
+			return
+		}
+		if db.FindSpotifyUser(*payload.UserID) == nil {
+			sendError(w, apierror.UnknownUser, "user not found: "+*payload.UserID)
+			return
+		}
+		if len(payload.Events) == 0 {
+			payload.Events = webhook.Events
+		}
+		secret, err := utils.RandomHex(32)
+		if err != nil {
+			logger("%s: utils.RandomHex: %v", funcName, err)
+			sendError(w, apierror.InternalError, err.Error())
+			return
+		}
+		created := db.InsertWebhook(db.Webhook{
+			UserID: *payload.UserID,
+			URL:    *payload.URL,
+			Secret: secret,
+			Events: payload.Events,
+		})
+		if created == nil {
+			sendError(w, apierror.InternalError, "couldn't register webhook")
+			return
+		}
+		sendJSON(w, http.StatusCreated, created)
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		if !authorize(w, req, userID) {
+			return
+		}
+		if !db.DeleteWebhook(userID, parts[0]) {
+			sendError(w, apierror.NotFound, "webhook not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "deliveries" && req.Method == http.MethodGet:
+		if !authorize(w, req, userID) {
+			return
+		}
+		if db.FindWebhook(userID, parts[0]) == nil {
+			sendError(w, apierror.NotFound, "webhook not found")
+			return
+		}
+		sendJSON(w, http.StatusOK, db.FindWebhookDeliveries(parts[0]))
+	default:
+		sendError(w, apierror.NotFound, "unknown route: "+req.Method+" "+req.URL.Path)
+	}
+}
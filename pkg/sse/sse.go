@@ -0,0 +1,184 @@
+/*
+Package sse streams job messages as server-sent events
+for clients which can't open a websocket (e.g. behind proxies
+which strip the Upgrade header).
+
+the stream quits when:
+1. the client disconnects
+2. the job has finished
+
+the event id is the message sequence number so a reconnecting
+EventSource resumes from the Last-Event-ID header it sends,
+messages it missed are rebuilt from the job store.
+*/
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/apierror"
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/hub"
+	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+	"github.com/yossisp/csv-to-spotify/pkg/utils"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+	// lastEventIDParam is for the first request, EventSource
+	// only sends Last-Event-ID header when it reconnects
+	lastEventIDParam  = "lastEventId"
+	keepaliveInterval = 15 * time.Second
+)
+
+var (
+	logger = utils.NewLogger("sse")
+)
+
+// eventStream writes the messages of a single job
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	jobID   string
+	// lastSeq is the sequence number of the last message written
+	lastSeq int
+}
+
+// write sends a message as an event
+func (stream *eventStream) write(msg kafkahelper.Message) (isJobFinished bool, err error) {
+	clientMessage, isJobFinished, ok := hub.NewClientMessage(msg)
+	if !ok {
+		return false, nil
+	}
+	data, err := json.Marshal(clientMessage)
+	if err != nil {
+		return false, err
+	}
+	if msg.Seq > 0 {
+		if _, err = fmt.Fprintf(stream.w, "id: %d\n", msg.Seq); err != nil {
+			return false, err
+		}
+		stream.lastSeq = msg.Seq
+	}
+	if _, err = fmt.Fprintf(stream.w, "event: %s\ndata: %s\n\n", clientMessage.MessageType, data); err != nil {
+		return false, err
+	}
+	stream.flusher.Flush()
+	return isJobFinished, nil
+}
+
+// catchUp sends the messages published after lastSeq from the job store
+func (stream *eventStream) catchUp() (isJobFinished bool, err error) {
+	job := db.FindJob(stream.jobID)
+	if job == nil {
+		return false, fmt.Errorf("job: %s not found", stream.jobID)
+	}
+	for _, msg := range hub.Replay(*job, db.FindJobTracks(job.ID), stream.lastSeq) {
+		if _, err = stream.write(msg); err != nil {
+			return false, err
+		}
+	}
+	if job.Seq > stream.lastSeq {
+		stream.lastSeq = job.Seq
+	}
+	return hub.IsJobDone(*job), nil
+}
+
+// getLastEventID returns the sequence number the client already has
+func getLastEventID(req *http.Request) int {
+	lastEventID := req.Header.Get(lastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get(lastEventIDParam)
+	}
+	seq, err := strconv.Atoi(lastEventID)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// EventsHandler (/jobs/{id}/events route) streams the job messages
+// the websocket carries. It shares the hub subscription mechanism
+// with the websocket: it subscribes first, catches up from the job store
+// and then forwards live messages of the job.
+func EventsHandler(w http.ResponseWriter, req *http.Request, jobID string) {
+	const funcName = "EventsHandler"
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror.Send(w, apierror.New(apierror.InternalError, "streaming unsupported"))
+		return
+	}
+	userID := req.URL.Query().Get("userId")
+	job := db.FindJob(jobID)
+	if job == nil || job.UserID != userID {
+		apierror.Send(w, apierror.New(apierror.NotFound, "job not found"))
+		return
+	}
+
+	subscription := hub.Subscribe(userID)
+	defer subscription.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disables nginx response buffering
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{
+		w:       w,
+		flusher: flusher,
+		jobID:   jobID,
+		lastSeq: getLastEventID(req),
+	}
+	isJobFinished, err := stream.catchUp()
+	if err != nil || isJobFinished {
+		return
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-subscription.Messages:
+			if msg.JobID != jobID || msg.Seq <= stream.lastSeq {
+				continue
+			}
+			if msg.Seq > stream.lastSeq+1 {
+				// messages were dropped by the hub
+				isJobFinished, err = stream.catchUp()
+			} else {
+				isJobFinished, err = stream.write(msg)
+			}
+			if err != nil {
+				logger("%s: job: %s write: %v", funcName, jobID, err)
+				return
+			}
+			if isJobFinished {
+				return
+			}
+		case <-subscription.Stale:
+			// messages were dropped by the hub, the last one of the job may be among them
+			isJobFinished, err = stream.catchUp()
+			if err != nil {
+				logger("%s: job: %s catchUp: %v", funcName, jobID, err)
+				return
+			}
+			if isJobFinished {
+				return
+			}
+		case <-keepalive.C:
+			// comment line, ignored by EventSource
+			if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
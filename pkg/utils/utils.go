@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"time"
@@ -29,3 +31,12 @@ func NewLogger(logPrefix string) LogCb {
 		log.Printf("["+logPrefix+"]: %s\n", message)
 	}
 }
+
+// RandomHex returns n random bytes hex encoded
+func RandomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
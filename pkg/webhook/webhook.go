@@ -0,0 +1,221 @@
+/*
+Package webhook notifies user registered URLs about job events.
+
+Every payload is signed with the webhook secret, the receiver should
+compute HMAC-SHA256 of the raw request body and compare it with
+the hex digest in the X-Webhook-Signature header ("sha256=<digest>").
+Failed deliveries (network errors, 429 and 5xx responses) are retried
+with exponential backoff, every attempt is saved in the delivery log.
+Webhooks are delivered to public addresses only, see CheckURL.
+*/
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/utils"
+)
+
+const (
+	// JobStarted - the job started looking up tracks
+	JobStarted = "job.started"
+	// JobFinished - the playlist was created
+	JobFinished = "job.finished"
+	// JobFailed - the job failed, the failure cause explains why
+	// (e.g. add_tracks_failed, sync_failed, migration_failed, interrupted)
+	JobFailed = "job.failed"
+	// JobCancelled - the user cancelled the job
+	JobCancelled = "job.cancelled"
+	// JobPreviewed - the tracks of a preview job were looked up, the job waits to be committed
+	JobPreviewed = "job.previewed"
+
+	// SignatureHeader carries the payload signature
+	SignatureHeader = "X-Webhook-Signature"
+	// EventHeader carries the event name
+	EventHeader = "X-Webhook-Event"
+	// DeliveryHeader carries the delivery id, it's the same for all attempts
+	DeliveryHeader = "X-Webhook-Delivery"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	logger = utils.NewLogger("webhook")
+	// Events are the events a webhook can subscribe to
+	Events = []string{JobStarted, JobFinished, JobFailed, JobCancelled, JobPreviewed}
+)
+
+// Payload is the JSON body sent to webhooks
+type Payload struct {
+	Event          string `json:"event"`
+	JobID          string `json:"jobId"`
+	UserID         string `json:"userId"`
+	FileName       string `json:"fileName"`
+	Status         string `json:"status"`
+	TracksAdded    int    `json:"tracksAdded"`
+	TracksNotAdded int    `json:"tracksNotAdded"`
+	// Cause is the apierror code of job.failed event
+	Cause     string    `json:"cause,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Dispatcher delivers job events to webhooks
+type Dispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	// backoff is the delay before the second attempt, it doubles with every attempt
+	backoff time.Duration
+	// findWebhooks returns the webhooks of a user
+	findWebhooks func(userID string) []db.Webhook
+	// logDelivery saves a delivery attempt
+	logDelivery func(delivery db.WebhookDelivery)
+}
+
+// NewDispatcher returns a dispatcher which uses the db for webhooks and delivery log
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		client:       newDeliveryClient(10 * time.Second),
+		maxAttempts:  5,
+		backoff:      2 * time.Second,
+		findWebhooks: db.FindWebhooks,
+		logDelivery:  db.InsertWebhookDelivery,
+	}
+}
+
+// IsEvent reports whether event is a known event name
+func IsEvent(event string) bool {
+	for _, knownEvent := range Events {
+		if knownEvent == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header value of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewPayload returns the payload of a job event
+func NewPayload(event string, job db.Job) Payload {
+	return Payload{
+		Event:          event,
+		JobID:          job.ID,
+		UserID:         job.UserID,
+		FileName:       job.FileName,
+		Status:         string(job.Status),
+		TracksAdded:    job.TracksAdded,
+		TracksNotAdded: job.TracksNotAdded,
+		Cause:          job.FailureCause,
+		Timestamp:      time.Now(),
+	}
+}
+
+func isSubscribed(webhook db.Webhook, event string) bool {
+	for _, subscribedEvent := range webhook.Events {
+		if subscribedEvent == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify sends a job event to the webhooks of the job's user
+// which subscribed to it, deliveries run in the background
+func (dispatcher *Dispatcher) Notify(event string, job db.Job) {
+	payload := NewPayload(event, job)
+	for _, webhook := range dispatcher.findWebhooks(job.UserID) {
+		if isSubscribed(webhook, event) {
+			go dispatcher.Deliver(webhook, payload)
+		}
+	}
+}
+
+// Deliver posts the payload to the webhook until it succeeds or attempts run out
+func (dispatcher *Dispatcher) Deliver(webhook db.Webhook, payload Payload) (isDelivered bool) {
+	const funcName = "Deliver"
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger("%s: json.Marshal: %v", funcName, err)
+		return false
+	}
+	deliveryID, err := utils.RandomHex(12)
+	if err != nil {
+		logger("%s: utils.RandomHex: %v", funcName, err)
+		return false
+	}
+	delay := dispatcher.backoff
+	for attempt := 1; attempt <= dispatcher.maxAttempts; attempt++ {
+		delivery := db.WebhookDelivery{
+			WebhookID: webhook.ID,
+			JobID:     payload.JobID,
+			Event:     payload.Event,
+			Attempt:   attempt,
+			CreatedAt: time.Now(),
+		}
+		statusCode, err := dispatcher.post(webhook, deliveryID, payload.Event, body)
+		delivery.StatusCode = statusCode
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		delivery.Success = err == nil && statusCode < http.StatusMultipleChoices
+		dispatcher.logDelivery(delivery)
+		if delivery.Success {
+			return true
+		}
+		if !isRetriable(statusCode, err) {
+			break
+		}
+		if attempt < dispatcher.maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	logger("%s: webhook: %s event: %s job: %s not delivered", funcName, webhook.ID, payload.Event, payload.JobID)
+	return false
+}
+
+// post makes a single delivery attempt
+func (dispatcher *Dispatcher) post(webhook db.Webhook, deliveryID string, event string, body []byte) (statusCode int, err error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+	response, err := dispatcher.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= http.StatusMultipleChoices {
+		return response.StatusCode, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// isRetriable reports whether a failed attempt may succeed later
+func isRetriable(statusCode int, err error) bool {
+	if statusCode == 0 {
+		// no response e.g. connection refused or timeout
+		return err != nil
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
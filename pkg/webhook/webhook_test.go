@@ -0,0 +1,218 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yossisp/csv-to-spotify/pkg/db"
+)
+
+// newTestDispatcher returns a dispatcher which keeps the delivery log in memory
+func newTestDispatcher(webhooks []db.Webhook) (*Dispatcher, func() []db.WebhookDelivery) {
+	var (
+		mutex      sync.Mutex
+		deliveries []db.WebhookDelivery
+	)
+	dispatcher := &Dispatcher{
+		client:      &http.Client{Timeout: time.Second},
+		maxAttempts: 3,
+		backoff:     time.Millisecond,
+		findWebhooks: func(userID string) []db.Webhook {
+			return webhooks
+		},
+		logDelivery: func(delivery db.WebhookDelivery) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			deliveries = append(deliveries, delivery)
+		},
+	}
+	return dispatcher, func() []db.WebhookDelivery {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]db.WebhookDelivery{}, deliveries...)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	job := db.Job{ID: "job", UserID: "user", FileName: "playlist", Status: db.JobFinished, TracksAdded: 2}
+
+	const testDeliverSigned = "TestDeliverSigned"
+	t.Run(testDeliverSigned, func(t *testing.T) {
+		const secret = "secret"
+		received := make(chan Payload, 1)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			if signature := req.Header.Get(SignatureHeader); signature != Sign(secret, body) {
+				t.Errorf("%s: bad signature: %s", testDeliverSigned, signature)
+			}
+			if event := req.Header.Get(EventHeader); event != JobFinished {
+				t.Errorf("%s: unexpected event header: %s", testDeliverSigned, event)
+			}
+			payload := Payload{}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Errorf("%s: json.Unmarshal: %v", testDeliverSigned, err)
+			}
+			received <- payload
+		}))
+		defer receiver.Close()
+
+		webhook := db.Webhook{ID: "hook", URL: receiver.URL, Secret: secret, Events: []string{JobFinished}}
+		dispatcher, deliveries := newTestDispatcher([]db.Webhook{webhook})
+		if !dispatcher.Deliver(webhook, NewPayload(JobFinished, job)) {
+			t.Fatalf("%s: not delivered", testDeliverSigned)
+		}
+		payload := <-received
+		if payload.JobID != job.ID || payload.TracksAdded != job.TracksAdded {
+			t.Errorf("%s: unexpected payload: %v", testDeliverSigned, payload)
+		}
+		if log := deliveries(); len(log) != 1 || !log[0].Success {
+			t.Errorf("%s: unexpected delivery log: %v", testDeliverSigned, log)
+		}
+	})
+
+	const testDeliverRetries = "TestDeliverRetries"
+	t.Run(testDeliverRetries, func(t *testing.T) {
+		var (
+			mutex          sync.Mutex
+			requests       int
+			delivery       string
+			sameDeliveryID = true
+		)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			requests++
+			if delivery != "" && delivery != req.Header.Get(DeliveryHeader) {
+				sameDeliveryID = false
+			}
+			delivery = req.Header.Get(DeliveryHeader)
+			if requests < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer receiver.Close()
+
+		webhook := db.Webhook{ID: "hook", URL: receiver.URL, Secret: "secret"}
+		dispatcher, deliveries := newTestDispatcher(nil)
+		if !dispatcher.Deliver(webhook, NewPayload(JobFinished, job)) {
+			t.Fatalf("%s: not delivered", testDeliverRetries)
+		}
+		log := deliveries()
+		if len(log) != 3 || log[0].Success || log[0].StatusCode != http.StatusServiceUnavailable || !log[2].Success {
+			t.Errorf("%s: unexpected delivery log: %v", testDeliverRetries, log)
+		}
+		if !sameDeliveryID {
+			t.Errorf("%s: delivery id changed between attempts", testDeliverRetries)
+		}
+	})
+
+	const testDeliverNoRetryOnClientError = "TestDeliverNoRetryOnClientError"
+	t.Run(testDeliverNoRetryOnClientError, func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusGone)
+		}))
+		defer receiver.Close()
+
+		webhook := db.Webhook{ID: "hook", URL: receiver.URL, Secret: "secret"}
+		dispatcher, deliveries := newTestDispatcher(nil)
+		if dispatcher.Deliver(webhook, NewPayload(JobFailed, job)) {
+			t.Fatalf("%s: unexpectedly delivered", testDeliverNoRetryOnClientError)
+		}
+		if log := deliveries(); len(log) != 1 {
+			t.Errorf("%s: expected a single attempt, got %d", testDeliverNoRetryOnClientError, len(log))
+		}
+	})
+
+	const testNotifySubscribedOnly = "TestNotifySubscribedOnly"
+	t.Run(testNotifySubscribedOnly, func(t *testing.T) {
+		received := make(chan string, 2)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received <- req.URL.Path
+		}))
+		defer receiver.Close()
+
+		webhooks := []db.Webhook{
+			{ID: "finished", URL: receiver.URL + "/finished", Events: []string{JobFinished}},
+			{ID: "started", URL: receiver.URL + "/started", Events: []string{JobStarted}},
+		}
+		dispatcher, _ := newTestDispatcher(webhooks)
+		dispatcher.Notify(JobFinished, job)
+		select {
+		case path := <-received:
+			if path != "/finished" {
+				t.Errorf("%s: unexpected webhook notified: %s", testNotifySubscribedOnly, path)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: webhook wasn't notified", testNotifySubscribedOnly)
+		}
+		select {
+		case path := <-received:
+			t.Errorf("%s: unsubscribed webhook notified: %s", testNotifySubscribedOnly, path)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestCheckURL(t *testing.T) {
+	const funcName = "TestCheckURL"
+	rejected := []string{
+		"ftp://example.com/hook",
+		"/hook",
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.1.2.3/hook",
+		"http://172.20.0.1/hook",
+		"https://192.168.1.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://[fd00::1]/hook",
+	}
+	for _, rawURL := range rejected {
+		if err := CheckURL(context.Background(), rawURL); err == nil {
+			t.Errorf("%s: %s should be rejected", funcName, rawURL)
+		}
+	}
+	for _, rawURL := range []string{"https://93.184.216.34/hook", "http://[2606:2800:220:1::]/hook"} {
+		if err := CheckURL(context.Background(), rawURL); err != nil {
+			t.Errorf("%s: %s should be accepted: %v", funcName, rawURL, err)
+		}
+	}
+}
+
+func TestDeliverNonPublicAddress(t *testing.T) {
+	const funcName = "TestDeliverNonPublicAddress"
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer receiver.Close()
+
+	// the delivery client of NewDispatcher checks the dialed address, e.g. of
+	// a host which resolved to a public address when it was registered
+	dispatcher, deliveries := newTestDispatcher(nil)
+	dispatcher.client = newDeliveryClient(time.Second)
+	dispatcher.maxAttempts = 1
+	webhook := db.Webhook{ID: "hook", URL: receiver.URL, Secret: "secret"}
+	if dispatcher.Deliver(webhook, NewPayload(JobFinished, db.Job{ID: "job"})) {
+		t.Fatalf("%s: delivered to %s", funcName, receiver.URL)
+	}
+	if requests != 0 {
+		t.Errorf("%s: the receiver got %d requests", funcName, requests)
+	}
+	if log := deliveries(); len(log) != 1 || log[0].Success || log[0].Error == "" {
+		t.Errorf("%s: unexpected delivery log: %v", funcName, log)
+	}
+	_, err := newDeliveryClient(time.Second).Get(receiver.URL)
+	if !errors.Is(err, ErrNonPublicAddress) {
+		t.Errorf("%s: expected ErrNonPublicAddress, got %v", funcName, err)
+	}
+}
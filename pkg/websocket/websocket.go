@@ -4,7 +4,19 @@ package websocket
 websocket connection quits when:
 1. client sends close message (e.g. page refresh)
 2. user id was not found
-3. job has finished
+3. job has finished, jobs of a batch once every job of the batch has finished
+4. client didn't answer a ping within pongWait (dead connection)
+
+messages of a job carry the job id and a sequence number (seq):
+1. once the user id is found the client gets a SNAPSHOT of the user's latest job
+   from the job store, then live job messages with seq greater than the snapshot's
+2. when the client notices a gap in seq it sends RESYNC (optionally with a job id)
+   and gets a new SNAPSHOT
+3. when the hub drops messages of a slow connection the client gets new snapshots
+   of its jobs without asking, see catchUp
+
+jobs which review matches get REVIEW_CHOICE messages with the candidate
+the user picked (or an empty trackId to skip the track), see reviewChoicePayload
 
 cases checked/handled:
 1. user sends playlist to server, refreshes the page, still gets the results
@@ -12,19 +24,22 @@ cases checked/handled:
 3. user login -> ws opened
 4. copy job started, user exits before it's finished
 5. 2 clients starting copy job in parallel
+6. the same user in several tabs, every tab gets the job messages
 */
 
 import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/yossisp/csv-to-spotify/pkg/utils"
 
+	"github.com/yossisp/csv-to-spotify/pkg/config"
 	"github.com/yossisp/csv-to-spotify/pkg/db"
+	"github.com/yossisp/csv-to-spotify/pkg/hub"
 	"github.com/yossisp/csv-to-spotify/pkg/kafkahelper"
+	"github.com/yossisp/csv-to-spotify/pkg/runner"
 
 	"github.com/gorilla/websocket"
 )
@@ -34,9 +49,28 @@ type clientPayload struct {
 	MessagePayload interface{} `json:"payload,omitempty"`
 }
 
+// reviewChoicePayload is the payload of REVIEW_CHOICE messages,
+// TrackID is one of the candidates of the track at Index or empty to skip it
+type reviewChoicePayload struct {
+	JobID   string `json:"jobId"`
+	Index   int    `json:"index"`
+	TrackID string `json:"trackId"`
+}
+
+// snapshotPayload is the job state sent before live job messages
+type snapshotPayload struct {
+	Job    db.Job        `json:"job"`
+	Tracks []db.JobTrack `json:"tracks"`
+}
+
+// writePayload is either a message to the client, a request to subscribe to the
+// job messages of the user (when isSubscribe is set) or, when isResync is set, a
+// request to send the client a snapshot of the job jobID (the latest job if empty)
 type writePayload struct {
-	message       interface{}
-	isJobFinished bool
+	message     interface{}
+	isSubscribe bool
+	isResync    bool
+	jobID       string
 }
 
 // Websocket makes sure to that only 1 writer is active
@@ -47,35 +81,58 @@ type Websocket struct {
 	*websocket.Conn
 	writeChan chan writePayload
 	quitChan  chan bool
-	now       time.Time // TODO: remove
-	userID    string
-}
-
-// SafeMap is intended for thread-safe access to map
-type safeMap struct {
-	smap  map[string]*Websocket
-	mutex sync.Mutex
+	// doneChan is closed when WSConnectionHandler returns
+	// so that listen() doesn't block on writeChan
+	doneChan chan bool
+	userID   string
+	// lastSeq is the sequence number of the last message sent per job id,
+	// it's only accessed by the writer goroutine
+	lastSeq map[string]int
 }
 
 const (
-	user        = "USER"
-	update      = "UPDATE"
-	jobFinished = "JOB_FINISHED"
-	pongWait    = 10 * time.Second
-	logPrefix   = "websocket.go"
+	user         = "USER"
+	snapshot     = "SNAPSHOT"
+	resync       = "RESYNC"
+	reviewChoice = "REVIEW_CHOICE"
+	// pongWait is how long to wait for any message (pong included) from the client
+	pongWait = 10 * time.Second
+	// pingPeriod must be less than pongWait
+	pingPeriod     = (pongWait * 9) / 10
+	writeWait      = 5 * time.Second
+	maxMessageSize = 4096
+	logPrefix      = "websocket.go"
 )
 
 var (
-	upgrader                                  = websocket.Upgrader{}
-	consumer                                  = kafkahelper.NewConsumer()
-	msgChan          chan kafkahelper.Message = make(chan kafkahelper.Message)
-	wsConnectionsMap *safeMap                 = &safeMap{smap: make(map[string]*Websocket)}
-	logger                                    = utils.NewLogger("websocket.go")
+	conf     = config.NewConfig()
+	upgrader = websocket.Upgrader{
+		CheckOrigin: checkOrigin,
+	}
+	logger = utils.NewLogger("websocket.go")
 )
 
-func init() {
-	go consumer.ConsumeMessages(msgChan)
-	go wsConnectionsMap.processKafkaMessage()
+// checkOrigin allows ALLOWED_ORIGINS, like CORS does for the other routes.
+// Requests without Origin header don't come from browsers so they're allowed.
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return conf.IsAllowedOrigin(origin)
+}
+
+// ping checks that the client is alive, listen() extends the read deadline on pong
+func (ws *Websocket) ping() error {
+	return ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+// send passes payload to the writer unless the connection was closed
+func (ws *Websocket) send(payload writePayload) {
+	select {
+	case ws.writeChan <- payload:
+	case <-ws.doneChan:
+	}
 }
 
 // listens on socket connection and quits if some read error occurred
@@ -86,6 +143,11 @@ func (ws *Websocket) listen() {
 		close(ws.quitChan)
 	}()
 
+	ws.SetReadLimit(maxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
 		clientMessage := clientPayload{}
 		_, message, err := ws.ReadMessage()
@@ -94,6 +156,7 @@ func (ws *Websocket) listen() {
 			break
 
 		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
 		err = json.Unmarshal(message, &clientMessage)
 		if err != nil {
 			logger("user: %s listen -> json.Unmarshal: %v", ws.userID, err)
@@ -106,31 +169,53 @@ func (ws *Websocket) listen() {
 				log.Println("ws listen: userID: ", userID)
 				dbUser := db.FindSpotifyUser(userID)
 				if dbUser != nil {
+					if ws.userID != "" {
+						logger("user: %s sent user message twice", ws.userID)
+						break
+					}
 					ws.userID = userID
-					wsConnectionsMap.mutex.Lock()
-					wsConnectionsMap.smap[userID] = ws
-					wsConnectionsMap.mutex.Unlock()
 					log.Println("ws listen: user found in db: ", dbUser.UserID)
-					ws.writeChan <- writePayload{
+					ws.send(writePayload{
 						message: map[string]interface{}{
 							"type":    user,
 							"payload": true,
 						},
-					}
-					wsConnectionsMap.mutex.Lock()
-					log.Println("wsConnectionsMap", wsConnectionsMap.smap)
-					wsConnectionsMap.mutex.Unlock()
+					})
+					ws.send(writePayload{isSubscribe: true})
+					ws.send(writePayload{isResync: true})
 				} else {
-					ws.writeChan <- writePayload{
+					ws.send(writePayload{
 						message: map[string]interface{}{
 							"type":    user,
 							"payload": false,
 						},
-					}
+					})
 					logger("user: %s not found", ws.userID)
 					return
 				}
 			}
+		case resync:
+			// the client noticed a gap in sequence numbers
+			if ws.userID == "" {
+				logger("resync requested before user message")
+				break
+			}
+			jobID, _ := clientMessage.MessagePayload.(string)
+			ws.send(writePayload{isResync: true, jobID: jobID})
+		case reviewChoice:
+			if ws.userID == "" {
+				logger("review choice sent before user message")
+				break
+			}
+			choice, err := newReviewChoicePayload(clientMessage.MessagePayload)
+			if err != nil {
+				logger("user: %s review choice: %v", ws.userID, err)
+				break
+			}
+			err = runner.Review(choice.JobID, ws.userID, choice.Index, choice.TrackID)
+			if err != nil {
+				logger("user: %s runner.Review: %v", ws.userID, err)
+			}
 		default:
 			logger("unknown message type received: %v", clientMessage)
 		}
@@ -138,78 +223,119 @@ func (ws *Websocket) listen() {
 	log.Println("end of listen")
 }
 
-func (connectionsMap *safeMap) get(userID string) (connection *Websocket, found bool) {
-	connectionsMap.mutex.Lock()
-	connection, found = connectionsMap.smap[userID]
-	connectionsMap.mutex.Unlock()
+// newReviewChoicePayload decodes the payload of a REVIEW_CHOICE message
+func newReviewChoicePayload(payload interface{}) (choice reviewChoicePayload, err error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(payloadJSON, &choice)
 	return
 }
 
-// processKafkaMessage is started at init()
-// it forwards results to WSConnectionHandler which writes to client
-func (connectionsMap *safeMap) processKafkaMessage() {
-	var (
-		msg kafkahelper.Message
-	)
-	for {
-		select {
-		case msg = <-msgChan:
-			log.Println("processKafkaMessage msg: ", msg)
-			switch msg.MsgType {
-			case kafkahelper.TrackProgress:
-				connection, found := connectionsMap.get(msg.UserID)
-				if found {
-					connection.writeChan <- writePayload{
-						message: clientPayload{
-							MessageType:    update,
-							MessagePayload: msg.Msg,
-						},
-					}
-				} else {
-					logger("processKafkaMessage: user id: %s not found in wsConnectionsMap", msg.UserID)
-				}
+// writeSnapshot sends the client the current state of a job of the user and returns the job.
+// Messages of the job with a sequence number up to the snapshot's
+// are skipped afterwards since the snapshot already contains them.
+func (ws *Websocket) writeSnapshot(jobID string) *db.Job {
+	var job *db.Job
+	if jobID == "" {
+		job = db.FindLatestJob(ws.userID)
+	} else {
+		job = db.FindJob(jobID)
+	}
+	if job == nil || job.UserID != ws.userID {
+		logger("user: %s writeSnapshot: job: %q not found", ws.userID, jobID)
+		return nil
+	}
+	payload := snapshotPayload{
+		Job:    *job,
+		Tracks: db.FindJobTracks(job.ID),
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	err := ws.WriteJSON(hub.ClientMessage{
+		MessageType:    snapshot,
+		MessagePayload: payload,
+		JobID:          job.ID,
+		Seq:            job.Seq,
+	})
+	if err != nil {
+		logger("user: %s writeSnapshot -> WriteJSON: %v", ws.userID, err)
+		return nil
+	}
+	ws.lastSeq[job.ID] = job.Seq
+	return job
+}
 
-			case kafkahelper.JobFinished:
-				connection, found := connectionsMap.get(msg.UserID)
-				if found {
-					connection.writeChan <- writePayload{
-						message: clientPayload{
-							MessageType: jobFinished,
-						},
-						isJobFinished: true,
-					}
-					log.Println("processKafkaMessage: JobFinished")
-				} else {
-					logger("processKafkaMessage: user id: %s not found in wsConnectionsMap", msg.UserID)
-				}
-			case kafkahelper.CSVFileError:
-				connection, found := connectionsMap.get(msg.UserID)
-				if found {
-					connection.writeChan <- writePayload{
-						message: clientPayload{
-							MessageType:    jobFinished,
-							MessagePayload: msg.Msg,
-						},
-						isJobFinished: true,
-					}
-				}
-			default:
-				logger("processKafkaMessage: unknown message: %v", msg)
-			}
+// catchUp sends new snapshots of the jobs the client got and of the latest job of the user
+// once the hub dropped messages of the subscription. isJobFinished is set if one of them
+// has finished since the client got it, like the last message of the job would.
+func (ws *Websocket) catchUp() (isJobFinished bool) {
+	jobIDs := make([]string, 0, len(ws.lastSeq)+1)
+	for jobID := range ws.lastSeq {
+		jobIDs = append(jobIDs, jobID)
+	}
+	if latest := db.FindLatestJob(ws.userID); latest != nil {
+		if _, found := ws.lastSeq[latest.ID]; !found {
+			jobIDs = append(jobIDs, latest.ID)
 		}
 	}
+	for _, jobID := range jobIDs {
+		lastSeq := ws.lastSeq[jobID]
+		job := ws.writeSnapshot(jobID)
+		if job != nil && job.Seq > lastSeq && hub.IsJobDone(*job) && isBatchDone(*job) {
+			isJobFinished = true
+		}
+	}
+	return isJobFinished
+}
+
+// isBatchDone reports whether every job of the batch of job is done,
+// jobs which aren't part of a batch are a batch of their own
+func isBatchDone(job db.Job) bool {
+	if job.BatchID == "" {
+		return true
+	}
+	for _, batchJob := range db.FindBatchJobs(job.BatchID) {
+		if !hub.IsJobDone(batchJob) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeJobMessage forwards a hub message to the client unless the client already got it
+// in a snapshot, isJobFinished is set for the last message of the job once its batch is done
+func (ws *Websocket) writeJobMessage(msg kafkahelper.Message) (isJobFinished bool) {
+	if msg.Seq <= ws.lastSeq[msg.JobID] {
+		return false
+	}
+	clientMessage, isJobFinished, ok := hub.NewClientMessage(msg)
+	if !ok {
+		return false
+	}
+	ws.lastSeq[msg.JobID] = msg.Seq
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	err := ws.WriteJSON(clientMessage)
+	log.Println("WriteJSON: msg", clientMessage)
+	if err != nil {
+		logger("WriteJSON: %v", err)
+	}
+	if isJobFinished {
+		// the rest of the jobs of a batch are still sent
+		if job := db.FindJob(msg.JobID); job != nil {
+			return isBatchDone(*job)
+		}
+	}
+	return isJobFinished
 }
 
 // WSConnectionHandler (/websocket route) handles
 // communication with the client via websocket.
-// It tells listen() to quit when the job finishes by closing socket connection
-// also removes user id from connections map so that
-// processKafkaMessage stops sending via writeChan
+// Job messages are received from a hub subscription which is
+// created once the user is found in listen() and removed when it returns.
+// It pings the client every pingPeriod, listen() quits when no pong arrives in time.
+// It tells listen() to quit when the job (or every job of its batch) finishes by closing socket connection
 func WSConnectionHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: filter allowed origins
-	upgrader.CheckOrigin = func(req *http.Request) bool {
-		return true
-	}
 	connection, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		logger("upgrade error: %v", err)
@@ -218,32 +344,58 @@ func WSConnectionHandler(w http.ResponseWriter, req *http.Request) {
 	defer connection.Close()
 	log.Println("new ws upgraded")
 	websocket := &Websocket{
-		connection,
-		make(chan writePayload),
-		make(chan bool),
-		time.Now(),
-		"",
+		Conn:      connection,
+		writeChan: make(chan writePayload),
+		quitChan:  make(chan bool),
+		doneChan:  make(chan bool),
+		lastSeq:   make(map[string]int),
 	}
+	pingTicker := time.NewTicker(pingPeriod)
+	// the subscription is created by this goroutine so that it's always removed
+	var subscription *hub.Subscription
 	defer func() {
-		close(websocket.writeChan)
-		wsConnectionsMap.mutex.Lock()
-		if _, found := wsConnectionsMap.smap[websocket.userID]; found {
-			delete(wsConnectionsMap.smap, websocket.userID)
-			log.Println("found websocket.user in wsConnectionsMap")
+		pingTicker.Stop()
+		close(websocket.doneChan)
+		if subscription != nil {
+			subscription.Unsubscribe()
 		}
-		wsConnectionsMap.mutex.Unlock()
 		log.Println("WSConnectionHandler quitChan")
 	}()
+	// nil until the user is found, receiving from them blocks
+	var jobMessages chan kafkahelper.Message
+	var stale chan struct{}
 	go websocket.listen()
 	for {
 		select {
 		case update := <-websocket.writeChan:
+			if update.isSubscribe {
+				subscription = hub.Subscribe(websocket.userID)
+				jobMessages = subscription.Messages
+				stale = subscription.Stale
+				continue
+			}
+			if update.isResync {
+				websocket.writeSnapshot(update.jobID)
+				continue
+			}
+			websocket.SetWriteDeadline(time.Now().Add(writeWait))
 			err := websocket.WriteJSON(update.message)
 			log.Println("WriteJSON: msg", update.message)
 			if err != nil {
 				logger("WriteJSON: %v", err)
 			}
-			if update.isJobFinished {
+		case <-pingTicker.C:
+			if err := websocket.ping(); err != nil {
+				logger("user: %s ping: %v", websocket.userID, err)
+				return
+			}
+		case msg := <-jobMessages:
+			if websocket.writeJobMessage(msg) {
+				log.Println("websocket.isJobFinished")
+				return
+			}
+		case <-stale:
+			if websocket.catchUp() {
 				log.Println("websocket.isJobFinished")
 				return
 			}